@@ -0,0 +1,497 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+)
+
+// Authentication request codes of the AuthenticationRequest message
+const (
+	authOK                = 0
+	authCleartextPassword = 3
+	authMD5Password       = 5
+	authSASL              = 10
+	authSASLContinue      = 11
+	authSASLFinal         = 12
+)
+
+// Password authentication methods, named as in pg_hba.conf
+const (
+	authMethodSCRAM    = "scram-sha-256"
+	authMethodMD5      = "md5"
+	authMethodPassword = "password"
+)
+
+// scramMechanism is the only SASL mechanism offered; channel binding
+// (SCRAM-SHA-256-PLUS) is not supported
+const scramMechanism = "SCRAM-SHA-256"
+
+// scramIterations is the iteration count of generated verifiers, the
+// PostgreSQL default
+const scramIterations = 4096
+
+// passwordVerifier holds what is stored of a password: a SCRAM-SHA-256 or
+// MD5 verifier in pg_authid's format, or the plaintext password along with
+// the SCRAM keys derived from it
+type passwordVerifier struct {
+	plaintext string
+
+	md5 string // "md5" followed by the hex MD5 of password and user name
+
+	iterations int
+	salt       []byte
+	storedKey  []byte
+	serverKey  []byte
+}
+
+// isSCRAM reports whether the verifier can answer a SCRAM exchange
+func (v passwordVerifier) isSCRAM() bool {
+	return v.storedKey != nil
+}
+
+// parsePasswordVerifier reads a configured password. Values in the format
+// of pg_authid.rolpassword are verifiers, anything else is plaintext.
+func parsePasswordVerifier(password string) (passwordVerifier, error) {
+	if strings.HasPrefix(password, "SCRAM-SHA-256$") {
+		// SCRAM-SHA-256$<iterations>:<salt>$<StoredKey>:<ServerKey>
+		parts := strings.Split(strings.TrimPrefix(password, "SCRAM-SHA-256$"), "$")
+		if len(parts) != 2 {
+			return passwordVerifier{}, fmt.Errorf("malformed SCRAM-SHA-256 verifier")
+		}
+		iterations, salt, ok1 := strings.Cut(parts[0], ":")
+		storedKey, serverKey, ok2 := strings.Cut(parts[1], ":")
+		if !ok1 || !ok2 {
+			return passwordVerifier{}, fmt.Errorf("malformed SCRAM-SHA-256 verifier")
+		}
+
+		v := passwordVerifier{}
+		var err error
+		if v.iterations, err = strconv.Atoi(iterations); err != nil || v.iterations < 1 {
+			return passwordVerifier{}, fmt.Errorf("invalid SCRAM-SHA-256 iteration count %q", iterations)
+		}
+		for _, field := range []struct {
+			dst   *[]byte
+			value string
+			size  int
+		}{{&v.salt, salt, 0}, {&v.storedKey, storedKey, sha256.Size}, {&v.serverKey, serverKey, sha256.Size}} {
+			decoded, err := base64.StdEncoding.DecodeString(field.value)
+			if err != nil || len(decoded) == 0 || (field.size > 0 && len(decoded) != field.size) {
+				return passwordVerifier{}, fmt.Errorf("malformed SCRAM-SHA-256 verifier")
+			}
+			*field.dst = decoded
+		}
+		return v, nil
+	}
+
+	if len(password) == 35 && strings.HasPrefix(password, "md5") {
+		if _, err := hex.DecodeString(password[3:]); err == nil {
+			return passwordVerifier{md5: password}, nil
+		}
+	}
+
+	return passwordVerifier{plaintext: password}, nil
+}
+
+// encryptPassword builds a SCRAM-SHA-256 verifier for a password, as
+// PostgreSQL stores it with password_encryption = scram-sha-256
+func encryptPassword(password string) (string, error) {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return "", fmt.Errorf("failed to generate salt: %w", err)
+	}
+	v := scramVerifier(password, salt, scramIterations)
+	return fmt.Sprintf("SCRAM-SHA-256$%d:%s$%s:%s", v.iterations,
+		base64.StdEncoding.EncodeToString(v.salt),
+		base64.StdEncoding.EncodeToString(v.storedKey),
+		base64.StdEncoding.EncodeToString(v.serverKey)), nil
+}
+
+// scramVerifier derives the SCRAM keys of a password (RFC 5802)
+func scramVerifier(password string, salt []byte, iterations int) passwordVerifier {
+	salted := saltedPassword(password, salt, iterations)
+	clientKey := hmacSHA256(salted, []byte("Client Key"))
+	storedKey := sha256.Sum256(clientKey)
+	return passwordVerifier{
+		iterations: iterations,
+		salt:       salt,
+		storedKey:  storedKey[:],
+		serverKey:  hmacSHA256(salted, []byte("Server Key")),
+	}
+}
+
+// saltedPassword is Hi() of RFC 5802, PBKDF2 with HMAC-SHA-256 producing a
+// single block
+func saltedPassword(password string, salt []byte, iterations int) []byte {
+	mac := hmac.New(sha256.New, []byte(password))
+	mac.Write(salt)
+	mac.Write([]byte{0, 0, 0, 1})
+	u := mac.Sum(nil)
+
+	result := append([]byte(nil), u...)
+	for i := 1; i < iterations; i++ {
+		mac.Reset()
+		mac.Write(u)
+		u = mac.Sum(u[:0])
+		for j := range result {
+			result[j] ^= u[j]
+		}
+	}
+	return result
+}
+
+func hmacSHA256(key []byte, data []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(data)
+	return mac.Sum(nil)
+}
+
+// md5Hex returns the hex MD5 digest of the concatenated parts
+func md5Hex(parts ...string) string {
+	h := md5.New()
+	for _, part := range parts {
+		h.Write([]byte(part))
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// authConn carries the authentication exchange of one connection
+type authConn interface {
+	// sendAuth sends an AuthenticationRequest with its payload
+	sendAuth(code int32, data []byte) error
+	// receivePassword reads the body of the client's password message,
+	// which also carries SASL responses
+	receivePassword() ([]byte, error)
+}
+
+// authError is an authentication failure reported to the client as FATAL
+type authError struct {
+	code    string
+	message string
+}
+
+func (e *authError) Error() string {
+	return e.message
+}
+
+func newAuthError(code string, format string, args ...interface{}) error {
+	return &authError{code: code, message: fmt.Sprintf(format, args...)}
+}
+
+// Authenticator verifies clients with the method of the first access rule
+// matching them
+type Authenticator struct {
+	users     *UserRegistry
+	rules     []accessRule
+	mockNonce []byte // salts the mock exchange of unknown users
+}
+
+// NewAuthenticator prepares the configured users' verifiers and access
+// rules. Without rules, every client uses the configured method.
+func NewAuthenticator(config AuthenticationConfig, ruleConfigs []AccessRuleConfig) (*Authenticator, error) {
+	method := config.Method
+	if method == "" {
+		method = authMethodSCRAM
+	}
+	switch method {
+	case authMethodSCRAM, authMethodMD5, authMethodPassword:
+	default:
+		return nil, fmt.Errorf("unsupported authentication method %q", method)
+	}
+
+	users, err := NewUserRegistry(config)
+	if err != nil {
+		return nil, err
+	}
+	rules, err := parseAccessRules(ruleConfigs, method)
+	if err != nil {
+		return nil, err
+	}
+
+	// An MD5 verifier cannot answer a SCRAM exchange
+	for _, rule := range rules {
+		if rule.method != authMethodSCRAM {
+			continue
+		}
+		for _, user := range users.users {
+			if rule.matchesUser(user.Name) && !user.verifier.isSCRAM() {
+				return nil, fmt.Errorf("user %s has an MD5 password verifier, which cannot be used with %s authentication", user.Name, rule.method)
+			}
+		}
+	}
+
+	mockNonce := make([]byte, 16)
+	if _, err := rand.Read(mockNonce); err != nil {
+		return nil, fmt.Errorf("failed to generate mock nonce: %w", err)
+	}
+	return &Authenticator{users: users, rules: rules, mockNonce: mockNonce}, nil
+}
+
+// Authenticate runs the authentication exchange of a new connection and
+// reports a failure to the client as FATAL
+func (a *Authenticator) Authenticate(conn *ProtocolConn, client clientInfo) (*User, error) {
+	user, err := a.authorize(conn, client)
+	if err != nil {
+		log.Printf("WARN: Authentication failed for user %s from %v: %v", client.user, conn.RemoteAddr(), err)
+		code, message := "28P01", fmt.Sprintf("password authentication failed for user %q", client.user)
+		if authErr, ok := err.(*authError); ok && authErr.code != "28P01" {
+			code, message = authErr.code, authErr.message
+		}
+		conn.WriteError("FATAL", code, message)
+		return nil, err
+	}
+
+	log.Printf("INFO: User authenticated: %s (%s)", client.user, user.Privilege)
+	return user, nil
+}
+
+// authorize applies the first access rule matching the client, runs its
+// authentication method and checks the user may connect to the database
+func (a *Authenticator) authorize(conn authConn, client clientInfo) (*User, error) {
+	rule, ok := matchAccessRule(a.rules, client)
+	if !ok {
+		return nil, newAuthError("28000", "no server.hba entry for host %q, user %q, database %q, %s",
+			client.addr, client.user, client.database, client.encryption())
+	}
+
+	switch rule.method {
+	case authMethodReject:
+		return nil, newAuthError("28000", "server.hba rejects connection for host %q, user %q, database %q, %s",
+			client.addr, client.user, client.database, client.encryption())
+	case authMethodTrust, authMethodCert:
+		if rule.method == authMethodCert {
+			if err := verifyCertificate(client); err != nil {
+				return nil, err
+			}
+		}
+		if a.users.Lookup(client.user) == nil {
+			return nil, newAuthError("28000", "role %q does not exist", client.user)
+		}
+		if err := conn.sendAuth(authOK, nil); err != nil {
+			return nil, err
+		}
+	default:
+		if err := a.authenticate(conn, client.user, rule.method); err != nil {
+			return nil, err
+		}
+	}
+
+	user := a.users.Lookup(client.user)
+	if !user.CanConnect(client.database) {
+		return nil, newAuthError("42501", "permission denied for database %q", client.database)
+	}
+	return user, nil
+}
+
+// authenticate runs the exchange of a password method and sends
+// AuthenticationOk on success
+func (a *Authenticator) authenticate(conn authConn, username string, method string) error {
+	verifier, known := a.lookup(username)
+
+	var err error
+	switch {
+	case method == authMethodPassword:
+		err = a.authenticateCleartext(conn, username, verifier, known)
+	case method == authMethodMD5 && (verifier.md5 != "" || verifier.plaintext != ""):
+		err = a.authenticateMD5(conn, username, verifier, known)
+	default:
+		// As in PostgreSQL, md5 falls back to SCRAM for SCRAM verifiers
+		err = a.authenticateSCRAM(conn, username, verifier, known)
+	}
+	if err != nil {
+		return err
+	}
+	return conn.sendAuth(authOK, nil)
+}
+
+// lookup returns the verifier of a user. Unknown users get a mock verifier
+// so that the exchange does not reveal whether the user exists.
+func (a *Authenticator) lookup(username string) (passwordVerifier, bool) {
+	if user := a.users.Lookup(username); user != nil {
+		return user.verifier, true
+	}
+	salt := hmacSHA256(a.mockNonce, []byte(username))[:16]
+	return passwordVerifier{iterations: scramIterations, salt: salt, storedKey: make([]byte, sha256.Size), serverKey: make([]byte, sha256.Size)}, false
+}
+
+// authenticateCleartext asks for the password itself
+func (a *Authenticator) authenticateCleartext(conn authConn, username string, verifier passwordVerifier, known bool) error {
+	if err := conn.sendAuth(authCleartextPassword, nil); err != nil {
+		return err
+	}
+	response, err := conn.receivePassword()
+	if err != nil {
+		return err
+	}
+	password := string(bytes.TrimSuffix(response, []byte{0}))
+
+	var ok bool
+	switch {
+	case verifier.plaintext != "":
+		ok = subtle.ConstantTimeCompare([]byte(password), []byte(verifier.plaintext)) == 1
+	case verifier.md5 != "":
+		ok = subtle.ConstantTimeCompare([]byte("md5"+md5Hex(password, username)), []byte(verifier.md5)) == 1
+	default:
+		computed := scramVerifier(password, verifier.salt, verifier.iterations)
+		ok = subtle.ConstantTimeCompare(computed.storedKey, verifier.storedKey) == 1
+	}
+	if !ok || !known {
+		return newAuthError("28P01", "password does not match")
+	}
+	return nil
+}
+
+// authenticateMD5 runs the salted MD5 challenge
+func (a *Authenticator) authenticateMD5(conn authConn, username string, verifier passwordVerifier, known bool) error {
+	salt := make([]byte, 4)
+	if _, err := rand.Read(salt); err != nil {
+		return fmt.Errorf("failed to generate salt: %w", err)
+	}
+	if err := conn.sendAuth(authMD5Password, salt); err != nil {
+		return err
+	}
+	response, err := conn.receivePassword()
+	if err != nil {
+		return err
+	}
+
+	stored := verifier.md5
+	if stored == "" {
+		stored = "md5" + md5Hex(verifier.plaintext, username)
+	}
+	expected := "md5" + md5Hex(stored[3:], string(salt))
+	if subtle.ConstantTimeCompare(bytes.TrimSuffix(response, []byte{0}), []byte(expected)) != 1 || !known {
+		return newAuthError("28P01", "password does not match")
+	}
+	return nil
+}
+
+// authenticateSCRAM runs a SCRAM-SHA-256 exchange (RFC 5802, RFC 7677).
+// The user name inside the exchange is ignored, as in PostgreSQL; the one
+// from the startup message is authenticated.
+func (a *Authenticator) authenticateSCRAM(conn authConn, username string, verifier passwordVerifier, known bool) error {
+	if err := conn.sendAuth(authSASL, []byte(scramMechanism+"\x00\x00")); err != nil {
+		return err
+	}
+
+	// SASLInitialResponse: mechanism, then the length-prefixed client-first-message
+	response, err := conn.receivePassword()
+	if err != nil {
+		return err
+	}
+	mechanism, rest, ok := bytes.Cut(response, []byte{0})
+	if !ok || len(rest) < 4 {
+		return newAuthError("08P01", "malformed SASL initial response")
+	}
+	if string(mechanism) != scramMechanism {
+		return newAuthError("28000", "client selected an invalid SASL authentication mechanism")
+	}
+	clientFirst := string(rest[4:])
+	if n := int32(binary.BigEndian.Uint32(rest)); n < 0 || int(n) != len(clientFirst) {
+		return newAuthError("08P01", "malformed SASL initial response")
+	}
+
+	gs2Header, clientFirstBare, err := parseClientFirst(clientFirst)
+	if err != nil {
+		return err
+	}
+	clientNonce := scramAttribute(clientFirstBare, 'r')
+	if clientNonce == "" {
+		return newAuthError("08P01", "malformed SCRAM message: missing nonce")
+	}
+
+	serverNonce := make([]byte, 18)
+	if _, err := rand.Read(serverNonce); err != nil {
+		return fmt.Errorf("failed to generate nonce: %w", err)
+	}
+	nonce := clientNonce + base64.StdEncoding.EncodeToString(serverNonce)
+	serverFirst := fmt.Sprintf("r=%s,s=%s,i=%d", nonce, base64.StdEncoding.EncodeToString(verifier.salt), verifier.iterations)
+	if err := conn.sendAuth(authSASLContinue, []byte(serverFirst)); err != nil {
+		return err
+	}
+
+	// SASLResponse: c=<channel binding>,r=<nonce>,p=<proof>
+	response, err = conn.receivePassword()
+	if err != nil {
+		return err
+	}
+	clientFinal := string(response)
+	proofStart := strings.LastIndex(clientFinal, ",p=")
+	if proofStart < 0 {
+		return newAuthError("08P01", "malformed SCRAM message: missing proof")
+	}
+	clientFinalWithoutProof := clientFinal[:proofStart]
+	if scramAttribute(clientFinalWithoutProof, 'c') != base64.StdEncoding.EncodeToString([]byte(gs2Header)) {
+		return newAuthError("08P01", "SCRAM channel binding check failed")
+	}
+	if scramAttribute(clientFinalWithoutProof, 'r') != nonce {
+		return newAuthError("08P01", "SCRAM nonce mismatch")
+	}
+	proof, err := base64.StdEncoding.DecodeString(clientFinal[proofStart+3:])
+	if err != nil || len(proof) != sha256.Size {
+		return newAuthError("08P01", "malformed SCRAM message: invalid proof")
+	}
+
+	authMessage := []byte(clientFirstBare + "," + serverFirst + "," + clientFinalWithoutProof)
+	if !verifyClientProof(verifier, authMessage, proof) || !known {
+		return newAuthError("28P01", "password does not match")
+	}
+
+	serverSignature := hmacSHA256(verifier.serverKey, authMessage)
+	return conn.sendAuth(authSASLFinal, []byte("v="+base64.StdEncoding.EncodeToString(serverSignature)))
+}
+
+// parseClientFirst splits a client-first-message into its GS2 header and
+// the bare message
+func parseClientFirst(message string) (string, string, error) {
+	switch {
+	case strings.HasPrefix(message, "p="):
+		return "", "", newAuthError("08P01", "channel binding is not supported")
+	case !strings.HasPrefix(message, "n,") && !strings.HasPrefix(message, "y,"):
+		return "", "", newAuthError("08P01", "malformed SCRAM message: invalid GS2 header")
+	}
+
+	// The authorization identity, if any, is ignored as in PostgreSQL
+	end := strings.IndexByte(message[2:], ',')
+	if end < 0 {
+		return "", "", newAuthError("08P01", "malformed SCRAM message: invalid GS2 header")
+	}
+	end += 3
+	bare := message[end:]
+	if strings.HasPrefix(bare, "m=") {
+		return "", "", newAuthError("08P01", "unsupported SCRAM extension")
+	}
+	return message[:end], bare, nil
+}
+
+// scramAttribute returns the value of an attribute of a SCRAM message
+func scramAttribute(message string, name byte) string {
+	for _, attr := range strings.Split(message, ",") {
+		if len(attr) >= 2 && attr[0] == name && attr[1] == '=' {
+			return attr[2:]
+		}
+	}
+	return ""
+}
+
+// verifyClientProof checks that the proof was computed from the password
+// behind the verifier's StoredKey
+func verifyClientProof(verifier passwordVerifier, authMessage []byte, proof []byte) bool {
+	clientSignature := hmacSHA256(verifier.storedKey, authMessage)
+	clientKey := make([]byte, len(proof))
+	for i := range proof {
+		clientKey[i] = proof[i] ^ clientSignature[i]
+	}
+	storedKey := sha256.Sum256(clientKey)
+	return subtle.ConstantTimeCompare(storedKey[:], verifier.storedKey) == 1
+}
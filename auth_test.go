@@ -0,0 +1,277 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/lib/pq"
+)
+
+// scriptedAuthConn plays the client side of an authentication exchange
+type scriptedAuthConn struct {
+	respond func(code int32, data []byte) []byte
+	codes   []int32
+	pending [][]byte
+}
+
+func (c *scriptedAuthConn) sendAuth(code int32, data []byte) error {
+	c.codes = append(c.codes, code)
+	if response := c.respond(code, data); response != nil {
+		c.pending = append(c.pending, response)
+	}
+	return nil
+}
+
+func (c *scriptedAuthConn) receivePassword() ([]byte, error) {
+	if len(c.pending) == 0 {
+		return nil, io.EOF
+	}
+	response := c.pending[0]
+	c.pending = c.pending[1:]
+	return response, nil
+}
+
+// scramClient answers a SCRAM-SHA-256 exchange the way libpq does
+type scramClient struct {
+	password        string
+	clientFirstBare string
+	serverSignature string // expected in SASLFinal
+	verified        bool
+}
+
+func (c *scramClient) respond(code int32, data []byte) []byte {
+	switch code {
+	case authSASL:
+		c.clientFirstBare = "n=,r=fyko+d2lbbFgONRv9qkxdawL"
+		first := "n,," + c.clientFirstBare
+		response := append([]byte(scramMechanism+"\x00"), binary.BigEndian.AppendUint32(nil, uint32(len(first)))...)
+		return append(response, first...)
+	case authSASLContinue:
+		serverFirst := string(data)
+		salt, _ := base64.StdEncoding.DecodeString(scramAttribute(serverFirst, 's'))
+		var iterations int
+		fmt.Sscan(scramAttribute(serverFirst, 'i'), &iterations)
+
+		clientFinal := "c=biws,r=" + scramAttribute(serverFirst, 'r')
+		authMessage := []byte(c.clientFirstBare + "," + serverFirst + "," + clientFinal)
+		salted := saltedPassword(c.password, salt, iterations)
+		clientKey := hmacSHA256(salted, []byte("Client Key"))
+		storedKey := sha256.Sum256(clientKey)
+		signature := hmacSHA256(storedKey[:], authMessage)
+		for i := range clientKey {
+			clientKey[i] ^= signature[i]
+		}
+		c.serverSignature = "v=" + base64.StdEncoding.EncodeToString(hmacSHA256(hmacSHA256(salted, []byte("Server Key")), authMessage))
+		return []byte(clientFinal + ",p=" + base64.StdEncoding.EncodeToString(clientKey))
+	case authSASLFinal:
+		c.verified = string(data) == c.serverSignature
+	}
+	return nil
+}
+
+// md5Client answers an MD5 challenge
+func md5Client(username string, password string) func(int32, []byte) []byte {
+	return func(code int32, data []byte) []byte {
+		if code != authMD5Password {
+			return nil
+		}
+		return []byte("md5" + md5Hex(md5Hex(password, username), string(data)) + "\x00")
+	}
+}
+
+func TestSCRAMTestVector(t *testing.T) {
+	// RFC 7677, section 3
+	salt, _ := base64.StdEncoding.DecodeString("W22ZaJ0SNY7soEsUEjb6gQ==")
+	verifier := scramVerifier("pencil", salt, 4096)
+	authMessage := []byte("n=user,r=rOprNGfwEbeRWgbNEkqO," +
+		"r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096," +
+		"c=biws,r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0")
+
+	proof, _ := base64.StdEncoding.DecodeString("dHzbZapWIk4jUhN+Ute9ytag9zjfMHgsqmmiz7AndVQ=")
+	if !verifyClientProof(verifier, authMessage, proof) {
+		t.Error("Expected the RFC 7677 client proof to verify")
+	}
+	proof[0] ^= 1
+	if verifyClientProof(verifier, authMessage, proof) {
+		t.Error("Expected a modified proof to be rejected")
+	}
+
+	signature := base64.StdEncoding.EncodeToString(hmacSHA256(verifier.serverKey, authMessage))
+	if signature != "6rriTRBi23WpRR/wtup+mMhUZUn/dB5nLTJRsjl95G4=" {
+		t.Errorf("Unexpected server signature %s", signature)
+	}
+}
+
+func TestParsePasswordVerifier(t *testing.T) {
+	encrypted, err := encryptPassword("secret")
+	if err != nil {
+		t.Fatalf("Failed to encrypt password: %v", err)
+	}
+	if !strings.HasPrefix(encrypted, "SCRAM-SHA-256$4096:") {
+		t.Errorf("Unexpected verifier format %s", encrypted)
+	}
+	v, err := parsePasswordVerifier(encrypted)
+	if err != nil || !v.isSCRAM() || v.iterations != 4096 || len(v.salt) != 16 {
+		t.Errorf("Failed to parse %s: %+v, %v", encrypted, v, err)
+	}
+	if expected := scramVerifier("secret", v.salt, v.iterations); string(expected.storedKey) != string(v.storedKey) {
+		t.Error("Expected the stored key to derive from the password")
+	}
+
+	md5 := "md5" + md5Hex("secret", "alice")
+	if v, err := parsePasswordVerifier(md5); err != nil || v.md5 != md5 {
+		t.Errorf("Failed to parse %s: %+v, %v", md5, v, err)
+	}
+	if v, _ := parsePasswordVerifier("md5-not-a-verifier"); v.plaintext != "md5-not-a-verifier" {
+		t.Errorf("Expected a plaintext password, got %+v", v)
+	}
+
+	for _, malformed := range []string{"SCRAM-SHA-256$4096:c2FsdA==", "SCRAM-SHA-256$x:c2FsdA==$a2V5:a2V5", "SCRAM-SHA-256$4096:c2FsdA==$a2V5:a2V5"} {
+		if _, err := parsePasswordVerifier(malformed); err == nil {
+			t.Errorf("Expected %q to be rejected", malformed)
+		}
+	}
+}
+
+func TestAuthenticateSCRAM(t *testing.T) {
+	encrypted, _ := encryptPassword("secret")
+	for _, password := range []string{"secret", encrypted} {
+		auth, err := NewAuthenticator(AuthenticationConfig{User: "alice", Password: password, Method: authMethodSCRAM}, nil)
+		if err != nil {
+			t.Fatalf("Failed to create authenticator: %v", err)
+		}
+
+		client := &scramClient{password: "secret"}
+		conn := &scriptedAuthConn{respond: client.respond}
+		if err := auth.authenticate(conn, "alice", authMethodSCRAM); err != nil {
+			t.Fatalf("Expected SCRAM authentication to succeed: %v", err)
+		}
+		if fmt.Sprint(conn.codes) != "[10 11 12 0]" {
+			t.Errorf("Unexpected exchange %v", conn.codes)
+		}
+		if !client.verified {
+			t.Error("Expected the client to verify the server signature")
+		}
+
+		for _, attempt := range []struct{ user, password string }{{"alice", "wrong"}, {"mallory", "secret"}} {
+			client := &scramClient{password: attempt.password}
+			conn := &scriptedAuthConn{respond: client.respond}
+			err := auth.authenticate(conn, attempt.user, authMethodSCRAM)
+			if authErr, ok := err.(*authError); !ok || authErr.code != "28P01" {
+				t.Errorf("Expected %s/%s to fail with 28P01, got %v", attempt.user, attempt.password, err)
+			}
+			if fmt.Sprint(conn.codes) != "[10 11]" {
+				t.Errorf("Unexpected exchange %v", conn.codes)
+			}
+		}
+	}
+
+	// Channel binding is not offered, so a client must not require it
+	auth, _ := NewAuthenticator(AuthenticationConfig{User: "alice", Password: "secret"}, nil)
+	conn := &scriptedAuthConn{respond: func(code int32, data []byte) []byte {
+		first := "p=tls-server-end-point,,n=,r=abc"
+		return append(append([]byte(scramMechanism+"\x00"), binary.BigEndian.AppendUint32(nil, uint32(len(first)))...), first...)
+	}}
+	if err := auth.authenticate(conn, "alice", authMethodSCRAM); err == nil {
+		t.Error("Expected channel binding to be refused")
+	}
+}
+
+func TestAuthenticateMD5(t *testing.T) {
+	for _, password := range []string{"secret", "md5" + md5Hex("secret", "alice")} {
+		auth, err := NewAuthenticator(AuthenticationConfig{User: "alice", Password: password, Method: authMethodMD5}, nil)
+		if err != nil {
+			t.Fatalf("Failed to create authenticator: %v", err)
+		}
+
+		conn := &scriptedAuthConn{respond: md5Client("alice", "secret")}
+		if err := auth.authenticate(conn, "alice", authMethodMD5); err != nil {
+			t.Errorf("Expected MD5 authentication to succeed: %v", err)
+		}
+		if fmt.Sprint(conn.codes) != "[5 0]" {
+			t.Errorf("Unexpected exchange %v", conn.codes)
+		}
+
+		if err := auth.authenticate(&scriptedAuthConn{respond: md5Client("alice", "wrong")}, "alice", authMethodMD5); err == nil {
+			t.Error("Expected a wrong password to fail")
+		}
+	}
+
+	// A SCRAM verifier cannot answer an MD5 challenge; SCRAM is used instead
+	encrypted, _ := encryptPassword("secret")
+	auth, _ := NewAuthenticator(AuthenticationConfig{User: "alice", Password: encrypted, Method: authMethodMD5}, nil)
+	client := &scramClient{password: "secret"}
+	if err := auth.authenticate(&scriptedAuthConn{respond: client.respond}, "alice", authMethodMD5); err != nil {
+		t.Errorf("Expected the SCRAM fallback to succeed: %v", err)
+	}
+
+	if _, err := NewAuthenticator(AuthenticationConfig{User: "alice", Password: "md5" + md5Hex("secret", "alice")}, nil); err == nil {
+		t.Error("Expected an MD5 verifier to be refused for SCRAM authentication")
+	}
+}
+
+func TestAuthenticateCleartext(t *testing.T) {
+	encrypted, _ := encryptPassword("secret")
+	for _, password := range []string{"secret", encrypted, "md5" + md5Hex("secret", "alice")} {
+		auth, err := NewAuthenticator(AuthenticationConfig{User: "alice", Password: password, Method: authMethodPassword}, nil)
+		if err != nil {
+			t.Fatalf("Failed to create authenticator: %v", err)
+		}
+
+		for _, attempt := range []struct {
+			password string
+			ok       bool
+		}{{"secret", true}, {"wrong", false}} {
+			conn := &scriptedAuthConn{respond: func(code int32, data []byte) []byte {
+				return []byte(attempt.password + "\x00")
+			}}
+			if err := auth.authenticate(conn, "alice", authMethodPassword); (err == nil) != attempt.ok {
+				t.Errorf("%s against %s: unexpected result %v", attempt.password, password, err)
+			}
+		}
+	}
+
+	if _, err := NewAuthenticator(AuthenticationConfig{User: "alice", Password: "secret", Method: "trust"}, nil); err == nil {
+		t.Error("Expected an unknown method to be refused")
+	}
+}
+
+func TestAuthenticationThroughServer(t *testing.T) {
+	storage, err := NewLocalStorage(t.TempDir())
+	if err != nil {
+		t.Fatalf("Failed to create local storage: %v", err)
+	}
+	listener, addr := startTestServer(t, storage)
+	auth, err := NewAuthenticator(AuthenticationConfig{Users: []UserConfig{
+		{Name: "reader", Password: "secret", Privilege: "read-only"},
+	}}, nil)
+	if err != nil {
+		t.Fatalf("Failed to create authenticator: %v", err)
+	}
+	listener.Authenticate = auth.Authenticate
+
+	// The listener runs the SCRAM exchange before psql-wire starts the session
+	var one int
+	if err := openTestClient(t, addr, "reader:secret").QueryRow("SELECT 1").Scan(&one); err != nil || one != 1 {
+		t.Errorf("Expected an authenticated query, got %d, %v", one, err)
+	}
+	_, err = openTestClient(t, addr, "reader:wrong").Exec("SELECT 1")
+	if pqErr, ok := err.(*pq.Error); !ok || pqErr.Code != "28P01" {
+		t.Errorf("Expected 28P01 for a wrong password, got %v", err)
+	}
+
+	// The session enforces the privilege of the authenticated user
+	_, err = openTestClient(t, addr, "reader:secret").Exec("CREATE TABLE t (id INTEGER)")
+	if pqErr, ok := err.(*pq.Error); !ok || pqErr.Code != "42501" {
+		t.Errorf("Expected 42501 for a read-only user, got %v", err)
+	}
+	var superuser string
+	if err := openTestClient(t, addr, "reader:secret").QueryRow("SHOW is_superuser").Scan(&superuser); err != nil || superuser != "off" {
+		t.Errorf("Expected is_superuser off for a read-only user, got %q, %v", superuser, err)
+	}
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"time"
+
+	wire "github.com/jeroenrinzema/psql-wire"
+	"github.com/lib/pq/oid"
+)
+
+// executeBatchSimple runs the statements of a simple Query message in order,
+// stopping at the first error. As in PostgreSQL, statements outside an
+// explicit transaction block run in one implicit transaction that commits
+// after the last statement and rolls back when a statement fails.
+func (h *SimpleWireHandler) executeBatchSimple(ctx context.Context, session *Session, connectionID string, statements []string, writer wire.DataWriter) error {
+	var conn *ProtocolConn
+	if session != nil {
+		conn = session.Conn
+	}
+
+	implicit := false
+	for i, query := range statements {
+		out := &batchWriter{conn: conn}
+		if i == len(statements)-1 {
+			out.final = writer
+		}
+
+		keyword := firstKeyword(query)
+		begin := keyword == "BEGIN" || keyword == "START"
+		switch {
+		case implicit && begin:
+			// BEGIN turns the implicit transaction into a transaction block
+			implicit = false
+			if err := out.Complete("BEGIN"); err != nil {
+				return err
+			}
+			continue
+		case !begin && h.txManager.GetTransactionStatus(connectionID) == TxIdle:
+			if err := h.txManager.Begin(connectionID, ""); err != nil {
+				return toPostgresError(err)
+			}
+			h.txMonitor.StartTransaction(connectionID)
+			implicit = true
+		}
+
+		if err := h.runStatementSimple(ctx, session, connectionID, query, out); err != nil {
+			if implicit {
+				h.handleRollbackSimple(connectionID)
+			}
+			return err
+		}
+
+		// COMMIT and ROLLBACK end the implicit transaction as well
+		if implicit && h.txManager.GetTransactionStatus(connectionID) == TxIdle {
+			implicit = false
+		}
+	}
+
+	if implicit {
+		return toPostgresError(h.handleCommitSimple(connectionID))
+	}
+	return nil
+}
+
+// runStatementSimple parses and executes one statement of a batch. Each
+// statement is described only after the previous ones ran, so it can use
+// the tables they created.
+func (h *SimpleWireHandler) runStatementSimple(ctx context.Context, session *Session, connectionID string, query string, writer *batchWriter) error {
+	if err := h.checkTransactionAborted(connectionID, query); err != nil {
+		return err
+	}
+	if err := checkPrivilege(session, query); err != nil {
+		return err
+	}
+
+	if firstKeyword(query) == "COPY" {
+		command, err := parseCopyCommand(query)
+		if err != nil {
+			return err
+		}
+		return h.executeCopy(ctx, session, connectionID, command, writer)
+	}
+
+	// A multi-statement query runs in an implicit transaction block
+	if dbCommand, ok, err := parseDatabaseCommand(query); ok || err != nil {
+		if err != nil {
+			return err
+		}
+		return newPostgresError("25001", "%s cannot run inside a transaction block", dbCommand.Tag())
+	}
+
+	command, ok, err := parseSettingCommand(query)
+	if err != nil {
+		return err
+	}
+	if ok {
+		writer.columns = command.Columns()
+		return h.executeSettingCommand(connectionID, command, writer)
+	}
+
+	stmt, err := h.prepareStatementSimple(connectionID, "", query)
+	if err != nil {
+		return err
+	}
+	columns, err := h.describeQuerySimple(connectionID, stmt)
+	if err != nil {
+		return toPostgresError(err)
+	}
+
+	writer.columns = columns
+	return toPostgresError(h.executeQuerySimple(ctx, connectionID, stmt, nil, columns, writer))
+}
+
+// batchWriter is the wire.DataWriter of a statement in a multi-statement
+// query. psql-wire describes a query once and expects a single result, so
+// the row descriptions, rows and command tags of the statements are written
+// to the connection directly. The last statement completes through the
+// psql-wire writer, which ends the query.
+//
+// psql-wire encodes every row in text format, so rows a Bind requested in
+// binary format are written through a batchWriter as well.
+type batchWriter struct {
+	conn      *ProtocolConn
+	columns   wire.Columns
+	formats   []int16 // result format codes, text when empty
+	final     wire.DataWriter
+	described bool
+	written   uint64
+}
+
+// describe sends the RowDescription before the first row
+func (w *batchWriter) describe() error {
+	if w.described || len(w.columns) == 0 {
+		return nil
+	}
+	w.described = true
+
+	var body bytes.Buffer
+	binary.Write(&body, binary.BigEndian, int16(len(w.columns)))
+	for i, column := range w.columns {
+		size := int16(-1)
+		if info, ok := lookupPgType(column.Oid); ok {
+			size = int16(info.Len)
+		}
+
+		body.WriteString(column.Name)
+		body.WriteByte(0)
+		binary.Write(&body, binary.BigEndian, int32(0)) // table OID
+		binary.Write(&body, binary.BigEndian, int16(0)) // attribute number
+		binary.Write(&body, binary.BigEndian, int32(column.Oid))
+		binary.Write(&body, binary.BigEndian, size)
+		binary.Write(&body, binary.BigEndian, int32(-1)) // type modifier
+		binary.Write(&body, binary.BigEndian, formatCode(w.formats, i))
+	}
+	return w.conn.writeMessage('T', body.Bytes())
+}
+
+func (w *batchWriter) Row(values []interface{}) error {
+	if err := w.describe(); err != nil {
+		return err
+	}
+
+	var body bytes.Buffer
+	binary.Write(&body, binary.BigEndian, int16(len(values)))
+	for i, value := range values {
+		if value == nil {
+			binary.Write(&body, binary.BigEndian, int32(-1))
+			continue
+		}
+
+		typeOid := oid.T_text
+		if i < len(w.columns) {
+			typeOid = w.columns[i].Oid
+		}
+		encoded := []byte(nil)
+		if formatCode(w.formats, i) == int16(wire.BinaryFormat) {
+			var err error
+			if encoded, err = encodeBinaryValue(value, typeOid); err != nil {
+				return err
+			}
+		} else {
+			encoded = []byte(encodeTextValue(value, typeOid))
+		}
+		binary.Write(&body, binary.BigEndian, int32(len(encoded)))
+		body.Write(encoded)
+	}
+
+	w.written++
+	return w.conn.writeMessage('D', body.Bytes())
+}
+
+func (w *batchWriter) Written() uint64 {
+	return w.written
+}
+
+func (w *batchWriter) Empty() error {
+	if w.final != nil {
+		return w.final.Empty()
+	}
+	return w.conn.writeMessage('I', nil)
+}
+
+func (w *batchWriter) Complete(description string) error {
+	if err := w.describe(); err != nil {
+		return err
+	}
+
+	if w.final != nil {
+		return w.final.Complete(description)
+	}
+	return w.conn.writeMessage('C', []byte(description+"\x00"))
+}
+
+// encodeTextValue renders a converted value in PostgreSQL text format
+func encodeTextValue(value interface{}, typeOid oid.Oid) string {
+	switch v := value.(type) {
+	case []byte:
+		if typeOid == oid.T_bytea {
+			return `\x` + hex.EncodeToString(v)
+		}
+		return string(v)
+	case time.Time:
+		if typeOid == oid.T_date {
+			return v.Format("2006-01-02")
+		}
+		return formatValueSimple(v)
+	default:
+		return formatValueSimple(v)
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"testing"
+)
+
+func TestSplitStatements(t *testing.T) {
+	query := `CREATE TABLE t (a TEXT); -- first
+		INSERT INTO t VALUES ('a;b'), ($$c;d$$); ;
+		/* block; comment */ SELECT "x;y" FROM t;
+		CREATE TRIGGER tr AFTER INSERT ON t BEGIN UPDATE t SET a = CASE WHEN a = 'x' THEN 'y' END; DELETE FROM t; END;
+		SELECT 1`
+
+	want := []string{
+		"CREATE TABLE t (a TEXT)",
+		"INSERT INTO t VALUES ('a;b'), ($$c;d$$)",
+		`SELECT "x;y" FROM t`,
+		"CREATE TRIGGER tr AFTER INSERT ON t BEGIN UPDATE t SET a = CASE WHEN a = 'x' THEN 'y' END; DELETE FROM t; END",
+		"SELECT 1",
+	}
+	if got := splitStatements(query); !reflect.DeepEqual(got, want) {
+		t.Errorf("Unexpected statements:\n got: %q\nwant: %q", got, want)
+	}
+}
+
+func TestMultiStatementQuery(t *testing.T) {
+	handler := newTestHandler(t)
+	ctx, _ := handler.StartSession(context.Background())
+	conn := &capturingConn{}
+	sessionFromContext(ctx).Conn = &ProtocolConn{Conn: conn}
+
+	writer := runQuery(t, handler, ctx, "CREATE TABLE t (id INTEGER PRIMARY KEY, name TEXT); INSERT INTO t VALUES (1, 'a'); SELECT name FROM t; SELECT count(*) FROM t")
+
+	// The last statement completes through psql-wire, the others are written directly
+	types, bodies := backendMessages(conn.written.Bytes())
+	if string(types) != "CCTDCTD" {
+		t.Fatalf("Unexpected messages: %q", types)
+	}
+	if string(bodies[0]) != "CREATE TABLE\x00" || string(bodies[1]) != "INSERT 0 1\x00" || string(bodies[4]) != "SELECT 1\x00" {
+		t.Errorf("Unexpected command tags: %q, %q, %q", bodies[0], bodies[1], bodies[4])
+	}
+	if string(bodies[3][6:]) != "a" {
+		t.Errorf("Unexpected data row: %q", bodies[3])
+	}
+	if writer.tag != "SELECT 1" || string(bodies[6][6:]) != "1" {
+		t.Errorf("Unexpected last statement result: %q %q", writer.tag, bodies[6])
+	}
+	if status := handler.txManager.GetTransactionStatus(getConnectionIDSimple(ctx)); status != TxIdle {
+		t.Errorf("Expected implicit transaction to be committed, got status %d", status)
+	}
+
+	// A failing statement rolls back the implicit transaction
+	fn, _, _, err := handler.ParseQuery(ctx, "INSERT INTO t VALUES (2, 'b'); INSERT INTO t VALUES (1, 'duplicate'); INSERT INTO t VALUES (3, 'c')")
+	if err != nil {
+		t.Fatalf("Failed to parse: %v", err)
+	}
+	if err := fn(ctx, &recordingWriter{}, nil); err == nil {
+		t.Fatal("Expected the duplicate key to fail")
+	}
+	writer = runQuery(t, handler, ctx, "SELECT count(*) FROM t")
+	if writer.rows[0][0] != int64(1) {
+		t.Errorf("Expected the batch to be rolled back, got %v rows", writer.rows[0][0])
+	}
+
+	// Statements before an explicit COMMIT stay committed
+	fn, _, _, _ = handler.ParseQuery(ctx, "BEGIN; INSERT INTO t VALUES (2, 'b'); COMMIT; INSERT INTO t VALUES (1, 'duplicate')")
+	if err := fn(ctx, &recordingWriter{}, nil); err == nil {
+		t.Fatal("Expected the duplicate key to fail")
+	}
+	writer = runQuery(t, handler, ctx, "SELECT name FROM t ORDER BY id")
+	if len(writer.rows) != 2 || writer.rows[1][0] != "b" {
+		t.Errorf("Unexpected rows after partial batch: %v", writer.rows)
+	}
+}
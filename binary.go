@@ -0,0 +1,269 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lib/pq/oid"
+)
+
+// Sign values of the binary numeric format
+const (
+	numericPositive = 0x0000
+	numericNegative = 0x4000
+	numericNaN      = 0xC000
+)
+
+// encodeBinaryValue renders a converted value in PostgreSQL binary format
+func encodeBinaryValue(value interface{}, typeOid oid.Oid) ([]byte, error) {
+	switch typeOid {
+	case oid.T_int4:
+		n, err := binaryInteger(value)
+		if err != nil {
+			return nil, err
+		}
+		if n < math.MinInt32 || n > math.MaxInt32 {
+			return nil, newPostgresError("22003", "integer out of range")
+		}
+		return binary.BigEndian.AppendUint32(nil, uint32(int32(n))), nil
+	case oid.T_int8:
+		n, err := binaryInteger(value)
+		if err != nil {
+			return nil, err
+		}
+		return binary.BigEndian.AppendUint64(nil, uint64(n)), nil
+	case oid.T_float8:
+		f, err := binaryFloat(value)
+		if err != nil {
+			return nil, err
+		}
+		return binary.BigEndian.AppendUint64(nil, math.Float64bits(f)), nil
+	case oid.T_numeric:
+		return encodeBinaryNumeric(formatNumericValue(value))
+	case oid.T_bool:
+		b, ok := value.(bool)
+		if !ok {
+			var err error
+			if b, err = parseBoolText(formatValueSimple(value)); err != nil {
+				return nil, err
+			}
+		}
+		if b {
+			return []byte{1}, nil
+		}
+		return []byte{0}, nil
+	case oid.T_bytea:
+		if b, ok := value.([]byte); ok {
+			return b, nil
+		}
+		return []byte(formatValueSimple(value)), nil
+	case oid.T_timestamp, oid.T_timestamptz:
+		t, ok := value.(time.Time)
+		if !ok {
+			return nil, newPostgresError("22007", "invalid input syntax for type timestamp: %q", formatValueSimple(value))
+		}
+		micros := t.Unix()*1000000 + int64(t.Nanosecond()/1000) - pgEpoch.Unix()*1000000
+		return binary.BigEndian.AppendUint64(nil, uint64(micros)), nil
+	case oid.T_date:
+		t, ok := value.(time.Time)
+		if !ok {
+			return nil, newPostgresError("22007", "invalid input syntax for type date: %q", formatValueSimple(value))
+		}
+		days := int32(math.Floor(float64(t.Unix()-pgEpoch.Unix()) / 86400))
+		return binary.BigEndian.AppendUint32(nil, uint32(days)), nil
+	case oid.T_uuid:
+		return parseUUID(formatValueSimple(value))
+	case oid.T_text, oid.T_varchar, oid.T_bpchar, oid.T_name:
+		return []byte(formatValueSimple(value)), nil
+	default:
+		return nil, newPostgresError("0A000", "binary format is not supported for type %d", typeOid)
+	}
+}
+
+// binaryInteger converts a value of an integer column
+func binaryInteger(value interface{}) (int64, error) {
+	switch v := value.(type) {
+	case int64:
+		return v, nil
+	case float64:
+		if v != math.Trunc(v) {
+			return 0, newPostgresError("22P02", "invalid input syntax for type integer: %q", formatValueSimple(v))
+		}
+		return int64(v), nil
+	}
+
+	text := formatValueSimple(value)
+	n, err := strconv.ParseInt(strings.TrimSpace(text), 10, 64)
+	if err != nil {
+		return 0, newPostgresError("22P02", "invalid input syntax for type integer: %q", text)
+	}
+	return n, nil
+}
+
+// binaryFloat converts a value of a floating point column
+func binaryFloat(value interface{}) (float64, error) {
+	switch v := value.(type) {
+	case float64:
+		return v, nil
+	case int64:
+		return float64(v), nil
+	}
+
+	text := formatValueSimple(value)
+	f, err := strconv.ParseFloat(strings.TrimSpace(text), 64)
+	if err != nil {
+		return 0, newPostgresError("22P02", "invalid input syntax for type double precision: %q", text)
+	}
+	return f, nil
+}
+
+// formatNumericValue renders a numeric column value as a plain decimal;
+// SQLite returns large and small reals in exponent notation
+func formatNumericValue(value interface{}) string {
+	switch v := value.(type) {
+	case int64:
+		return strconv.FormatInt(v, 10)
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	}
+
+	text := strings.TrimSpace(formatValueSimple(value))
+	if strings.ContainsAny(text, "eE") {
+		if f, err := strconv.ParseFloat(text, 64); err == nil {
+			return strconv.FormatFloat(f, 'f', -1, 64)
+		}
+	}
+	return text
+}
+
+// encodeBinaryNumeric encodes a decimal in the binary numeric format: a
+// header of digit count, weight, sign and display scale followed by base
+// 10000 digits
+func encodeBinaryNumeric(text string) ([]byte, error) {
+	if strings.EqualFold(text, "NaN") {
+		nan := make([]byte, 8)
+		binary.BigEndian.PutUint16(nan[4:], numericNaN)
+		return nan, nil
+	}
+
+	sign := uint16(numericPositive)
+	switch {
+	case strings.HasPrefix(text, "-"):
+		sign = numericNegative
+		text = text[1:]
+	case strings.HasPrefix(text, "+"):
+		text = text[1:]
+	}
+
+	intPart, fracPart, _ := strings.Cut(text, ".")
+	if intPart+fracPart == "" || strings.Trim(intPart+fracPart, "0123456789") != "" {
+		return nil, newPostgresError("22P02", "invalid input syntax for type numeric: %q", text)
+	}
+	scale := len(fracPart)
+
+	// Pad both parts to whole base 10000 digits around the decimal point
+	intPart = strings.Repeat("0", (4-len(intPart)%4)%4) + intPart
+	fracPart += strings.Repeat("0", (4-len(fracPart)%4)%4)
+
+	var digits []int16
+	for _, part := range []string{intPart, fracPart} {
+		for i := 0; i < len(part); i += 4 {
+			d, _ := strconv.Atoi(part[i : i+4])
+			digits = append(digits, int16(d))
+		}
+	}
+	weight := len(intPart)/4 - 1
+
+	// Leading and trailing zero digits are implied by the weight
+	for len(digits) > 0 && digits[0] == 0 {
+		digits = digits[1:]
+		weight--
+	}
+	for len(digits) > 0 && digits[len(digits)-1] == 0 {
+		digits = digits[:len(digits)-1]
+	}
+	if len(digits) == 0 {
+		weight = 0
+		sign = numericPositive
+	}
+
+	buf := make([]byte, 0, 8+2*len(digits))
+	buf = binary.BigEndian.AppendUint16(buf, uint16(len(digits)))
+	buf = binary.BigEndian.AppendUint16(buf, uint16(int16(weight)))
+	buf = binary.BigEndian.AppendUint16(buf, sign)
+	buf = binary.BigEndian.AppendUint16(buf, uint16(scale))
+	for _, d := range digits {
+		buf = binary.BigEndian.AppendUint16(buf, uint16(d))
+	}
+	return buf, nil
+}
+
+// decodeBinaryNumeric decodes the binary numeric format into a decimal
+func decodeBinaryNumeric(value []byte) (string, error) {
+	if len(value) < 8 {
+		return "", fmt.Errorf("invalid binary numeric of %d bytes", len(value))
+	}
+	count := int(binary.BigEndian.Uint16(value))
+	weight := int(int16(binary.BigEndian.Uint16(value[2:])))
+	sign := binary.BigEndian.Uint16(value[4:])
+	scale := int(binary.BigEndian.Uint16(value[6:]))
+	if len(value) != 8+2*count {
+		return "", fmt.Errorf("invalid binary numeric of %d bytes", len(value))
+	}
+	if sign == numericNaN {
+		return "NaN", nil
+	}
+
+	// digit returns the base 10000 digit with the given power
+	digit := func(power int) int {
+		i := weight - power
+		if i < 0 || i >= count {
+			return 0
+		}
+		return int(binary.BigEndian.Uint16(value[8+2*i:]))
+	}
+
+	var sb strings.Builder
+	if sign == numericNegative {
+		sb.WriteByte('-')
+	}
+	if weight < 0 {
+		sb.WriteByte('0')
+	}
+	for power := weight; power >= 0; power-- {
+		if power == weight {
+			sb.WriteString(strconv.Itoa(digit(power)))
+		} else {
+			fmt.Fprintf(&sb, "%04d", digit(power))
+		}
+	}
+	if scale > 0 {
+		var frac strings.Builder
+		for power := -1; frac.Len() < scale; power-- {
+			fmt.Fprintf(&frac, "%04d", digit(power))
+		}
+		sb.WriteByte('.')
+		sb.WriteString(frac.String()[:scale])
+	}
+	return sb.String(), nil
+}
+
+// parseUUID decodes the text form of a UUID into its 16 bytes
+func parseUUID(text string) ([]byte, error) {
+	b, err := hex.DecodeString(strings.ReplaceAll(strings.Trim(text, "{}"), "-", ""))
+	if err != nil || len(b) != 16 {
+		return nil, newPostgresError("22P02", "invalid input syntax for type uuid: %q", text)
+	}
+	return b, nil
+}
+
+// formatUUID renders 16 bytes in the text form of a UUID
+func formatUUID(b []byte) string {
+	s := hex.EncodeToString(b)
+	return s[0:8] + "-" + s[8:12] + "-" + s[12:16] + "-" + s[16:20] + "-" + s[20:32]
+}
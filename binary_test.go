@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+	"time"
+
+	"github.com/lib/pq/oid"
+)
+
+func TestBinaryNumeric(t *testing.T) {
+	for _, text := range []string{"0", "1", "-12.34", "12345678.9", "0.0001", "0.00000123", "100000000", "5.10", "NaN"} {
+		encoded, err := encodeBinaryNumeric(text)
+		if err != nil {
+			t.Errorf("encodeBinaryNumeric(%q) failed: %v", text, err)
+			continue
+		}
+		if decoded, err := decodeBinaryNumeric(encoded); err != nil || decoded != text {
+			t.Errorf("numeric %q round trip = %q, %v", text, decoded, err)
+		}
+	}
+
+	// 12345678.9 is the base 10000 digits 1234 5678 9000 with weight 1
+	encoded, _ := encodeBinaryNumeric("12345678.9")
+	want := []byte{0, 3, 0, 1, 0, 0, 0, 1, 0x04, 0xd2, 0x16, 0x2e, 0x23, 0x28}
+	if !bytes.Equal(encoded, want) {
+		t.Errorf("Unexpected numeric encoding: % x", encoded)
+	}
+
+	if _, err := encodeBinaryValue(int64(1)<<40, oid.T_int4); err == nil {
+		t.Error("Expected an out of range int4 to fail")
+	}
+}
+
+func TestBinaryResults(t *testing.T) {
+	storage, err := NewLocalStorage(t.TempDir())
+	if err != nil {
+		t.Fatalf("Failed to create local storage: %v", err)
+	}
+	_, addr := startTestServer(t, storage)
+	client := dialTestClient(t, addr)
+
+	client.send('Q', "CREATE TABLE t (n INT4, big BIGINT, f DOUBLE PRECISION, ok BOOLEAN, data BYTEA, at TIMESTAMP, id UUID, amount NUMERIC(10,2))\x00")
+	client.receive()
+	client.send('P', "\x00INSERT INTO t (n, big, f, ok, data, at, id, amount) VALUES (7, 9000000000, 1.5, TRUE, $1, '2000-01-02 00:00:01', 'a0eebc99-9c0b-4ef8-bb6d-6bb9bd380a11', 12.5)\x00\x00\x00")
+	client.send('B', "\x00\x00\x00\x00\x00\x01\x00\x00\x00\x06\\x0102\x00\x00")
+	client.send('E', "\x00\x00\x00\x00\x00")
+	client.send('S', "")
+	if types, bodies := client.receive(); string(types) != "12CZ" {
+		t.Fatalf("Failed to insert: %q %q", types, bodies)
+	}
+
+	// The client binds the portal with binary results and describes it
+	var bind bytes.Buffer
+	bind.WriteString("\x00\x00")
+	binary.Write(&bind, binary.BigEndian, []int16{0, 0, 1, 1}) // no parameters, all results binary
+	client.send('P', "\x00SELECT n, big, f, ok, data, at, id, amount FROM t\x00\x00\x00")
+	client.send('B', bind.String())
+	client.send('D', "P\x00")
+	client.send('E', "\x00\x00\x00\x00\x00")
+	client.send('S', "")
+	types, bodies := client.receive()
+	if string(types) != "12TDCZ" {
+		t.Fatalf("Unexpected messages: %q %q", types, bodies)
+	}
+	bodies = bodies[2:]
+
+	// psql-wire describes the statement in text format, the format codes are corrected
+	if format := binary.BigEndian.Uint16(bodies[0][len(bodies[0])-2:]); format != 1 {
+		t.Errorf("Expected binary format in RowDescription, got %d", format)
+	}
+	if typeOid := binary.BigEndian.Uint32(bodies[0][2+len("n\x00")+6:]); typeOid != uint32(oid.T_int4) {
+		t.Errorf("Expected n to be described as int4, got %d", typeOid)
+	}
+
+	// Split the DataRow into its values
+	var values [][]byte
+	row := bodies[1][2:]
+	for len(row) > 0 {
+		n := int(binary.BigEndian.Uint32(row))
+		values = append(values, row[4:4+n])
+		row = row[4+n:]
+	}
+	micros := make([]byte, 8)
+	binary.BigEndian.PutUint64(micros, uint64((24*time.Hour+time.Second)/time.Microsecond))
+	amount, _ := encodeBinaryNumeric("12.5")
+	want := [][]byte{
+		{0, 0, 0, 7},
+		{0, 0, 0, 2, 0x18, 0x71, 0x1a, 0},
+		{0x3f, 0xf8, 0, 0, 0, 0, 0, 0},
+		{1},
+		{1, 2},
+		micros,
+		{0xa0, 0xee, 0xbc, 0x99, 0x9c, 0x0b, 0x4e, 0xf8, 0xbb, 0x6d, 0x6b, 0xb9, 0xbd, 0x38, 0x0a, 0x11},
+		amount,
+	}
+	if len(values) != len(want) {
+		t.Fatalf("Unexpected values: %q", values)
+	}
+	for i := range want {
+		if !bytes.Equal(values[i], want[i]) {
+			t.Errorf("column %d = % x; want % x", i+1, values[i], want[i])
+		}
+	}
+}
+
+func TestBinaryParameters(t *testing.T) {
+	storage, err := NewLocalStorage(t.TempDir())
+	if err != nil {
+		t.Fatalf("Failed to create local storage: %v", err)
+	}
+	_, addr := startTestServer(t, storage)
+	client := dialTestClient(t, addr)
+	client.send('Q', "CREATE TABLE p (n INT4, data BYTEA, id UUID)\x00")
+	client.receive()
+
+	id := []byte{0xa0, 0xee, 0xbc, 0x99, 0x9c, 0x0b, 0x4e, 0xf8, 0xbb, 0x6d, 0x6b, 0xb9, 0xbd, 0x38, 0x0a, 0x11}
+	insert := func(parse string, values ...[]byte) {
+		t.Helper()
+		var bind bytes.Buffer
+		bind.WriteString("\x00\x00")
+		binary.Write(&bind, binary.BigEndian, []int16{1, 1, int16(len(values))}) // all parameters binary
+		for _, value := range values {
+			binary.Write(&bind, binary.BigEndian, int32(len(value)))
+			bind.Write(value)
+		}
+		bind.WriteString("\x00\x00")
+		client.send('P', parse)
+		client.send('B', bind.String())
+		client.send('E', "\x00\x00\x00\x00\x00")
+		client.send('S', "")
+		if types, bodies := client.receive(); string(types) != "12CZ" {
+			t.Fatalf("Failed to insert: %q %q", types, bodies)
+		}
+	}
+
+	// The types are inferred from the columns, or declared in the Parse
+	insert("\x00INSERT INTO p (n, data, id) VALUES ($1, $2, $3)\x00\x00\x00", []byte{0, 0, 0, 7}, []byte{0, 1, 2}, id)
+	insert("\x00INSERT INTO p (n) SELECT $1\x00\x00\x01\x00\x00\x00\x17", []byte{0, 0, 0, 8})
+
+	client.send('Q', "SELECT n, data, id FROM p ORDER BY n\x00")
+	types, bodies := client.receive()
+	if string(types) != "TDDCZ" {
+		t.Fatalf("Unexpected messages: %q %q", types, bodies)
+	}
+	for i, want := range []string{
+		"\x00\x03\x00\x00\x00\x017\x00\x00\x00\x08\\x000102\x00\x00\x00\x24a0eebc99-9c0b-4ef8-bb6d-6bb9bd380a11",
+		"\x00\x03\x00\x00\x00\x018\xff\xff\xff\xff\xff\xff\xff\xff",
+	} {
+		if string(bodies[1+i]) != want {
+			t.Errorf("row %d = %q; want %q", i+1, bodies[1+i], want)
+		}
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// cancelRequestCode is the protocol code carried by a CancelRequest
+const cancelRequestCode = 80877102
+
+// CancelRegistry maps the keys sent to clients in BackendKeyData to their
+// sessions, so a CancelRequest arriving on another connection can find the
+// statement to interrupt
+type CancelRegistry struct {
+	mu       sync.Mutex
+	sessions map[uint32]*Session
+}
+
+// NewCancelRegistry creates an empty registry
+func NewCancelRegistry() *CancelRegistry {
+	return &CancelRegistry{sessions: make(map[uint32]*Session)}
+}
+
+// Register gives the session a random secret key under its process ID
+func (r *CancelRegistry) Register(session *Session) error {
+	var secret [4]byte
+	if _, err := rand.Read(secret[:]); err != nil {
+		return fmt.Errorf("failed to generate cancel key: %w", err)
+	}
+	session.SecretKey = binary.BigEndian.Uint32(secret[:])
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.sessions[session.ProcessID] = session
+	return nil
+}
+
+// Unregister forgets the session's key
+func (r *CancelRegistry) Unregister(session *Session) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.sessions[session.ProcessID] == session {
+		delete(r.sessions, session.ProcessID)
+	}
+}
+
+// Sessions returns all registered sessions
+func (r *CancelRegistry) Sessions() []*Session {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	sessions := make([]*Session, 0, len(r.sessions))
+	for _, session := range r.sessions {
+		sessions = append(sessions, session)
+	}
+	return sessions
+}
+
+// Cancel interrupts the statement running for the key, if any. As in
+// PostgreSQL, requests with an unknown key are silently ignored.
+func (r *CancelRegistry) Cancel(processID uint32, secretKey uint32) {
+	r.mu.Lock()
+	session, ok := r.sessions[processID]
+	r.mu.Unlock()
+
+	var got, want [4]byte
+	binary.BigEndian.PutUint32(got[:], secretKey)
+	if ok {
+		binary.BigEndian.PutUint32(want[:], session.SecretKey)
+	}
+	if !ok || subtle.ConstantTimeCompare(got[:], want[:]) != 1 {
+		log.Printf("WARN: Ignoring cancel request with an unknown key for process %d", processID)
+		return
+	}
+
+	if session.cancelStatement() {
+		log.Printf("INFO: Canceled the running statement of connection %s", session.ID)
+	}
+}
+
+// startStatement derives the context a statement runs with, ending after
+// the timeout when one is set; a cancel request for the session cancels it
+// until done is called
+func (s *Session) startStatement(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	var cancel context.CancelFunc
+	if timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+	} else {
+		ctx, cancel = context.WithCancel(ctx)
+	}
+
+	s.mu.Lock()
+	s.cancel = cancel
+	s.mu.Unlock()
+
+	return ctx, func() {
+		s.mu.Lock()
+		s.cancel = nil
+		s.idleSince = time.Now()
+		s.mu.Unlock()
+		cancel()
+	}
+}
+
+// cancelStatement cancels the running statement and reports whether there was one
+func (s *Session) cancelStatement() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.cancel == nil {
+		return false
+	}
+	s.cancel()
+	return true
+}
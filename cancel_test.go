@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"testing"
+	"time"
+
+	psqlerr "github.com/jeroenrinzema/psql-wire/errors"
+)
+
+func TestBackendKeyData(t *testing.T) {
+	conn := &capturingConn{}
+	pc := &ProtocolConn{Conn: conn, awaitingReady: true}
+
+	// psql-wire's parameters are dropped, the session sends the key itself
+	pc.Write(frontendMessage('S', []byte("server_version\x0015.0\x00")))
+	pc.WriteBackendKeyData(7, 0xdeadbeef)
+	pc.Write(frontendMessage('Z', []byte("I")))
+
+	types, bodies := backendMessages(conn.written.Bytes())
+	if string(types) != "KZ" || string(bodies[0]) != "\x00\x00\x00\x07\xde\xad\xbe\xef" {
+		t.Errorf("Unexpected messages: %q %q", types, bodies)
+	}
+
+	// A CancelRequest is an untyped startup packet carrying the key
+	var got [2]uint32
+	listener := &ProtocolListener{OnCancel: func(processID uint32, secretKey uint32) {
+		got = [2]uint32{processID, secretKey}
+	}}
+	request := binary.BigEndian.AppendUint32(nil, 16)
+	request = binary.BigEndian.AppendUint32(request, cancelRequestCode)
+	request = binary.BigEndian.AppendUint32(request, 7)
+	request = binary.BigEndian.AppendUint32(request, 0xdeadbeef)
+	cancel := newProtocolConn(&streamConn{stream: bytes.NewReader(request)}, listener, "1")
+	packet := make([]byte, len(request))
+	if _, err := io.ReadFull(cancel, packet); err != nil || !bytes.Equal(packet, request) {
+		t.Errorf("Expected the request to be passed on, got %q, %v", packet, err)
+	}
+	if got != [2]uint32{7, 0xdeadbeef} {
+		t.Errorf("Unexpected cancel key: %v", got)
+	}
+}
+
+func TestCancelRequest(t *testing.T) {
+	handler := newTestHandler(t)
+	ctx, _ := handler.StartSession(context.Background())
+	session := sessionFromContext(ctx)
+
+	// A recursive query that never ends on its own
+	fn, _, _, err := handler.ParseQuery(ctx, "WITH RECURSIVE c(x) AS (SELECT 1 UNION ALL SELECT x + 1 FROM c) SELECT count(*) FROM c")
+	if err != nil {
+		t.Fatalf("Failed to parse: %v", err)
+	}
+	result := make(chan error, 1)
+	go func() {
+		result <- fn(ctx, &recordingWriter{}, nil)
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+	handler.cancels.Cancel(session.ProcessID, session.SecretKey+1)
+	select {
+	case err := <-result:
+		t.Fatalf("Expected a wrong secret key to be ignored, got %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	handler.cancels.Cancel(session.ProcessID, session.SecretKey)
+	select {
+	case err := <-result:
+		if code := psqlerr.GetCode(err); code != "57014" {
+			t.Errorf("Expected 57014, got %s: %v", code, err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Statement was not canceled")
+	}
+
+	// The session stays usable and a cancel between statements is a no-op
+	handler.cancels.Cancel(session.ProcessID, session.SecretKey)
+	writer := runQuery(t, handler, ctx, "SELECT 1")
+	if len(writer.rows) != 1 {
+		t.Errorf("Unexpected rows after cancel: %v", writer.rows)
+	}
+
+	handler.CloseSession(ctx)
+	handler.cancels.mu.Lock()
+	_, registered := handler.cancels.sessions[session.ProcessID]
+	handler.cancels.mu.Unlock()
+	if registered {
+		t.Error("Expected the cancel key to be dropped when the session closes")
+	}
+}
@@ -0,0 +1,508 @@
+package main
+
+import (
+	"context"
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/lib/pq/oid"
+	"github.com/mattn/go-sqlite3"
+)
+
+// OIDs of emulated catalog objects. Relations use the sqlite_master rowid
+// offset into the range PostgreSQL reserves for user objects.
+const (
+	namespaceCatalog           = 11
+	namespacePublic            = 2200
+	namespaceInformationSchema = 13000
+
+	userObjectOID     = 16384
+	primaryKeyOID     = userObjectOID + 1000000 // implicit rowid primary key indexes
+	constraintBaseOID = userObjectOID + 2000000
+	defaultBaseOID    = userObjectOID + 3000000
+	databaseBaseOID   = userObjectOID + 4000000
+)
+
+// pgTypeInfo describes a type listed in pg_type
+type pgTypeInfo struct {
+	OID      oid.Oid
+	Name     string
+	SQLName  string // name used by format_type and information_schema
+	Len      int
+	Category string
+	Array    oid.Oid
+}
+
+// pgTypes are the types SQLite columns map to, plus the ones clients
+// commonly look up by name
+var pgTypes = []pgTypeInfo{
+	{oid.T_bool, "bool", "boolean", 1, "B", oid.T__bool},
+	{oid.T_bytea, "bytea", "bytea", -1, "U", oid.T__bytea},
+	{oid.T_char, "char", "\"char\"", 1, "S", oid.T__char},
+	{oid.T_name, "name", "name", 64, "S", oid.T__name},
+	{oid.T_int8, "int8", "bigint", 8, "N", oid.T__int8},
+	{oid.T_int2, "int2", "smallint", 2, "N", oid.T__int2},
+	{oid.T_int4, "int4", "integer", 4, "N", oid.T__int4},
+	{oid.T_text, "text", "text", -1, "S", oid.T__text},
+	{oid.T_oid, "oid", "oid", 4, "N", oid.T__oid},
+	{oid.T_json, "json", "json", -1, "U", oid.T__json},
+	{oid.T_float4, "float4", "real", 4, "N", oid.T__float4},
+	{oid.T_float8, "float8", "double precision", 8, "N", oid.T__float8},
+	{oid.T_bpchar, "bpchar", "character", -1, "S", oid.T__bpchar},
+	{oid.T_varchar, "varchar", "character varying", -1, "S", oid.T__varchar},
+	{oid.T_date, "date", "date", 4, "D", oid.T__date},
+	{oid.T_time, "time", "time without time zone", 8, "D", oid.T__time},
+	{oid.T_timestamp, "timestamp", "timestamp without time zone", 8, "D", oid.T__timestamp},
+	{oid.T_timestamptz, "timestamptz", "timestamp with time zone", 8, "D", oid.T__timestamptz},
+	{oid.T_numeric, "numeric", "numeric", -1, "N", oid.T__numeric},
+	{oid.T_uuid, "uuid", "uuid", 16, "U", oid.T__uuid},
+	{oid.T_jsonb, "jsonb", "jsonb", -1, "U", oid.T__jsonb},
+}
+
+// lookupPgType returns the pg_type entry for a type OID
+func lookupPgType(typeOid oid.Oid) (pgTypeInfo, bool) {
+	for _, info := range pgTypes {
+		if info.OID == typeOid {
+			return info, true
+		}
+	}
+	return pgTypeInfo{}, false
+}
+
+// sqliteConnector opens connections through a driver carrying the backend's
+// connect hook, so every pooled connection gets the catalog emulation
+type sqliteConnector struct {
+	driver *sqlite3.SQLiteDriver
+	dsn    string
+}
+
+func (c *sqliteConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	return c.driver.Open(c.dsn)
+}
+
+func (c *sqliteConnector) Driver() driver.Driver {
+	return c.driver
+}
+
+// setupConnection prepares a new SQLite connection: it registers the
+// PostgreSQL functions tools call and creates the pg_catalog and
+// information_schema relations as temporary views. Temporary objects are
+// private to the connection and never end up in the database file.
+func (b *SQLiteBackend) setupConnection(conn *sqlite3.SQLiteConn) error {
+	if err := b.registerFunctions(conn); err != nil {
+		return fmt.Errorf("failed to register functions: %w", err)
+	}
+	if _, err := conn.Exec(catalogSchema(), nil); err != nil {
+		return fmt.Errorf("failed to create catalog: %w", err)
+	}
+	return nil
+}
+
+// registerFunctions registers the PostgreSQL functions catalog queries use
+func (b *SQLiteBackend) registerFunctions(conn *sqlite3.SQLiteConn) error {
+	functions := []struct {
+		name string
+		impl interface{}
+		pure bool
+	}{
+		{"pgblob_type_oid", func(declType interface{}) int64 { return int64(declaredTypeOID(declType)) }, true},
+		{"pgblob_type_name", func(declType interface{}) string { return SQLiteTypeToPostgres(sqlText(declType)) }, true},
+		{"pgblob_type_len", func(declType interface{}) int64 {
+			info, _ := lookupPgType(declaredTypeOID(declType))
+			return int64(info.Len)
+		}, true},
+		{"pgblob_sql_type", func(declType interface{}) string {
+			info, _ := lookupPgType(declaredTypeOID(declType))
+			return info.SQLName
+		}, true},
+		{"pgblob_typmod", func(declType interface{}) int64 { return declaredTypeModifier(sqlText(declType)) }, true},
+		{"format_type", formatType, true},
+		{"pg_get_expr", func(args ...interface{}) interface{} { return args[0] }, true},
+		{"pg_table_is_visible", func(relationOid interface{}) bool { return true }, true},
+		{"pg_type_is_visible", func(typeOid interface{}) bool { return true }, true},
+		{"pg_get_userbyid", func(roleOid interface{}) string { return "postgres" }, true},
+		{"obj_description", func(args ...interface{}) interface{} { return nil }, true},
+		{"col_description", func(args ...interface{}) interface{} { return nil }, true},
+		{"shobj_description", func(args ...interface{}) interface{} { return nil }, true},
+		{"pg_encoding_to_char", func(encoding interface{}) string { return "UTF8" }, true},
+		{"current_schema", func() string { return "public" }, true},
+		{"current_database", b.DatabaseName, false},
+		{"pgblob_databases", b.listDatabases, false},
+		{"array_to_string", func(array interface{}, separator interface{}) interface{} { return array }, true},
+		{"version", postgresVersion, true},
+		{"regexp", matchRegexp, true},
+		{"pgblob_current_setting", b.currentSetting, false},
+		{"pgblob_set_config", b.setConfig, false},
+	}
+
+	for _, fn := range functions {
+		if err := conn.RegisterFunc(fn.name, fn.impl, fn.pure); err != nil {
+			return fmt.Errorf("%s: %w", fn.name, err)
+		}
+	}
+	return nil
+}
+
+// listDatabases implements pgblob_databases(), the JSON array of database
+// names pg_database is read from
+func (b *SQLiteBackend) listDatabases() (string, error) {
+	names := []string{b.DatabaseName()}
+	if b.databaseLister != nil {
+		var err error
+		if names, err = b.databaseLister(); err != nil {
+			return "", err
+		}
+	}
+	encoded, err := json.Marshal(names)
+	return string(encoded), err
+}
+
+// SetDatabaseLister sets the function listing the databases in pg_database
+func (b *SQLiteBackend) SetDatabaseLister(lister func() ([]string, error)) {
+	b.databaseLister = lister
+}
+
+// sqlText converts a SQLite function argument to text, NULL becomes empty
+func sqlText(value interface{}) string {
+	switch v := value.(type) {
+	case string:
+		return v
+	case []byte:
+		return string(v)
+	case nil:
+		return ""
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// declaredTypeOID returns the PostgreSQL type OID for a SQLite declared type
+func declaredTypeOID(declType interface{}) oid.Oid {
+	return PostgresTypeOID(SQLiteTypeToPostgres(sqlText(declType)))
+}
+
+var typeModifierRe = regexp.MustCompile(`\(\s*(\d+)\s*(?:,\s*(\d+)\s*)?\)`)
+
+// declaredTypeModifier returns the PostgreSQL typmod for a declared type:
+// the length of character types and the precision and scale of numerics
+func declaredTypeModifier(declType string) int64 {
+	m := typeModifierRe.FindStringSubmatch(declType)
+	if m == nil {
+		return -1
+	}
+	first, _ := strconv.ParseInt(m[1], 10, 64)
+	switch SQLiteTypeToPostgres(declType) {
+	case "text":
+		return first + 4
+	case "numeric":
+		scale, _ := strconv.ParseInt(m[2], 10, 64)
+		return (first<<16 | scale) + 4
+	default:
+		return -1
+	}
+}
+
+// formatType implements format_type(type_oid, typemod)
+func formatType(typeOid interface{}, typmod interface{}) interface{} {
+	n, ok := typeOid.(int64)
+	if !ok {
+		return nil
+	}
+	info, ok := lookupPgType(oid.Oid(n))
+	if !ok {
+		return "???"
+	}
+
+	mod, _ := typmod.(int64)
+	switch {
+	case mod >= 4 && (info.OID == oid.T_text || info.OID == oid.T_varchar):
+		return fmt.Sprintf("character varying(%d)", mod-4)
+	case mod >= 4 && info.OID == oid.T_numeric:
+		return fmt.Sprintf("numeric(%d,%d)", (mod-4)>>16, (mod-4)&0xffff)
+	default:
+		return info.SQLName
+	}
+}
+
+// postgresVersion implements version()
+func postgresVersion() string {
+	sqliteVersion, _, _ := sqlite3.Version()
+	return fmt.Sprintf("PostgreSQL 13.0 (pgblob, SQLite %s)", sqliteVersion)
+}
+
+// regexpCache holds compiled patterns of the regular expression operators
+var regexpCache sync.Map
+
+// matchRegexp implements the SQLite REGEXP operator the ~ operators translate to
+func matchRegexp(pattern interface{}, value interface{}) (interface{}, error) {
+	if pattern == nil || value == nil {
+		return nil, nil
+	}
+	if b, ok := value.([]byte); ok && b == nil {
+		return nil, nil
+	}
+
+	expr := sqlText(pattern)
+	cached, ok := regexpCache.Load(expr)
+	if !ok {
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid regular expression: %w", err)
+		}
+		cached, _ = regexpCache.LoadOrStore(expr, re)
+	}
+	return cached.(*regexp.Regexp).MatchString(sqlText(value)), nil
+}
+
+// catalogView is an emulated catalog relation. SQLite only reports declared
+// column types for views through the last SELECT of a compound, so each view
+// ends with a UNION ALL over an empty table declaring the column types.
+// Comparison affinity comes from the first SELECT instead, which is why OID
+// columns are cast there: clients compare them with quoted literals.
+type catalogView struct {
+	Name    string
+	Columns string
+	Select  string
+}
+
+// columnNames lists the view's column names for CREATE VIEW
+func (v catalogView) columnNames() string {
+	var names []string
+	for _, column := range strings.Split(v.Columns, ",") {
+		names = append(names, strings.Fields(column)[0])
+	}
+	return strings.Join(names, ", ")
+}
+
+// userRelation matches the tables and views of the main database
+const userRelation = `m.type IN ('table', 'view') AND m.name NOT LIKE 'sqlite\_%' ESCAPE '\'`
+
+// rowidPrimaryKey matches tables whose primary key is the rowid; SQLite has no
+// index for it, so a <table>_pkey index is emulated
+var rowidPrimaryKey = `m.type = 'table' AND ` +
+	`(SELECT count(*) FROM pragma_table_info(m.name, 'main') WHERE pk > 0) = 1 AND ` +
+	`EXISTS (SELECT 1 FROM pragma_table_info(m.name, 'main') WHERE pk = 1 AND upper(type) = 'INTEGER') AND ` +
+	`NOT EXISTS (SELECT 1 FROM pragma_index_list(m.name, 'main') WHERE origin = 'pk')`
+
+var catalogViews = []catalogView{
+	{
+		Name: "pg_class",
+		Columns: `oid INTEGER, relname TEXT, relnamespace INTEGER, reltype INTEGER, reloftype INTEGER,
+			relowner INTEGER, relam INTEGER, relfilenode INTEGER, reltablespace INTEGER, relpages INTEGER,
+			reltuples REAL, relallvisible INTEGER, reltoastrelid INTEGER, relhasindex BOOLEAN,
+			relisshared BOOLEAN, relpersistence TEXT, relkind TEXT, relnatts INTEGER, relchecks INTEGER,
+			relhasrules BOOLEAN, relhastriggers BOOLEAN, relhassubclass BOOLEAN, relrowsecurity BOOLEAN,
+			relforcerowsecurity BOOLEAN, relispopulated BOOLEAN, relreplident TEXT, relispartition BOOLEAN,
+			relacl TEXT, reloptions TEXT`,
+		Select: `SELECT CAST({user} + m.rowid AS INTEGER), {indexname:m}, {public}, 0, 0, 10, CASE m.type WHEN 'index' THEN 403 ELSE 0 END,
+				CAST({user} + m.rowid AS INTEGER), 0, 0, -1, 0, 0,
+				m.type = 'table' AND (EXISTS (SELECT 1 FROM main.sqlite_master i WHERE i.type = 'index' AND i.tbl_name = m.name) OR ({rowidpk})),
+				0, 'p', CASE m.type WHEN 'table' THEN 'r' WHEN 'view' THEN 'v' ELSE 'i' END,
+				CASE m.type WHEN 'index' THEN (SELECT count(*) FROM pragma_index_info(m.name, 'main'))
+					ELSE (SELECT count(*) FROM pragma_table_info(m.name, 'main')) END,
+				0, 0, EXISTS (SELECT 1 FROM main.sqlite_master t WHERE t.type = 'trigger' AND t.tbl_name = m.name),
+				0, 0, 0, 1, 'd', 0, NULL, NULL
+			FROM main.sqlite_master m
+			WHERE (m.type = 'index' AND m.tbl_name NOT LIKE 'sqlite\_%' ESCAPE '\') OR ({userrel})
+			UNION ALL
+			SELECT CAST({pkey} + m.rowid AS INTEGER), m.name || '_pkey', {public}, 0, 0, 10, 403, CAST({pkey} + m.rowid AS INTEGER), 0, 0, -1, 0, 0,
+				0, 0, 'p', 'i', 1, 0, 0, 0, 0, 0, 0, 1, 'n', 0, NULL, NULL
+			FROM main.sqlite_master m WHERE ({userrel}) AND ({rowidpk})`,
+	},
+	{
+		Name: "pg_attribute",
+		Columns: `attrelid INTEGER, attname TEXT, atttypid INTEGER, attstattarget INTEGER, attlen INTEGER,
+			attnum INTEGER, attndims INTEGER, attcacheoff INTEGER, atttypmod INTEGER, attbyval BOOLEAN,
+			attalign TEXT, attstorage TEXT, attnotnull BOOLEAN, atthasdef BOOLEAN, atthasmissing BOOLEAN,
+			attidentity TEXT, attgenerated TEXT, attisdropped BOOLEAN, attislocal BOOLEAN,
+			attinhcount INTEGER, attcollation INTEGER, attacl TEXT`,
+		Select: `SELECT CAST({user} + m.rowid AS INTEGER), c.name, pgblob_type_oid(c.type), -1, pgblob_type_len(c.type), c.cid + 1,
+				0, -1, pgblob_typmod(c.type), pgblob_type_len(c.type) IN (1, 2, 4, 8), 'i', 'p',
+				c."notnull" OR c.pk > 0, c.dflt_value IS NOT NULL, 0,
+				CASE WHEN c.pk = 1 AND ({rowidpk}) THEN 'd' ELSE '' END, '', 0, 1, 0, 0, NULL
+			FROM main.sqlite_master m JOIN pragma_table_info(m.name, 'main') c
+			WHERE {userrel}
+			UNION ALL
+			SELECT CAST({user} + m.rowid AS INTEGER), coalesce(i.name, 'expr'), pgblob_type_oid(c.type), -1, pgblob_type_len(c.type),
+				i.seqno + 1, 0, -1, pgblob_typmod(c.type), pgblob_type_len(c.type) IN (1, 2, 4, 8), 'i', 'p',
+				0, 0, 0, '', '', 0, 1, 0, 0, NULL
+			FROM main.sqlite_master m JOIN pragma_index_info(m.name, 'main') i
+				LEFT JOIN pragma_table_info(m.tbl_name, 'main') c ON c.cid = i.cid
+			WHERE m.type = 'index' AND m.tbl_name NOT LIKE 'sqlite\_%' ESCAPE '\'
+			UNION ALL
+			SELECT CAST({pkey} + m.rowid AS INTEGER), c.name, pgblob_type_oid(c.type), -1, pgblob_type_len(c.type), 1,
+				0, -1, -1, 1, 'i', 'p', 1, 0, 0, '', '', 0, 1, 0, 0, NULL
+			FROM main.sqlite_master m JOIN pragma_table_info(m.name, 'main') c
+			WHERE ({userrel}) AND c.pk = 1 AND ({rowidpk})`,
+	},
+	{
+		Name:    "pg_attrdef",
+		Columns: `oid INTEGER, adrelid INTEGER, adnum INTEGER, adbin TEXT`,
+		Select: `SELECT {default} + m.rowid * 1000 + c.cid, CAST({user} + m.rowid AS INTEGER), c.cid + 1, c.dflt_value
+			FROM main.sqlite_master m JOIN pragma_table_info(m.name, 'main') c
+			WHERE ({userrel}) AND c.dflt_value IS NOT NULL`,
+	},
+	{
+		Name: "pg_index",
+		Columns: `indexrelid INTEGER, indrelid INTEGER, indnatts INTEGER, indnkeyatts INTEGER,
+			indisunique BOOLEAN, indisprimary BOOLEAN, indisexclusion BOOLEAN, indimmediate BOOLEAN,
+			indisclustered BOOLEAN, indisvalid BOOLEAN, indcheckxmin BOOLEAN, indisready BOOLEAN,
+			indislive BOOLEAN, indisreplident BOOLEAN, indkey TEXT, indcollation TEXT, indclass TEXT,
+			indoption TEXT, indexprs TEXT, indpred TEXT`,
+		Select: `SELECT CAST({user} + i.rowid AS INTEGER), CAST({user} + m.rowid AS INTEGER),
+				(SELECT count(*) FROM pragma_index_info(l.name, 'main')),
+				(SELECT count(*) FROM pragma_index_info(l.name, 'main')),
+				l."unique", l.origin = 'pk', 0, 1, 0, 1, 0, 1, 1, 0,
+				(SELECT group_concat(CASE WHEN cid < 0 THEN 0 ELSE cid + 1 END, ' ') FROM pragma_index_info(l.name, 'main')),
+				'', '', '', NULL,
+				CASE WHEN l.partial THEN substr(i.sql, instr(upper(i.sql), ' WHERE ') + 7) END
+			FROM main.sqlite_master m JOIN pragma_index_list(m.name, 'main') l
+				JOIN main.sqlite_master i ON i.type = 'index' AND i.name = l.name
+			WHERE m.type = 'table' AND ({userrel})
+			UNION ALL
+			SELECT CAST({pkey} + m.rowid AS INTEGER), CAST({user} + m.rowid AS INTEGER), 1, 1, 1, 1, 0, 1, 0, 1, 0, 1, 1, 0,
+				(SELECT cid + 1 FROM pragma_table_info(m.name, 'main') WHERE pk = 1), '', '', '', NULL, NULL
+			FROM main.sqlite_master m WHERE ({userrel}) AND ({rowidpk})`,
+	},
+	{
+		Name: "pg_constraint",
+		Columns: `oid INTEGER, conname TEXT, connamespace INTEGER, contype TEXT, condeferrable BOOLEAN,
+			condeferred BOOLEAN, convalidated BOOLEAN, conrelid INTEGER, contypid INTEGER, conindid INTEGER,
+			conparentid INTEGER, confrelid INTEGER, confupdtype TEXT, confdeltype TEXT, confmatchtype TEXT,
+			conislocal BOOLEAN, coninhcount INTEGER, connoinherit BOOLEAN, conkey TEXT, confkey TEXT, conbin TEXT`,
+		Select: `SELECT {constraint} + m.rowid * 100 + l.seq + 1,
+				{indexname:i},
+				{public}, CASE l.origin WHEN 'pk' THEN 'p' ELSE 'u' END, 0, 0, 1, CAST({user} + m.rowid AS INTEGER), 0, CAST({user} + i.rowid AS INTEGER),
+				0, 0, ' ', ' ', ' ', 1, 0, 1,
+				'{' || (SELECT group_concat(cid + 1, ',') FROM pragma_index_info(l.name, 'main')) || '}', NULL, NULL
+			FROM main.sqlite_master m JOIN pragma_index_list(m.name, 'main') l
+				JOIN main.sqlite_master i ON i.type = 'index' AND i.name = l.name
+			WHERE m.type = 'table' AND ({userrel}) AND l.origin IN ('pk', 'u')
+			UNION ALL
+			SELECT {constraint} + m.rowid * 100, m.name || '_pkey', {public}, 'p', 0, 0, 1, CAST({user} + m.rowid AS INTEGER), 0,
+				CAST({pkey} + m.rowid AS INTEGER), 0, 0, ' ', ' ', ' ', 1, 0, 1,
+				'{' || (SELECT cid + 1 FROM pragma_table_info(m.name, 'main') WHERE pk = 1) || '}', NULL, NULL
+			FROM main.sqlite_master m WHERE ({userrel}) AND ({rowidpk})
+			UNION ALL
+			SELECT {constraint} + m.rowid * 100 + 50 + f.id, m.name || '_' || group_concat(f."from", '_') || '_fkey',
+				{public}, 'f', 0, 0, 1, CAST({user} + m.rowid AS INTEGER), 0, 0, 0,
+				(SELECT CAST({user} + r.rowid AS INTEGER) FROM main.sqlite_master r WHERE r.type = 'table' AND r.name = f."table"),
+				{action:on_update}, {action:on_delete}, 's', 1, 0, 1,
+				'{' || group_concat((SELECT cid + 1 FROM pragma_table_info(m.name, 'main') WHERE name = f."from"), ',') || '}',
+				'{' || group_concat((SELECT cid + 1 FROM pragma_table_info(f."table", 'main')
+					WHERE name = f."to" OR (f."to" IS NULL AND pk = f.seq + 1)), ',') || '}',
+				NULL
+			FROM main.sqlite_master m JOIN pragma_foreign_key_list(m.name, 'main') f
+			WHERE m.type = 'table' AND ({userrel})
+			GROUP BY m.rowid, f.id`,
+	},
+	{
+		Name: "information_schema_columns",
+		Columns: `table_catalog TEXT, table_schema TEXT, table_name TEXT, column_name TEXT,
+			ordinal_position INTEGER, column_default TEXT, is_nullable TEXT, data_type TEXT,
+			character_maximum_length INTEGER, numeric_precision INTEGER, numeric_scale INTEGER,
+			datetime_precision INTEGER, udt_catalog TEXT, udt_schema TEXT, udt_name TEXT, is_identity TEXT,
+			identity_generation TEXT, is_generated TEXT, generation_expression TEXT, is_updatable TEXT`,
+		Select: `SELECT current_database(), 'public', m.name, c.name, c.cid + 1, c.dflt_value,
+				CASE WHEN c."notnull" OR c.pk > 0 THEN 'NO' ELSE 'YES' END, pgblob_sql_type(c.type),
+				CASE WHEN pgblob_type_name(c.type) = 'text' AND pgblob_typmod(c.type) >= 4 THEN pgblob_typmod(c.type) - 4 END,
+				CASE WHEN pgblob_type_name(c.type) = 'numeric' AND pgblob_typmod(c.type) >= 4 THEN (pgblob_typmod(c.type) - 4) >> 16 END,
+				CASE WHEN pgblob_type_name(c.type) = 'numeric' AND pgblob_typmod(c.type) >= 4 THEN (pgblob_typmod(c.type) - 4) & 65535 END,
+				NULL, current_database(), 'pg_catalog', pgblob_type_name(c.type),
+				CASE WHEN c.pk = 1 AND ({rowidpk}) THEN 'YES' ELSE 'NO' END,
+				CASE WHEN c.pk = 1 AND ({rowidpk}) THEN 'BY DEFAULT' END,
+				'NEVER', NULL, CASE m.type WHEN 'table' THEN 'YES' ELSE 'NO' END
+			FROM main.sqlite_master m JOIN pragma_table_info(m.name, 'main') c
+			WHERE {userrel}`,
+	},
+	{
+		Name: "information_schema_tables",
+		Columns: `table_catalog TEXT, table_schema TEXT, table_name TEXT, table_type TEXT,
+			self_referencing_column_name TEXT, reference_generation TEXT, user_defined_type_catalog TEXT,
+			user_defined_type_schema TEXT, user_defined_type_name TEXT, is_insertable_into TEXT,
+			is_typed TEXT, commit_action TEXT`,
+		Select: `SELECT current_database(), 'public', m.name, CASE m.type WHEN 'table' THEN 'BASE TABLE' ELSE 'VIEW' END,
+				NULL, NULL, NULL, NULL, NULL, CASE m.type WHEN 'table' THEN 'YES' ELSE 'NO' END, 'NO', NULL
+			FROM main.sqlite_master m
+			WHERE {userrel}`,
+	},
+	{
+		Name: "pg_database",
+		Columns: `oid INTEGER, datname TEXT, datdba INTEGER, encoding INTEGER, datlocprovider TEXT,
+			datistemplate BOOLEAN, datallowconn BOOLEAN, datconnlimit INTEGER, datfrozenxid INTEGER,
+			datminmxid INTEGER, dattablespace INTEGER, datcollate TEXT, datctype TEXT, datlocale TEXT,
+			daticulocale TEXT, daticurules TEXT, datcollversion TEXT, datacl TEXT`,
+		Select: `SELECT CAST({database} + d.key AS INTEGER), d.value, 10, 6, 'c', 0, 1, -1, 0, 1, 1663,
+				'C', 'C', NULL, NULL, NULL, NULL, NULL
+			FROM json_each(pgblob_databases()) d`,
+	},
+}
+
+// foreignKeyAction renders the pg_constraint action code of a foreign key action column
+func foreignKeyAction(column string) string {
+	return fmt.Sprintf(`CASE f.%s WHEN 'CASCADE' THEN 'c' WHEN 'SET NULL' THEN 'n' WHEN 'SET DEFAULT' THEN 'd' `+
+		`WHEN 'RESTRICT' THEN 'r' ELSE 'a' END`, column)
+}
+
+// indexName renders the PostgreSQL name of the index in a sqlite_master row:
+// SQLite names the indexes behind PRIMARY KEY and UNIQUE constraints
+// sqlite_autoindex_<table>_<n>, PostgreSQL names them after the constraint
+func indexName(alias string) string {
+	return strings.ReplaceAll(`CASE WHEN m.name NOT LIKE 'sqlite\_autoindex\_%' ESCAPE '\' THEN m.name `+
+		`WHEN (SELECT origin FROM pragma_index_list(m.tbl_name, 'main') WHERE name = m.name) = 'pk' THEN m.tbl_name || '_pkey' `+
+		`ELSE m.tbl_name || '_' || (SELECT group_concat(name, '_') FROM pragma_index_info(m.name, 'main')) || '_key' END`,
+		"m.", alias+".")
+}
+
+// catalogSchema returns the script creating the catalog relations of a connection
+func catalogSchema() string {
+	var sb strings.Builder
+
+	sb.WriteString("CREATE TEMP TABLE pg_namespace (oid INTEGER, nspname TEXT, nspowner INTEGER, nspacl TEXT);\n")
+	fmt.Fprintf(&sb, "INSERT INTO pg_namespace VALUES (%d, 'pg_catalog', 10, NULL), (%d, 'public', 10, NULL), (%d, 'information_schema', 10, NULL);\n",
+		namespaceCatalog, namespacePublic, namespaceInformationSchema)
+
+	sb.WriteString("CREATE TEMP TABLE pg_am (oid INTEGER, amname TEXT, amhandler TEXT, amtype TEXT);\n")
+	sb.WriteString("INSERT INTO pg_am VALUES (403, 'btree', 'bthandler', 'i');\n")
+
+	sb.WriteString(`CREATE TEMP TABLE pg_type (oid INTEGER, typname TEXT, typnamespace INTEGER, typowner INTEGER,
+		typlen INTEGER, typbyval BOOLEAN, typtype TEXT, typcategory TEXT, typispreferred BOOLEAN,
+		typisdefined BOOLEAN, typdelim TEXT, typrelid INTEGER, typelem INTEGER, typarray INTEGER,
+		typinput TEXT, typoutput TEXT, typreceive TEXT, typsend TEXT, typalign TEXT, typstorage TEXT,
+		typnotnull BOOLEAN, typbasetype INTEGER, typtypmod INTEGER, typndims INTEGER, typcollation INTEGER,
+		typdefault TEXT);` + "\n")
+	for _, t := range pgTypes {
+		byval := t.Len > 0 && t.Len <= 8
+		fmt.Fprintf(&sb, "INSERT INTO pg_type VALUES (%d, '%s', %d, 10, %d, %t, 'b', '%s', 0, 1, ',', 0, 0, %d, '%sin', '%sout', '%srecv', '%ssend', 'i', 'p', 0, 0, -1, 0, 0, NULL);\n",
+			t.OID, t.Name, namespaceCatalog, t.Len, byval, t.Category, t.Array, t.Name, t.Name, t.Name, t.Name)
+		fmt.Fprintf(&sb, "INSERT INTO pg_type VALUES (%d, '_%s', %d, 10, -1, 0, 'b', 'A', 0, 1, ',', 0, %d, 0, 'array_in', 'array_out', 'array_recv', 'array_send', 'i', 'x', 0, 0, -1, 0, 0, NULL);\n",
+			t.Array, t.Name, namespaceCatalog, t.OID)
+	}
+
+	replacer := strings.NewReplacer(
+		"{userrel}", userRelation,
+		"{rowidpk}", rowidPrimaryKey,
+		"{user}", strconv.Itoa(userObjectOID),
+		"{pkey}", strconv.Itoa(primaryKeyOID),
+		"{constraint}", strconv.Itoa(constraintBaseOID),
+		"{default}", strconv.Itoa(defaultBaseOID),
+		"{database}", strconv.Itoa(databaseBaseOID),
+		"{public}", strconv.Itoa(namespacePublic),
+		"{indexname:m}", indexName("m"),
+		"{indexname:i}", indexName("i"),
+		"{action:on_update}", foreignKeyAction("on_update"),
+		"{action:on_delete}", foreignKeyAction("on_delete"),
+	)
+	for _, view := range catalogViews {
+		fmt.Fprintf(&sb, "CREATE TEMP TABLE pgblob_%s_columns (%s);\n", view.Name, view.Columns)
+		fmt.Fprintf(&sb, "CREATE TEMP VIEW %s (%s) AS %s\nUNION ALL SELECT * FROM pgblob_%s_columns;\n",
+			view.Name, view.columnNames(), replacer.Replace(view.Select), view.Name)
+	}
+
+	return sb.String()
+}
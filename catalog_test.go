@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/lib/pq/oid"
+)
+
+func TestCatalogEmulation(t *testing.T) {
+	handler := newTestHandler(t)
+	ctx, _ := handler.StartSession(context.Background())
+
+	runQuery(t, handler, ctx, "CREATE TABLE users (id SERIAL PRIMARY KEY, email VARCHAR(255) NOT NULL UNIQUE, score NUMERIC(10,2), active BOOLEAN DEFAULT TRUE)")
+	runQuery(t, handler, ctx, "CREATE TABLE posts (id BIGINT PRIMARY KEY, user_id INTEGER REFERENCES users (id) ON DELETE CASCADE, body TEXT)")
+	runQuery(t, handler, ctx, "CREATE INDEX posts_user_idx ON posts (user_id)")
+
+	// psql \dt
+	writer := runQuery(t, handler, ctx, `SELECT n.nspname, c.relname, CASE c.relkind WHEN 'r' THEN 'table' END
+		FROM pg_catalog.pg_class c LEFT JOIN pg_catalog.pg_namespace n ON n.oid = c.relnamespace
+		WHERE c.relkind IN ('r','p','') AND n.nspname !~ '^pg_toast' AND pg_catalog.pg_table_is_visible(c.oid)
+		ORDER BY 1, 2`)
+	if len(writer.rows) != 2 || writer.rows[0][1] != "posts" || writer.rows[1][1] != "users" || writer.rows[0][0] != "public" {
+		t.Fatalf("Unexpected tables: %v", writer.rows)
+	}
+
+	// psql \d users
+	writer = runQuery(t, handler, ctx, `SELECT c.oid FROM pg_catalog.pg_class c
+		WHERE c.relname OPERATOR(pg_catalog.~) '^(users)$' COLLATE pg_catalog.default`)
+	if len(writer.rows) != 1 {
+		t.Fatalf("Expected users to be found, got %v", writer.rows)
+	}
+	if relid := writer.rows[0][0]; relid != int64(16385) {
+		t.Fatalf("Expected users to have oid 16385, got %v", relid)
+	}
+
+	_, _, columns, err := handler.ParseQuery(ctx, "SELECT a.attname, a.atttypid, a.attnotnull FROM pg_catalog.pg_attribute a WHERE a.attrelid = $1")
+	if err != nil {
+		t.Fatalf("Failed to parse: %v", err)
+	}
+	if columns[1].Oid != oid.T_int8 || columns[2].Oid != oid.T_bool {
+		t.Errorf("Unexpected catalog column types: %+v", columns)
+	}
+
+	// OIDs are compared with quoted literals
+	writer = runQuery(t, handler, ctx, `SELECT a.attname, a.atttypid, pg_catalog.format_type(a.atttypid, a.atttypmod), a.attnotnull
+		FROM pg_catalog.pg_attribute a WHERE a.attrelid = '16385' AND a.attnum > 0 AND NOT a.attisdropped ORDER BY a.attnum`)
+	want := [][]interface{}{
+		{"id", int64(PostgresTypeOID(SQLiteTypeToPostgres("INTEGER"))), "bigint", true},
+		{"email", int64(oid.T_text), "character varying(255)", true},
+		{"score", int64(oid.T_numeric), "numeric(10,2)", false},
+		{"active", int64(oid.T_bool), "boolean", false},
+	}
+	if len(writer.rows) != len(want) {
+		t.Fatalf("Unexpected attributes: %v", writer.rows)
+	}
+	for i, row := range writer.rows {
+		for j := range row {
+			if row[j] != want[i][j] {
+				t.Errorf("attribute %d column %d = %#v; want %#v", i, j, row[j], want[i][j])
+			}
+		}
+	}
+
+	writer = runQuery(t, handler, ctx, `SELECT c2.relname, i.indisprimary, i.indisunique, i.indkey
+		FROM pg_catalog.pg_class c, pg_catalog.pg_class c2, pg_catalog.pg_index i
+		WHERE c.relname = 'posts' AND c.oid = i.indrelid AND i.indexrelid = c2.oid
+		ORDER BY i.indisprimary DESC, c2.relname`)
+	if len(writer.rows) != 2 || writer.rows[0][0] != "posts_pkey" || writer.rows[0][1] != true || writer.rows[1][0] != "posts_user_idx" || writer.rows[1][3] != "2" {
+		t.Errorf("Unexpected indexes: %v", writer.rows)
+	}
+
+	writer = runQuery(t, handler, ctx, `SELECT conname, contype, confdeltype, confrelid = 'users'::regclass, conkey
+		FROM pg_catalog.pg_constraint WHERE conrelid = 'posts'::regclass ORDER BY conname`)
+	if len(writer.rows) != 2 || writer.rows[0][0] != "posts_pkey" || writer.rows[1][0] != "posts_user_id_fkey" ||
+		writer.rows[1][2] != "c" || writer.rows[1][3] != "1" || writer.rows[1][4] != "{2}" {
+		t.Errorf("Unexpected constraints: %v", writer.rows)
+	}
+
+	writer = runQuery(t, handler, ctx, `SELECT column_name, data_type, is_nullable, character_maximum_length, column_default
+		FROM information_schema.columns WHERE table_schema = 'public' AND table_name = 'users' ORDER BY ordinal_position`)
+	if len(writer.rows) != 4 || writer.rows[1][0] != "email" || writer.rows[1][2] != "NO" || writer.rows[1][3] != int64(255) ||
+		writer.rows[3][4] != "1" {
+		t.Errorf("Unexpected information_schema.columns rows: %v", writer.rows)
+	}
+
+	writer = runQuery(t, handler, ctx, "SELECT current_database(), current_schema(), 'a1' ~ '^[a-z][0-9]$', 'ABC' ~* 'b'")
+	if row := writer.rows[0]; row[0] != "postgres" || row[1] != "public" || row[2] != "1" || row[3] != "1" {
+		t.Errorf("Unexpected function results: %v", row)
+	}
+}
@@ -18,32 +18,71 @@ type Config struct {
 
 // ServerConfig contains PostgreSQL server settings
 type ServerConfig struct {
-	Port           int                `yaml:"port"`
-	Host           string             `yaml:"host"`
+	Port           int                  `yaml:"port"`
+	Host           string               `yaml:"host"`
 	Authentication AuthenticationConfig `yaml:"authentication"`
+	TLS            TLSConfig            `yaml:"tls"`
+	HBA            []AccessRuleConfig   `yaml:"hba"`
+}
+
+// AccessRuleConfig is a pg_hba.conf-style rule choosing the authentication
+// method of matching clients; the first matching rule applies
+type AccessRuleConfig struct {
+	Type     string `yaml:"type"`     // host (default), hostssl or hostnossl
+	Address  string `yaml:"address"`  // CIDR, single address or all
+	Database string `yaml:"database"` // comma-separated names, sameuser or all
+	User     string `yaml:"user"`     // comma-separated names or all
+	Method   string `yaml:"method"`   // trust, scram-sha-256, md5, password, cert or reject
+}
+
+// TLSConfig contains TLS settings; TLS is enabled when a certificate is set
+type TLSConfig struct {
+	CertFile     string `yaml:"cert_file"`
+	KeyFile      string `yaml:"key_file"`
+	ClientCAFile string `yaml:"client_ca_file"`
+	MinVersion   string `yaml:"min_version"`
+	Required     bool   `yaml:"required"`
 }
 
 // AuthenticationConfig contains authentication settings
 type AuthenticationConfig struct {
-	User     string `yaml:"user"`
-	Password string `yaml:"password"`
+	User     string       `yaml:"user"`
+	Password string       `yaml:"password"` // plaintext or a SCRAM-SHA-256/MD5 verifier
+	Method   string       `yaml:"method"`   // scram-sha-256, md5 or password
+	Users    []UserConfig `yaml:"users"`    // replaces user and password when set
+}
+
+// UserConfig describes a user of the user registry
+type UserConfig struct {
+	Name      string   `yaml:"name"`
+	Password  string   `yaml:"password"`  // plaintext or a SCRAM-SHA-256/MD5 verifier
+	Databases []string `yaml:"databases"` // databases the user may connect to, all when empty
+	Privilege string   `yaml:"privilege"` // read-only, read-write or ddl
 }
 
 // DatabaseConfig contains SQLite database settings
 type DatabaseConfig struct {
-	Name            string `yaml:"name"`
-	SQLitePath      string `yaml:"sqlite_path"`
-	TransactionMode string `yaml:"transaction_mode"`
-	ConnectionPoolSize int `yaml:"connection_pool_size"`
+	Name                            string `yaml:"name"`
+	SQLitePath                      string `yaml:"sqlite_path"`
+	TransactionMode                 string `yaml:"transaction_mode"`
+	ConnectionPoolSize              int    `yaml:"connection_pool_size"`
+	StatementTimeout                string `yaml:"statement_timeout"`
+	IdleInTransactionSessionTimeout string `yaml:"idle_in_transaction_session_timeout"`
+	MaxOpen                         int    `yaml:"max_open"`     // open databases, 0 for no limit
+	MaxDiskMB                       int    `yaml:"max_disk_mb"`  // local copies of open databases, 0 for no limit
+	IdleTimeout                     string `yaml:"idle_timeout"` // closes databases without sessions, 0 disables
+	Template                        string `yaml:"template"`     // copied by CREATE DATABASE, empty databases when unset
 }
 
 // StorageConfig contains blob storage settings
 type StorageConfig struct {
-	Backend string       `yaml:"backend"`
-	Local   LocalConfig  `yaml:"local"`
-	S3      S3Config     `yaml:"s3"`
-	Azure   AzureConfig  `yaml:"azure"`
-	CacheTTLMinutes int  `yaml:"cache_ttl_minutes"`
+	Backend          string      `yaml:"backend"`
+	Local            LocalConfig `yaml:"local"`
+	S3               S3Config    `yaml:"s3"`
+	Azure            AzureConfig `yaml:"azure"`
+	CacheTTLMinutes  int         `yaml:"cache_ttl_minutes"`
+	Replication      string      `yaml:"replication"`       // snapshot or wal
+	SnapshotInterval string      `yaml:"snapshot_interval"` // between snapshots with wal replication, 0 disables
 }
 
 // LocalConfig contains local filesystem storage settings
@@ -81,20 +120,29 @@ func LoadConfig(configPath string) (*Config, error) {
 			Authentication: AuthenticationConfig{
 				User:     "postgres",
 				Password: "postgres",
+				Method:   "scram-sha-256",
+			},
+			TLS: TLSConfig{
+				MinVersion: "1.2",
 			},
 		},
 		Database: DatabaseConfig{
-			Name:               "myapp",
-			SQLitePath:         "/tmp/myapp.sqlite",
-			TransactionMode:    "deferred",
-			ConnectionPoolSize: 10,
+			Name:                            "myapp",
+			SQLitePath:                      "/tmp/myapp.sqlite",
+			TransactionMode:                 "deferred",
+			ConnectionPoolSize:              10,
+			StatementTimeout:                "0",
+			IdleInTransactionSessionTimeout: "0",
+			IdleTimeout:                     "0",
 		},
 		Storage: StorageConfig{
 			Backend: "local",
 			Local: LocalConfig{
 				BasePath: "./data",
 			},
-			CacheTTLMinutes: 5,
+			CacheTTLMinutes:  5,
+			Replication:      "snapshot",
+			SnapshotInterval: "1h",
 		},
 		Logging: LoggingConfig{
 			Level:  "info",
@@ -133,12 +181,40 @@ func LoadConfig(configPath string) (*Config, error) {
 	if val := os.Getenv("PG_PASSWORD"); val != "" {
 		config.Server.Authentication.Password = val
 	}
+	if val := os.Getenv("PG_AUTH_METHOD"); val != "" {
+		config.Server.Authentication.Method = val
+	}
+	if val := os.Getenv("TLS_CERT_FILE"); val != "" {
+		config.Server.TLS.CertFile = val
+	}
+	if val := os.Getenv("TLS_KEY_FILE"); val != "" {
+		config.Server.TLS.KeyFile = val
+	}
+	if val := os.Getenv("TLS_CLIENT_CA_FILE"); val != "" {
+		config.Server.TLS.ClientCAFile = val
+	}
+	if val := os.Getenv("TLS_MIN_VERSION"); val != "" {
+		config.Server.TLS.MinVersion = val
+	}
+	if val := os.Getenv("TLS_REQUIRED"); val != "" {
+		required, err := strconv.ParseBool(val)
+		if err != nil {
+			return nil, fmt.Errorf("invalid TLS_REQUIRED: %w", err)
+		}
+		config.Server.TLS.Required = required
+	}
 	if val := os.Getenv("DB_NAME"); val != "" {
 		config.Database.Name = val
 	}
 	if val := os.Getenv("DB_PATH"); val != "" {
 		config.Database.SQLitePath = val
 	}
+	if val := os.Getenv("STATEMENT_TIMEOUT"); val != "" {
+		config.Database.StatementTimeout = val
+	}
+	if val := os.Getenv("IDLE_IN_TRANSACTION_SESSION_TIMEOUT"); val != "" {
+		config.Database.IdleInTransactionSessionTimeout = val
+	}
 	if val := os.Getenv("STORAGE"); val != "" {
 		config.Storage.Backend = val
 	}
@@ -173,6 +249,32 @@ func LoadConfig(configPath string) (*Config, error) {
 		}
 		config.Database.ConnectionPoolSize = poolSize
 	}
+	if val := os.Getenv("DB_MAX_OPEN"); val != "" {
+		maxOpen, err := strconv.Atoi(val)
+		if err != nil {
+			return nil, fmt.Errorf("invalid DB_MAX_OPEN: %w", err)
+		}
+		config.Database.MaxOpen = maxOpen
+	}
+	if val := os.Getenv("DB_MAX_DISK_MB"); val != "" {
+		maxDisk, err := strconv.Atoi(val)
+		if err != nil {
+			return nil, fmt.Errorf("invalid DB_MAX_DISK_MB: %w", err)
+		}
+		config.Database.MaxDiskMB = maxDisk
+	}
+	if val := os.Getenv("DB_IDLE_TIMEOUT"); val != "" {
+		config.Database.IdleTimeout = val
+	}
+	if val := os.Getenv("DB_TEMPLATE"); val != "" {
+		config.Database.Template = val
+	}
+	if val := os.Getenv("STORAGE_REPLICATION"); val != "" {
+		config.Storage.Replication = val
+	}
+	if val := os.Getenv("STORAGE_SNAPSHOT_INTERVAL"); val != "" {
+		config.Storage.SnapshotInterval = val
+	}
 	if val := os.Getenv("CACHE_TTL_MINUTES"); val != "" {
 		ttl, err := strconv.Atoi(val)
 		if err != nil {
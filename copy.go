@@ -0,0 +1,999 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"strconv"
+	"strings"
+
+	wire "github.com/jeroenrinzema/psql-wire"
+	psqlerr "github.com/jeroenrinzema/psql-wire/errors"
+	"github.com/lib/pq/oid"
+)
+
+// copyBatchRows is the number of rows inserted per call into the backend
+const copyBatchRows = 1000
+
+// binaryCopySignature starts every binary COPY stream
+var binaryCopySignature = []byte("PGCOPY\n\xff\r\n\x00")
+
+// copyCommand is a parsed COPY ... FROM STDIN or COPY ... TO STDOUT
+type copyCommand struct {
+	Table      string   // target or source table
+	Columns    []string // column list, all columns when empty
+	Query      string   // source query of COPY (query) TO STDOUT
+	From       bool     // FROM STDIN, otherwise TO STDOUT
+	Format     string   // text, csv or binary
+	Delimiter  byte
+	Null       string
+	Header     bool
+	Quote      byte
+	Escape     byte
+	ForceQuote []string // columns always quoted in CSV output, "*" for all
+}
+
+// parseCopyCommand parses a COPY statement in the current and the pre-9.0
+// option syntax
+func parseCopyCommand(query string) (*copyCommand, error) {
+	tokens := tokenize(query)
+	sig := significantTokens(tokens)
+	for len(sig) > 0 && sig[len(sig)-1].isPunct(";") {
+		sig = sig[:len(sig)-1]
+	}
+
+	command := &copyCommand{}
+	i := 1
+	switch {
+	case i < len(sig) && sig[i].isPunct("("):
+		// COPY (query) TO STDOUT; the query keeps its original spacing
+		closing := matchingParen(sig, i)
+		if closing < 0 {
+			return nil, newPostgresError("42601", "syntax error at end of input")
+		}
+		open := 0
+		for open < len(tokens) && !tokens[open].isPunct("(") {
+			open++
+		}
+		command.Query = strings.TrimSpace(joinTokens(tokens[open+1 : matchingParen(tokens, open)]))
+		i = closing + 1
+	case i < len(sig) && (sig[i].Kind == tokenIdent || sig[i].Kind == tokenQuotedIdent):
+		command.Table = sig[i].name()
+		i++
+		// Only the table name of a schema-qualified name is kept
+		for i+1 < len(sig) && sig[i].isPunct(".") {
+			command.Table = sig[i+1].name()
+			i += 2
+		}
+		if i < len(sig) && sig[i].isPunct("(") {
+			closing := matchingParen(sig, i)
+			if closing < 0 {
+				return nil, newPostgresError("42601", "syntax error at end of input")
+			}
+			for _, t := range sig[i+1 : closing] {
+				if !t.isPunct(",") {
+					command.Columns = append(command.Columns, t.name())
+				}
+			}
+			i = closing + 1
+		}
+	default:
+		return nil, newPostgresError("42601", "syntax error at or near %q", tokenText(sig, i))
+	}
+
+	switch {
+	case i+1 < len(sig) && sig[i].is("FROM") && sig[i+1].is("STDIN"):
+		command.From = true
+	case i+1 < len(sig) && sig[i].is("TO") && sig[i+1].is("STDOUT"):
+	case i+1 < len(sig) && (sig[i].is("FROM") || sig[i].is("TO")):
+		return nil, newPostgresError("0A000", "COPY only supports STDIN and STDOUT, server files and programs are not available")
+	default:
+		return nil, newPostgresError("42601", "syntax error at or near %q", tokenText(sig, i))
+	}
+	if command.From && command.Query != "" {
+		return nil, newPostgresError("42601", "COPY (query) cannot be used with FROM STDIN")
+	}
+
+	if err := command.parseOptions(sig[i+2:]); err != nil {
+		return nil, err
+	}
+	return command, nil
+}
+
+// tokenText returns the text of the token at i for syntax errors
+func tokenText(sig []token, i int) string {
+	if i < len(sig) {
+		return sig[i].Text
+	}
+	return ""
+}
+
+// parseOptions parses [WITH] (option [, ...]) or the pre-9.0 option list
+// and fills in the defaults of the chosen format
+func (c *copyCommand) parseOptions(sig []token) error {
+	if len(sig) > 0 && sig[0].is("WITH") {
+		sig = sig[1:]
+	}
+
+	options := make(map[string][]token)
+	var order []string
+	add := func(name string, value []token) {
+		options[name] = value
+		order = append(order, name)
+	}
+
+	if len(sig) > 0 && sig[0].isPunct("(") {
+		closing := matchingParen(sig, 0)
+		if closing != len(sig)-1 {
+			return newPostgresError("42601", "syntax error in COPY options")
+		}
+		var option []token
+		for _, t := range append(sig[1:closing], token{Kind: tokenPunct, Text: ","}) {
+			if !t.isPunct(",") || hasOpenParen(option) {
+				option = append(option, t)
+				continue
+			}
+			if len(option) == 0 {
+				return newPostgresError("42601", "syntax error in COPY options")
+			}
+			add(strings.ToLower(option[0].Text), option[1:])
+			option = nil
+		}
+	} else {
+		for j := 0; j < len(sig); j++ {
+			word := strings.ToLower(sig[j].Text)
+			switch {
+			case word == "binary" || word == "csv":
+				add("format", []token{{Kind: tokenIdent, Text: word}})
+			case word == "header":
+				add("header", nil)
+			case word == "delimiter" || word == "null" || word == "quote" || word == "escape":
+				if j+1 < len(sig) && sig[j+1].is("AS") {
+					j++
+				}
+				if j+1 >= len(sig) {
+					return newPostgresError("42601", "syntax error at end of input")
+				}
+				add(word, sig[j+1:j+2])
+				j++
+			case word == "force" && j+1 < len(sig) && sig[j+1].is("QUOTE"):
+				// The column list runs while items are separated by commas
+				end := j + 2
+				for end < len(sig) && (end == j+2 || sig[end].isPunct(",") || sig[end-1].isPunct(",")) {
+					end++
+				}
+				add("force_quote", sig[j+2:end])
+				j = end - 1
+			default:
+				return newPostgresError("42601", "syntax error at or near %q", sig[j].Text)
+			}
+		}
+	}
+
+	c.Format = "text"
+	if value, ok := options["format"]; ok {
+		if len(value) != 1 {
+			return newPostgresError("42601", "syntax error in COPY format")
+		}
+		c.Format = strings.ToLower(value[0].name())
+		if c.Format != "text" && c.Format != "csv" && c.Format != "binary" {
+			return newPostgresError("22023", "COPY format %q not recognized", c.Format)
+		}
+	}
+
+	c.Delimiter, c.Null = '\t', `\N`
+	if c.Format == "csv" {
+		c.Delimiter, c.Null, c.Quote, c.Escape = ',', "", '"', 0
+	}
+
+	for _, name := range order {
+		value := options[name]
+		var err error
+		switch name {
+		case "format":
+		case "delimiter":
+			c.Delimiter, err = singleByteOption(name, value)
+		case "null":
+			c.Null, err = stringOption(name, value)
+		case "quote":
+			c.Quote, err = singleByteOption(name, value)
+		case "escape":
+			c.Escape, err = singleByteOption(name, value)
+		case "header":
+			c.Header, err = booleanOption(value)
+		case "force_quote":
+			for _, t := range value {
+				switch {
+				case t.isPunct("*"):
+					c.ForceQuote = append(c.ForceQuote, "*")
+				case t.Kind == tokenIdent || t.Kind == tokenQuotedIdent:
+					c.ForceQuote = append(c.ForceQuote, t.name())
+				}
+			}
+		case "encoding":
+			var encoding string
+			encoding, err = stringOption(name, value)
+			if err == nil && !strings.EqualFold(strings.ReplaceAll(encoding, "-", ""), "UTF8") {
+				err = newPostgresError("0A000", "COPY only supports the UTF8 encoding")
+			}
+		case "freeze":
+			_, err = booleanOption(value)
+		default:
+			err = newPostgresError("0A000", "COPY option %q is not supported", name)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	if c.Format == "csv" && c.Escape == 0 {
+		c.Escape = c.Quote
+	}
+	switch {
+	case c.Format == "binary" && (options["delimiter"] != nil || options["null"] != nil || options["header"] != nil):
+		return newPostgresError("42601", "cannot specify DELIMITER, NULL or HEADER in BINARY mode")
+	case c.Format != "csv" && (options["quote"] != nil || options["escape"] != nil || options["force_quote"] != nil):
+		return newPostgresError("0A000", "COPY QUOTE, ESCAPE and FORCE_QUOTE are only available using CSV format")
+	case c.Delimiter == '\n' || c.Delimiter == '\r' || (c.Format == "text" && c.Delimiter == '\\'):
+		return newPostgresError("22023", "COPY delimiter cannot be newline, carriage return or backslash")
+	case c.Format == "csv" && c.Delimiter == c.Quote:
+		return newPostgresError("22023", "COPY delimiter and quote must be different")
+	case c.From && c.ForceQuote != nil:
+		return newPostgresError("0A000", "COPY FORCE_QUOTE only available using COPY TO")
+	}
+	return nil
+}
+
+// hasOpenParen reports whether the tokens leave a parenthesis open
+func hasOpenParen(tokens []token) bool {
+	depth := 0
+	for _, t := range tokens {
+		switch {
+		case t.isPunct("("):
+			depth++
+		case t.isPunct(")"):
+			depth--
+		}
+	}
+	return depth > 0
+}
+
+func stringOption(name string, value []token) (string, error) {
+	if len(value) != 1 || value[0].Kind != tokenString {
+		return "", newPostgresError("42601", "COPY %s must be a string literal", name)
+	}
+	return decodeStringLiteral(value[0].Text), nil
+}
+
+func singleByteOption(name string, value []token) (byte, error) {
+	s, err := stringOption(name, value)
+	if err != nil {
+		return 0, err
+	}
+	if len(s) != 1 {
+		return 0, newPostgresError("22023", "COPY %s must be a single one-byte character", name)
+	}
+	return s[0], nil
+}
+
+func booleanOption(value []token) (bool, error) {
+	if len(value) == 0 {
+		return true, nil
+	}
+	if len(value) == 1 && value[0].is("MATCH") {
+		return true, nil
+	}
+	text := value[0].Text
+	if value[0].Kind == tokenString {
+		text = decodeStringLiteral(text)
+	}
+	return parseBoolText(text)
+}
+
+// formatCode returns the overall format code of the copy stream
+func (c *copyCommand) formatCode() int16 {
+	if c.Format == "binary" {
+		return int16(wire.BinaryFormat)
+	}
+	return int16(wire.TextFormat)
+}
+
+// copyResponse encodes the body of a CopyInResponse or CopyOutResponse
+func (c *copyCommand) copyResponse(columns int) []byte {
+	var body bytes.Buffer
+	body.WriteByte(byte(c.formatCode()))
+	binary.Write(&body, binary.BigEndian, int16(columns))
+	for i := 0; i < columns; i++ {
+		binary.Write(&body, binary.BigEndian, c.formatCode())
+	}
+	return body.Bytes()
+}
+
+// executeCopy runs COPY FROM STDIN or COPY TO STDOUT
+func (h *SimpleWireHandler) executeCopy(ctx context.Context, session *Session, connectionID string, command *copyCommand, writer wire.DataWriter) error {
+	if session == nil || session.Conn == nil || (command.From && session.Reader == nil) {
+		return newPostgresError("0A000", "COPY is not supported on this connection")
+	}
+	if command.From {
+		return h.copyFromStdin(ctx, session, connectionID, command, writer)
+	}
+	return h.copyToStdout(ctx, session, connectionID, command, writer)
+}
+
+// copyFromStdin inserts the rows the client streams. Outside a transaction
+// block all rows are inserted in one transaction, so the database is
+// uploaded once after the last row.
+func (h *SimpleWireHandler) copyFromStdin(ctx context.Context, session *Session, connectionID string, command *copyCommand, writer wire.DataWriter) error {
+	columns, types, err := h.copyColumns(ctx, connectionID, command)
+	if err != nil {
+		return err
+	}
+
+	quoted := make([]string, len(columns))
+	placeholders := make([]string, len(columns))
+	for i, column := range columns {
+		quoted[i] = quoteIdentifier(column)
+		placeholders[i] = "?"
+	}
+	insert := fmt.Sprintf("INSERT INTO %s (%s) VALUES (%s)", quoteIdentifier(command.Table),
+		strings.Join(quoted, ", "), strings.Join(placeholders, ", "))
+
+	if err := session.Conn.writeMessage('G', command.copyResponse(len(columns))); err != nil {
+		return err
+	}
+
+	implicit := false
+	if h.txManager.GetTransactionStatus(connectionID) == TxIdle {
+		if err := h.txManager.Begin(connectionID, ""); err != nil {
+			return toPostgresError(err)
+		}
+		h.txMonitor.StartTransaction(connectionID)
+		implicit = true
+	}
+
+	count, err := h.copyIn(ctx, session.Reader, connectionID, command, insert, columns, types)
+	if err != nil {
+		if implicit {
+			h.handleRollbackSimple(connectionID)
+		}
+		return err
+	}
+	if implicit {
+		if err := h.handleCommitSimple(connectionID); err != nil {
+			return toPostgresError(err)
+		}
+	}
+	return writer.Complete(fmt.Sprintf("COPY %d", count))
+}
+
+// copyColumns returns the target columns of COPY FROM and their types
+func (h *SimpleWireHandler) copyColumns(ctx context.Context, connectionID string, command *copyCommand) ([]string, []oid.Oid, error) {
+	rows, err := h.backend.QueryContext(ctx, connectionID, "SELECT name, type FROM pragma_table_info(?) ORDER BY cid", command.Table)
+	if err != nil {
+		return nil, nil, toPostgresError(err)
+	}
+	defer rows.Close()
+
+	var columns []string
+	declared := make(map[string]string)
+	for rows.Next() {
+		var name, declType string
+		if err := rows.Scan(&name, &declType); err != nil {
+			return nil, nil, err
+		}
+		columns = append(columns, name)
+		declared[strings.ToLower(name)] = declType
+	}
+	if err := rows.Err(); err != nil {
+		return nil, nil, err
+	}
+	if len(columns) == 0 {
+		return nil, nil, newPostgresError("42P01", "relation %q does not exist", command.Table)
+	}
+
+	if len(command.Columns) > 0 {
+		columns = command.Columns
+	}
+	types := make([]oid.Oid, len(columns))
+	for i, column := range columns {
+		declType, ok := declared[strings.ToLower(column)]
+		if !ok {
+			return nil, nil, newPostgresError("42703", "column %q of relation %q does not exist", column, command.Table)
+		}
+		types[i] = PostgresTypeOID(SQLiteTypeToPostgres(declType))
+	}
+	return columns, types, nil
+}
+
+// copyIn reads CopyData messages until CopyDone and inserts their rows in
+// batches. After an error the remaining data is read and dropped until the
+// client ends the copy, as PostgreSQL does.
+func (h *SimpleWireHandler) copyIn(ctx context.Context, reader frontendReader, connectionID string, command *copyCommand, insert string, columns []string, types []oid.Oid) (int64, error) {
+	decoder := &copyDecoder{command: command, header: command.Header || command.Format == "binary"}
+	var count int64
+	var failure error
+	var batch [][]interface{}
+
+	for {
+		msgType, body, err := reader.ReadMessage()
+		if err != nil {
+			return count, err
+		}
+
+		final := false
+		switch msgType {
+		case 'd':
+		case 'c':
+			final = true
+		case 'f':
+			message := string(bytes.TrimRight(body, "\x00"))
+			return count, newPostgresError("57014", "COPY from stdin failed: %s", message)
+		case 'H', 'S':
+			continue
+		default:
+			return count, newPostgresError("08P01", "unexpected message type 0x%02X during COPY from stdin", msgType)
+		}
+
+		if failure == nil {
+			failure = func() error {
+				rows, firstLine, err := decoder.decode(body, final)
+				if err != nil {
+					return err
+				}
+				for i, fields := range rows {
+					row, err := convertCopyRow(fields, columns, types, command.formatCode())
+					if err != nil {
+						return psqlerr.WithDetail(err, fmt.Sprintf("COPY %s, line %d", command.Table, firstLine+i))
+					}
+					batch = append(batch, row)
+					if len(batch) >= copyBatchRows {
+						if err := h.backend.InsertRows(ctx, connectionID, insert, batch); err != nil {
+							return toPostgresError(err)
+						}
+						count += int64(len(batch))
+						batch = batch[:0]
+					}
+				}
+				return nil
+			}()
+		}
+
+		if final {
+			if failure == nil && len(batch) > 0 {
+				if err := h.backend.InsertRows(ctx, connectionID, insert, batch); err != nil {
+					return count, toPostgresError(err)
+				}
+				count += int64(len(batch))
+			}
+			return count, failure
+		}
+	}
+}
+
+// convertCopyRow converts the fields of a row to values SQLite can bind
+func convertCopyRow(fields []copyField, columns []string, types []oid.Oid, format int16) ([]interface{}, error) {
+	switch {
+	case format == int16(wire.BinaryFormat) && len(fields) != len(columns):
+		return nil, newPostgresError("22P04", "row field count is %d, expected %d", len(fields), len(columns))
+	case len(fields) > len(columns):
+		return nil, newPostgresError("22P04", "extra data after last expected column")
+	case len(fields) < len(columns):
+		return nil, newPostgresError("22P04", "missing data for column %q", columns[len(fields)])
+	}
+
+	row := make([]interface{}, len(fields))
+	for i, field := range fields {
+		if field.Null {
+			continue
+		}
+		value, err := decodeParameter(string(field.Value), types[i], format)
+		if err != nil {
+			return nil, newPostgresError("22P02", "%v", err)
+		}
+		row[i] = value
+	}
+	return row, nil
+}
+
+// copyField is one field of a COPY row
+type copyField struct {
+	Value []byte
+	Null  bool
+}
+
+// copyDecoder splits the COPY data stream into rows. CopyData messages need
+// not align with rows, so incomplete rows are kept until more data arrives.
+type copyDecoder struct {
+	command *copyCommand
+	pending []byte
+	header  bool // the header line or binary header is still to be read
+	done    bool // the end-of-data marker was read
+	line    int
+}
+
+// decode returns the complete rows in the data received so far and the line
+// number of the first one; final marks the end of the data
+func (d *copyDecoder) decode(data []byte, final bool) ([][]copyField, int, error) {
+	d.pending = append(d.pending, data...)
+
+	var rows [][]copyField
+	first := 0
+	for !d.done {
+		var fields []copyField
+		var ok bool
+		var err error
+		switch d.command.Format {
+		case "binary":
+			fields, ok, err = d.nextBinaryRow()
+		case "csv":
+			fields, ok, err = d.nextCSVRow(final)
+		default:
+			fields, ok, err = d.nextTextRow(final)
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+		if !ok {
+			break
+		}
+		if d.header {
+			d.header = false
+			continue
+		}
+		if first == 0 {
+			first = d.line
+		}
+		rows = append(rows, fields)
+	}
+
+	if final && !d.done && len(d.pending) > 0 {
+		return nil, 0, newPostgresError("22P04", "unexpected EOF in COPY data")
+	}
+	return rows, first, nil
+}
+
+// nextTextRow reads a line of the text format
+func (d *copyDecoder) nextTextRow(final bool) ([]copyField, bool, error) {
+	line, ok := d.nextLine(final)
+	if !ok {
+		return nil, false, nil
+	}
+
+	var fields []copyField
+	start := 0
+	for i := 0; i <= len(line); i++ {
+		switch {
+		case i < len(line) && line[i] == '\\':
+			i++
+		case i == len(line) || line[i] == d.command.Delimiter:
+			raw := line[start:i]
+			if string(raw) == d.command.Null {
+				fields = append(fields, copyField{Null: true})
+			} else {
+				fields = append(fields, copyField{Value: unescapeCopyText(raw)})
+			}
+			start = i + 1
+		}
+	}
+	return fields, true, nil
+}
+
+// nextLine returns the next complete line; \. on a line of its own ends the data
+func (d *copyDecoder) nextLine(final bool) ([]byte, bool) {
+	end := bytes.IndexByte(d.pending, '\n')
+	var line []byte
+	switch {
+	case end >= 0:
+		line, d.pending = d.pending[:end], d.pending[end+1:]
+	case final && len(d.pending) > 0:
+		line, d.pending = d.pending, nil
+	default:
+		return nil, false
+	}
+
+	line = bytes.TrimSuffix(line, []byte("\r"))
+	d.line++
+	if string(line) == `\.` {
+		d.done = true
+		d.pending = nil
+		return nil, false
+	}
+	return line, true
+}
+
+// unescapeCopyText decodes the backslash escapes of the text format
+func unescapeCopyText(raw []byte) []byte {
+	if bytes.IndexByte(raw, '\\') < 0 {
+		return raw
+	}
+
+	value := make([]byte, 0, len(raw))
+	for i := 0; i < len(raw); i++ {
+		if raw[i] != '\\' || i+1 == len(raw) {
+			value = append(value, raw[i])
+			continue
+		}
+		i++
+		switch c := raw[i]; c {
+		case 'b':
+			value = append(value, '\b')
+		case 'f':
+			value = append(value, '\f')
+		case 'n':
+			value = append(value, '\n')
+		case 'r':
+			value = append(value, '\r')
+		case 't':
+			value = append(value, '\t')
+		case 'v':
+			value = append(value, '\v')
+		case 'x':
+			end := i + 1
+			for end < len(raw) && end < i+3 && strings.IndexByte("0123456789abcdefABCDEF", raw[end]) >= 0 {
+				end++
+			}
+			if end == i+1 {
+				value = append(value, c)
+				continue
+			}
+			n, _ := strconv.ParseUint(string(raw[i+1:end]), 16, 8)
+			value = append(value, byte(n))
+			i = end - 1
+		case '0', '1', '2', '3', '4', '5', '6', '7':
+			end := i + 1
+			for end < len(raw) && end < i+3 && raw[end] >= '0' && raw[end] <= '7' {
+				end++
+			}
+			n, _ := strconv.ParseUint(string(raw[i:end]), 8, 8)
+			value = append(value, byte(n))
+			i = end - 1
+		default:
+			value = append(value, c)
+		}
+	}
+	return value
+}
+
+// nextCSVRow reads a record of the CSV format. Quoted fields may span
+// lines; an unquoted field equal to the NULL string is NULL.
+func (d *copyDecoder) nextCSVRow(final bool) ([]copyField, bool, error) {
+	c := d.command
+	data := d.pending
+	if bytes.HasPrefix(data, []byte(`\.`)) {
+		rest := bytes.TrimPrefix(data[2:], []byte("\r"))
+		if len(rest) > 0 && rest[0] == '\n' || len(rest) == 0 && final {
+			d.done = true
+			d.pending = nil
+			return nil, false, nil
+		}
+	}
+	if len(data) == 0 {
+		return nil, false, nil
+	}
+
+	var fields []copyField
+	pos := 0
+	for {
+		var value []byte
+		quoted := false
+
+	field:
+		for pos < len(data) {
+			ch := data[pos]
+			switch {
+			case ch == c.Quote:
+				quoted = true
+				pos++
+				for {
+					if pos >= len(data) {
+						if final {
+							return nil, false, newPostgresError("22P04", "unterminated CSV quoted field")
+						}
+						return nil, false, nil
+					}
+					ch = data[pos]
+					if (ch == c.Escape || ch == c.Quote) && pos+1 == len(data) && !final {
+						// An escaped or doubled quote may continue in the next message
+						return nil, false, nil
+					}
+					if ch == c.Escape && pos+1 < len(data) && (data[pos+1] == c.Quote || data[pos+1] == c.Escape) {
+						value = append(value, data[pos+1])
+						pos += 2
+						continue
+					}
+					if ch == c.Quote {
+						pos++
+						break
+					}
+					value = append(value, ch)
+					pos++
+				}
+			case ch == c.Delimiter || ch == '\n' || ch == '\r':
+				break field
+			default:
+				value = append(value, ch)
+				pos++
+			}
+		}
+
+		fields = append(fields, copyField{Value: value, Null: !quoted && string(value) == c.Null})
+
+		switch {
+		case pos >= len(data):
+			if !final {
+				return nil, false, nil
+			}
+		case data[pos] == c.Delimiter:
+			pos++
+			continue
+		case data[pos] == '\r':
+			pos++
+			if pos < len(data) && data[pos] == '\n' {
+				pos++
+			} else if pos == len(data) && !final {
+				return nil, false, nil
+			}
+		default:
+			pos++
+		}
+
+		d.pending = data[pos:]
+		d.line++
+		return fields, true, nil
+	}
+}
+
+// nextBinaryRow reads a tuple of the binary format
+func (d *copyDecoder) nextBinaryRow() ([]copyField, bool, error) {
+	if d.header {
+		if len(d.pending) < len(binaryCopySignature)+8 {
+			return nil, false, nil
+		}
+		if !bytes.HasPrefix(d.pending, binaryCopySignature) {
+			return nil, false, newPostgresError("22P04", "COPY file signature not recognized")
+		}
+		extension := int(binary.BigEndian.Uint32(d.pending[len(binaryCopySignature)+4:]))
+		size := len(binaryCopySignature) + 8 + extension
+		if len(d.pending) < size {
+			return nil, false, nil
+		}
+		d.pending = d.pending[size:]
+		return nil, true, nil
+	}
+
+	if len(d.pending) < 2 {
+		return nil, false, nil
+	}
+	count := int(int16(binary.BigEndian.Uint16(d.pending)))
+	if count == -1 {
+		d.done = true
+		d.pending = nil
+		return nil, false, nil
+	}
+
+	fields := make([]copyField, count)
+	pos := 2
+	for i := range fields {
+		if len(d.pending) < pos+4 {
+			return nil, false, nil
+		}
+		size := int(int32(binary.BigEndian.Uint32(d.pending[pos:])))
+		pos += 4
+		if size < 0 {
+			fields[i].Null = true
+			continue
+		}
+		if len(d.pending) < pos+size {
+			return nil, false, nil
+		}
+		fields[i].Value = d.pending[pos : pos+size]
+		pos += size
+	}
+
+	d.pending = d.pending[pos:]
+	d.line++
+	return fields, true, nil
+}
+
+// copyToStdout streams the rows of a table or query to the client
+func (h *SimpleWireHandler) copyToStdout(ctx context.Context, session *Session, connectionID string, command *copyCommand, writer wire.DataWriter) error {
+	query := command.Query
+	if query == "" {
+		columns := "*"
+		if len(command.Columns) > 0 {
+			quoted := make([]string, len(command.Columns))
+			for i, column := range command.Columns {
+				quoted[i] = quoteIdentifier(column)
+			}
+			columns = strings.Join(quoted, ", ")
+		}
+		query = fmt.Sprintf("SELECT %s FROM %s", columns, quoteIdentifier(command.Table))
+	}
+
+	stmt, err := h.prepareStatementSimple(connectionID, "", query)
+	if err != nil {
+		return err
+	}
+	rows, err := h.backend.QueryContext(ctx, connectionID, stmt.Query)
+	if err != nil {
+		return toPostgresError(err)
+	}
+	defer rows.Close()
+
+	columnTypes, err := rows.ColumnTypes()
+	if err != nil {
+		return toPostgresError(err)
+	}
+	out := &copyWriter{conn: session.Conn, command: command, columns: buildColumns(describeColumnTypes(columnTypes))}
+	if err := out.start(); err != nil {
+		return err
+	}
+	count, err := writeRowsSimple(rows, out.columns, out)
+	if err != nil {
+		return toPostgresError(err)
+	}
+	if err := out.finish(); err != nil {
+		return err
+	}
+	return writer.Complete(fmt.Sprintf("COPY %d", count))
+}
+
+// copyWriter is the wire.DataWriter of COPY TO STDOUT; each row is sent in
+// a CopyData message
+type copyWriter struct {
+	conn    *ProtocolConn
+	command *copyCommand
+	columns wire.Columns
+	written uint64
+}
+
+// start sends the CopyOutResponse and the header
+func (w *copyWriter) start() error {
+	if err := w.conn.writeMessage('H', w.command.copyResponse(len(w.columns))); err != nil {
+		return err
+	}
+
+	switch {
+	case w.command.Format == "binary":
+		header := append(append([]byte(nil), binaryCopySignature...), 0, 0, 0, 0, 0, 0, 0, 0)
+		return w.conn.writeMessage('d', header)
+	case w.command.Header:
+		names := make([]interface{}, len(w.columns))
+		for i, column := range w.columns {
+			names[i] = column.Name
+		}
+		return w.conn.writeMessage('d', w.encodeRow(names, false))
+	}
+	return nil
+}
+
+// finish sends the binary trailer and CopyDone
+func (w *copyWriter) finish() error {
+	if w.command.Format == "binary" {
+		if err := w.conn.writeMessage('d', []byte{0xff, 0xff}); err != nil {
+			return err
+		}
+	}
+	return w.conn.writeMessage('c', nil)
+}
+
+func (w *copyWriter) Row(values []interface{}) error {
+	var data []byte
+	if w.command.Format == "binary" {
+		data = binary.BigEndian.AppendUint16(nil, uint16(len(values)))
+		for i, value := range values {
+			if value == nil {
+				data = binary.BigEndian.AppendUint32(data, 0xffffffff)
+				continue
+			}
+			encoded, err := encodeBinaryValue(value, w.columns[i].Oid)
+			if err != nil {
+				return err
+			}
+			data = binary.BigEndian.AppendUint32(data, uint32(len(encoded)))
+			data = append(data, encoded...)
+		}
+	} else {
+		data = w.encodeRow(values, true)
+	}
+
+	w.written++
+	return w.conn.writeMessage('d', data)
+}
+
+// encodeRow renders a row in the text or CSV format
+func (w *copyWriter) encodeRow(values []interface{}, typed bool) []byte {
+	c := w.command
+	var line []byte
+	for i, value := range values {
+		if i > 0 {
+			line = append(line, c.Delimiter)
+		}
+		if value == nil {
+			line = append(line, c.Null...)
+			continue
+		}
+
+		text := formatValueSimple(value)
+		if typed {
+			text = encodeTextValue(value, w.columns[i].Oid)
+		}
+		if c.Format == "csv" {
+			line = append(line, c.quoteCSV(text, w.forceQuote(i))...)
+		} else {
+			line = append(line, escapeCopyText(text, c.Delimiter)...)
+		}
+	}
+	return append(line, '\n')
+}
+
+// forceQuote reports whether FORCE_QUOTE applies to the column
+func (w *copyWriter) forceQuote(i int) bool {
+	for _, name := range w.command.ForceQuote {
+		if name == "*" || strings.EqualFold(name, w.columns[i].Name) {
+			return true
+		}
+	}
+	return false
+}
+
+func (w *copyWriter) Written() uint64 {
+	return w.written
+}
+
+func (w *copyWriter) Empty() error {
+	return nil
+}
+
+func (w *copyWriter) Complete(description string) error {
+	return nil
+}
+
+// escapeCopyText escapes a value for the text format
+func escapeCopyText(text string, delimiter byte) string {
+	var sb strings.Builder
+	for i := 0; i < len(text); i++ {
+		switch c := text[i]; c {
+		case '\\':
+			sb.WriteString(`\\`)
+		case '\b':
+			sb.WriteString(`\b`)
+		case '\f':
+			sb.WriteString(`\f`)
+		case '\n':
+			sb.WriteString(`\n`)
+		case '\r':
+			sb.WriteString(`\r`)
+		case '\t':
+			sb.WriteString(`\t`)
+		case '\v':
+			sb.WriteString(`\v`)
+		default:
+			if c == delimiter {
+				sb.WriteByte('\\')
+			}
+			sb.WriteByte(c)
+		}
+	}
+	return sb.String()
+}
+
+// quoteCSV quotes a CSV value when it contains special characters or could
+// be read back as NULL
+func (c *copyCommand) quoteCSV(text string, force bool) string {
+	if !force && text != c.Null && text != `\.` && !strings.ContainsAny(text, string([]byte{c.Delimiter, c.Quote, c.Escape, '\r', '\n'})) {
+		return text
+	}
+
+	var sb strings.Builder
+	sb.WriteByte(c.Quote)
+	for i := 0; i < len(text); i++ {
+		if text[i] == c.Quote || text[i] == c.Escape {
+			sb.WriteByte(c.Escape)
+		}
+		sb.WriteByte(text[i])
+	}
+	sb.WriteByte(c.Quote)
+	return sb.String()
+}
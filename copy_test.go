@@ -0,0 +1,263 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+
+	psqlerr "github.com/jeroenrinzema/psql-wire/errors"
+	"github.com/lib/pq"
+)
+
+// scriptedReader is a frontendReader replaying a fixed list of client messages
+type scriptedReader struct {
+	types  []byte
+	bodies [][]byte
+}
+
+func (r *scriptedReader) send(msgType byte, body string) *scriptedReader {
+	r.types = append(r.types, msgType)
+	r.bodies = append(r.bodies, []byte(body))
+	return r
+}
+
+func (r *scriptedReader) ReadMessage() (byte, []byte, error) {
+	if len(r.types) == 0 {
+		return 0, nil, io.EOF
+	}
+	msgType, body := r.types[0], r.bodies[0]
+	r.types, r.bodies = r.types[1:], r.bodies[1:]
+	return msgType, body, nil
+}
+
+func TestParseCopyCommand(t *testing.T) {
+	command, err := parseCopyCommand(`COPY public.items (id, "Name") FROM STDIN WITH (FORMAT csv, HEADER, DELIMITER ';')`)
+	if err != nil {
+		t.Fatalf("Failed to parse: %v", err)
+	}
+	want := &copyCommand{Table: "items", Columns: []string{"id", "Name"}, From: true, Format: "csv",
+		Delimiter: ';', Header: true, Quote: '"', Escape: '"'}
+	if !reflect.DeepEqual(command, want) {
+		t.Errorf("Unexpected command:\n got: %+v\nwant: %+v", command, want)
+	}
+
+	command, err = parseCopyCommand("COPY (SELECT a, (b) FROM t) TO STDOUT CSV HEADER FORCE QUOTE a, b")
+	if err != nil {
+		t.Fatalf("Failed to parse: %v", err)
+	}
+	if command.Query != "SELECT a, (b) FROM t" || command.From || command.Format != "csv" || !command.Header ||
+		!reflect.DeepEqual(command.ForceQuote, []string{"a", "b"}) {
+		t.Errorf("Unexpected command: %+v", command)
+	}
+
+	command, err = parseCopyCommand("COPY t TO STDOUT (FORMAT binary)")
+	if err != nil || command.Format != "binary" {
+		t.Errorf("Unexpected binary command: %+v, %v", command, err)
+	}
+
+	failures := map[string]string{
+		"COPY t FROM '/etc/passwd'":                  "0A000",
+		"COPY t TO PROGRAM 'ls'":                     "0A000",
+		"COPY t FROM STDIN (FORMAT xml)":             "22023",
+		"COPY t FROM STDIN (QUOTE '''')":             "0A000",
+		"COPY t FROM STDIN (FORMAT binary, NULL '')": "42601",
+		"COPY t FROM STDIN (DELIMITER '::')":         "22023",
+		"COPY (SELECT 1) FROM STDIN":                 "42601",
+	}
+	for query, code := range failures {
+		_, err := parseCopyCommand(query)
+		if got := psqlerr.GetCode(err); string(got) != code {
+			t.Errorf("%s: expected %s, got %s (%v)", query, code, got, err)
+		}
+	}
+}
+
+func TestCopyFromStdin(t *testing.T) {
+	handler := newTestHandler(t)
+	ctx, _ := handler.StartSession(context.Background())
+	session := sessionFromContext(ctx)
+	conn := &capturingConn{}
+	session.Conn = &ProtocolConn{Conn: conn}
+
+	runQuery(t, handler, ctx, "CREATE TABLE items (id INTEGER, name TEXT, price NUMERIC, data BYTEA)")
+
+	// Rows may be split across CopyData messages at any point
+	session.Reader = (&scriptedReader{}).
+		send('d', "1\tplain\t1.5\t\\\\x0102\n2\ttab\\there\t").
+		send('d', "\\N\t\\N\n3\tline\\nbreak\t2\t\\N\n\\.\n").
+		send('c', "")
+	writer := runQuery(t, handler, ctx, "COPY items FROM STDIN")
+	if writer.tag != "COPY 3" {
+		t.Errorf("Expected COPY 3 tag, got %q", writer.tag)
+	}
+	types, bodies := backendMessages(conn.written.Bytes())
+	if string(types) != "G" || string(bodies[0]) != "\x00\x00\x04\x00\x00\x00\x00\x00\x00\x00\x00" {
+		t.Errorf("Unexpected CopyInResponse: %q %q", types, bodies)
+	}
+
+	session.Reader = (&scriptedReader{}).
+		send('d', "id,name\n4,\"quoted, \"\"name\"\"\"\n5,\"multi\nline\"\n6,\n7,\"\"\n").
+		send('c', "")
+	writer = runQuery(t, handler, ctx, "COPY items (id, name) FROM STDIN WITH (FORMAT csv, HEADER true)")
+	if writer.tag != "COPY 4" {
+		t.Errorf("Expected COPY 4 tag, got %q", writer.tag)
+	}
+
+	// Binary rows: id int8 and name text, with a NULL name
+	data := append([]byte(nil), binaryCopySignature...)
+	data = append(data, 0, 0, 0, 0, 0, 0, 0, 0)
+	data = binary.BigEndian.AppendUint16(data, 2)
+	data = binary.BigEndian.AppendUint32(data, 8)
+	data = binary.BigEndian.AppendUint64(data, 8)
+	data = binary.BigEndian.AppendUint32(data, 0xffffffff)
+	data = binary.BigEndian.AppendUint16(data, 0xffff)
+	session.Reader = (&scriptedReader{}).send('d', string(data[:10])).send('d', string(data[10:])).send('c', "")
+	writer = runQuery(t, handler, ctx, "COPY items (id, name) FROM STDIN (FORMAT binary)")
+	if writer.tag != "COPY 1" {
+		t.Errorf("Expected COPY 1 tag, got %q", writer.tag)
+	}
+
+	writer = runQuery(t, handler, ctx, "SELECT id, name, price, data FROM items ORDER BY id")
+	want := [][]interface{}{
+		{int64(1), "plain", 1.5, []byte{1, 2}},
+		{int64(2), "tab\there", nil, nil},
+		{int64(3), "line\nbreak", int64(2), nil},
+		{int64(4), `quoted, "name"`, nil, nil},
+		{int64(5), "multi\nline", nil, nil},
+		{int64(6), nil, nil, nil},
+		{int64(7), "", nil, nil},
+		{int64(8), nil, nil, nil},
+	}
+	if len(writer.rows) != len(want) {
+		t.Fatalf("Expected %d rows, got %v", len(want), writer.rows)
+	}
+	for i, row := range want {
+		if !reflect.DeepEqual(writer.rows[i][:2], row[:2]) {
+			t.Errorf("Row %d: expected %v, got %v", i, row[:2], writer.rows[i][:2])
+		}
+	}
+	if data, ok := writer.rows[0][3].([]byte); !ok || string(data) != "\x01\x02" {
+		t.Errorf("Expected bytea to be decoded, got %#v", writer.rows[0][3])
+	}
+
+	// A bad row fails the whole copy, the rest of the data is drained
+	session.Reader = (&scriptedReader{}).send('d', "9\tnine\n").send('d', "x\tbad\n").send('d', "10\tten\n").send('c', "")
+	fn, _, _, _ := handler.ParseQuery(ctx, "COPY items (id, name) FROM STDIN")
+	err := fn(ctx, &recordingWriter{}, nil)
+	if code := psqlerr.GetCode(err); code != "22P02" || !strings.Contains(psqlerr.Flatten(err).Detail, "line 2") {
+		t.Errorf("Expected 22P02 on line 2, got %s: %+v", code, psqlerr.Flatten(err))
+	}
+	if len(session.Reader.(*scriptedReader).types) != 0 {
+		t.Error("Expected the remaining copy data to be drained")
+	}
+
+	session.Reader = (&scriptedReader{}).send('d', "11\televen\n").send('f', "client gave up\x00")
+	fn, _, _, _ = handler.ParseQuery(ctx, "COPY items (id, name) FROM STDIN")
+	if err := fn(ctx, &recordingWriter{}, nil); psqlerr.GetCode(err) != "57014" {
+		t.Errorf("Expected 57014 after CopyFail, got %v", err)
+	}
+
+	fn, _, _, _ = handler.ParseQuery(ctx, "COPY missing FROM STDIN")
+	if err := fn(ctx, &recordingWriter{}, nil); psqlerr.GetCode(err) != "42P01" {
+		t.Errorf("Expected 42P01 for an unknown table, got %v", err)
+	}
+	fn, _, _, _ = handler.ParseQuery(ctx, "COPY items (nope) FROM STDIN")
+	if err := fn(ctx, &recordingWriter{}, nil); psqlerr.GetCode(err) != "42703" {
+		t.Errorf("Expected 42703 for an unknown column, got %v", err)
+	}
+
+	writer = runQuery(t, handler, ctx, "SELECT count(*) FROM items")
+	if writer.rows[0][0] != int64(8) {
+		t.Errorf("Expected failed copies to be rolled back, got %v rows", writer.rows[0][0])
+	}
+	if status := handler.txManager.GetTransactionStatus(session.ID); status != TxIdle {
+		t.Errorf("Expected the implicit transaction to end, got status %d", status)
+	}
+}
+
+func TestCopyToStdout(t *testing.T) {
+	handler := newTestHandler(t)
+	ctx, _ := handler.StartSession(context.Background())
+	conn := &capturingConn{}
+	sessionFromContext(ctx).Conn = &ProtocolConn{Conn: conn}
+
+	runQuery(t, handler, ctx, "CREATE TABLE items (id INTEGER, name TEXT)")
+	runQuery(t, handler, ctx, "INSERT INTO items VALUES (1, 'a\tb'), (2, NULL), (3, 'x,\"y\"')")
+
+	copyOut := func(query string) []string {
+		t.Helper()
+		conn.written.Reset()
+		writer := runQuery(t, handler, ctx, query)
+		if writer.tag != "COPY 3" {
+			t.Errorf("%s: expected COPY 3 tag, got %q", query, writer.tag)
+		}
+		types, bodies := backendMessages(conn.written.Bytes())
+		if types[0] != 'H' || types[len(types)-1] != 'c' {
+			t.Fatalf("%s: unexpected messages %q", query, types)
+		}
+		var data []string
+		for _, body := range bodies[1 : len(bodies)-1] {
+			data = append(data, string(body))
+		}
+		return data
+	}
+
+	if got, want := copyOut("COPY items TO STDOUT"), []string{"1\ta\\tb\n", "2\t\\N\n", "3\tx,\"y\"\n"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Unexpected text output: %q", got)
+	}
+	if got, want := copyOut("COPY (SELECT name, id FROM items ORDER BY id) TO STDOUT WITH (FORMAT csv, HEADER)"),
+		[]string{"name,id\n", "a\tb,1\n", ",2\n", "\"x,\"\"y\"\"\",3\n"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Unexpected CSV output: %q", got)
+	}
+
+	got := copyOut("COPY items (id) TO STDOUT (FORMAT binary)")
+	if len(got) != 5 || got[0] != string(binaryCopySignature)+"\x00\x00\x00\x00\x00\x00\x00\x00" || got[4] != "\xff\xff" {
+		t.Fatalf("Unexpected binary output: %q", got)
+	}
+	if got[1] != "\x00\x01\x00\x00\x00\x08\x00\x00\x00\x00\x00\x00\x00\x01" {
+		t.Errorf("Unexpected binary tuple: %q", got[1])
+	}
+}
+
+func TestCopyThroughServer(t *testing.T) {
+	storage, err := NewLocalStorage(t.TempDir())
+	if err != nil {
+		t.Fatalf("Failed to create local storage: %v", err)
+	}
+	db := serveTestDatabases(t, storage)
+	if _, err := db.Exec("CREATE TABLE items (id INTEGER, name TEXT)"); err != nil {
+		t.Fatalf("Failed to create table: %v", err)
+	}
+
+	// The CopyData messages are read from the client past psql-wire
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatalf("Failed to begin: %v", err)
+	}
+	stmt, err := tx.Prepare(pq.CopyIn("items", "id", "name"))
+	if err != nil {
+		t.Fatalf("Failed to start COPY: %v", err)
+	}
+	for i, name := range []string{"one", "two", "three"} {
+		if _, err := stmt.Exec(i+1, name); err != nil {
+			t.Fatalf("Failed to copy row: %v", err)
+		}
+	}
+	if _, err := stmt.Exec(); err != nil {
+		t.Fatalf("Failed to finish COPY: %v", err)
+	}
+	if err := stmt.Close(); err != nil {
+		t.Fatalf("Failed to close COPY: %v", err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatalf("Failed to commit: %v", err)
+	}
+
+	var names string
+	if err := db.QueryRow("SELECT group_concat(name) FROM items").Scan(&names); err != nil || names != "one,two,three" {
+		t.Errorf("Expected the copied rows, got %q, %v", names, err)
+	}
+}
@@ -0,0 +1,470 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+
+	wire "github.com/jeroenrinzema/psql-wire"
+	psqlerr "github.com/jeroenrinzema/psql-wire/errors"
+)
+
+// Template names PostgreSQL clients use: template0 is the pristine, empty
+// database and template1 the default one
+const (
+	emptyTemplate   = "template0"
+	defaultTemplate = "template1"
+)
+
+// createDatabaseOptions are the options CREATE DATABASE accepts; all but
+// TEMPLATE describe PostgreSQL storage and are ignored
+var createDatabaseOptions = map[string]bool{
+	"owner": true, "template": true, "encoding": true, "strategy": true,
+	"locale": true, "lc_collate": true, "lc_ctype": true, "builtin_locale": true,
+	"icu_locale": true, "icu_rules": true, "locale_provider": true,
+	"collation_version": true, "tablespace": true, "allow_connections": true,
+	"connection_limit": true, "is_template": true, "oid": true,
+}
+
+// databaseCommand is a parsed CREATE DATABASE or DROP DATABASE statement
+type databaseCommand struct {
+	Verb     string // CREATE or DROP
+	Name     string
+	Template string // empty for the configured template
+	IfExists bool
+	Force    bool
+}
+
+// Tag returns the command tag of the statement
+func (c *databaseCommand) Tag() string {
+	return c.Verb + " DATABASE"
+}
+
+// parseDatabaseCommand recognizes CREATE DATABASE and DROP DATABASE
+func parseDatabaseCommand(query string) (*databaseCommand, bool, error) {
+	sig := significantTokens(tokenize(query))
+	for len(sig) > 0 && sig[len(sig)-1].isPunct(";") {
+		sig = sig[:len(sig)-1]
+	}
+	if len(sig) < 2 || !sig[1].is("DATABASE") {
+		return nil, false, nil
+	}
+
+	switch {
+	case sig[0].is("CREATE"):
+		command, err := parseCreateDatabase(sig[2:])
+		return command, true, err
+	case sig[0].is("DROP"):
+		command, err := parseDropDatabase(sig[2:])
+		return command, true, err
+	default:
+		return nil, false, nil
+	}
+}
+
+// parseCreateDatabase parses the tokens following CREATE DATABASE
+func parseCreateDatabase(sig []token) (*databaseCommand, error) {
+	command := &databaseCommand{Verb: "CREATE"}
+	name, sig, err := parseDatabaseName(sig)
+	if err != nil {
+		return nil, err
+	}
+	command.Name = name
+
+	if len(sig) > 0 && sig[0].is("WITH") {
+		sig = sig[1:]
+	}
+	for len(sig) > 0 {
+		if sig[0].Kind != tokenIdent {
+			return nil, newPostgresError("42601", "syntax error at or near %q", sig[0].Text)
+		}
+		option := sig[0].name()
+		sig = sig[1:]
+		if option == "connection" && len(sig) > 0 && sig[0].is("LIMIT") {
+			option, sig = "connection_limit", sig[1:]
+		}
+		if !createDatabaseOptions[option] {
+			return nil, newPostgresError("42601", "option %q not recognized", option)
+		}
+		if len(sig) > 0 && sig[0].isPunct("=") {
+			sig = sig[1:]
+		}
+		if len(sig) == 0 {
+			return nil, newPostgresError("42601", "syntax error at end of input")
+		}
+
+		value := sig[0]
+		sig = sig[1:]
+		if option != "template" || value.is("DEFAULT") {
+			continue
+		}
+		switch value.Kind {
+		case tokenIdent, tokenQuotedIdent:
+			command.Template = value.name()
+		case tokenString:
+			command.Template = decodeStringLiteral(value.Text)
+		default:
+			return nil, newPostgresError("42601", "syntax error at or near %q", value.Text)
+		}
+	}
+	return command, nil
+}
+
+// parseDropDatabase parses the tokens following DROP DATABASE
+func parseDropDatabase(sig []token) (*databaseCommand, error) {
+	command := &databaseCommand{Verb: "DROP"}
+	if len(sig) > 1 && sig[0].is("IF") && sig[1].is("EXISTS") {
+		command.IfExists, sig = true, sig[2:]
+	}
+	name, sig, err := parseDatabaseName(sig)
+	if err != nil {
+		return nil, err
+	}
+	command.Name = name
+
+	if len(sig) > 0 && sig[0].is("WITH") {
+		sig = sig[1:]
+	}
+	if len(sig) == 0 {
+		return command, nil
+	}
+	if !sig[0].isPunct("(") || !sig[len(sig)-1].isPunct(")") {
+		return nil, newPostgresError("42601", "syntax error at or near %q", sig[0].Text)
+	}
+	for _, t := range sig[1 : len(sig)-1] {
+		switch {
+		case t.isPunct(","):
+		case t.is("FORCE"):
+			command.Force = true
+		default:
+			return nil, newPostgresError("42601", "unrecognized DROP DATABASE option %q", t.Text)
+		}
+	}
+	return command, nil
+}
+
+// parseDatabaseName reads the database name starting a command
+func parseDatabaseName(sig []token) (string, []token, error) {
+	if len(sig) == 0 {
+		return "", nil, newPostgresError("42601", "syntax error at end of input")
+	}
+	if sig[0].Kind != tokenIdent && sig[0].Kind != tokenQuotedIdent {
+		return "", nil, newPostgresError("42601", "syntax error at or near %q", sig[0].Text)
+	}
+	return sig[0].name(), sig[1:], nil
+}
+
+// executeDatabaseCommand creates or drops a database in blob storage.
+// Neither can be undone, so they do not run in a transaction block.
+func (h *SimpleWireHandler) executeDatabaseCommand(ctx context.Context, connectionID string, command *databaseCommand, writer wire.DataWriter) error {
+	if h.txManager.GetTransactionStatus(connectionID) != TxIdle {
+		return newPostgresError("25001", "%s cannot run inside a transaction block", command.Tag())
+	}
+	if h.router == nil {
+		return newPostgresError("0A000", "%s is not supported", command.Tag())
+	}
+
+	if session := sessionFromContext(ctx); session != nil && session.User != nil {
+		if !session.User.CanConnect(command.Name) {
+			return newPostgresError("42501", "permission denied for database %q", command.Name)
+		}
+		if command.Template != "" && !session.User.CanConnect(command.Template) {
+			return newPostgresError("42501", "permission denied for database %q", command.Template)
+		}
+	}
+
+	var err error
+	switch command.Verb {
+	case "CREATE":
+		err = h.router.CreateDatabase(ctx, command.Name, command.Template)
+	case "DROP":
+		err = h.router.DropDatabase(ctx, command.Name, h.backend.DatabaseName(), command.IfExists, command.Force)
+	}
+	if err != nil {
+		return err
+	}
+	return writer.Complete(command.Tag())
+}
+
+// CreateDatabase uploads a new database, a copy of the template or empty
+// for template0. Without a template the configured one is used.
+func (r *DatabaseRouter) CreateDatabase(ctx context.Context, name string, template string) error {
+	if !validDatabaseName(name) {
+		return newPostgresError("42602", "invalid database name %q", name)
+	}
+	if template == "" || template == defaultTemplate {
+		template = r.config.Database.Template
+	}
+
+	entry, err := r.claim(ctx, name)
+	if err != nil {
+		return err
+	}
+	defer r.unclaim(name, entry, false)
+
+	exists := entry.db != nil
+	if !exists {
+		if exists, err = r.storage.Exists(ctx, name); err != nil {
+			return fmt.Errorf("failed to look up database %s: %w", name, err)
+		}
+	}
+	if exists {
+		return newPostgresError("42P04", "database %q already exists", name)
+	}
+
+	var data io.Reader = bytes.NewReader(nil)
+	if template != "" && template != emptyTemplate {
+		reader, err := r.templateReader(ctx, template)
+		if err != nil {
+			return err
+		}
+		defer reader.Close()
+		data = reader
+	}
+	if err := r.storage.Upload(ctx, name, data); err != nil {
+		return fmt.Errorf("failed to create database %s: %w", name, err)
+	}
+
+	log.Printf("INFO: Created database %s", name)
+	return nil
+}
+
+// templateReader returns the contents of a template database. An open
+// template is uploaded first; like PostgreSQL, a template with sessions
+// cannot be copied.
+func (r *DatabaseRouter) templateReader(ctx context.Context, template string) (io.ReadCloser, error) {
+	var db *Database
+	r.mu.Lock()
+	if entry, ok := r.databases[template]; ok && entry.closing == nil {
+		select {
+		case <-entry.ready:
+			db = entry.db
+		default:
+		}
+	}
+	busy := db != nil && db.sessions > 0
+	r.mu.Unlock()
+
+	if busy {
+		return nil, newPostgresError("55006", "source database %q is being accessed by other users", template)
+	}
+	if db != nil {
+		if err := db.txManager.ForceUpload(ctx); err != nil {
+			return nil, err
+		}
+	}
+
+	exists, err := r.storage.Exists(ctx, template)
+	if err != nil {
+		return nil, fmt.Errorf("failed to look up template database %s: %w", template, err)
+	}
+	if !exists {
+		return nil, newPostgresError("3D000", "template database %q does not exist", template)
+	}
+
+	// Download the template like a database being opened, so that its WAL
+	// segments are replayed
+	file, err := os.CreateTemp("", template+"-*.sqlite")
+	if err != nil {
+		return nil, fmt.Errorf("failed to read template database %s: %w", template, err)
+	}
+	file.Close()
+	cache := &DatabaseCache{storage: r.storage, localPath: file.Name(), dbName: template, wal: r.replication.wal}
+	if err := cache.Download(ctx); err != nil {
+		cache.Cleanup()
+		return nil, fmt.Errorf("failed to read template database %s: %w", template, err)
+	}
+	if file, err = os.Open(cache.GetLocalPath()); err != nil {
+		cache.Cleanup()
+		return nil, fmt.Errorf("failed to read template database %s: %w", template, err)
+	}
+	return &downloadedDatabase{File: file, cache: cache}, nil
+}
+
+// downloadedDatabase reads a downloaded database and removes it on Close
+type downloadedDatabase struct {
+	*os.File
+	cache *DatabaseCache
+}
+
+func (d *downloadedDatabase) Close() error {
+	err := d.File.Close()
+	d.cache.Cleanup()
+	return err
+}
+
+// DropDatabase deletes a database from blob storage. A database with
+// sessions is only dropped with force, which terminates them.
+func (r *DatabaseRouter) DropDatabase(ctx context.Context, name string, current string, ifExists bool, force bool) error {
+	if name == current {
+		return newPostgresError("55006", "cannot drop the currently open database")
+	}
+	if !validDatabaseName(name) {
+		if ifExists {
+			return nil
+		}
+		return unknownDatabaseError(name)
+	}
+
+	entry, err := r.claim(ctx, name)
+	if err != nil {
+		return err
+	}
+	removed := false
+	defer func() { r.unclaim(name, entry, removed) }()
+
+	if db := entry.db; db != nil {
+		r.mu.Lock()
+		sessions := db.sessions
+		var idle chan struct{}
+		if sessions > 0 && force {
+			idle = make(chan struct{})
+			db.idle = idle
+		}
+		r.mu.Unlock()
+
+		if sessions > 0 && !force {
+			err := newPostgresError("55006", "database %q is being accessed by other users", name)
+			return psqlerr.WithDetail(err, fmt.Sprintf("There are %d other sessions using the database.", sessions))
+		}
+		if idle != nil {
+			// The terminated sessions still use the backend until they
+			// are released
+			r.terminateSessions(db)
+			select {
+			case <-idle:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+		db.discard()
+		removed = true
+	} else {
+		exists, err := r.storage.Exists(ctx, name)
+		if err != nil {
+			return fmt.Errorf("failed to look up database %s: %w", name, err)
+		}
+		if !exists {
+			if ifExists {
+				return nil
+			}
+			return unknownDatabaseError(name)
+		}
+	}
+
+	// Segments go first, so that none is left for a database created later
+	// under the same name
+	if err := deleteSegments(ctx, r.storage, name); err != nil {
+		return fmt.Errorf("failed to drop database %s: %w", name, err)
+	}
+	if err := r.storage.Delete(ctx, name); err != nil {
+		return fmt.Errorf("failed to drop database %s: %w", name, err)
+	}
+	removed = true
+
+	log.Printf("INFO: Dropped database %s", name)
+	return nil
+}
+
+// terminateSessions ends the sessions of a database being dropped
+func (r *DatabaseRouter) terminateSessions(db *Database) {
+	for _, session := range r.cancels.Sessions() {
+		if _, ok := db.backend.lookupConnection(session.ID); !ok {
+			continue
+		}
+		session.cancelStatement()
+		session.terminate("57P01", "terminating connection due to administrator command")
+	}
+}
+
+// discard releases a database without uploading it
+func (d *Database) discard() {
+	d.txManager.Stop()
+	if err := d.backend.Close(); err != nil {
+		log.Printf("WARN: Failed to close database %s: %v", d.Name, err)
+	}
+	if err := d.cache.Cleanup(); err != nil {
+		log.Printf("WARN: Failed to cleanup cache of database %s: %v", d.Name, err)
+	}
+}
+
+// claim keeps sessions away from the named database until unclaim, after
+// it finished opening or being evicted. The entry holds the database when
+// it is open.
+func (r *DatabaseRouter) claim(ctx context.Context, name string) (*databaseEntry, error) {
+	for {
+		r.mu.Lock()
+		entry, ok := r.databases[name]
+		if !ok {
+			entry = &databaseEntry{ready: make(chan struct{}), closing: make(chan struct{})}
+			close(entry.ready)
+			r.databases[name] = entry
+			r.mu.Unlock()
+			return entry, nil
+		}
+
+		wait := entry.closing
+		if wait == nil {
+			select {
+			case <-entry.ready:
+			default:
+				wait = entry.ready
+			}
+		}
+		if wait == nil {
+			entry.closing = make(chan struct{})
+			r.mu.Unlock()
+			return entry, nil
+		}
+		r.mu.Unlock()
+
+		select {
+		case <-wait:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// unclaim lets sessions use a claimed database again; a removed database
+// or one that was not open is forgotten
+func (r *DatabaseRouter) unclaim(name string, entry *databaseEntry, removed bool) {
+	r.mu.Lock()
+	if (removed || entry.db == nil) && r.databases[name] == entry {
+		delete(r.databases, name)
+	}
+	closing := entry.closing
+	entry.closing = nil
+	r.mu.Unlock()
+	close(closing)
+}
+
+// ListDatabases returns the names of the databases clients can connect to
+func (r *DatabaseRouter) ListDatabases(ctx context.Context) ([]string, error) {
+	stored, err := r.storage.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	names := map[string]bool{r.config.Database.Name: true}
+	for _, name := range stored {
+		// WAL segments are stored next to the databases they belong to
+		if !isSegmentName(name) && validDatabaseName(name) {
+			names[name] = true
+		}
+	}
+	for _, db := range r.Databases() {
+		names[db.Name] = true
+	}
+
+	list := make([]string, 0, len(names))
+	for name := range names {
+		list = append(list, name)
+	}
+	sort.Strings(list)
+	return list, nil
+}
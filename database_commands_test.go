@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	psqlerr "github.com/jeroenrinzema/psql-wire/errors"
+)
+
+func TestParseDatabaseCommand(t *testing.T) {
+	tests := []struct {
+		query string
+		want  string // %+v of the command, empty when not a database command
+	}{
+		{"CREATE DATABASE sales", "&{Verb:CREATE Name:sales Template: IfExists:false Force:false}"},
+		{`create database "Sales";`, "&{Verb:CREATE Name:Sales Template: IfExists:false Force:false}"},
+		{"CREATE DATABASE sales WITH OWNER = app TEMPLATE template0 ENCODING 'UTF8'", "&{Verb:CREATE Name:sales Template:template0 IfExists:false Force:false}"},
+		{"CREATE DATABASE sales TEMPLATE = 'base' CONNECTION LIMIT 10", "&{Verb:CREATE Name:sales Template:base IfExists:false Force:false}"},
+		{"DROP DATABASE sales", "&{Verb:DROP Name:sales Template: IfExists:false Force:false}"},
+		{"DROP DATABASE IF EXISTS sales WITH (FORCE)", "&{Verb:DROP Name:sales Template: IfExists:true Force:true}"},
+		{"DROP DATABASE sales (force)", "&{Verb:DROP Name:sales Template: IfExists:false Force:true}"},
+		{"CREATE TABLE database (id INTEGER)", ""},
+		{"DROP TABLE sales", ""},
+	}
+	for _, tt := range tests {
+		command, ok, err := parseDatabaseCommand(tt.query)
+		if err != nil {
+			t.Errorf("%q: unexpected error %v", tt.query, err)
+			continue
+		}
+		got := ""
+		if ok {
+			got = fmt.Sprintf("%+v", command)
+		}
+		if got != tt.want {
+			t.Errorf("%q: got %s, want %s", tt.query, got, tt.want)
+		}
+	}
+
+	for _, invalid := range []string{
+		"CREATE DATABASE",
+		"CREATE DATABASE sales WITH COLOR blue",
+		"CREATE DATABASE sales TEMPLATE",
+		"DROP DATABASE sales WITH (CASCADE)",
+		"DROP DATABASE 'sales'",
+	} {
+		if _, _, err := parseDatabaseCommand(invalid); psqlerr.GetCode(err) != "42601" {
+			t.Errorf("%q: expected 42601, got %v", invalid, err)
+		}
+	}
+}
+
+func TestCreateDropDatabase(t *testing.T) {
+	storage, err := NewLocalStorage(t.TempDir())
+	if err != nil {
+		t.Fatalf("Failed to create local storage: %v", err)
+	}
+	router := newTestRouter(t, storage)
+	ctx := context.Background()
+
+	start := func(name string) context.Context {
+		session, err := router.startSession(ctx, name)
+		if err != nil {
+			t.Fatalf("Failed to start session on %s: %v", name, err)
+		}
+		return session
+	}
+	exec := func(session context.Context, query string) (*recordingWriter, error) {
+		writer := &recordingWriter{}
+		fn, _, _, err := router.ParseQuery(session, query)
+		if err == nil {
+			err = fn(session, writer, nil)
+		}
+		return writer, err
+	}
+	expect := func(session context.Context, query string, code string) {
+		t.Helper()
+		_, err := exec(session, query)
+		if got := string(psqlerr.GetCode(err)); err == nil && code != "" || err != nil && got != code {
+			t.Errorf("%q: expected %q, got %v", query, code, err)
+		}
+	}
+	databases := func(session context.Context) string {
+		t.Helper()
+		writer, err := exec(session, "SELECT d.datname, pg_catalog.array_to_string(d.datacl, E'\\n') FROM pg_catalog.pg_database d ORDER BY 1")
+		if err != nil {
+			t.Fatalf("Failed to list databases: %v", err)
+		}
+		var names []interface{}
+		for _, row := range writer.rows {
+			names = append(names, row[0])
+		}
+		return fmt.Sprint(names)
+	}
+
+	main := start("main")
+	expect(main, "CREATE DATABASE sales", "")
+	expect(main, "CREATE DATABASE sales", "42P04")
+	expect(main, "CREATE DATABASE main", "42P04")
+	expect(main, `CREATE DATABASE "../x"`, "42602")
+	expect(main, "CREATE DATABASE copy TEMPLATE missing", "3D000")
+	if got := databases(main); got != "[main sales]" {
+		t.Errorf("Unexpected databases %s", got)
+	}
+
+	// A template with sessions cannot be copied
+	sales := start("sales")
+	runQuery(t, databaseFromContext(sales).handler, sales, "CREATE TABLE orders (id INTEGER)")
+	runQuery(t, databaseFromContext(sales).handler, sales, "INSERT INTO orders VALUES (1)")
+	expect(main, "CREATE DATABASE copy TEMPLATE sales", "55006")
+	router.CloseSession(sales)
+	expect(main, "CREATE DATABASE copy TEMPLATE sales", "")
+
+	router.config.Database.Template = "sales"
+	expect(main, "CREATE DATABASE copy2", "")
+	expect(main, "CREATE DATABASE empty TEMPLATE template0", "")
+	for name, want := range map[string]int64{"copy": 1, "copy2": 1, "empty": 0} {
+		session := start(name)
+		writer, err := exec(session, "SELECT count(*) FROM sqlite_master WHERE name = 'orders'")
+		if err != nil || writer.rows[0][0] != want {
+			t.Errorf("%s: expected %d orders tables, got %v, %v", name, want, writer.rows, err)
+		}
+		router.CloseSession(session)
+	}
+
+	// A database with sessions is only dropped with FORCE
+	copySession := start("copy")
+	expect(main, "DROP DATABASE main", "55006")
+	expect(main, "DROP DATABASE copy", "55006")
+
+	// The forced drop waits for the terminated session to release it
+	dropped := make(chan error, 1)
+	go func() {
+		_, err := exec(main, "DROP DATABASE copy WITH (FORCE)")
+		dropped <- err
+	}()
+	select {
+	case err := <-dropped:
+		t.Fatalf("Expected the drop to wait for the session, got %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	router.CloseSession(copySession)
+	if err := <-dropped; err != nil {
+		t.Errorf("Failed to force the drop: %v", err)
+	}
+	expect(main, "DROP DATABASE copy2", "")
+	expect(main, "DROP DATABASE copy2", "3D000")
+	expect(main, "DROP DATABASE IF EXISTS copy2", "")
+	if _, err := router.startSession(ctx, "copy"); psqlerr.GetCode(err) != "3D000" {
+		t.Errorf("Expected the dropped database to be gone, got %v", err)
+	}
+	if got := databases(main); got != "[empty main sales]" {
+		t.Errorf("Unexpected databases %s", got)
+	}
+
+	// Neither command runs in a transaction block
+	expect(main, "BEGIN", "")
+	expect(main, "CREATE DATABASE other", "25001")
+	expect(main, "ROLLBACK", "")
+	expect(main, "SELECT 1; DROP DATABASE empty", "25001")
+	if exists, _ := storage.Exists(ctx, "empty"); !exists {
+		t.Error("Expected the database to survive a failed drop")
+	}
+
+	// Users only create and drop the databases they may connect to
+	sessionFromContext(main).User = &User{Name: "alice", Privilege: PrivilegeDDL, databases: map[string]bool{"main": true, "own": true}}
+	expect(main, "DROP DATABASE empty", "42501")
+	expect(main, "CREATE DATABASE other", "42501")
+	expect(main, "CREATE DATABASE own TEMPLATE sales", "42501")
+	expect(main, "CREATE DATABASE own", "")
+	expect(main, "DROP DATABASE own", "")
+}
@@ -0,0 +1,427 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	wire "github.com/jeroenrinzema/psql-wire"
+	"github.com/jeroenrinzema/psql-wire/codes"
+	psqlerr "github.com/jeroenrinzema/psql-wire/errors"
+	"github.com/lib/pq/oid"
+)
+
+// maxDatabaseNameLength is PostgreSQL's NAMEDATALEN - 1
+const maxDatabaseNameLength = 63
+
+// Database is a SQLite database downloaded from blob storage together with
+// the backend and transaction manager serving it
+type Database struct {
+	Name      string
+	cache     *DatabaseCache
+	backend   *SQLiteBackend
+	txManager *TransactionManager
+	txMonitor *TransactionMonitor
+	handler   *SimpleWireHandler
+
+	// sessions, lastUsed and idle are guarded by the router's mu
+	sessions int
+	lastUsed time.Time
+	// idle is closed when the last session releases the database
+	idle chan struct{}
+}
+
+// databaseKey is the context key of the database a session is served from
+type databaseKey struct{}
+
+// databaseFromContext returns the database attached to the context, if any
+func databaseFromContext(ctx context.Context) *Database {
+	db, _ := ctx.Value(databaseKey{}).(*Database)
+	return db
+}
+
+// Close uploads the final state of the database and releases its backend
+// and local copy. A database whose upload fails stays open, so no commit is
+// lost.
+func (d *Database) Close(ctx context.Context) error {
+	if err := d.txManager.ForceUpload(ctx); err != nil {
+		return err
+	}
+	d.txManager.Stop()
+
+	if err := d.backend.Close(); err != nil {
+		log.Printf("WARN: Failed to close database %s: %v", d.Name, err)
+	}
+	if err := d.cache.Cleanup(); err != nil {
+		log.Printf("WARN: Failed to cleanup cache of database %s: %v", d.Name, err)
+	}
+	return nil
+}
+
+// databaseEntry is a database being opened, open or being evicted
+type databaseEntry struct {
+	ready   chan struct{} // closed once db or err is set
+	db      *Database
+	err     error
+	closing chan struct{} // set while the database is evicted
+}
+
+// DatabaseRouter serves every session from the database named by its
+// database startup parameter. Databases are downloaded from blob storage on
+// first connect and each gets its own backend and transaction manager; the
+// least recently used are evicted to stay within the configured limits.
+type DatabaseRouter struct {
+	storage     BlobStorage
+	config      *Config
+	listener    *ProtocolListener
+	cancels     *CancelRegistry // shared, as cancel requests carry no database
+	limits      databaseLimits
+	replication replicationSettings
+
+	mu        sync.Mutex
+	databases map[string]*databaseEntry
+}
+
+// NewDatabaseRouter creates a router for the databases in storage
+func NewDatabaseRouter(storage BlobStorage, listener *ProtocolListener, config *Config) (*DatabaseRouter, error) {
+	limits, err := parseDatabaseLimits(config.Database)
+	if err != nil {
+		return nil, err
+	}
+	replication, err := parseReplicationSettings(config.Storage)
+	if err != nil {
+		return nil, err
+	}
+	return &DatabaseRouter{
+		storage:     storage,
+		config:      config,
+		listener:    listener,
+		cancels:     NewCancelRegistry(),
+		limits:      limits,
+		replication: replication,
+		databases:   make(map[string]*databaseEntry),
+	}, nil
+}
+
+// Open returns the named database, downloading it on first use. The
+// configured database is created when missing; any other database must
+// exist in blob storage.
+func (r *DatabaseRouter) Open(ctx context.Context, name string) (*Database, error) {
+	db, err := r.acquire(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	r.release(db)
+	return db, nil
+}
+
+// acquire opens the named database and holds it open until release
+func (r *DatabaseRouter) acquire(ctx context.Context, name string) (*Database, error) {
+	for {
+		r.mu.Lock()
+		entry, ok := r.databases[name]
+		if ok && entry.closing != nil {
+			// The next download must see the evicted database's upload
+			closing := entry.closing
+			r.mu.Unlock()
+			select {
+			case <-closing:
+				continue
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+		}
+		if !ok {
+			entry = &databaseEntry{ready: make(chan struct{})}
+			r.databases[name] = entry
+		}
+		r.mu.Unlock()
+
+		if ok {
+			select {
+			case <-entry.ready:
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+		} else {
+			entry.db, entry.err = r.open(ctx, name)
+			r.mu.Lock()
+			if entry.err != nil {
+				// A later connection tries again
+				delete(r.databases, name)
+			}
+			r.mu.Unlock()
+			close(entry.ready)
+		}
+		if entry.err != nil {
+			return nil, entry.err
+		}
+
+		r.mu.Lock()
+		if entry.closing != nil || r.databases[name] != entry {
+			// Evicted between opening and now
+			r.mu.Unlock()
+			continue
+		}
+		entry.db.sessions++
+		entry.db.lastUsed = time.Now()
+		r.mu.Unlock()
+
+		if !ok {
+			// Make room for the new database
+			r.evict()
+		}
+		return entry.db, nil
+	}
+}
+
+// release ends a use of a database returned by acquire
+func (r *DatabaseRouter) release(db *Database) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	db.sessions--
+	db.lastUsed = time.Now()
+	if db.sessions == 0 && db.idle != nil {
+		close(db.idle)
+		db.idle = nil
+	}
+}
+
+// open downloads a database and creates the backend serving it
+func (r *DatabaseRouter) open(ctx context.Context, name string) (*Database, error) {
+	if !validDatabaseName(name) {
+		return nil, unknownDatabaseError(name)
+	}
+	if name != r.config.Database.Name {
+		exists, err := r.storage.Exists(ctx, name)
+		if err != nil {
+			return nil, fmt.Errorf("failed to look up database %s: %w", name, err)
+		}
+		if !exists {
+			return nil, unknownDatabaseError(name)
+		}
+	}
+
+	log.Printf("INFO: Downloading database %s from blob storage...", name)
+	cache := NewDatabaseCache(r.storage, name, r.config.Storage.CacheTTLMinutes)
+	cache.wal = r.replication.wal
+	if err := cache.Download(ctx); err != nil {
+		cache.Cleanup()
+		return nil, fmt.Errorf("failed to download database %s: %w", name, err)
+	}
+	log.Printf("INFO: Database %s downloaded to: %s", name, cache.GetLocalPath())
+
+	backend, err := NewSQLiteBackend(
+		cache.GetLocalPath(),
+		r.config.Database.TransactionMode,
+		r.config.Database.ConnectionPoolSize,
+	)
+	if err != nil {
+		cache.Cleanup()
+		return nil, fmt.Errorf("failed to create SQLite backend: %w", err)
+	}
+	backend.SetDatabaseName(name)
+	settings := map[string]string{
+		"statement_timeout":                   r.config.Database.StatementTimeout,
+		"idle_in_transaction_session_timeout": r.config.Database.IdleInTransactionSessionTimeout,
+	}
+	for setting, value := range settings {
+		if err := backend.SetServerSetting(setting, value); err != nil {
+			backend.Close()
+			cache.Cleanup()
+			return nil, fmt.Errorf("invalid %s: %w", setting, err)
+		}
+	}
+
+	var txManager *TransactionManager
+	if r.replication.wal {
+		replicator, err := NewReplicator(ctx, cache, r.replication.snapshotInterval)
+		if err != nil {
+			backend.Close()
+			cache.Cleanup()
+			return nil, fmt.Errorf("failed to start replication of database %s: %w", name, err)
+		}
+		txManager = NewReplicatingTransactionManager(backend, cache, replicator)
+	} else {
+		txManager = NewTransactionManager(backend, cache)
+	}
+
+	db := &Database{
+		Name:      name,
+		cache:     cache,
+		backend:   backend,
+		txManager: txManager,
+		txMonitor: NewTransactionMonitor(),
+	}
+	db.handler = NewSimpleWireHandler(backend, db.txManager, db.txMonitor, r.listener, r.config)
+	db.handler.cancels = r.cancels
+	db.handler.router = r
+	backend.SetDatabaseLister(func() ([]string, error) {
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		return r.ListDatabases(ctx)
+	})
+	return db, nil
+}
+
+// Databases returns the open databases ordered by name
+func (r *DatabaseRouter) Databases() []*Database {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	databases := make([]*Database, 0, len(r.databases))
+	for _, entry := range r.databases {
+		select {
+		case <-entry.ready:
+			if entry.db != nil && entry.closing == nil {
+				databases = append(databases, entry.db)
+			}
+		default:
+		}
+	}
+	sort.Slice(databases, func(i, j int) bool { return databases[i].Name < databases[j].Name })
+	return databases
+}
+
+// Close closes every open database, uploading its final state
+func (r *DatabaseRouter) Close(ctx context.Context) error {
+	var firstErr error
+	for _, db := range r.Databases() {
+		if err := db.Close(ctx); err != nil {
+			log.Printf("ERROR: Failed to upload database %s: %v", db.Name, err)
+			log.Printf("WARN: Keeping local copy of database %s at %s", db.Name, db.cache.GetLocalPath())
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+
+	r.mu.Lock()
+	r.databases = make(map[string]*databaseEntry)
+	r.mu.Unlock()
+	return firstErr
+}
+
+// Cancel handles a CancelRequest for a session of any database
+func (r *DatabaseRouter) Cancel(processID uint32, secretKey uint32) {
+	r.cancels.Cancel(processID, secretKey)
+}
+
+// RunIdleReaper ends the transactions left idle past their timeout in all
+// open databases until ctx is done
+func (r *DatabaseRouter) RunIdleReaper(ctx context.Context) {
+	ticker := time.NewTicker(idleCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			for _, db := range r.Databases() {
+				db.handler.reapIdleTransactions()
+			}
+		}
+	}
+}
+
+// StartSession implements the psql-wire SessionHandler; it opens the
+// database the client asked for and starts the session on it. Like
+// PostgreSQL the database defaults to the user name.
+func (r *DatabaseRouter) StartSession(ctx context.Context) (context.Context, error) {
+	name := wire.ClientParameters(ctx)[wire.ParamDatabase]
+	if name == "" {
+		name = wire.AuthenticatedUsername(ctx)
+	}
+	if name == "" {
+		name = r.config.Database.Name
+	}
+
+	conn := r.listener.Lookup(wire.ClientParameters(ctx)[connectionParameter])
+	ctx, err := r.startSession(ctx, name)
+	if err != nil {
+		// psql-wire does not report session errors to the client
+		code := psqlerr.GetCode(err)
+		if code == "" || code == codes.Uncategorized {
+			code = codes.Internal
+		}
+		if writeErr := conn.WriteError("FATAL", string(code), err.Error()); writeErr != nil {
+			log.Printf("WARN: Failed to report session error: %v", writeErr)
+		}
+		return ctx, err
+	}
+
+	// psql-wire only reports the client's Terminate, so the session also
+	// ends with its connection
+	conn.SetCloseHandler(func() {
+		if err := r.CloseSession(ctx); err != nil {
+			log.Printf("WARN: Failed to close session: %v", err)
+		}
+	})
+	return ctx, nil
+}
+
+// startSession starts a session on the named database, which stays open
+// until the session ends
+func (r *DatabaseRouter) startSession(ctx context.Context, name string) (context.Context, error) {
+	db, err := r.acquire(ctx, name)
+	if err != nil {
+		return ctx, err
+	}
+	ctx, err = db.handler.StartSession(context.WithValue(ctx, databaseKey{}, db))
+	if err != nil {
+		r.release(db)
+	}
+	return ctx, err
+}
+
+// ParseQuery implements the psql-wire ParseFn interface for the session's
+// database
+func (r *DatabaseRouter) ParseQuery(ctx context.Context, query string) (wire.PreparedStatementFn, []oid.Oid, wire.Columns, error) {
+	db := databaseFromContext(ctx)
+	if db == nil {
+		return nil, nil, nil, newPostgresError("08003", "no database selected")
+	}
+	return db.handler.ParseQuery(ctx, query)
+}
+
+// CloseSession implements the psql-wire CloseFn for the session's database
+func (r *DatabaseRouter) CloseSession(ctx context.Context) error {
+	db, session := databaseFromContext(ctx), sessionFromContext(ctx)
+	if db == nil || session == nil {
+		return nil
+	}
+
+	// Both the client's Terminate and the closed connection end the
+	// session; the database is released once
+	var err error
+	session.closeOnce.Do(func() {
+		err = db.handler.CloseSession(ctx)
+		r.release(db)
+	})
+	return err
+}
+
+// validDatabaseName reports whether a name can be used as a blob name and
+// a file name
+func validDatabaseName(name string) bool {
+	if name == "" || len(name) > maxDatabaseNameLength || name[0] == '.' || name[0] == '-' {
+		return false
+	}
+	for _, c := range name {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9', c == '_', c == '-', c == '.':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+func unknownDatabaseError(name string) error {
+	return newPostgresError("3D000", "database %q does not exist", name)
+}
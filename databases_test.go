@@ -0,0 +1,251 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	psqlerr "github.com/jeroenrinzema/psql-wire/errors"
+)
+
+// newTestRouter creates a router for databases in a temporary directory
+// with "main" as the default database
+func newTestRouter(t *testing.T, storage BlobStorage) *DatabaseRouter {
+	t.Helper()
+
+	config, err := LoadConfig("")
+	if err != nil {
+		t.Fatalf("Failed to load default config: %v", err)
+	}
+	config.Database.Name = "main"
+
+	router, err := NewDatabaseRouter(storage, nil, config)
+	if err != nil {
+		t.Fatalf("Failed to create router: %v", err)
+	}
+	t.Cleanup(func() { router.Close(context.Background()) })
+	return router
+}
+
+func TestDatabaseRouting(t *testing.T) {
+	storage, err := NewLocalStorage(t.TempDir())
+	if err != nil {
+		t.Fatalf("Failed to create local storage: %v", err)
+	}
+	ctx := context.Background()
+
+	// The default database is created on first connect
+	router := newTestRouter(t, storage)
+	session, err := router.StartSession(ctx)
+	if err != nil {
+		t.Fatalf("Failed to start session: %v", err)
+	}
+	main := databaseFromContext(session)
+	runQuery(t, main.handler, session, "CREATE TABLE orders (id INTEGER)")
+	runQuery(t, main.handler, session, "INSERT INTO orders VALUES (1)")
+	router.CloseSession(session)
+
+	// Any other database must exist in storage
+	for _, name := range []string{"sales", "../main", ".hidden", ""} {
+		_, err := router.startSession(ctx, name)
+		if psqlerr.GetCode(err) != "3D000" {
+			t.Errorf("%q: expected 3D000, got %v", name, err)
+		}
+	}
+	if err := router.Close(ctx); err != nil {
+		t.Fatalf("Failed to close databases: %v", err)
+	}
+	file, _ := storage.Download(ctx, "main")
+	if err := storage.Upload(ctx, "sales", file); err != nil {
+		t.Fatalf("Failed to copy database: %v", err)
+	}
+	file.Close()
+
+	// Each database is served by its own backend
+	router = newTestRouter(t, storage)
+	sessions := map[string]context.Context{}
+	for _, name := range []string{"main", "sales"} {
+		session, err := router.startSession(ctx, name)
+		if err != nil {
+			t.Fatalf("Failed to start session on %s: %v", name, err)
+		}
+		sessions[name] = session
+	}
+	sales := databaseFromContext(sessions["sales"])
+	runQuery(t, sales.handler, sessions["sales"], "INSERT INTO orders VALUES (2)")
+
+	for name, want := range map[string]int64{"main": 1, "sales": 2} {
+		db := databaseFromContext(sessions[name])
+		writer := runQuery(t, db.handler, sessions[name], "SELECT count(*), current_database() FROM orders")
+		if len(writer.rows) != 1 || writer.rows[0][0] != want || writer.rows[0][1] != name {
+			t.Errorf("%s: unexpected rows %v", name, writer.rows)
+		}
+	}
+	if len(router.Databases()) != 2 {
+		t.Errorf("Expected two open databases, got %d", len(router.Databases()))
+	}
+
+	fn, _, _, err := router.ParseQuery(sessions["sales"], "SELECT 1")
+	if err != nil || fn(sessions["sales"], &recordingWriter{}, nil) != nil {
+		t.Errorf("Failed to route query: %v", err)
+	}
+	if _, _, _, err := router.ParseQuery(ctx, "SELECT 1"); err == nil {
+		t.Error("Expected a query without a session database to fail")
+	}
+}
+
+func TestDatabaseClose(t *testing.T) {
+	storage, err := NewLocalStorage(t.TempDir())
+	if err != nil {
+		t.Fatalf("Failed to create local storage: %v", err)
+	}
+	ctx := context.Background()
+
+	// Closing uploads the commits the background upload has not sent yet
+	router := newTestRouter(t, storage)
+	session, err := router.startSession(ctx, "main")
+	if err != nil {
+		t.Fatalf("Failed to start session: %v", err)
+	}
+	db := databaseFromContext(session)
+	runQuery(t, db.handler, session, "CREATE TABLE orders (id INTEGER)")
+	runQuery(t, db.handler, session, "INSERT INTO orders VALUES (1)")
+	router.CloseSession(session)
+	if err := router.Close(ctx); err != nil {
+		t.Fatalf("Failed to close: %v", err)
+	}
+
+	router = newTestRouter(t, storage)
+	session, err = router.startSession(ctx, "main")
+	if err != nil {
+		t.Fatalf("Failed to reopen: %v", err)
+	}
+	db = databaseFromContext(session)
+	if writer := runQuery(t, db.handler, session, "SELECT count(*) FROM orders"); writer.rows[0][0] != int64(1) {
+		t.Errorf("Expected the insert after reopening, got %v", writer.rows)
+	}
+}
+
+func TestDatabaseOpenedOnce(t *testing.T) {
+	storage, err := NewLocalStorage(t.TempDir())
+	if err != nil {
+		t.Fatalf("Failed to create local storage: %v", err)
+	}
+	router := newTestRouter(t, storage)
+
+	var wg sync.WaitGroup
+	opened := make([]*Database, 8)
+	for i := range opened {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			opened[i], _ = router.Open(context.Background(), "main")
+		}(i)
+	}
+	wg.Wait()
+
+	for _, db := range opened {
+		if db == nil || db != opened[0] {
+			t.Fatalf("Expected every connection to share one database, got %v", opened)
+		}
+	}
+}
+
+func TestDatabaseEviction(t *testing.T) {
+	storage, err := NewLocalStorage(t.TempDir())
+	if err != nil {
+		t.Fatalf("Failed to create local storage: %v", err)
+	}
+	ctx := context.Background()
+	for _, name := range []string{"a", "b", "c"} {
+		if err := storage.Upload(ctx, name, bytes.NewReader(nil)); err != nil {
+			t.Fatalf("Failed to create database %s: %v", name, err)
+		}
+	}
+
+	router := newTestRouter(t, storage)
+	router.limits.maxOpen = 2
+	openNames := func() string {
+		var names []string
+		for _, db := range router.Databases() {
+			names = append(names, db.Name)
+		}
+		return strings.Join(names, ",")
+	}
+
+	sessionA, err := router.startSession(ctx, "a")
+	if err != nil {
+		t.Fatalf("Failed to start session: %v", err)
+	}
+	sessionB, err := router.startSession(ctx, "b")
+	if err != nil {
+		t.Fatalf("Failed to start session: %v", err)
+	}
+	b := databaseFromContext(sessionB)
+	runQuery(t, b.handler, sessionB, "CREATE TABLE t (id INTEGER)")
+	runQuery(t, b.handler, sessionB, "INSERT INTO t VALUES (1)")
+	router.CloseSession(sessionB)
+	router.CloseSession(sessionB)
+
+	// Opening a third database evicts the idle one, not the one in use
+	sessionC, err := router.startSession(ctx, "c")
+	if err != nil {
+		t.Fatalf("Failed to start session: %v", err)
+	}
+	if got := openNames(); got != "a,c" {
+		t.Errorf("Expected a and c to stay open, got %s", got)
+	}
+	if _, err := os.Stat(b.cache.GetLocalPath()); !os.IsNotExist(err) {
+		t.Errorf("Expected the local copy of b to be removed, got %v", err)
+	}
+
+	// Sessions keep databases open beyond the limit; b reloads with its rows
+	sessionB, err = router.startSession(ctx, "b")
+	if err != nil {
+		t.Fatalf("Failed to reopen b: %v", err)
+	}
+	reloaded := databaseFromContext(sessionB)
+	if reloaded == b {
+		t.Error("Expected b to be downloaded again")
+	}
+	writer := runQuery(t, reloaded.handler, sessionB, "SELECT id FROM t")
+	if len(writer.rows) != 1 || writer.rows[0][0] != int64(1) {
+		t.Errorf("Expected the evicted rows to be uploaded, got %v", writer.rows)
+	}
+	if got := openNames(); got != "a,b,c" {
+		t.Errorf("Expected every database in use to stay open, got %s", got)
+	}
+
+	router.CloseSession(sessionA)
+	router.evict()
+	if got := openNames(); got != "b,c" {
+		t.Errorf("Expected the idle database to be evicted once over the limit, got %s", got)
+	}
+
+	// Databases without sessions are evicted after the idle timeout or to
+	// stay within the disk limit
+	router.limits.maxOpen = 0
+	router.limits.idleTimeout = time.Millisecond
+	router.CloseSession(sessionB)
+	time.Sleep(5 * time.Millisecond)
+	router.evict()
+	if got := openNames(); got != "c" {
+		t.Errorf("Expected the idle database to be evicted, got %s", got)
+	}
+
+	router.limits.idleTimeout = 0
+	router.limits.maxDisk = 1
+	router.evict()
+	if got := openNames(); got != "c" {
+		t.Errorf("Expected the database in use to stay open, got %s", got)
+	}
+	router.CloseSession(sessionC)
+	router.evict()
+	if got := openNames(); got != "" {
+		t.Errorf("Expected every database to be evicted, got %s", got)
+	}
+}
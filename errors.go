@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/jeroenrinzema/psql-wire/codes"
+	psqlerr "github.com/jeroenrinzema/psql-wire/errors"
+	"github.com/mattn/go-sqlite3"
+)
+
+// backendError carries the PostgreSQL wording of a backend error while
+// keeping the original error reachable through errors.Is and errors.As
+type backendError struct {
+	message string
+	table   string
+	column  string
+	err     error
+}
+
+func (e *backendError) Error() string {
+	return e.message
+}
+
+func (e *backendError) Unwrap() error {
+	return e.err
+}
+
+// errorDescription is the PostgreSQL rendering of a SQLite error. Table,
+// Column and Constraint are set for the errors PostgreSQL reports them in.
+type errorDescription struct {
+	Message    string
+	Detail     string
+	Hint       string
+	Constraint string
+	Table      string
+	Column     string
+}
+
+var (
+	constraintColumnsRe = regexp.MustCompile(`constraint failed: (.+)$`)
+	nearTokenRe         = regexp.MustCompile(`near "(.*)": syntax error`)
+	noSuchObjectRe      = regexp.MustCompile(`no such (table|column|function): (.+)$`)
+)
+
+// newPostgresError creates an error response with the given SQLSTATE code
+func newPostgresError(code string, format string, args ...interface{}) error {
+	err := psqlerr.WithCode(fmt.Errorf(format, args...), codes.Code(code))
+	return psqlerr.WithSeverity(err, psqlerr.LevelError)
+}
+
+// toPostgresError converts a backend error into an error response carrying
+// the mapped SQLSTATE code. Errors that already carry a code are returned as is.
+func toPostgresError(err error) error {
+	if err == nil {
+		return nil
+	}
+	if code := psqlerr.GetCode(err); code != "" && code != codes.Uncategorized {
+		return err
+	}
+	if errors.Is(err, context.Canceled) {
+		return newPostgresError("57014", "canceling statement due to user request")
+	}
+
+	code := MapSQLiteError(err)
+	desc := describeSQLiteError(code, err)
+
+	var result error = &backendError{message: desc.Message, table: desc.Table, column: desc.Column, err: err}
+	result = psqlerr.WithCode(result, codes.Code(code))
+	result = psqlerr.WithSeverity(result, psqlerr.LevelError)
+	if desc.Detail != "" {
+		result = psqlerr.WithDetail(result, desc.Detail)
+	}
+	if desc.Hint != "" {
+		result = psqlerr.WithHint(result, desc.Hint)
+	}
+	if desc.Constraint != "" {
+		result = psqlerr.WithConstraintName(result, desc.Constraint)
+	}
+	return result
+}
+
+// encodeError encodes the ErrorResponse for err, with the schema, table,
+// column and constraint fields of a backend error
+func encodeError(err error) []byte {
+	desc := psqlerr.Flatten(err)
+	fields := []errorField{
+		{'S', string(desc.Severity)},
+		{'V', string(desc.Severity)},
+		{'C', string(desc.Code)},
+		{'M', desc.Message},
+		{'D', desc.Detail},
+		{'H', desc.Hint},
+	}
+	var backendErr *backendError
+	if errors.As(err, &backendErr) && backendErr.table != "" {
+		fields = append(fields, errorField{'s', "public"}, errorField{'t', backendErr.table}, errorField{'c', backendErr.column})
+	}
+	return encodeErrorFields(append(fields, errorField{'n', desc.ConstraintName}))
+}
+
+// describeSQLiteError rewrites a SQLite error message the way PostgreSQL
+// words the same error, recovering the table, column and constraint names
+// SQLite puts in the message
+func describeSQLiteError(code string, err error) errorDescription {
+	message := err.Error()
+	var sqliteErr sqlite3.Error
+	if errors.As(err, &sqliteErr) {
+		message = sqliteErr.Error()
+	}
+	desc := errorDescription{Message: message}
+
+	var table string
+	var columns []string
+	if m := constraintColumnsRe.FindStringSubmatch(message); m != nil {
+		// UNIQUE and NOT NULL failures list table.column pairs
+		for _, ref := range strings.Split(m[1], ", ") {
+			if dot := strings.IndexByte(ref, '.'); dot > 0 {
+				table = ref[:dot]
+				columns = append(columns, ref[dot+1:])
+			}
+		}
+	}
+
+	switch code {
+	case "23505":
+		if table == "" {
+			break
+		}
+		desc.Table = table
+		if sqliteErr.ExtendedCode == sqlite3.ErrConstraintPrimaryKey || sqliteErr.ExtendedCode == sqlite3.ErrConstraintRowID {
+			desc.Constraint = table + "_pkey"
+		} else {
+			desc.Constraint = table + "_" + strings.Join(columns, "_") + "_key"
+		}
+		desc.Message = fmt.Sprintf("duplicate key value violates unique constraint %q", desc.Constraint)
+		desc.Detail = fmt.Sprintf("Key (%s) already exists.", strings.Join(columns, ", "))
+	case "23502":
+		if table == "" || len(columns) != 1 {
+			break
+		}
+		desc.Table, desc.Column = table, columns[0]
+		desc.Message = fmt.Sprintf("null value in column %q of relation %q violates not-null constraint", desc.Column, desc.Table)
+		desc.Detail = fmt.Sprintf("Failing column: %s.%s.", desc.Table, desc.Column)
+	case "23503":
+		desc.Message = "insert or update violates foreign key constraint"
+	case "23514":
+		if m := constraintColumnsRe.FindStringSubmatch(message); m != nil {
+			desc.Constraint = m[1]
+			desc.Message = fmt.Sprintf("new row violates check constraint %q", desc.Constraint)
+		}
+	case "42P01", "42703", "42883":
+		if m := noSuchObjectRe.FindStringSubmatch(message); m != nil {
+			name := m[2]
+			switch m[1] {
+			case "table":
+				desc.Message = fmt.Sprintf("relation %q does not exist", name)
+			case "column":
+				desc.Message = fmt.Sprintf("column %q does not exist", name)
+			case "function":
+				desc.Message = fmt.Sprintf("function %s does not exist", name)
+			}
+		}
+	case "42601":
+		if m := nearTokenRe.FindStringSubmatch(message); m != nil {
+			desc.Message = fmt.Sprintf("syntax error at or near %q", m[1])
+		} else if strings.Contains(message, "incomplete input") {
+			desc.Message = "syntax error at end of input"
+		}
+	case "57014":
+		desc.Message = "canceling statement due to user request"
+	case "40001":
+		desc.Message = "could not serialize access due to concurrent update"
+		desc.Detail = message
+		desc.Hint = "The transaction might succeed if retried."
+	}
+
+	return desc
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"time"
+)
+
+// evictionCheckInterval is how often databases are checked against the
+// limits besides when one is opened
+const evictionCheckInterval = 10 * time.Second
+
+// databaseLimits bound the databases kept open; zero disables a limit
+type databaseLimits struct {
+	maxOpen     int
+	maxDisk     int64 // bytes
+	idleTimeout time.Duration
+}
+
+// parseDatabaseLimits reads the limits of the database settings
+func parseDatabaseLimits(config DatabaseConfig) (databaseLimits, error) {
+	if config.MaxOpen < 0 {
+		return databaseLimits{}, fmt.Errorf("invalid max_open %d", config.MaxOpen)
+	}
+	if config.MaxDiskMB < 0 {
+		return databaseLimits{}, fmt.Errorf("invalid max_disk_mb %d", config.MaxDiskMB)
+	}
+	idleTimeout, err := parseTimeoutSetting(config.IdleTimeout)
+	if err != nil {
+		return databaseLimits{}, fmt.Errorf("invalid idle_timeout: %w", err)
+	}
+	return databaseLimits{
+		maxOpen:     config.MaxOpen,
+		maxDisk:     int64(config.MaxDiskMB) << 20,
+		idleTimeout: idleTimeout,
+	}, nil
+}
+
+// diskUsage returns the size of the local copy of the database, including
+// its WAL
+func (d *Database) diskUsage() int64 {
+	var size int64
+	path := d.cache.GetLocalPath()
+	for _, file := range []string{path, path + "-wal", path + "-shm"} {
+		if info, err := os.Stat(file); err == nil {
+			size += info.Size()
+		}
+	}
+	return size
+}
+
+// RunEviction closes databases left without sessions past the idle timeout
+// or beyond the limits until ctx is done
+func (r *DatabaseRouter) RunEviction(ctx context.Context) {
+	ticker := time.NewTicker(evictionCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			r.evict()
+		}
+	}
+}
+
+// evict closes the least recently used databases without sessions while
+// the limits are exceeded, and those idle past the idle timeout. Databases
+// with sessions are never evicted, so the limits may be exceeded until
+// their sessions end.
+func (r *DatabaseRouter) evict() {
+	r.mu.Lock()
+	victims := r.evictionVictims(time.Now())
+	for _, entry := range victims {
+		entry.closing = make(chan struct{})
+	}
+	r.mu.Unlock()
+
+	for _, entry := range victims {
+		db := entry.db
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		err := db.Close(ctx)
+		cancel()
+
+		r.mu.Lock()
+		if err != nil {
+			log.Printf("WARN: Failed to evict database %s, keeping it open: %v", db.Name, err)
+		} else {
+			log.Printf("INFO: Evicted database %s", db.Name)
+			delete(r.databases, db.Name)
+		}
+		closing := entry.closing
+		entry.closing = nil
+		r.mu.Unlock()
+		close(closing)
+	}
+}
+
+// evictionVictims picks the databases to evict; r.mu must be held
+func (r *DatabaseRouter) evictionVictims(now time.Time) []*databaseEntry {
+	var idle []*databaseEntry
+	open, disk := 0, int64(0)
+	for _, entry := range r.databases {
+		if entry.closing != nil {
+			continue
+		}
+		open++
+		select {
+		case <-entry.ready:
+		default:
+			continue // still downloading
+		}
+		if entry.db == nil {
+			continue
+		}
+		disk += entry.db.diskUsage()
+		if entry.db.sessions == 0 {
+			idle = append(idle, entry)
+		}
+	}
+	sort.Slice(idle, func(i, j int) bool { return idle[i].db.lastUsed.Before(idle[j].db.lastUsed) })
+
+	var victims []*databaseEntry
+	for _, entry := range idle {
+		switch {
+		case r.limits.maxOpen > 0 && open > r.limits.maxOpen:
+		case r.limits.maxDisk > 0 && disk > r.limits.maxDisk:
+		case r.limits.idleTimeout > 0 && now.Sub(entry.db.lastUsed) > r.limits.idleTimeout:
+		default:
+			continue
+		}
+		victims = append(victims, entry)
+		open--
+		disk -= entry.db.diskUsage()
+	}
+	return victims
+}
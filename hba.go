@@ -0,0 +1,200 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// Methods of access rules besides the password methods
+const (
+	authMethodTrust  = "trust"
+	authMethodCert   = "cert"
+	authMethodReject = "reject"
+)
+
+// Connection types of access rules, as in pg_hba.conf
+const (
+	connTypeHost      = "host"
+	connTypeHostSSL   = "hostssl"
+	connTypeHostNoSSL = "hostnossl"
+)
+
+// accessRule is a parsed server.hba entry
+type accessRule struct {
+	connType  string
+	network   *net.IPNet      // nil matches every address
+	databases map[string]bool // nil matches every database
+	sameUser  bool            // the database named like the user matches
+	users     map[string]bool // nil matches every user
+	method    string
+}
+
+// clientInfo describes a connecting client for matching access rules
+type clientInfo struct {
+	user     string
+	database string
+	addr     net.IP
+	tls      *tls.ConnectionState // nil without TLS
+}
+
+// encryption describes the client's transport the way PostgreSQL's
+// messages do
+func (c clientInfo) encryption() string {
+	if c.tls != nil {
+		return "SSL encryption"
+	}
+	return "no encryption"
+}
+
+// parseAccessRules reads the server.hba entries. Without entries every
+// client authenticates with the default method.
+func parseAccessRules(configs []AccessRuleConfig, defaultMethod string) ([]accessRule, error) {
+	if len(configs) == 0 {
+		return []accessRule{{connType: connTypeHost, method: defaultMethod}}, nil
+	}
+
+	rules := make([]accessRule, 0, len(configs))
+	for i, rc := range configs {
+		rule, err := parseAccessRule(rc)
+		if err != nil {
+			return nil, fmt.Errorf("server.hba entry %d: %w", i+1, err)
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// parseAccessRule reads a single server.hba entry
+func parseAccessRule(rc AccessRuleConfig) (accessRule, error) {
+	rule := accessRule{connType: rc.Type, method: rc.Method}
+	if rule.connType == "" {
+		rule.connType = connTypeHost
+	}
+	switch rule.connType {
+	case connTypeHost, connTypeHostSSL, connTypeHostNoSSL:
+	default:
+		return accessRule{}, fmt.Errorf("unknown connection type %q", rc.Type)
+	}
+
+	switch rule.method {
+	case "scram":
+		rule.method = authMethodSCRAM
+	case authMethodSCRAM, authMethodMD5, authMethodPassword, authMethodTrust, authMethodReject:
+	case authMethodCert:
+		if rule.connType != connTypeHostSSL {
+			return accessRule{}, fmt.Errorf("cert authentication is only supported on hostssl connections")
+		}
+	case "":
+		return accessRule{}, fmt.Errorf("missing method")
+	default:
+		return accessRule{}, fmt.Errorf("unknown method %q", rc.Method)
+	}
+
+	switch address := strings.TrimSpace(rc.Address); address {
+	case "", "all":
+	default:
+		if !strings.Contains(address, "/") {
+			// A single address, as a host-length network
+			if ip := net.ParseIP(address); ip != nil {
+				bits := 128
+				if ip.To4() != nil {
+					bits = 32
+				}
+				address = fmt.Sprintf("%s/%d", address, bits)
+			}
+		}
+		_, network, err := net.ParseCIDR(address)
+		if err != nil {
+			return accessRule{}, fmt.Errorf("invalid address %q", rc.Address)
+		}
+		rule.network = network
+	}
+
+	for _, database := range splitRuleList(rc.Database) {
+		if database == "all" {
+			rule.databases, rule.sameUser = nil, false
+			break
+		}
+		if rule.databases == nil {
+			rule.databases = make(map[string]bool)
+		}
+		if database == "sameuser" {
+			rule.sameUser = true
+			continue
+		}
+		rule.databases[database] = true
+	}
+
+	for _, user := range splitRuleList(rc.User) {
+		if user == "all" {
+			rule.users = nil
+			break
+		}
+		if rule.users == nil {
+			rule.users = make(map[string]bool)
+		}
+		rule.users[user] = true
+	}
+	return rule, nil
+}
+
+// splitRuleList splits a comma-separated list of names; an empty list
+// means all
+func splitRuleList(value string) []string {
+	var names []string
+	for _, name := range strings.Split(value, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			names = append(names, name)
+		}
+	}
+	if len(names) == 0 {
+		return []string{"all"}
+	}
+	return names
+}
+
+// matches reports whether the rule applies to the client
+func (r accessRule) matches(client clientInfo) bool {
+	switch {
+	case r.connType == connTypeHostSSL && client.tls == nil:
+		return false
+	case r.connType == connTypeHostNoSSL && client.tls != nil:
+		return false
+	case r.network != nil && (client.addr == nil || !r.network.Contains(client.addr)):
+		return false
+	case r.users != nil && !r.users[client.user]:
+		return false
+	case r.databases != nil && !r.databases[client.database] && !(r.sameUser && client.database == client.user):
+		return false
+	}
+	return true
+}
+
+// matchesUser reports whether the rule may apply to the user
+func (r accessRule) matchesUser(user string) bool {
+	return r.users == nil || r.users[user]
+}
+
+// matchAccessRule returns the first rule applying to the client
+func matchAccessRule(rules []accessRule, client clientInfo) (accessRule, bool) {
+	for _, rule := range rules {
+		if rule.matches(client) {
+			return rule, true
+		}
+	}
+	return accessRule{}, false
+}
+
+// verifyCertificate checks that the client presented a certificate signed
+// by the client CA and issued to the user, as the cert method does
+func verifyCertificate(client clientInfo) error {
+	if client.tls == nil || len(client.tls.VerifiedChains) == 0 {
+		return newAuthError("28000", "connection requires a valid client certificate")
+	}
+	if cn := client.tls.PeerCertificates[0].Subject.CommonName; cn != client.user {
+		return newAuthError("28000", "certificate authentication failed for user %q", client.user)
+	}
+	return nil
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"net"
+	"testing"
+)
+
+func TestParseAccessRules(t *testing.T) {
+	rules, err := parseAccessRules(nil, authMethodMD5)
+	if err != nil || len(rules) != 1 || !rules[0].matches(clientInfo{user: "any", database: "any"}) || rules[0].method != authMethodMD5 {
+		t.Errorf("Expected a single rule with the default method, got %+v, %v", rules, err)
+	}
+
+	rules, err = parseAccessRules([]AccessRuleConfig{
+		{Address: "192.168.1.7", Method: "scram"},
+		{Type: "hostssl", Address: "::1/128", Database: "sales, hr", User: "alice,bob", Method: "cert"},
+	}, authMethodSCRAM)
+	if err != nil {
+		t.Fatalf("Failed to parse rules: %v", err)
+	}
+	if rules[0].method != authMethodSCRAM || rules[0].network.String() != "192.168.1.7/32" {
+		t.Errorf("Unexpected rule %+v", rules[0])
+	}
+	if !rules[1].databases["hr"] || !rules[1].users["bob"] || rules[1].network.String() != "::1/128" {
+		t.Errorf("Unexpected rule %+v", rules[1])
+	}
+
+	for _, invalid := range []AccessRuleConfig{
+		{Method: "ident"},
+		{Address: "10.0.0.0/8"},
+		{Address: "10.0.0/8", Method: "trust"},
+		{Type: "local", Method: "trust"},
+		{Method: "cert"},
+	} {
+		if _, err := parseAccessRules([]AccessRuleConfig{invalid}, authMethodSCRAM); err == nil {
+			t.Errorf("Expected %+v to be rejected", invalid)
+		}
+	}
+}
+
+func TestMatchAccessRule(t *testing.T) {
+	rules, err := parseAccessRules([]AccessRuleConfig{
+		{Address: "10.1.0.0/16", Method: "reject"},
+		{Type: "hostssl", Address: "10.0.0.0/8", User: "admin", Method: "cert"},
+		{Type: "hostnossl", Address: "10.0.0.0/8", Method: "reject"},
+		{Address: "10.0.0.0/8", Database: "sameuser,reports", Method: "scram-sha-256"},
+		{Address: "127.0.0.1", Method: "trust"},
+	}, authMethodSCRAM)
+	if err != nil {
+		t.Fatalf("Failed to parse rules: %v", err)
+	}
+
+	secure := &tls.ConnectionState{}
+	tests := []struct {
+		client clientInfo
+		method string
+	}{
+		{clientInfo{user: "app", database: "app", addr: net.ParseIP("10.1.2.3"), tls: secure}, authMethodReject},
+		{clientInfo{user: "admin", database: "app", addr: net.ParseIP("10.2.0.1"), tls: secure}, authMethodCert},
+		{clientInfo{user: "admin", database: "app", addr: net.ParseIP("10.2.0.1")}, authMethodReject},
+		{clientInfo{user: "app", database: "app", addr: net.ParseIP("10.2.0.1"), tls: secure}, authMethodSCRAM},
+		{clientInfo{user: "app", database: "reports", addr: net.ParseIP("10.2.0.1"), tls: secure}, authMethodSCRAM},
+		{clientInfo{user: "app", database: "other", addr: net.ParseIP("10.2.0.1"), tls: secure}, ""},
+		{clientInfo{user: "app", database: "other", addr: net.ParseIP("::ffff:127.0.0.1")}, authMethodTrust},
+		{clientInfo{user: "app", database: "other", addr: net.ParseIP("192.168.0.1")}, ""},
+	}
+	for _, tt := range tests {
+		rule, ok := matchAccessRule(rules, tt.client)
+		if got := rule.method; !ok && tt.method != "" || ok && got != tt.method {
+			t.Errorf("%+v: got %q (%v), want %q", tt.client, got, ok, tt.method)
+		}
+	}
+}
+
+func TestAuthorize(t *testing.T) {
+	auth, err := NewAuthenticator(AuthenticationConfig{Users: []UserConfig{
+		{Name: "alice", Password: "secret", Databases: []string{"sales"}},
+		{Name: "admin", Password: "secret", Privilege: "ddl"},
+	}}, []AccessRuleConfig{
+		{Type: "hostssl", User: "admin", Method: "cert"},
+		{Address: "127.0.0.1", Method: "trust"},
+		{Address: "10.0.0.0/8", Method: "reject"},
+		{Address: "192.168.0.0/16", Method: "scram-sha-256"},
+	})
+	if err != nil {
+		t.Fatalf("Failed to create authenticator: %v", err)
+	}
+
+	certificate := func(name string) *tls.ConnectionState {
+		cert := &x509.Certificate{Subject: pkix.Name{CommonName: name}}
+		return &tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}, VerifiedChains: [][]*x509.Certificate{{cert}}}
+	}
+	local, remote, blocked := net.ParseIP("127.0.0.1"), net.ParseIP("192.168.1.1"), net.ParseIP("10.0.0.1")
+
+	tests := []struct {
+		client   clientInfo
+		password string // answers SCRAM
+		code     string // expected error, empty for success
+		exchange string
+	}{
+		{clientInfo{user: "alice", database: "sales", addr: local}, "", "", "[0]"},
+		{clientInfo{user: "alice", database: "hr", addr: local}, "", "42501", "[0]"},
+		{clientInfo{user: "mallory", database: "sales", addr: local}, "", "28000", "[]"},
+		{clientInfo{user: "alice", database: "sales", addr: blocked}, "", "28000", "[]"},
+		{clientInfo{user: "alice", database: "sales", addr: net.ParseIP("172.16.0.1")}, "", "28000", "[]"},
+		{clientInfo{user: "alice", database: "sales", addr: remote}, "secret", "", "[10 11 12 0]"},
+		{clientInfo{user: "alice", database: "sales", addr: remote}, "wrong", "28P01", "[10 11]"},
+		{clientInfo{user: "admin", database: "sales", addr: blocked, tls: certificate("admin")}, "", "", "[0]"},
+		{clientInfo{user: "admin", database: "sales", addr: blocked, tls: certificate("alice")}, "", "28000", "[]"},
+		{clientInfo{user: "admin", database: "sales", addr: blocked, tls: &tls.ConnectionState{}}, "", "28000", "[]"},
+	}
+	for _, tt := range tests {
+		client := &scramClient{password: tt.password}
+		conn := &scriptedAuthConn{respond: client.respond}
+		user, err := auth.authorize(conn, tt.client)
+
+		code := ""
+		if err != nil {
+			authErr, ok := err.(*authError)
+			if !ok {
+				t.Errorf("%+v: unexpected error %v", tt.client, err)
+				continue
+			}
+			code = authErr.code
+		} else if user.Name != tt.client.user {
+			t.Errorf("%+v: authorized as %s", tt.client, user.Name)
+		}
+		if code != tt.code || fmt.Sprint(conn.codes) != tt.exchange {
+			t.Errorf("%+v: got %q after %v, want %q after %s", tt.client, code, conn.codes, tt.code, tt.exchange)
+		}
+	}
+
+	// A rule requiring SCRAM cannot apply to a user with an MD5 verifier
+	_, err = NewAuthenticator(AuthenticationConfig{Users: []UserConfig{
+		{Name: "legacy", Password: "md5" + md5Hex("secret", "legacy")},
+	}}, []AccessRuleConfig{{User: "legacy", Method: "md5"}, {Method: "scram-sha-256"}})
+	if err == nil {
+		t.Error("Expected an MD5 verifier under a SCRAM rule to be rejected")
+	}
+}
@@ -0,0 +1,337 @@
+package main
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// tokenKind classifies a lexical token of a PostgreSQL statement
+type tokenKind int
+
+const (
+	tokenWhitespace  tokenKind = iota
+	tokenComment               // -- line or /* block */ comment
+	tokenIdent                 // unquoted identifier or keyword
+	tokenQuotedIdent           // "identifier"
+	tokenString                // 'string', E'string', $tag$string$tag$
+	tokenNumber                // numeric literal
+	tokenParam                 // $1 placeholder
+	tokenPunct                 // operators and punctuation
+)
+
+// token is a single lexical element; Text holds the exact source text so
+// joining all tokens reproduces the original statement
+type token struct {
+	Kind tokenKind
+	Text string
+}
+
+// is reports whether the token is the given keyword (case-insensitive)
+func (t token) is(keyword string) bool {
+	return t.Kind == tokenIdent && strings.EqualFold(t.Text, keyword)
+}
+
+// isPunct reports whether the token is the given operator or punctuation
+func (t token) isPunct(punct string) bool {
+	return t.Kind == tokenPunct && t.Text == punct
+}
+
+// significant reports whether the token carries meaning (not whitespace or a comment)
+func (t token) significant() bool {
+	return t.Kind != tokenWhitespace && t.Kind != tokenComment
+}
+
+// name returns the identifier the token refers to, unquoting and folding case
+// the way PostgreSQL does
+func (t token) name() string {
+	if t.Kind == tokenQuotedIdent {
+		return strings.ReplaceAll(t.Text[1:len(t.Text)-1], `""`, `"`)
+	}
+	return strings.ToLower(t.Text)
+}
+
+// tokenize splits a statement into tokens following PostgreSQL's lexical rules
+func tokenize(query string) []token {
+	var tokens []token
+	for i := 0; i < len(query); {
+		kind, end := scanToken(query, i)
+		tokens = append(tokens, token{Kind: kind, Text: query[i:end]})
+		i = end
+	}
+	return tokens
+}
+
+// joinTokens reassembles tokens into statement text
+func joinTokens(tokens []token) string {
+	var sb strings.Builder
+	for _, t := range tokens {
+		sb.WriteString(t.Text)
+	}
+	return sb.String()
+}
+
+// significantTokens filters out whitespace and comments
+func significantTokens(tokens []token) []token {
+	result := make([]token, 0, len(tokens))
+	for _, t := range tokens {
+		if t.significant() {
+			result = append(result, t)
+		}
+	}
+	return result
+}
+
+// splitTopLevel splits tokens at commas outside parentheses
+func splitTopLevel(tokens []token) [][]token {
+	var parts [][]token
+	depth := 0
+	start := 0
+	for i, t := range tokens {
+		switch {
+		case t.isPunct("("):
+			depth++
+		case t.isPunct(")"):
+			depth--
+		case t.isPunct(",") && depth == 0:
+			parts = append(parts, tokens[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, tokens[start:])
+}
+
+// matchingParen returns the index of the parenthesis closing the one at open, or -1
+func matchingParen(tokens []token, open int) int {
+	depth := 0
+	for i := open; i < len(tokens); i++ {
+		switch {
+		case tokens[i].isPunct("("):
+			depth++
+		case tokens[i].isPunct(")"):
+			depth--
+			if depth == 0 {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+// splitStatements splits a query string into its statements at top-level
+// semicolons. Comments around statements and empty statements are dropped.
+// The body of a SQLite CREATE TRIGGER holds statements of its own, so
+// semicolons between its BEGIN and END do not split.
+func splitStatements(query string) []string {
+	var statements []string
+	var current []token
+	trigger := false
+	depth := 0
+	flush := func() {
+		if trimmed := trimTokens(current); len(trimmed) > 0 {
+			statements = append(statements, joinTokens(trimmed))
+		}
+		current = current[:0]
+		trigger = false
+		depth = 0
+	}
+
+	for _, t := range tokenize(query) {
+		switch {
+		case t.isPunct(";") && depth == 0:
+			flush()
+			continue
+		case t.is("TRIGGER") && firstKeyword(joinTokens(current)) == "CREATE":
+			trigger = true
+		case trigger && (t.is("BEGIN") || t.is("CASE")):
+			depth++
+		case trigger && t.is("END") && depth > 0:
+			depth--
+		}
+		current = append(current, t)
+	}
+	flush()
+	return statements
+}
+
+// firstKeyword returns the upper-cased leading keyword of a statement
+func firstKeyword(query string) string {
+	for _, t := range tokenize(query) {
+		if !t.significant() {
+			continue
+		}
+		if t.Kind == tokenIdent {
+			return strings.ToUpper(t.Text)
+		}
+		return ""
+	}
+	return ""
+}
+
+const operatorChars = "+-*/<>=~!@#%^&|`?"
+
+// scanToken returns the kind and end offset of the token starting at i
+func scanToken(s string, i int) (tokenKind, int) {
+	c := s[i]
+	switch {
+	case c == '-' && strings.HasPrefix(s[i:], "--"):
+		end := strings.IndexByte(s[i:], '\n')
+		if end < 0 {
+			return tokenComment, len(s)
+		}
+		return tokenComment, i + end + 1
+	case c == '/' && strings.HasPrefix(s[i:], "/*"):
+		return tokenComment, scanBlockComment(s, i)
+	case c == '\'':
+		return tokenString, scanQuoted(s, i, '\'', false)
+	case c == '"':
+		return tokenQuotedIdent, scanQuoted(s, i, '"', false)
+	case (c == 'e' || c == 'E') && i+1 < len(s) && s[i+1] == '\'':
+		return tokenString, scanQuoted(s, i+1, '\'', true)
+	case (c == 'b' || c == 'B' || c == 'x' || c == 'X' || c == 'n' || c == 'N') && i+1 < len(s) && s[i+1] == '\'':
+		return tokenString, scanQuoted(s, i+1, '\'', false)
+	case c == '$':
+		if i+1 < len(s) && isDigit(s[i+1]) {
+			end := i + 1
+			for end < len(s) && isDigit(s[end]) {
+				end++
+			}
+			return tokenParam, end
+		}
+		if end, ok := scanDollarQuoted(s, i); ok {
+			return tokenString, end
+		}
+		return tokenPunct, i + 1
+	case isDigit(c) || (c == '.' && i+1 < len(s) && isDigit(s[i+1])):
+		return tokenNumber, scanNumber(s, i)
+	case c == ':' && i+1 < len(s) && s[i+1] == ':':
+		return tokenPunct, i + 2
+	case strings.IndexByte(operatorChars, c) >= 0:
+		end := i + 1
+		for end < len(s) && strings.IndexByte(operatorChars, s[end]) >= 0 {
+			if strings.HasPrefix(s[end:], "--") || strings.HasPrefix(s[end:], "/*") {
+				break
+			}
+			end++
+		}
+		return tokenPunct, end
+	}
+
+	r, size := utf8.DecodeRuneInString(s[i:])
+	switch {
+	case unicode.IsSpace(r):
+		end := i + size
+		for end < len(s) {
+			r, size := utf8.DecodeRuneInString(s[end:])
+			if !unicode.IsSpace(r) {
+				break
+			}
+			end += size
+		}
+		return tokenWhitespace, end
+	case isIdentStart(r):
+		end := i + size
+		for end < len(s) {
+			r, size := utf8.DecodeRuneInString(s[end:])
+			if !isIdentStart(r) && !unicode.IsDigit(r) && r != '$' {
+				break
+			}
+			end += size
+		}
+		return tokenIdent, end
+	default:
+		return tokenPunct, i + size
+	}
+}
+
+// scanQuoted scans a quoted string or identifier starting at the opening quote;
+// a doubled quote is an escaped quote, backslashes escape in E-prefixed strings
+func scanQuoted(s string, i int, quote byte, backslashes bool) int {
+	for j := i + 1; j < len(s); j++ {
+		switch s[j] {
+		case '\\':
+			if backslashes {
+				j++
+			}
+		case quote:
+			if j+1 < len(s) && s[j+1] == quote {
+				j++
+				continue
+			}
+			return j + 1
+		}
+	}
+	return len(s)
+}
+
+// scanBlockComment scans a (possibly nested) block comment
+func scanBlockComment(s string, i int) int {
+	depth := 0
+	for j := i; j < len(s)-1; j++ {
+		switch {
+		case s[j] == '/' && s[j+1] == '*':
+			depth++
+			j++
+		case s[j] == '*' && s[j+1] == '/':
+			depth--
+			j++
+			if depth == 0 {
+				return j + 1
+			}
+		}
+	}
+	return len(s)
+}
+
+// scanDollarQuoted scans a $tag$...$tag$ string
+func scanDollarQuoted(s string, i int) (int, bool) {
+	j := i + 1
+	for j < len(s) && s[j] != '$' {
+		r, size := utf8.DecodeRuneInString(s[j:])
+		if !isIdentStart(r) && !(j > i+1 && unicode.IsDigit(r)) {
+			return 0, false
+		}
+		j += size
+	}
+	if j >= len(s) {
+		return 0, false
+	}
+	tag := s[i : j+1]
+	end := strings.Index(s[j+1:], tag)
+	if end < 0 {
+		return len(s), true
+	}
+	return j + 1 + end + len(tag), true
+}
+
+// scanNumber scans an integer or decimal literal with an optional exponent
+func scanNumber(s string, i int) int {
+	j := i
+	for j < len(s) && (isDigit(s[j]) || s[j] == '.' || s[j] == '_') {
+		if s[j] == '.' && j+1 < len(s) && s[j+1] == '.' {
+			break
+		}
+		j++
+	}
+	if j < len(s) && (s[j] == 'e' || s[j] == 'E') {
+		k := j + 1
+		if k < len(s) && (s[k] == '+' || s[k] == '-') {
+			k++
+		}
+		if k < len(s) && isDigit(s[k]) {
+			j = k
+			for j < len(s) && isDigit(s[j]) {
+				j++
+			}
+		}
+	}
+	return j
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func isIdentStart(r rune) bool {
+	return r == '_' || unicode.IsLetter(r)
+}
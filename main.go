@@ -1,11 +1,15 @@
 package main
 
 import (
+	"bufio"
 	"context"
 	"fmt"
+	"io"
 	"log"
+	"net"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 	"time"
 
@@ -13,11 +17,38 @@ import (
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "encrypt-password" {
+		if err := runEncryptPassword(); err != nil {
+			log.Fatalf("FATAL: %v", err)
+		}
+		return
+	}
+
 	if err := run(); err != nil {
 		log.Fatalf("FATAL: Server error: %v", err)
 	}
 }
 
+// runEncryptPassword prints the SCRAM-SHA-256 verifier of the password
+// read from stdin, for use as server.authentication.password
+func runEncryptPassword() error {
+	password, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return fmt.Errorf("failed to read password: %w", err)
+	}
+	password = strings.TrimRight(password, "\r\n")
+	if password == "" {
+		return fmt.Errorf("empty password")
+	}
+
+	verifier, err := encryptPassword(password)
+	if err != nil {
+		return err
+	}
+	fmt.Println(verifier)
+	return nil
+}
+
 func run() error {
 	// Load configuration
 	configPath := os.Getenv("CONFIG_PATH")
@@ -35,7 +66,7 @@ func run() error {
 
 	log.Printf("INFO: Starting PostgreSQL Wire Protocol Server")
 	log.Printf("INFO: Storage backend: %s", config.Storage.Backend)
-	log.Printf("INFO: Database: %s", config.Database.Name)
+	log.Printf("INFO: Default database: %s", config.Database.Name)
 
 	// Create blob storage backend
 	storage, err := NewBlobStorage(config)
@@ -43,78 +74,63 @@ func run() error {
 		return fmt.Errorf("failed to create storage backend: %w", err)
 	}
 
-	// Create database cache
-	cache := NewDatabaseCache(storage, config.Database.Name, config.Storage.CacheTTLMinutes)
-	defer func() {
-		if err := cache.Cleanup(); err != nil {
-			log.Printf("WARN: Failed to cleanup cache: %v", err)
+	// Listen for client connections
+	addr := fmt.Sprintf("%s:%d", config.Server.Host, config.Server.Port)
+	tcpListener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %w", addr, err)
+	}
+	listener := NewProtocolListener(tcpListener)
+	if config.Server.TLS.CertFile != "" {
+		if err := listener.EnableTLS(config.Server.TLS); err != nil {
+			return fmt.Errorf("failed to configure TLS: %w", err)
 		}
-	}()
-
-	// Download database from blob storage
-	log.Printf("INFO: Downloading database from blob storage...")
-	ctx := context.Background()
-	if err := cache.Download(ctx); err != nil {
-		return fmt.Errorf("failed to download database: %w", err)
+		log.Printf("INFO: TLS enabled (minimum version %s, required: %v)", config.Server.TLS.MinVersion, config.Server.TLS.Required)
+	} else if config.Server.TLS.Required {
+		return fmt.Errorf("server.tls.required is set without a certificate")
 	}
-	log.Printf("INFO: Database downloaded to: %s", cache.GetLocalPath())
 
-	// Create SQLite backend
-	backend, err := NewSQLiteBackend(
-		cache.GetLocalPath(),
-		config.Database.TransactionMode,
-		config.Database.ConnectionPoolSize,
-	)
+	// Route sessions to the database named at startup; other databases
+	// are downloaded on first connect
+	router, err := NewDatabaseRouter(storage, listener, config)
 	if err != nil {
-		return fmt.Errorf("failed to create SQLite backend: %w", err)
+		return fmt.Errorf("invalid database limits: %w", err)
 	}
-	defer backend.Close()
+	defer router.Close(context.Background())
 
-	// Create transaction manager
-	txManager := NewTransactionManager(backend, cache)
-	defer txManager.Stop()
-
-	// Create transaction monitor
-	txMonitor := NewTransactionMonitor()
+	// Download the default database from blob storage
+	ctx := context.Background()
+	if _, err := router.Open(ctx, config.Database.Name); err != nil {
+		return err
+	}
+	listener.OnCancel = router.Cancel
 
-	// Create wire handler
-	handler := NewSimpleWireHandler(backend, txManager, txMonitor, config)
+	// End transactions left idle past their timeout and close databases
+	// beyond the limits
+	reaperCtx, stopReaper := context.WithCancel(ctx)
+	defer stopReaper()
+	go router.RunIdleReaper(reaperCtx)
+	go router.RunEviction(reaperCtx)
 
-	// Setup server parameters
-	params := wire.Parameters{
-		wire.ParamServerVersion:  "13.0",
-		wire.ParamServerEncoding: "UTF8",
-		wire.ParamClientEncoding: "UTF8",
-		wire.ParameterStatus("DateStyle"):  "ISO, MDY",
-		wire.ParameterStatus("TimeZone"):   "UTC",
+	// Authenticate clients before psql-wire starts their sessions
+	authenticator, err := NewAuthenticator(config.Server.Authentication, config.Server.HBA)
+	if err != nil {
+		return fmt.Errorf("failed to configure authentication: %w", err)
 	}
-
-	// Create authentication strategy
-	authStrategy := wire.ClearTextPassword(func(username, password string) (bool, error) {
-		if username != config.Server.Authentication.User || password != config.Server.Authentication.Password {
-			return false, fmt.Errorf("authentication failed for user: %s", username)
-		}
-		log.Printf("INFO: User authenticated: %s", username)
-		return true, nil
-	})
+	listener.Authenticate = authenticator.Authenticate
 
 	// Create PostgreSQL wire server
-	server, err := wire.NewServer(
-		handler.ParseQuery,
-		wire.GlobalParameters(params),
-		wire.SessionAuthStrategy(authStrategy),
-	)
+	server, err := newWireServer(router)
 	if err != nil {
 		return fmt.Errorf("failed to create wire server: %w", err)
 	}
 
 	// Start server in a goroutine
-	addr := fmt.Sprintf("%s:%d", config.Server.Host, config.Server.Port)
 	log.Printf("INFO: Starting server on %s", addr)
 
 	errChan := make(chan error, 1)
 	go func() {
-		if err := server.ListenAndServe(addr); err != nil {
+		if err := server.Serve(listener); err != nil {
 			errChan <- fmt.Errorf("server listen error: %w", err)
 		}
 	}()
@@ -135,30 +151,47 @@ func run() error {
 			log.Printf("WARN: Error closing server: %v", err)
 		}
 
-		// Final upload to blob storage
+		// Final upload to blob storage; eviction must not close the
+		// databases at the same time
+		stopReaper()
 		log.Printf("INFO: Uploading final database state to blob storage...")
+		databases := router.Databases()
 		uploadCtx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
 		defer cancel()
-		if err := txManager.ForceUpload(uploadCtx); err != nil {
-			log.Printf("ERROR: Failed to upload database on shutdown: %v", err)
+		if err := router.Close(uploadCtx); err != nil {
+			log.Printf("ERROR: Failed to upload databases on shutdown: %v", err)
 		} else {
-			log.Printf("INFO: Database uploaded successfully")
+			log.Printf("INFO: %d database(s) uploaded successfully", len(databases))
 		}
 
 		// Print metrics
-		metrics := txMonitor.GetMetrics()
-		log.Printf("INFO: Transaction metrics:")
-		log.Printf("  - Total transactions: %d", metrics.TotalTransactions)
-		log.Printf("  - Committed: %d", metrics.CommittedTx)
-		log.Printf("  - Rolled back: %d", metrics.RolledBackTx)
-		log.Printf("  - Average duration: %v", metrics.AvgTxDuration)
-		log.Printf("  - Longest transaction: %v", metrics.LongestTx)
+		for _, db := range databases {
+			metrics := db.txMonitor.GetMetrics()
+			log.Printf("INFO: Transaction metrics for %s:", db.Name)
+			log.Printf("  - Total transactions: %d", metrics.TotalTransactions)
+			log.Printf("  - Committed: %d", metrics.CommittedTx)
+			log.Printf("  - Rolled back: %d", metrics.RolledBackTx)
+			log.Printf("  - Average duration: %v", metrics.AvgTxDuration)
+			log.Printf("  - Longest transaction: %v", metrics.LongestTx)
+		}
 
 		log.Printf("INFO: Server stopped")
 		return nil
 	}
 }
 
+// newWireServer creates the psql-wire server for the router's sessions. The
+// listener authenticates clients and reports the session parameters, so
+// psql-wire needs neither an authentication strategy nor parameters.
+func newWireServer(router *DatabaseRouter) (*wire.Server, error) {
+	return wire.NewServer(
+		router.ParseQuery,
+		wire.Statements(sessionStatements{}),
+		wire.Session(router.StartSession),
+		wire.TerminateConn(router.CloseSession),
+	)
+}
+
 func setupLogging(config LoggingConfig) {
 	// Setup log level and format
 	logFlags := log.Ldate | log.Ltime
@@ -0,0 +1,455 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lib/pq/oid"
+)
+
+// pgEpoch is the zero point of PostgreSQL's binary date and timestamp formats
+var pgEpoch = time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// Statement is a client statement prepared for execution on SQLite
+type Statement struct {
+	Name       string    // named prepared statement, empty when unnamed
+	Query      string    // statement text with $n rewritten to ?n
+	ParamTypes []oid.Oid // inferred type of each $n placeholder
+}
+
+// rewritePlaceholders rewrites PostgreSQL $n placeholders into SQLite ?n
+// placeholders and returns the number of parameters referenced
+func rewritePlaceholders(tokens []token) ([]token, int) {
+	count := 0
+	rewritten := make([]token, len(tokens))
+	for i, t := range tokens {
+		rewritten[i] = t
+		if t.Kind != tokenParam {
+			continue
+		}
+		n, err := strconv.Atoi(t.Text[1:])
+		if err != nil {
+			continue
+		}
+		if n > count {
+			count = n
+		}
+		rewritten[i].Text = "?" + t.Text[1:]
+	}
+	return rewritten, count
+}
+
+// columnTypeLookup resolves the declared SQLite type of a column; the
+// qualifier is the table name or alias, empty when unqualified
+type columnTypeLookup func(qualifier string, column string) (string, bool)
+
+// inferParameterTypes derives the type of each placeholder from the
+// surrounding statement: explicit casts, comparisons against columns,
+// INSERT column lists and LIMIT/OFFSET clauses. Anything else is text,
+// which is what PostgreSQL resolves an unknown parameter to.
+func inferParameterTypes(tokens []token, count int, lookup columnTypeLookup) []oid.Oid {
+	if count == 0 {
+		return nil
+	}
+
+	types := make([]oid.Oid, count)
+	for i := range types {
+		types[i] = oid.T_text
+	}
+
+	sig := significantTokens(tokens)
+	insertColumns := insertColumnPositions(sig)
+
+	for i, t := range sig {
+		if t.Kind != tokenParam {
+			continue
+		}
+		n, err := strconv.Atoi(t.Text[1:])
+		if err != nil || n < 1 || n > count {
+			continue
+		}
+
+		if sqliteType, ok := inferParameterType(sig, i, insertColumns, lookup); ok {
+			types[n-1] = PostgresTypeOID(SQLiteTypeToPostgres(sqliteType))
+		}
+	}
+	return types
+}
+
+// inferParameterType infers the SQLite type of the placeholder at sig[i]
+func inferParameterType(sig []token, i int, insertColumns map[int]string, lookup columnTypeLookup) (string, bool) {
+	// $1::type
+	if i+2 < len(sig) && sig[i+1].isPunct("::") {
+		return castTypeName(sig[i+2:]), true
+	}
+
+	// CAST($1 AS type)
+	if i >= 2 && i+2 < len(sig) && sig[i-1].isPunct("(") && sig[i-2].is("CAST") && sig[i+1].is("AS") {
+		return castTypeName(sig[i+2:]), true
+	}
+
+	if i >= 1 && (sig[i-1].is("LIMIT") || sig[i-1].is("OFFSET")) {
+		return "INTEGER", true
+	}
+
+	if i >= 1 && (sig[i-1].is("LIKE") || sig[i-1].is("ILIKE")) {
+		return "TEXT", true
+	}
+
+	// column <op> $1
+	if i >= 2 && isComparison(sig[i-1]) {
+		if qualifier, column, ok := columnReferenceBefore(sig, i-2); ok {
+			if sqliteType, ok := lookup(qualifier, column); ok {
+				return sqliteType, true
+			}
+		}
+	}
+
+	// $1 <op> column
+	if i+2 < len(sig) && isComparison(sig[i+1]) {
+		if qualifier, column, ok := columnReferenceAfter(sig, i+2); ok {
+			if sqliteType, ok := lookup(qualifier, column); ok {
+				return sqliteType, true
+			}
+		}
+	}
+
+	// column IN ($1, $2, ...)
+	if open := enclosingParen(sig, i); open >= 2 && sig[open-1].is("IN") {
+		if qualifier, column, ok := columnReferenceBefore(sig, open-2); ok {
+			if sqliteType, ok := lookup(qualifier, column); ok {
+				return sqliteType, true
+			}
+		}
+	}
+
+	// INSERT INTO t (a, b) VALUES ($1, $2)
+	if column, ok := insertColumns[i]; ok {
+		return lookup("", column)
+	}
+
+	return "", false
+}
+
+// castTypeName reads a (possibly multi-word) type name following :: or AS
+func castTypeName(sig []token) string {
+	var words []string
+	for _, t := range sig {
+		if t.Kind != tokenIdent && t.Kind != tokenQuotedIdent {
+			break
+		}
+		if len(words) > 0 && !isTypeNameContinuation(t) {
+			break
+		}
+		words = append(words, t.name())
+	}
+	return strings.Join(words, " ")
+}
+
+func isTypeNameContinuation(t token) bool {
+	for _, word := range []string{"precision", "varying", "with", "without", "time", "zone"} {
+		if t.is(word) {
+			return true
+		}
+	}
+	return false
+}
+
+func isComparison(t token) bool {
+	if t.Kind != tokenPunct {
+		return false
+	}
+	switch t.Text {
+	case "=", "<>", "!=", "<", ">", "<=", ">=":
+		return true
+	default:
+		return false
+	}
+}
+
+// columnReferenceBefore reads a [qualifier.]column reference ending at sig[end]
+func columnReferenceBefore(sig []token, end int) (string, string, bool) {
+	if end < 0 || !isIdentifierToken(sig[end]) {
+		return "", "", false
+	}
+	column := sig[end].name()
+	if end >= 2 && sig[end-1].isPunct(".") && isIdentifierToken(sig[end-2]) {
+		return sig[end-2].name(), column, true
+	}
+	return "", column, true
+}
+
+// columnReferenceAfter reads a [qualifier.]column reference starting at sig[start]
+func columnReferenceAfter(sig []token, start int) (string, string, bool) {
+	if start >= len(sig) || !isIdentifierToken(sig[start]) {
+		return "", "", false
+	}
+	if start+2 < len(sig) && sig[start+1].isPunct(".") && isIdentifierToken(sig[start+2]) {
+		return sig[start].name(), sig[start+2].name(), true
+	}
+	return "", sig[start].name(), true
+}
+
+func isIdentifierToken(t token) bool {
+	return t.Kind == tokenIdent || t.Kind == tokenQuotedIdent
+}
+
+// enclosingParen returns the index of the parenthesis enclosing sig[i], or -1
+func enclosingParen(sig []token, i int) int {
+	depth := 0
+	for j := i - 1; j >= 0; j-- {
+		switch {
+		case sig[j].isPunct(")"):
+			depth++
+		case sig[j].isPunct("("):
+			if depth == 0 {
+				return j
+			}
+			depth--
+		}
+	}
+	return -1
+}
+
+// insertColumnPositions maps the token index of each VALUES entry of an
+// INSERT with an explicit column list to the column it is inserted into
+func insertColumnPositions(sig []token) map[int]string {
+	positions := make(map[int]string)
+	if len(sig) == 0 || !sig[0].is("INSERT") {
+		return positions
+	}
+
+	// Column list
+	i := 0
+	for i < len(sig) && !sig[i].isPunct("(") {
+		if sig[i].is("VALUES") || sig[i].is("SELECT") {
+			return positions
+		}
+		i++
+	}
+	var columns []string
+	for i++; i < len(sig) && !sig[i].isPunct(")"); i++ {
+		if isIdentifierToken(sig[i]) {
+			columns = append(columns, sig[i].name())
+		}
+	}
+
+	for i < len(sig) && !sig[i].is("VALUES") {
+		i++
+	}
+
+	// Each VALUES tuple, tracking the position within the tuple
+	depth, position := 0, 0
+	for i++; i < len(sig); i++ {
+		switch {
+		case sig[i].isPunct("("):
+			depth++
+			if depth == 1 {
+				position = 0
+			}
+		case sig[i].isPunct(")"):
+			depth--
+		case sig[i].isPunct(",") && depth == 1:
+			position++
+		case depth == 1 && position < len(columns):
+			positions[i] = columns[position]
+		case depth == 0 && !sig[i].isPunct(","):
+			return positions
+		}
+	}
+	return positions
+}
+
+// statementTables returns the tables referenced by a statement keyed by
+// their alias (or their own name when not aliased)
+func statementTables(sig []token) map[string]string {
+	tables := make(map[string]string)
+	for i := 0; i < len(sig); i++ {
+		if !(sig[i].is("FROM") || sig[i].is("JOIN") || sig[i].is("UPDATE") || sig[i].is("INTO")) {
+			continue
+		}
+
+		j := i + 1
+		for j < len(sig) {
+			if !isIdentifierToken(sig[j]) {
+				break
+			}
+			table := sig[j].name()
+			j++
+			// schema.table
+			if j+1 < len(sig) && sig[j].isPunct(".") && isIdentifierToken(sig[j+1]) {
+				table = sig[j+1].name()
+				j += 2
+			}
+			alias := table
+			if j < len(sig) && sig[j].is("AS") {
+				j++
+			}
+			if j < len(sig) && sig[j].Kind == tokenIdent && !isClauseKeyword(sig[j]) {
+				alias = sig[j].name()
+				j++
+			}
+			tables[alias] = table
+			tables[table] = table
+
+			// FROM a, b
+			if j < len(sig) && sig[j].isPunct(",") && sig[i].is("FROM") {
+				j++
+				continue
+			}
+			break
+		}
+	}
+	return tables
+}
+
+func isClauseKeyword(t token) bool {
+	for _, keyword := range []string{"WHERE", "SET", "JOIN", "INNER", "LEFT", "RIGHT", "FULL", "CROSS", "ON", "USING",
+		"GROUP", "ORDER", "LIMIT", "OFFSET", "HAVING", "UNION", "EXCEPT", "INTERSECT", "VALUES", "SELECT",
+		"DEFAULT", "RETURNING", "NATURAL", "WINDOW", "FOR"} {
+		if t.is(keyword) {
+			return true
+		}
+	}
+	return false
+}
+
+// decodeParameter converts a bound parameter value in text (0) or binary (1)
+// format into a value SQLite can bind
+func decodeParameter(value string, typeOid oid.Oid, format int16) (interface{}, error) {
+	if format == 1 {
+		return decodeBinaryParameter([]byte(value), typeOid)
+	}
+
+	switch typeOid {
+	case oid.T_int2, oid.T_int4:
+		if n, err := strconv.ParseInt(strings.TrimSpace(value), 10, 32); err == nil {
+			return n, nil
+		}
+		return nil, fmt.Errorf("invalid input syntax for type integer: %q", value)
+	case oid.T_int8:
+		if n, err := strconv.ParseInt(strings.TrimSpace(value), 10, 64); err == nil {
+			return n, nil
+		}
+		return nil, fmt.Errorf("invalid input syntax for type bigint: %q", value)
+	case oid.T_float4, oid.T_float8:
+		f, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid input syntax for type double precision: %q", value)
+		}
+		return f, nil
+	case oid.T_bool:
+		b, err := parseBoolText(value)
+		if err != nil {
+			return nil, err
+		}
+		if b {
+			return int64(1), nil
+		}
+		return int64(0), nil
+	case oid.T_bytea:
+		return decodeByteaText(value)
+	default:
+		return value, nil
+	}
+}
+
+// decodeBinaryParameter decodes a parameter sent in binary format
+func decodeBinaryParameter(value []byte, typeOid oid.Oid) (interface{}, error) {
+	switch typeOid {
+	case oid.T_int2, oid.T_int4, oid.T_int8:
+		switch len(value) {
+		case 2:
+			return int64(int16(binary.BigEndian.Uint16(value))), nil
+		case 4:
+			return int64(int32(binary.BigEndian.Uint32(value))), nil
+		case 8:
+			return int64(binary.BigEndian.Uint64(value)), nil
+		}
+	case oid.T_float4, oid.T_float8:
+		switch len(value) {
+		case 4:
+			return float64(math.Float32frombits(binary.BigEndian.Uint32(value))), nil
+		case 8:
+			return math.Float64frombits(binary.BigEndian.Uint64(value)), nil
+		}
+	case oid.T_bool:
+		if len(value) == 1 {
+			return int64(value[0]), nil
+		}
+	case oid.T_bytea:
+		return value, nil
+	case oid.T_text, oid.T_varchar, oid.T_bpchar:
+		return string(value), nil
+	case oid.T_numeric:
+		return decodeBinaryNumeric(value)
+	case oid.T_uuid:
+		if len(value) == 16 {
+			return formatUUID(value), nil
+		}
+	case oid.T_timestamp, oid.T_timestamptz:
+		if len(value) == 8 {
+			micros := int64(binary.BigEndian.Uint64(value))
+			return pgEpoch.Add(time.Duration(micros) * time.Microsecond).Format("2006-01-02 15:04:05.999999"), nil
+		}
+	case oid.T_date:
+		if len(value) == 4 {
+			days := int32(binary.BigEndian.Uint32(value))
+			return pgEpoch.AddDate(0, 0, int(days)).Format("2006-01-02"), nil
+		}
+	default:
+		return nil, fmt.Errorf("binary format is not supported for type %d", typeOid)
+	}
+	return nil, fmt.Errorf("invalid binary value of %d bytes for type %d", len(value), typeOid)
+}
+
+// parseBoolText parses the boolean literals PostgreSQL accepts
+func parseBoolText(value string) (bool, error) {
+	switch strings.ToLower(strings.TrimSpace(value)) {
+	case "t", "true", "y", "yes", "on", "1":
+		return true, nil
+	case "f", "false", "n", "no", "off", "0":
+		return false, nil
+	default:
+		return false, fmt.Errorf("invalid input syntax for type boolean: %q", value)
+	}
+}
+
+// decodeByteaText decodes the hex (\x...) and escape bytea text formats
+func decodeByteaText(value string) ([]byte, error) {
+	if strings.HasPrefix(value, `\x`) {
+		b, err := hex.DecodeString(value[2:])
+		if err != nil {
+			return nil, fmt.Errorf("invalid hexadecimal data: %w", err)
+		}
+		return b, nil
+	}
+
+	var b []byte
+	for i := 0; i < len(value); i++ {
+		if value[i] != '\\' {
+			b = append(b, value[i])
+			continue
+		}
+		switch {
+		case i+1 < len(value) && value[i+1] == '\\':
+			b = append(b, '\\')
+			i++
+		case i+3 < len(value):
+			n, err := strconv.ParseUint(value[i+1:i+4], 8, 8)
+			if err != nil {
+				return nil, fmt.Errorf("invalid input syntax for type bytea")
+			}
+			b = append(b, byte(n))
+			i += 3
+		default:
+			return nil, fmt.Errorf("invalid input syntax for type bytea")
+		}
+	}
+	return b, nil
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	"github.com/lib/pq/oid"
+)
+
+func TestRewritePlaceholders(t *testing.T) {
+	tokens, count := rewritePlaceholders(tokenize(`SELECT '$1', "$2", $$ $3 $$, $1 + $12 -- $4`))
+	if got := joinTokens(tokens); got != `SELECT '$1', "$2", $$ $3 $$, ?1 + ?12 -- $4` {
+		t.Errorf("Unexpected rewrite: %s", got)
+	}
+	if count != 12 {
+		t.Errorf("Expected 12 parameters, got %d", count)
+	}
+}
+
+func TestInferParameterTypes(t *testing.T) {
+	columns := map[string]map[string]string{
+		"users": {"id": "INTEGER", "name": "TEXT", "score": "REAL", "active": "BOOLEAN"},
+	}
+	lookup := func(qualifier string, column string) (string, bool) {
+		declType, ok := columns["users"][column]
+		return declType, ok
+	}
+
+	tests := []struct {
+		query string
+		types []oid.Oid
+	}{
+		{"SELECT * FROM users WHERE id = $1 AND name = $2", []oid.Oid{oid.T_int8, oid.T_text}},
+		{"SELECT * FROM users u WHERE $1 < u.score LIMIT $2", []oid.Oid{oid.T_float8, oid.T_int8}},
+		{"INSERT INTO users (name, active, id) VALUES ($1, $2, $3)", []oid.Oid{oid.T_text, oid.T_bool, oid.T_int8}},
+		{"UPDATE users SET score = $2 WHERE id IN ($1, $3)", []oid.Oid{oid.T_int8, oid.T_float8, oid.T_int8}},
+		{"SELECT $1::bigint, CAST($2 AS double precision), $3", []oid.Oid{oid.T_int8, oid.T_float8, oid.T_text}},
+	}
+
+	for _, tt := range tests {
+		tokens, count := rewritePlaceholders(tokenize(tt.query))
+		types := inferParameterTypes(tokens, count, lookup)
+		if len(types) != len(tt.types) {
+			t.Errorf("%s: expected %d parameters, got %d", tt.query, len(tt.types), len(types))
+			continue
+		}
+		for i := range types {
+			if types[i] != tt.types[i] {
+				t.Errorf("%s: parameter $%d = %d; want %d", tt.query, i+1, types[i], tt.types[i])
+			}
+		}
+	}
+}
+
+func TestDecodeParameter(t *testing.T) {
+	int8Value := make([]byte, 8)
+	binary.BigEndian.PutUint64(int8Value, 42)
+	int4Value := make([]byte, 4)
+	binary.BigEndian.PutUint32(int4Value, 7)
+
+	tests := []struct {
+		value  string
+		oid    oid.Oid
+		format int16
+		want   interface{}
+	}{
+		{"42", oid.T_int8, 0, int64(42)},
+		{"1.5", oid.T_float8, 0, 1.5},
+		{"true", oid.T_bool, 0, int64(1)},
+		{"hello", oid.T_text, 0, "hello"},
+		{string(int8Value), oid.T_int8, 1, int64(42)},
+		{string(int4Value), oid.T_int8, 1, int64(7)},
+		{"\x01", oid.T_bool, 1, int64(1)},
+		{string(int4Value), oid.T_int4, 1, int64(7)},
+		{"\x00\x02\x00\x00\x40\x00\x00\x02\x00\x0c\x0d\x48", oid.T_numeric, 1, "-12.34"},
+		{"\x12\x34\x56\x78\x9a\xbc\xde\xf0\x12\x34\x56\x78\x9a\xbc\xde\xf0", oid.T_uuid, 1, "12345678-9abc-def0-1234-56789abcdef0"},
+	}
+
+	for _, tt := range tests {
+		got, err := decodeParameter(tt.value, tt.oid, tt.format)
+		if err != nil {
+			t.Errorf("decodeParameter(%q) failed: %v", tt.value, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("decodeParameter(%q) = %v (%T); want %v (%T)", tt.value, got, got, tt.want, tt.want)
+		}
+	}
+
+	bytea, err := decodeParameter(`\x0102ff`, oid.T_bytea, 0)
+	if err != nil || !bytes.Equal(bytea.([]byte), []byte{1, 2, 255}) {
+		t.Errorf("Unexpected bytea decode: %v, %v", bytea, err)
+	}
+
+	if _, err := decodeParameter("abc", oid.T_int8, 0); err == nil {
+		t.Error("Expected invalid integer to fail")
+	}
+}
@@ -0,0 +1,778 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+
+	"github.com/lib/pq/oid"
+)
+
+// protocolVersion3 is the protocol code carried by a v3 StartupMessage
+const protocolVersion3 = 196608
+
+// connectionParameter is the startup parameter carrying the ID the listener
+// gives every connection. psql-wire does not tell a session which connection
+// it serves, so the ID is added to the parameters the client sent.
+const connectionParameter = "pgblob.connection_id"
+
+// ProtocolListener wraps the server listener and keeps track of the
+// connections it hands out, so sessions can find their own connection
+type ProtocolListener struct {
+	net.Listener
+	mu     sync.Mutex
+	conns  map[string]*ProtocolConn
+	lastID uint64
+
+	// OnCancel receives the key of every CancelRequest. psql-wire closes
+	// the connection of a CancelRequest without reading the key.
+	OnCancel func(processID uint32, secretKey uint32)
+
+	// Authenticate verifies the client of a new connection before psql-wire
+	// reads its StartupMessage, as psql-wire's authentication strategies
+	// cannot be written outside its package. Without it every client is
+	// accepted.
+	Authenticate func(conn *ProtocolConn, client clientInfo) (*User, error)
+
+	// tls answers SSLRequests when set; psql-wire cannot reload
+	// certificates or refuse connections without TLS
+	tls        *certificateStore
+	requireTLS bool
+}
+
+// NewProtocolListener wraps a listener
+func NewProtocolListener(listener net.Listener) *ProtocolListener {
+	return &ProtocolListener{
+		Listener: listener,
+		conns:    make(map[string]*ProtocolConn),
+	}
+}
+
+// EnableTLS answers SSLRequests with the configured certificates and, when
+// required, refuses clients that do not ask for TLS
+func (l *ProtocolListener) EnableTLS(config TLSConfig) error {
+	store, err := newCertificateStore(config)
+	if err != nil {
+		return err
+	}
+	l.tls = store
+	l.requireTLS = config.Required
+	return nil
+}
+
+// Accept waits for the next connection and starts following its messages
+func (l *ProtocolListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	conn = &negotiatingConn{Conn: conn, store: l.tls, required: l.requireTLS}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.lastID++
+	pc := newProtocolConn(conn, l, strconv.FormatUint(l.lastID, 10))
+	l.conns[pc.id] = pc
+	return pc, nil
+}
+
+// Lookup returns the connection with the given ID
+func (l *ProtocolListener) Lookup(id string) *ProtocolConn {
+	if l == nil || id == "" {
+		return nil
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.conns[id]
+}
+
+func (l *ProtocolListener) remove(pc *ProtocolConn) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.conns[pc.id] == pc {
+		delete(l.conns, pc.id)
+	}
+}
+
+// statementMessage is a Parse or simple Query message
+type statementMessage struct {
+	Type       byte
+	Name       string
+	Query      string
+	ParamTypes []oid.Oid // types declared by a Parse, zero when unspecified
+}
+
+// bindMessage is a Bind message, kept as the portal it creates
+type bindMessage struct {
+	Portal        string
+	Statement     string
+	ParamFormats  []int16
+	Values        []string
+	Nulls         []bool
+	ResultFormats []int16
+}
+
+// maxMessageSize bounds a frontend message, as psql-wire's default message
+// buffer does
+const maxMessageSize = 1 << 24
+
+// ProtocolConn sits between a client and psql-wire. It hands psql-wire one
+// frontend message at a time; psql-wire handles a message completely before
+// it reads the next, so the backend messages it writes always answer the
+// message delivered last. The connection uses this to tell the handler what
+// psql-wire does not pass along, such as statement names and parameter
+// formats, and to correct what psql-wire cannot know.
+type ProtocolConn struct {
+	net.Conn
+	listener *ProtocolListener
+	id       string
+	reader   *bufio.Reader
+	user     *User // the authenticated user, nil without authentication
+
+	// The frontend side is only used on the goroutine psql-wire serves the
+	// connection on, which also writes psql-wire's backend messages
+	started    bool
+	pending    []byte           // rest of the message psql-wire is reading
+	msgType    byte             // type of the message psql-wire is handling
+	current    statementMessage // the Parse or Query psql-wire is handling
+	bind       *bindMessage     // the portal psql-wire is executing
+	described  *bindMessage     // the portal psql-wire is describing
+	statements map[string]statementMessage
+	portals    map[string]*bindMessage
+	failed     bool  // an extended query failed, discard until Sync
+	err        error // the error psql-wire is about to report
+
+	closeStatement func(name string)
+
+	mu        sync.Mutex
+	closeOnce sync.Once
+	onClose   func()
+
+	// The backend message stream is followed as well, to correct what
+	// psql-wire cannot know: the transaction status in ReadyForQuery and
+	// the result formats of a bound portal in RowDescription. The
+	// authentication and parameters it writes on startup are dropped, the
+	// connection and the session send their own. psql-wire also answers
+	// most messages with a ReadyForQuery, where a client expects one after
+	// startup and for each Query and Sync only; the others are dropped.
+	txStatus      func() TransactionStatus
+	out           []byte
+	ready         bool
+	awaitingReady bool
+}
+
+// newProtocolConn wraps an accepted connection
+func newProtocolConn(conn net.Conn, listener *ProtocolListener, id string) *ProtocolConn {
+	return &ProtocolConn{
+		Conn:     conn,
+		listener: listener,
+		id:       id,
+		reader:   bufio.NewReader(conn),
+	}
+}
+
+// User returns the user the client authenticated as, nil without
+// authentication
+func (c *ProtocolConn) User() *User {
+	if c == nil {
+		return nil
+	}
+	return c.user
+}
+
+// Read hands psql-wire the next frontend message
+func (c *ProtocolConn) Read(p []byte) (int, error) {
+	if len(c.pending) == 0 {
+		msg, err := c.nextMessage()
+		if err != nil {
+			return 0, err
+		}
+		c.pending = msg
+	}
+
+	n := copy(p, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+// nextMessage reads the client's messages until one is for psql-wire
+func (c *ProtocolConn) nextMessage() ([]byte, error) {
+	if !c.started {
+		c.started = true
+		return c.startup()
+	}
+
+	for {
+		msgType, body, err := c.ReadMessage()
+		if err != nil {
+			return nil, err
+		}
+		msg, err := c.frontend(msgType, body)
+		if err != nil {
+			return nil, err
+		}
+		if msg != nil {
+			return msg, nil
+		}
+	}
+}
+
+// ReadMessage reads a typed frontend message, for the exchanges psql-wire
+// does not handle itself such as authentication and COPY FROM STDIN
+func (c *ProtocolConn) ReadMessage() (byte, []byte, error) {
+	var header [5]byte
+	if _, err := io.ReadFull(c.reader, header[:]); err != nil {
+		return 0, nil, err
+	}
+
+	length := int(binary.BigEndian.Uint32(header[1:])) - 4
+	if length < 0 || length > maxMessageSize {
+		return 0, nil, fmt.Errorf("invalid message length %d from %s", length, c.RemoteAddr())
+	}
+	body := make([]byte, length)
+	if _, err := io.ReadFull(c.reader, body); err != nil {
+		return 0, nil, err
+	}
+	return header[0], body, nil
+}
+
+// startup reads the StartupMessage or CancelRequest, authenticates the
+// client and returns the packet psql-wire reads in its place
+func (c *ProtocolConn) startup() ([]byte, error) {
+	packet, err := readStartupPacket(c.reader)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &messageReader{data: packet[4:]}
+	switch code := uint32(r.int32()); code {
+	case cancelRequestCode:
+		processID, secretKey := uint32(r.int32()), uint32(r.int32())
+		if !r.failed && c.listener != nil && c.listener.OnCancel != nil {
+			c.listener.OnCancel(processID, secretKey)
+		}
+		return packet, nil
+	case protocolVersion3:
+	default:
+		c.WriteError("FATAL", "0A000", fmt.Sprintf("unsupported frontend protocol %d.%d: server supports 3.0", code>>16, code&0xffff))
+		return nil, fmt.Errorf("unsupported frontend protocol %d from %s", code, c.RemoteAddr())
+	}
+
+	client := clientInfo{tls: c.TLSState()}
+	if addr, ok := c.RemoteAddr().(*net.TCPAddr); ok {
+		client.addr = addr.IP
+	}
+	body := binary.BigEndian.AppendUint32(nil, protocolVersion3)
+	for {
+		name := r.cstring()
+		if name == "" || r.failed {
+			break
+		}
+		value := r.cstring()
+		switch name {
+		case "user":
+			client.user = value
+		case "database":
+			client.database = value
+		case connectionParameter:
+			continue
+		}
+		body = append(body, name+"\x00"+value+"\x00"...)
+	}
+	body = append(body, connectionParameter+"\x00"+c.id+"\x00\x00"...)
+	if client.database == "" {
+		// As in PostgreSQL, the database defaults to the user name
+		client.database = client.user
+	}
+
+	if c.listener != nil && c.listener.Authenticate != nil {
+		user, err := c.listener.Authenticate(c, client)
+		if err != nil {
+			return nil, err
+		}
+		c.user = user
+	} else if err := c.sendAuth(authOK, nil); err != nil {
+		return nil, err
+	}
+
+	c.awaitingReady = true
+	msg := binary.BigEndian.AppendUint32(nil, uint32(4+len(body)))
+	return append(msg, body...), nil
+}
+
+// sendAuth sends an AuthenticationRequest with its payload
+func (c *ProtocolConn) sendAuth(code int32, data []byte) error {
+	return c.writeMessage('R', append(binary.BigEndian.AppendUint32(nil, uint32(code)), data...))
+}
+
+// receivePassword reads the body of the client's password message, which
+// also carries SASL responses
+func (c *ProtocolConn) receivePassword() ([]byte, error) {
+	msgType, body, err := c.ReadMessage()
+	if err != nil {
+		return nil, err
+	}
+	if msgType != 'p' {
+		return nil, newAuthError("08P01", "expected password response, got message type %c", msgType)
+	}
+	return body, nil
+}
+
+// frontend handles a typed message before psql-wire sees it and returns the
+// message to deliver, nil for a message answered here. psql-wire keeps the
+// portals of all connections in one cache and cannot bind NULL or close
+// anything, so the connection binds, executes and closes itself.
+func (c *ProtocolConn) frontend(msgType byte, body []byte) ([]byte, error) {
+	// After an error in an extended query the messages up to the next
+	// Sync are discarded
+	if c.failed && msgType != 'S' && msgType != 'X' {
+		return nil, nil
+	}
+
+	c.msgType = msgType
+	c.current = statementMessage{}
+	c.bind, c.described = nil, nil
+	c.err = nil
+	c.awaitingReady = msgType == 'Q' || msgType == 'S'
+
+	r := &messageReader{data: body}
+	switch msgType {
+	case 'Q':
+		c.current = statementMessage{Type: 'Q', Query: r.cstring()}
+	case 'P':
+		name := r.cstring()
+		c.current = statementMessage{Type: 'P', Name: name, Query: r.cstring()}
+		count := int(r.int16())
+		for i := 0; i < count && !r.failed; i++ {
+			c.current.ParamTypes = append(c.current.ParamTypes, oid.Oid(r.int32()))
+		}
+	case 'B':
+		bind, ok := readBind(r)
+		if !ok {
+			return nil, c.extendedError("08P01", "invalid Bind message")
+		}
+		if _, ok := c.statements[bind.Statement]; !ok {
+			return nil, c.extendedError("26000", fmt.Sprintf("prepared statement %q does not exist", bind.Statement))
+		}
+		if c.portals == nil {
+			c.portals = make(map[string]*bindMessage)
+		}
+		c.portals[bind.Portal] = bind
+		return nil, c.writeMessage('2', nil)
+	case 'D':
+		switch kind, name := r.byte(), r.cstring(); kind {
+		case 'S':
+			if _, ok := c.statements[name]; !ok {
+				return nil, c.extendedError("26000", fmt.Sprintf("prepared statement %q does not exist", name))
+			}
+		case 'P':
+			bind, ok := c.portals[name]
+			if !ok {
+				return nil, c.extendedError("34000", fmt.Sprintf("portal %q does not exist", name))
+			}
+			// The portal's statement is described instead, with the
+			// result formats of the portal
+			c.described = bind
+			return encodeMessage('D', []byte("S"+bind.Statement+"\x00")), nil
+		default:
+			return nil, c.extendedError("08P01", "invalid Describe message")
+		}
+	case 'E':
+		name := r.cstring()
+		bind, ok := c.portals[name]
+		if !ok {
+			return nil, c.extendedError("34000", fmt.Sprintf("portal %q does not exist", name))
+		}
+		// psql-wire executes the portal as a Query of the statement's text;
+		// the handler runs the statement the portal is bound to
+		c.bind = bind
+		return encodeMessage('Q', []byte(c.statements[bind.Statement].Query+"\x00")), nil
+	case 'C':
+		switch kind, name := r.byte(), r.cstring(); kind {
+		case 'S':
+			delete(c.statements, name)
+			if c.closeStatement != nil {
+				c.closeStatement(name)
+			}
+		case 'P':
+			delete(c.portals, name)
+		}
+		return nil, c.writeMessage('3', nil)
+	case 'H':
+		// Every message is written as soon as it is complete
+		return nil, nil
+	case 'S':
+		c.failed = false
+	case 'd', 'c', 'f':
+		// Left over from a failed COPY, which PostgreSQL ignores as well
+		return nil, nil
+	}
+	return encodeMessage(msgType, body), nil
+}
+
+// extendedError answers an extended query message with an error; the
+// messages up to the next Sync are discarded
+func (c *ProtocolConn) extendedError(code string, message string) error {
+	c.failed = true
+	return c.WriteError("ERROR", code, message)
+}
+
+// readBind decodes the body of a Bind message
+func readBind(r *messageReader) (*bindMessage, bool) {
+	bind := &bindMessage{Portal: r.cstring(), Statement: r.cstring()}
+	bind.ParamFormats = r.int16s()
+	count := int(r.int16())
+	for i := 0; i < count && !r.failed; i++ {
+		length := r.int32()
+		if length < 0 {
+			bind.Values = append(bind.Values, "")
+			bind.Nulls = append(bind.Nulls, true)
+			continue
+		}
+		bind.Values = append(bind.Values, string(r.bytes(int(length))))
+		bind.Nulls = append(bind.Nulls, false)
+	}
+	bind.ResultFormats = r.int16s()
+	return bind, !r.failed
+}
+
+// reportError records the error the handler returns to psql-wire, whose
+// ErrorResponse leaves out the table, column and constraint names
+func (c *ProtocolConn) reportError(err error) {
+	if c == nil {
+		return
+	}
+	c.err = err
+}
+
+// statement returns the Parse or Query message psql-wire is handling
+func (c *ProtocolConn) statement() statementMessage {
+	if c == nil {
+		return statementMessage{}
+	}
+	return c.current
+}
+
+// portalBind returns the Bind of the portal psql-wire is executing, nil
+// outside an Execute
+func (c *ProtocolConn) portalBind() *bindMessage {
+	if c == nil {
+		return nil
+	}
+	return c.bind
+}
+
+// Write writes psql-wire's backend messages to the connection, correcting
+// them on the way
+func (c *ProtocolConn) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// Messages may span writes; they are passed on once complete
+	c.out = append(c.out, p...)
+	var out []byte
+	for len(c.out) >= 5 {
+		end := 1 + int(binary.BigEndian.Uint32(c.out[1:]))
+		if end < 5 || len(c.out) < end {
+			break
+		}
+		out = append(out, c.filterBackend(c.out[:end])...)
+		c.out = c.out[end:]
+	}
+
+	if len(out) > 0 {
+		if _, err := c.Conn.Write(out); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+// filterBackend corrects a complete backend message written by psql-wire,
+// returning nil to drop it
+func (c *ProtocolConn) filterBackend(msg []byte) []byte {
+	switch msg[0] {
+	case 'R', 'S':
+		// The connection authenticated the client and the session
+		// reports its own parameters
+		if !c.ready {
+			return nil
+		}
+	case 'Z':
+		if !c.awaitingReady {
+			return nil
+		}
+		if c.txStatus != nil && len(msg) == 6 {
+			msg[5] = c.txStatus().Indicator()
+		}
+		c.ready, c.awaitingReady = true, false
+	case 'E':
+		if c.msgType == 'P' || c.msgType == 'D' || c.msgType == 'E' {
+			c.failed = true
+		}
+		if c.err != nil {
+			msg = encodeError(c.err)
+			c.err = nil
+		}
+	case '1':
+		if c.statements == nil {
+			c.statements = make(map[string]statementMessage)
+		}
+		c.statements[c.current.Name] = c.current
+	case 't':
+		// A portal is described without its parameters
+		if c.described != nil {
+			return nil
+		}
+	case 'T':
+		// An Execute sends no RowDescription, unlike the Query psql-wire
+		// handles in its place
+		if c.msgType == 'E' {
+			return nil
+		}
+		if c.described != nil {
+			setResultFormats(msg[5:], c.described.ResultFormats)
+		}
+	}
+	return msg
+}
+
+// SetTransactionStatus sets the source of the status reported in
+// ReadyForQuery messages
+func (c *ProtocolConn) SetTransactionStatus(status func() TransactionStatus) {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.txStatus = status
+}
+
+// SetCloseStatement sets the function called when the client closes a
+// prepared statement; psql-wire ignores Close messages
+func (c *ProtocolConn) SetCloseStatement(closeStatement func(name string)) {
+	if c == nil {
+		return
+	}
+	c.closeStatement = closeStatement
+}
+
+// SetCloseHandler sets the function called once the connection is closed.
+// psql-wire only reports the client's Terminate, not a dropped connection.
+func (c *ProtocolConn) SetCloseHandler(onClose func()) {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.onClose = onClose
+}
+
+// setResultFormats sets the format codes of a RowDescription body
+func setResultFormats(body []byte, formats []int16) {
+	if len(formats) == 0 || len(body) < 2 {
+		return
+	}
+
+	count := int(binary.BigEndian.Uint16(body))
+	pos := 2
+	for i := 0; i < count; i++ {
+		end := bytes.IndexByte(body[pos:], 0)
+		if end < 0 {
+			return
+		}
+		pos += end + 1 + 16 // name, table OID, attribute, type OID, size, modifier
+		if pos+2 > len(body) {
+			return
+		}
+		binary.BigEndian.PutUint16(body[pos:], uint16(formatCode(formats, i)))
+		pos += 2
+	}
+}
+
+// Close closes the connection and ends its session
+func (c *ProtocolConn) Close() error {
+	err := c.Conn.Close()
+	c.closeOnce.Do(func() {
+		if c.listener != nil {
+			c.listener.remove(c)
+		}
+		c.mu.Lock()
+		onClose := c.onClose
+		c.mu.Unlock()
+		if onClose != nil {
+			onClose()
+		}
+	})
+	return err
+}
+
+// writeMessage sends a backend message to the client. psql-wire writes each
+// of its messages to the connection as it completes, so messages written
+// while a statement executes land in stream order with its own responses.
+func (c *ProtocolConn) writeMessage(msgType byte, body []byte) error {
+	if c == nil {
+		return nil
+	}
+	return c.writeRaw(encodeMessage(msgType, body))
+}
+
+// writeRaw writes encoded messages past the corrections of Write
+func (c *ProtocolConn) writeRaw(msg []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	_, err := c.Conn.Write(msg)
+	return err
+}
+
+// WriteParameterStatus sends a ParameterStatus message
+func (c *ProtocolConn) WriteParameterStatus(name string, value string) error {
+	return c.writeMessage('S', []byte(name+"\x00"+value+"\x00"))
+}
+
+// WriteBackendKeyData sends the key the client cancels statements with
+func (c *ProtocolConn) WriteBackendKeyData(processID uint32, secretKey uint32) error {
+	return c.writeMessage('K', binary.BigEndian.AppendUint32(binary.BigEndian.AppendUint32(nil, processID), secretKey))
+}
+
+// WriteError sends an ErrorResponse with the given severity, SQLSTATE code
+// and message
+func (c *ProtocolConn) WriteError(severity string, code string, message string) error {
+	if c == nil {
+		return nil
+	}
+	return c.writeRaw(errorResponse(severity, code, message))
+}
+
+// WriteNotice sends a NoticeResponse, which has the fields of an
+// ErrorResponse
+func (c *ProtocolConn) WriteNotice(severity string, code string, message string) error {
+	if c == nil {
+		return nil
+	}
+	notice := errorResponse(severity, code, message)
+	notice[0] = 'N'
+	return c.writeRaw(notice)
+}
+
+// encodeMessage encodes a typed protocol message
+func encodeMessage(msgType byte, body []byte) []byte {
+	msg := make([]byte, 5, 5+len(body))
+	msg[0] = msgType
+	binary.BigEndian.PutUint32(msg[1:], uint32(4+len(body)))
+	return append(msg, body...)
+}
+
+// errorField is a field of an ErrorResponse
+type errorField struct {
+	kind  byte
+	value string
+}
+
+// errorResponse encodes an ErrorResponse message
+func errorResponse(severity string, code string, message string) []byte {
+	return encodeErrorFields([]errorField{{'S', severity}, {'V', severity}, {'C', code}, {'M', message}})
+}
+
+// encodeErrorFields encodes an ErrorResponse with the fields that are set
+func encodeErrorFields(fields []errorField) []byte {
+	var body []byte
+	for _, field := range fields {
+		if field.value != "" {
+			body = append(append(append(body, field.kind), field.value...), 0)
+		}
+	}
+	return encodeMessage('E', append(body, 0))
+}
+
+// format returns the format code for a column or parameter; a single code
+// applies to all of them and no codes means text
+func formatCode(formats []int16, i int) int16 {
+	switch {
+	case len(formats) == 0:
+		return 0
+	case len(formats) == 1:
+		return formats[0]
+	case i < len(formats):
+		return formats[i]
+	default:
+		return 0
+	}
+}
+
+// messageReader decodes the fields of a protocol message body
+type messageReader struct {
+	data   []byte
+	failed bool
+}
+
+func (r *messageReader) byte() byte {
+	if len(r.data) < 1 {
+		r.failed = true
+		return 0
+	}
+	b := r.data[0]
+	r.data = r.data[1:]
+	return b
+}
+
+func (r *messageReader) int16() int16 {
+	if len(r.data) < 2 {
+		r.failed = true
+		return 0
+	}
+	v := int16(binary.BigEndian.Uint16(r.data))
+	r.data = r.data[2:]
+	return v
+}
+
+func (r *messageReader) int32() int32 {
+	if len(r.data) < 4 {
+		r.failed = true
+		return 0
+	}
+	v := int32(binary.BigEndian.Uint32(r.data))
+	r.data = r.data[4:]
+	return v
+}
+
+func (r *messageReader) int16s() []int16 {
+	count := int(r.int16())
+	values := make([]int16, 0, count)
+	for i := 0; i < count && !r.failed; i++ {
+		values = append(values, r.int16())
+	}
+	return values
+}
+
+func (r *messageReader) bytes(n int) []byte {
+	if n < 0 || len(r.data) < n {
+		r.failed = true
+		return nil
+	}
+	b := r.data[:n]
+	r.data = r.data[n:]
+	return b
+}
+
+func (r *messageReader) cstring() string {
+	end := bytes.IndexByte(r.data, 0)
+	if end < 0 {
+		r.failed = true
+		return ""
+	}
+	s := string(r.data[:end])
+	r.data = r.data[end+1:]
+	return s
+}
@@ -0,0 +1,454 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	_ "github.com/lib/pq"
+)
+
+// frontendMessage encodes a typed frontend message
+func frontendMessage(msgType byte, body []byte) []byte {
+	msg := []byte{msgType, 0, 0, 0, 0}
+	binary.BigEndian.PutUint32(msg[1:], uint32(len(body)+4))
+	return append(msg, body...)
+}
+
+// capturingConn is a net.Conn that records what the server writes
+type capturingConn struct {
+	net.Conn
+	written bytes.Buffer
+	closed  bool
+}
+
+func (c *capturingConn) Write(p []byte) (int, error) {
+	return c.written.Write(p)
+}
+
+func (c *capturingConn) Close() error {
+	c.closed = true
+	return nil
+}
+
+// backendMessages splits the bytes written by the server into message types
+// and bodies
+func backendMessages(data []byte) ([]byte, [][]byte) {
+	var types []byte
+	var bodies [][]byte
+	for len(data) >= 5 {
+		length := int(binary.BigEndian.Uint32(data[1:5]))
+		types = append(types, data[0])
+		bodies = append(bodies, data[5:1+length])
+		data = data[1+length:]
+	}
+	return types, bodies
+}
+
+func startupMessage() []byte {
+	body := make([]byte, 4)
+	binary.BigEndian.PutUint32(body, protocolVersion3)
+	body = append(body, "user\x00postgres\x00\x00"...)
+
+	msg := make([]byte, 4)
+	binary.BigEndian.PutUint32(msg, uint32(len(body)+4))
+	return append(msg, body...)
+}
+
+// startTestServer serves the databases in storage on a local port like run
+// does and returns its listener and address
+func startTestServer(t *testing.T, storage BlobStorage) (*ProtocolListener, string) {
+	t.Helper()
+
+	tcp, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	listener := NewProtocolListener(tcp)
+	router := newTestRouter(t, storage)
+	router.listener = listener
+	server, err := newWireServer(router)
+	if err != nil {
+		t.Fatalf("Failed to create server: %v", err)
+	}
+	go server.Serve(listener)
+	t.Cleanup(func() { server.Close() })
+	return listener, tcp.Addr().String()
+}
+
+// openTestClient opens a lib/pq client for the main database; userinfo is
+// a user name with an optional password
+func openTestClient(t *testing.T, addr string, userinfo string) *sql.DB {
+	t.Helper()
+
+	db, err := sql.Open("postgres", "postgres://"+userinfo+"@"+addr+"/main?sslmode=disable")
+	if err != nil {
+		t.Fatalf("Failed to open client: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+// serveTestDatabases starts a test server and returns a client for it
+func serveTestDatabases(t *testing.T, storage BlobStorage) *sql.DB {
+	t.Helper()
+
+	_, addr := startTestServer(t, storage)
+	return openTestClient(t, addr, "postgres")
+}
+
+// testClient speaks the frontend protocol to a test server
+type testClient struct {
+	t      *testing.T
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+// dialTestClient connects to a test server as postgres and reads until the
+// server is ready for queries
+func dialTestClient(t *testing.T, addr string) *testClient {
+	t.Helper()
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	client := &testClient{t: t, conn: conn, reader: bufio.NewReader(conn)}
+	startup := binary.BigEndian.AppendUint32(nil, protocolVersion3)
+	startup = append(startup, "user\x00postgres\x00database\x00main\x00\x00"...)
+	if _, err := conn.Write(append(binary.BigEndian.AppendUint32(nil, uint32(4+len(startup))), startup...)); err != nil {
+		t.Fatalf("Failed to send startup message: %v", err)
+	}
+	client.receive()
+	return client
+}
+
+// send writes a frontend message
+func (c *testClient) send(msgType byte, body string) {
+	c.t.Helper()
+	if _, err := c.conn.Write(frontendMessage(msgType, []byte(body))); err != nil {
+		c.t.Fatalf("Failed to send %c: %v", msgType, err)
+	}
+}
+
+// receive reads backend messages up to and including ReadyForQuery
+func (c *testClient) receive() ([]byte, [][]byte) {
+	c.t.Helper()
+	c.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var types []byte
+	var bodies [][]byte
+	for {
+		msgType, body := readDelivered(c.t, c.reader, true)
+		types = append(types, msgType)
+		bodies = append(bodies, body)
+		if msgType == 'Z' {
+			return types, bodies
+		}
+	}
+}
+
+// streamConn is a connection replaying a scripted client stream
+type streamConn struct {
+	capturingConn
+	stream io.Reader
+}
+
+func (c *streamConn) Read(p []byte) (int, error) {
+	return c.stream.Read(p)
+}
+
+func (c *streamConn) RemoteAddr() net.Addr {
+	return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)}
+}
+
+// readDelivered reads the next message a ProtocolConn hands psql-wire
+func readDelivered(t *testing.T, r *bufio.Reader, typed bool) (byte, []byte) {
+	t.Helper()
+	var msgType byte
+	if typed {
+		msgType, _ = r.ReadByte()
+	}
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(r, header); err != nil {
+		t.Fatalf("Failed to read delivered message: %v", err)
+	}
+	body := make([]byte, binary.BigEndian.Uint32(header)-4)
+	if _, err := io.ReadFull(r, body); err != nil {
+		t.Fatalf("Failed to read delivered message: %v", err)
+	}
+	return msgType, body
+}
+
+func TestProtocolConnFrontend(t *testing.T) {
+	var stream bytes.Buffer
+	spoofed := startupMessage()
+	spoofed = append(spoofed[:len(spoofed)-1], connectionParameter+"\x0099\x00\x00"...)
+	binary.BigEndian.PutUint32(spoofed, uint32(len(spoofed)))
+	stream.Write(spoofed)
+	stream.Write(frontendMessage('P', []byte("stmt1\x00SELECT ?1\x00\x00\x00")))
+
+	var bind bytes.Buffer
+	bind.WriteString("\x00stmt1\x00")
+	binary.Write(&bind, binary.BigEndian, []int16{1, 1}) // one binary format code
+	binary.Write(&bind, binary.BigEndian, int16(2))      // two parameters
+	binary.Write(&bind, binary.BigEndian, int32(4))
+	binary.Write(&bind, binary.BigEndian, int32(9))
+	binary.Write(&bind, binary.BigEndian, int32(-1))     // NULL
+	binary.Write(&bind, binary.BigEndian, []int16{1, 0}) // one text result format
+	stream.Write(frontendMessage('B', bind.Bytes()))
+	stream.Write(frontendMessage('D', []byte("P\x00")))
+	stream.Write(frontendMessage('E', []byte("\x00\x00\x00\x00\x00")))
+	stream.Write(frontendMessage('C', []byte("Sstmt1\x00")))
+	stream.Write(frontendMessage('B', []byte("\x00stmt1\x00\x00\x00\x00\x00\x00\x00")))
+	stream.Write(frontendMessage('E', []byte("\x00\x00\x00\x00\x00")))
+	stream.Write(frontendMessage('S', nil))
+	stream.Write(frontendMessage('Q', []byte("SELECT 1\x00")))
+
+	conn := &streamConn{stream: &stream}
+	pc := newProtocolConn(conn, nil, "7")
+	var closed []string
+	pc.SetCloseStatement(func(name string) { closed = append(closed, name) })
+	delivered := bufio.NewReader(pc)
+
+	// The connection ID replaces any the client sent, and the client is
+	// accepted without authentication
+	_, startup := readDelivered(t, delivered, false)
+	if !bytes.HasSuffix(startup, []byte(connectionParameter+"\x007\x00\x00")) || bytes.Contains(startup, []byte("99")) {
+		t.Errorf("Unexpected startup packet: %q", startup)
+	}
+
+	if msgType, _ := readDelivered(t, delivered, true); msgType != 'P' {
+		t.Fatalf("Expected Parse, got %c", msgType)
+	}
+	if msg := pc.statement(); msg.Type != 'P' || msg.Name != "stmt1" || msg.Query != "SELECT ?1" {
+		t.Errorf("Unexpected parse: %+v", msg)
+	}
+	pc.Write(frontendMessage('1', nil))
+
+	// The Bind is answered by the connection, the portal is described
+	// through its statement and executed as a Query of its text
+	msgType, body := readDelivered(t, delivered, true)
+	if msgType != 'D' || string(body) != "Sstmt1\x00" {
+		t.Fatalf("Expected the statement to be described, got %c %q", msgType, body)
+	}
+	msgType, body = readDelivered(t, delivered, true)
+	if msgType != 'Q' || string(body) != "SELECT ?1\x00" {
+		t.Fatalf("Expected the portal to be executed as a query, got %c %q", msgType, body)
+	}
+	got := pc.portalBind()
+	if got == nil {
+		t.Fatal("Expected the bind of the executed portal")
+	}
+	if got.Statement != "stmt1" || formatCode(got.ParamFormats, 1) != 1 || !got.Nulls[1] || len(got.ResultFormats) != 1 {
+		t.Errorf("Unexpected bind: %+v", got)
+	}
+
+	// After the statement is closed, binding it fails and the Execute is
+	// discarded up to the Sync
+	if msgType, _ := readDelivered(t, delivered, true); msgType != 'S' {
+		t.Fatalf("Expected Sync, got %c", msgType)
+	}
+	if len(closed) != 1 || closed[0] != "stmt1" {
+		t.Errorf("Expected stmt1 to be closed, got %v", closed)
+	}
+	readDelivered(t, delivered, true)
+	if msg := pc.statement(); msg.Type != 'Q' || msg.Query != "SELECT 1" || pc.portalBind() != nil {
+		t.Errorf("Unexpected query: %+v", msg)
+	}
+
+	types, bodies := backendMessages(conn.written.Bytes())
+	if string(types) != "R123E" || !bytes.Contains(bodies[4], []byte("26000")) {
+		t.Errorf("Unexpected messages: %q %q", types, bodies)
+	}
+}
+
+func TestReadyForQueryStatus(t *testing.T) {
+	conn := &capturingConn{}
+	pc := &ProtocolConn{Conn: conn}
+	status := TxInTransaction
+	pc.SetTransactionStatus(func() TransactionStatus { return status })
+
+	// psql-wire reports an idle session; messages may span writes
+	var stream bytes.Buffer
+	stream.Write(frontendMessage('C', []byte("INSERT 0 1\x00")))
+	stream.Write(frontendMessage('Z', []byte("I")))
+	data := stream.Bytes()
+	split := len(data) - 3
+	pc.frontend('Q', []byte("INSERT INTO t VALUES (1)\x00"))
+	for _, p := range [][]byte{data[:split], data[split:]} {
+		if _, err := pc.Write(p); err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+	}
+	if data[len(data)-1] != 'I' {
+		t.Error("Expected the caller's buffer to be left unchanged")
+	}
+
+	// Only a Sync is answered with ReadyForQuery, psql-wire answers the
+	// Parse of a failing statement as well
+	status = TxFailed
+	pc.frontend('P', []byte("\x00SELECT * FROM missing\x00\x00\x00"))
+	pc.Write(frontendMessage('E', []byte("SERROR\x00C42P01\x00\x00")))
+	pc.Write(frontendMessage('Z', []byte("I")))
+	pc.frontend('S', nil)
+	pc.Write(frontendMessage('Z', []byte("I")))
+	pc.Write(frontendMessage('Z', []byte("I")))
+
+	types, bodies := backendMessages(conn.written.Bytes())
+	if string(types) != "CZEZ" || string(bodies[1]) != "T" || string(bodies[3]) != "E" {
+		t.Errorf("Unexpected messages: %q %q", types, bodies)
+	}
+}
+
+func TestServer(t *testing.T) {
+	storage, err := NewLocalStorage(t.TempDir())
+	if err != nil {
+		t.Fatalf("Failed to create local storage: %v", err)
+	}
+	db := serveTestDatabases(t, storage)
+
+	if _, err := db.Exec("CREATE TABLE items (id INTEGER, name TEXT)"); err != nil {
+		t.Fatalf("Failed to create table: %v", err)
+	}
+	if _, err := db.Exec("INSERT INTO items VALUES ($1, $2)", 1, "one"); err != nil {
+		t.Fatalf("Failed to insert: %v", err)
+	}
+
+	// Every connection has its own session
+	conns := make([]*sql.Conn, 2)
+	for i := range conns {
+		if conns[i], err = db.Conn(context.Background()); err != nil {
+			t.Fatalf("Failed to connect: %v", err)
+		}
+		defer conns[i].Close()
+	}
+	if _, err := conns[0].ExecContext(context.Background(), "SET application_name = 'first'"); err != nil {
+		t.Fatalf("Failed to set: %v", err)
+	}
+	for i, want := range []string{"first", ""} {
+		var name string
+		if err := conns[i].QueryRowContext(context.Background(), "SHOW application_name").Scan(&name); err != nil || name != want {
+			t.Errorf("connection %d: expected application_name %q, got %q, %v", i, want, name, err)
+		}
+	}
+
+	var name string
+	if err := db.QueryRow("SELECT name FROM items WHERE id = $1", 1).Scan(&name); err != nil || name != "one" {
+		t.Errorf("Expected one, got %q, %v", name, err)
+	}
+}
+
+func TestTransactionStatusAfterSync(t *testing.T) {
+	storage, err := NewLocalStorage(t.TempDir())
+	if err != nil {
+		t.Fatalf("Failed to create local storage: %v", err)
+	}
+	_, addr := startTestServer(t, storage)
+	client := dialTestClient(t, addr)
+
+	client.send('Q', "BEGIN\x00")
+	if types, bodies := client.receive(); string(types) != "CZ" || string(bodies[1]) != "T" {
+		t.Errorf("Unexpected BEGIN response: %q %q", types, bodies)
+	}
+
+	// A failing Parse is answered with an error only, the Sync reports the
+	// failed transaction
+	client.send('P', "\x00SELECT * FROM missing\x00\x00\x00")
+	client.send('S', "")
+	if types, bodies := client.receive(); string(types) != "EZ" || string(bodies[1]) != "E" {
+		t.Errorf("Unexpected response to the failed statement: %q %q", types, bodies)
+	}
+
+	client.send('Q', "ROLLBACK\x00")
+	if types, bodies := client.receive(); string(types) != "CZ" || string(bodies[1]) != "I" {
+		t.Errorf("Unexpected ROLLBACK response: %q %q", types, bodies)
+	}
+}
+
+func TestNestedBegin(t *testing.T) {
+	storage, err := NewLocalStorage(t.TempDir())
+	if err != nil {
+		t.Fatalf("Failed to create local storage: %v", err)
+	}
+	_, addr := startTestServer(t, storage)
+	client := dialTestClient(t, addr)
+
+	client.send('Q', "CREATE TABLE items (id INTEGER)\x00")
+	client.receive()
+	client.send('Q', "BEGIN\x00")
+	client.receive()
+
+	// A second BEGIN warns and leaves the transaction usable
+	client.send('Q', "BEGIN\x00")
+	types, bodies := client.receive()
+	if string(types) != "NCZ" || !bytes.Contains(bodies[0], []byte("C25001\x00")) || string(bodies[2]) != "T" {
+		t.Errorf("Unexpected response to the nested BEGIN: %q %q", types, bodies)
+	}
+	client.send('Q', "INSERT INTO items VALUES (1)\x00")
+	if types, bodies := client.receive(); string(types) != "CZ" || string(bodies[1]) != "T" {
+		t.Errorf("Unexpected INSERT response: %q %q", types, bodies)
+	}
+	client.send('Q', "COMMIT\x00")
+	if types, bodies := client.receive(); string(types) != "CZ" || string(bodies[1]) != "I" {
+		t.Errorf("Unexpected COMMIT response: %q %q", types, bodies)
+	}
+}
+
+func TestExtendedQueries(t *testing.T) {
+	storage, err := NewLocalStorage(t.TempDir())
+	if err != nil {
+		t.Fatalf("Failed to create local storage: %v", err)
+	}
+	ctx := context.Background()
+	conn, err := serveTestDatabases(t, storage).Conn(ctx)
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer conn.Close()
+
+	if _, err := conn.ExecContext(ctx, "CREATE TABLE items (id INTEGER, name TEXT)"); err != nil {
+		t.Fatalf("Failed to create table: %v", err)
+	}
+
+	// NULL parameters are bound as NULL
+	if _, err := conn.ExecContext(ctx, "INSERT INTO items VALUES ($1, $2)", 1, nil); err != nil {
+		t.Fatalf("Failed to insert NULL: %v", err)
+	}
+	var name sql.NullString
+	if err := conn.QueryRowContext(ctx, "SELECT name FROM items WHERE id = $1", 1).Scan(&name); err != nil || name.Valid {
+		t.Errorf("Expected NULL, got %v, %v", name, err)
+	}
+
+	// The connection stays in step after an error
+	if _, err := conn.ExecContext(ctx, "INSERT INTO missing VALUES ($1)", 1); err == nil {
+		t.Error("Expected an error for a missing table")
+	}
+	var count int
+	if err := conn.QueryRowContext(ctx, "SELECT count(*) FROM items WHERE id = $1", 1).Scan(&count); err != nil || count != 1 {
+		t.Errorf("Expected a query after the error to succeed, got %d, %v", count, err)
+	}
+
+	// A prepared statement is executed until it is closed
+	stmt, err := conn.PrepareContext(ctx, "INSERT INTO items VALUES ($1, $2)")
+	if err != nil {
+		t.Fatalf("Failed to prepare: %v", err)
+	}
+	for i := 2; i <= 3; i++ {
+		if _, err := stmt.ExecContext(ctx, i, "item"); err != nil {
+			t.Fatalf("Failed to execute prepared statement: %v", err)
+		}
+	}
+	if err := stmt.Close(); err != nil {
+		t.Fatalf("Failed to close prepared statement: %v", err)
+	}
+	if err := conn.QueryRowContext(ctx, "SELECT count(*) FROM items").Scan(&count); err != nil || count != 3 {
+		t.Errorf("Expected 3 rows after closing the statement, got %d, %v", count, err)
+	}
+}
@@ -0,0 +1,537 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+// replicationInterval is how often the replicator ships the WAL besides
+// after each commit, which also covers statements outside transaction blocks
+const replicationInterval = time.Second
+
+// checkpointFrames is the WAL size in frames past which the replicator lets
+// SQLite checkpoint, SQLite's default wal_autocheckpoint
+const checkpointFrames = 1000
+
+// The WAL file format, see https://www.sqlite.org/fileformat.html#the_write_ahead_log
+const (
+	walHeaderSize      = 32
+	walFrameHeaderSize = 24
+	walMagic           = 0x377f0682 // the low bit selects big-endian checksums
+)
+
+// replicationSettings configure how databases are written to blob storage
+type replicationSettings struct {
+	wal              bool          // ship WAL segments instead of whole snapshots
+	snapshotInterval time.Duration // between snapshots when shipping the WAL, 0 disables
+}
+
+// parseReplicationSettings reads the replication settings of the storage
+// settings
+func parseReplicationSettings(config StorageConfig) (replicationSettings, error) {
+	var settings replicationSettings
+	switch strings.ToLower(config.Replication) {
+	case "", "snapshot":
+	case "wal":
+		settings.wal = true
+	default:
+		return replicationSettings{}, fmt.Errorf("invalid replication %q", config.Replication)
+	}
+	interval, err := parseTimeoutSetting(config.SnapshotInterval)
+	if err != nil {
+		return replicationSettings{}, fmt.Errorf("invalid snapshot_interval: %w", err)
+	}
+	settings.snapshotInterval = interval
+	return settings, nil
+}
+
+// Replicator ships the WAL of a database to blob storage: every call to Sync
+// uploads the frames committed since the previous one as the next numbered
+// segment on top of the last snapshot, and takes a new snapshot when due.
+//
+// Between calls the replicator holds a read transaction open. SQLite never
+// checkpoints frames past the oldest reader and only restarts the WAL, which
+// overwrites its frames, once every frame is checkpointed, so no frame is
+// lost before it is shipped. The replicator moves its read transaction
+// forward while it keeps writers out and after shipping every frame.
+type Replicator struct {
+	cache            *DatabaseCache
+	snapshotInterval time.Duration
+	db               *sql.DB   // outside the backend's pool, so clients cannot starve it
+	reader           *sql.Conn // holds the read transaction
+
+	header       []byte    // of the WAL being shipped, nil before the first frame
+	offset       int64     // of the first frame not shipped yet
+	checksum     [2]uint32 // of the frames up to offset
+	checkpointed int64     // offset of the last checkpoint
+	lastSnapshot time.Time
+}
+
+// NewReplicator starts replicating the database of cache
+func NewReplicator(ctx context.Context, cache *DatabaseCache, snapshotInterval time.Duration) (*Replicator, error) {
+	db, err := sql.Open("sqlite3", cache.GetLocalPath()+"?_journal_mode=WAL&_busy_timeout=5000")
+	if err != nil {
+		return nil, fmt.Errorf("failed to open database for replication: %w", err)
+	}
+	// The reader and a connection keeping writers out
+	db.SetMaxOpenConns(2)
+
+	reader, err := db.Conn(ctx)
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to open database for replication: %w", err)
+	}
+	r := &Replicator{
+		cache:            cache,
+		snapshotInterval: snapshotInterval,
+		db:               db,
+		reader:           reader,
+		lastSnapshot:     time.Now(),
+	}
+
+	unlock, err := r.lockWriters(ctx)
+	if err != nil {
+		r.Close()
+		return nil, err
+	}
+	defer unlock()
+	if err := r.beginRead(ctx); err != nil {
+		r.Close()
+		return nil, err
+	}
+	return r, nil
+}
+
+// Close ends the read transaction; the WAL must be shipped first
+func (r *Replicator) Close() error {
+	r.endRead(context.Background())
+	r.reader.Close()
+	return r.db.Close()
+}
+
+// Sync ships the frames committed since the last call and checkpoints the
+// WAL once it grew past checkpointFrames. It takes a snapshot instead when
+// none was uploaded yet, the snapshot interval passed or the segments to
+// replay outgrew the database.
+func (r *Replicator) Sync(ctx context.Context) error {
+	if r.snapshotDue() {
+		err := r.Snapshot(ctx)
+		if !writersBusy(err) {
+			return err
+		}
+		// A long write transaction holds the snapshot back; the WAL is
+		// shipped meanwhile
+	}
+	if err := r.ship(ctx); err != nil {
+		return err
+	}
+	if r.header != nil && r.offset != r.checkpointed && r.offset >= walHeaderSize+checkpointFrames*r.frameSize() {
+		return r.checkpoint(ctx)
+	}
+	return nil
+}
+
+// snapshotDue reports whether Sync should take a snapshot, which is also
+// when replaying the segments would download more than the snapshot
+func (r *Replicator) snapshotDue() bool {
+	if r.cache.generation == "" {
+		return true
+	}
+	if r.snapshotInterval > 0 && time.Since(r.lastSnapshot) >= r.snapshotInterval {
+		return true
+	}
+	return r.cache.segmentBytes > r.cache.snapshotBytes
+}
+
+// Snapshot ships the WAL and uploads a snapshot, which the following
+// segments apply to
+func (r *Replicator) Snapshot(ctx context.Context) error {
+	path := r.cache.snapshotPath()
+	if err := r.backup(ctx, path); err != nil {
+		return err
+	}
+	defer os.Remove(path)
+
+	// Frames shipped until the upload completes belong to the previous
+	// snapshot, which stays the latest if the upload fails
+	if err := verifySnapshot(ctx, path); err != nil {
+		return err
+	}
+	if err := r.cache.Upload(ctx, path); err != nil {
+		return err
+	}
+	r.lastSnapshot = time.Now()
+	log.Printf("INFO: Uploaded snapshot of database %s", r.cache.dbName)
+	return nil
+}
+
+// backup ships the WAL and copies the database to path while writers are
+// kept out, so that the copy holds exactly the frames shipped
+func (r *Replicator) backup(ctx context.Context, path string) (err error) {
+	unlock, err := r.lockWriters(ctx)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	if err := r.ship(ctx); err != nil {
+		return err
+	}
+	if err := r.endRead(ctx); err != nil {
+		return err
+	}
+	defer func() {
+		if readErr := r.beginRead(ctx); err == nil {
+			err = readErr
+		}
+	}()
+	return backupDatabase(r.reader, path)
+}
+
+// checkpoint ships the WAL and checkpoints it while writers are kept out.
+// Once every frame is checkpointed the next writer restarts the WAL.
+func (r *Replicator) checkpoint(ctx context.Context) (err error) {
+	unlock, err := r.lockWriters(ctx)
+	if writersBusy(err) {
+		return nil // retried at the next Sync
+	}
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	if err := r.ship(ctx); err != nil {
+		return err
+	}
+	if err := r.endRead(ctx); err != nil {
+		return err
+	}
+	defer func() {
+		if readErr := r.beginRead(ctx); err == nil {
+			err = readErr
+		}
+	}()
+
+	// Other readers may hold the checkpoint back; it is retried at the
+	// next Sync
+	var busy, logFrames, copied int
+	if err := r.reader.QueryRowContext(ctx, "PRAGMA main.wal_checkpoint(PASSIVE)").Scan(&busy, &logFrames, &copied); err != nil {
+		return fmt.Errorf("failed to checkpoint database: %w", err)
+	}
+	r.checkpointed = r.offset
+	return nil
+}
+
+// ship uploads the frames of the transactions committed after offset as the
+// next segment
+func (r *Replicator) ship(ctx context.Context) error {
+	file, err := os.Open(r.cache.GetLocalPath() + "-wal")
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to open WAL: %w", err)
+	}
+	defer file.Close()
+
+	header := make([]byte, walHeaderSize)
+	if _, err := file.ReadAt(header, 0); err != nil {
+		// Nothing written since the last checkpoint truncated the WAL
+		return nil
+	}
+	if !bytes.Equal(header, r.header) {
+		checksum, ok := walHeaderChecksum(header)
+		if !ok {
+			return nil // still being written
+		}
+		// SQLite restarted the WAL, which it only does once every frame
+		// was checkpointed; the read transaction ensures they were shipped
+		r.header, r.offset, r.checksum = header, walHeaderSize, checksum
+	}
+
+	end, checksum, err := r.scan(file)
+	if err != nil || end == r.offset {
+		return err
+	}
+	// Frames written before the first snapshot are part of it
+	if r.cache.generation != "" {
+		segment := make([]byte, walHeaderSize+end-r.offset)
+		copy(segment, r.header)
+		if _, err := file.ReadAt(segment[walHeaderSize:], r.offset); err != nil {
+			return fmt.Errorf("failed to read WAL: %w", err)
+		}
+		if err := r.cache.UploadSegment(ctx, segment); err != nil {
+			return err
+		}
+	}
+	r.offset, r.checksum = end, checksum
+	return nil
+}
+
+// scan follows the frames after offset as long as their checksums hold and
+// returns the end of the last commit frame and the checksum up to it
+func (r *Replicator) scan(file *os.File) (int64, [2]uint32, error) {
+	order := walByteOrder(r.header)
+	frame := make([]byte, r.frameSize())
+	end, endChecksum := r.offset, r.checksum
+	checksum := r.checksum
+	for offset := r.offset; ; offset += int64(len(frame)) {
+		if _, err := file.ReadAt(frame, offset); err == io.EOF {
+			break
+		} else if err != nil {
+			return 0, checksum, fmt.Errorf("failed to read WAL: %w", err)
+		}
+		// Frames left from before a restart carry other salts, and the
+		// checksum of a frame being written does not match
+		if !bytes.Equal(frame[8:16], r.header[16:24]) {
+			break
+		}
+		checksum = walChecksum(order, checksum, frame[:8])
+		checksum = walChecksum(order, checksum, frame[walFrameHeaderSize:])
+		if checksum[0] != binary.BigEndian.Uint32(frame[16:]) || checksum[1] != binary.BigEndian.Uint32(frame[20:]) {
+			break
+		}
+		if binary.BigEndian.Uint32(frame[4:]) != 0 {
+			end, endChecksum = offset+int64(len(frame)), checksum
+		}
+	}
+	return end, endChecksum, nil
+}
+
+// frameSize returns the size of the frames of the WAL being shipped
+func (r *Replicator) frameSize() int64 {
+	return walFrameHeaderSize + int64(binary.BigEndian.Uint32(r.header[8:]))
+}
+
+// beginRead starts the read transaction holding back checkpoints
+func (r *Replicator) beginRead(ctx context.Context) error {
+	if _, err := r.reader.ExecContext(ctx, "BEGIN"); err != nil {
+		return fmt.Errorf("failed to begin replication read: %w", err)
+	}
+	// SQLite takes the read lock on the first read
+	var tables int
+	if err := r.reader.QueryRowContext(ctx, "SELECT count(*) FROM main.sqlite_master").Scan(&tables); err != nil {
+		r.endRead(ctx)
+		return fmt.Errorf("failed to begin replication read: %w", err)
+	}
+	return nil
+}
+
+// endRead ends the read transaction
+func (r *Replicator) endRead(ctx context.Context) error {
+	if _, err := r.reader.ExecContext(ctx, "ROLLBACK"); err != nil {
+		return fmt.Errorf("failed to end replication read: %w", err)
+	}
+	return nil
+}
+
+// lockWriters keeps other connections from writing until the returned
+// function is called
+func (r *Replicator) lockWriters(ctx context.Context) (func(), error) {
+	conn, err := r.db.Conn(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to lock database: %w", err)
+	}
+	if _, err := conn.ExecContext(ctx, "BEGIN IMMEDIATE"); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to lock database: %w", err)
+	}
+	return func() {
+		conn.ExecContext(context.Background(), "ROLLBACK")
+		conn.Close()
+	}, nil
+}
+
+// writersBusy reports whether lockWriters failed because a write transaction
+// outlasted the busy timeout
+func writersBusy(err error) bool {
+	var sqliteErr sqlite3.Error
+	return errors.As(err, &sqliteErr) && sqliteErr.Code == sqlite3.ErrBusy
+}
+
+// walByteOrder returns the byte order of the checksums of a WAL
+func walByteOrder(header []byte) binary.ByteOrder {
+	if binary.BigEndian.Uint32(header)&1 != 0 {
+		return binary.BigEndian
+	}
+	return binary.LittleEndian
+}
+
+// walHeaderChecksum validates a WAL header and returns its checksum, which
+// the checksum of the first frame starts from
+func walHeaderChecksum(header []byte) ([2]uint32, bool) {
+	if binary.BigEndian.Uint32(header)&^1 != walMagic {
+		return [2]uint32{}, false
+	}
+	checksum := walChecksum(walByteOrder(header), [2]uint32{}, header[:24])
+	ok := checksum[0] == binary.BigEndian.Uint32(header[24:]) && checksum[1] == binary.BigEndian.Uint32(header[28:])
+	return checksum, ok
+}
+
+// walChecksum continues a WAL checksum over data, a multiple of 8 bytes
+func walChecksum(order binary.ByteOrder, checksum [2]uint32, data []byte) [2]uint32 {
+	s0, s1 := checksum[0], checksum[1]
+	for i := 0; i+8 <= len(data); i += 8 {
+		s0 += order.Uint32(data[i:]) + s1
+		s1 += order.Uint32(data[i+4:]) + s0
+	}
+	return [2]uint32{s0, s1}
+}
+
+// segmentName returns the blob name of a WAL segment. Segments are named
+// after the snapshot they apply to, so that segments a crash left behind are
+// never replayed on another snapshot. Database names cannot contain '@'.
+func segmentName(dbName string, generation string, seq int) string {
+	return fmt.Sprintf("%s@%s-%08d", dbName, generation, seq)
+}
+
+// isSegmentName reports whether a blob name is that of a WAL segment
+func isSegmentName(name string) bool {
+	return strings.Contains(name, "@")
+}
+
+// snapshotGeneration returns the name segments use for the snapshot at path
+// and its size
+func snapshotGeneration(path string) (string, int64, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", 0, err
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	size, err := io.Copy(hash, file)
+	if err != nil {
+		return "", 0, err
+	}
+	return hex.EncodeToString(hash.Sum(nil))[:16], size, nil
+}
+
+// applySegment writes the pages of a WAL segment to a database file, as a
+// checkpoint would
+func applySegment(file *os.File, segment []byte) error {
+	if len(segment) < walHeaderSize {
+		return errors.New("truncated WAL segment")
+	}
+	header, frames := segment[:walHeaderSize], segment[walHeaderSize:]
+	if _, ok := walHeaderChecksum(header); !ok {
+		return errors.New("invalid WAL header")
+	}
+	pageSize := int64(binary.BigEndian.Uint32(header[8:]))
+	frameSize := walFrameHeaderSize + pageSize
+	if pageSize < 512 || len(frames) == 0 || int64(len(frames))%frameSize != 0 {
+		return errors.New("truncated WAL segment")
+	}
+	for offset := int64(0); offset < int64(len(frames)); offset += frameSize {
+		frame := frames[offset : offset+frameSize]
+		if !bytes.Equal(frame[8:16], header[16:24]) || binary.BigEndian.Uint32(frame) == 0 {
+			return errors.New("invalid WAL frame")
+		}
+	}
+	if binary.BigEndian.Uint32(frames[int64(len(frames))-frameSize+4:]) == 0 {
+		return errors.New("WAL segment ends inside a transaction")
+	}
+
+	for offset := int64(0); offset < int64(len(frames)); offset += frameSize {
+		frame := frames[offset : offset+frameSize]
+		page := int64(binary.BigEndian.Uint32(frame))
+		if _, err := file.WriteAt(frame[walFrameHeaderSize:], (page-1)*pageSize); err != nil {
+			return err
+		}
+		// Commit frames carry the size of the database in pages
+		if pages := int64(binary.BigEndian.Uint32(frame[4:])); pages != 0 {
+			if err := file.Truncate(pages * pageSize); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// replaySegments applies the WAL segments shipped on top of the downloaded
+// snapshot to the local file
+func (c *DatabaseCache) replaySegments(ctx context.Context, file *os.File) error {
+	c.nextSegment, c.segmentBytes = 0, 0
+	if c.generation == "" {
+		return nil
+	}
+	for {
+		reader, err := c.storage.Download(ctx, segmentName(c.dbName, c.generation, c.nextSegment))
+		if err != nil {
+			return fmt.Errorf("failed to download WAL segment %d: %w", c.nextSegment, err)
+		}
+		if reader == nil {
+			return nil
+		}
+		segment, err := io.ReadAll(reader)
+		reader.Close()
+		if err != nil {
+			return fmt.Errorf("failed to download WAL segment %d: %w", c.nextSegment, err)
+		}
+		if err := applySegment(file, segment); err != nil {
+			return fmt.Errorf("failed to replay WAL segment %d: %w", c.nextSegment, err)
+		}
+		c.nextSegment++
+		c.segmentBytes += int64(len(segment))
+	}
+}
+
+// UploadSegment uploads a WAL segment on top of the current snapshot
+func (c *DatabaseCache) UploadSegment(ctx context.Context, segment []byte) error {
+	name := segmentName(c.dbName, c.generation, c.nextSegment)
+	if err := c.storage.Upload(ctx, name, bytes.NewReader(segment)); err != nil {
+		return fmt.Errorf("failed to upload WAL segment: %w", err)
+	}
+	c.nextSegment++
+	c.segmentBytes += int64(len(segment))
+	c.lastSync = time.Now()
+	return nil
+}
+
+// startGeneration makes an uploaded snapshot the one the following segments
+// apply to and deletes the segments of the previous one
+func (c *DatabaseCache) startGeneration(ctx context.Context, generation string, size int64) {
+	c.snapshotBytes = size
+	if generation == c.generation {
+		// The segments replay to this very snapshot, so numbering goes on
+		c.segmentBytes = 0
+		return
+	}
+	previous, segments := c.generation, c.nextSegment
+	c.generation, c.nextSegment, c.segmentBytes = generation, 0, 0
+	for seq := 0; seq < segments; seq++ {
+		if err := c.storage.Delete(ctx, segmentName(c.dbName, previous, seq)); err != nil {
+			log.Printf("WARN: Failed to delete WAL segments of database %s: %v", c.dbName, err)
+			return
+		}
+	}
+}
+
+// deleteSegments deletes every WAL segment of a database
+func deleteSegments(ctx context.Context, storage BlobStorage, dbName string) error {
+	names, err := storage.List(ctx)
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		if strings.HasPrefix(name, dbName+"@") {
+			if err := storage.Delete(ctx, name); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
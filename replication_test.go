@@ -0,0 +1,238 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReplication(t *testing.T) {
+	storage, err := NewLocalStorage(t.TempDir())
+	if err != nil {
+		t.Fatalf("Failed to create local storage: %v", err)
+	}
+	ctx := context.Background()
+
+	cache := NewDatabaseCache(storage, "testdb", 5)
+	cache.wal = true
+	defer cache.Cleanup()
+	if err := cache.Download(ctx); err != nil {
+		t.Fatalf("Failed to download: %v", err)
+	}
+	backend, err := NewSQLiteBackend(cache.GetLocalPath(), "deferred", 5)
+	if err != nil {
+		t.Fatalf("Failed to create backend: %v", err)
+	}
+	defer backend.Close()
+	replicator, err := NewReplicator(ctx, cache, 0)
+	if err != nil {
+		t.Fatalf("Failed to start replication: %v", err)
+	}
+	txManager := NewReplicatingTransactionManager(backend, cache, replicator)
+
+	exec := func(connectionID string, query string) {
+		t.Helper()
+		if _, err := backend.Exec(connectionID, query); err != nil {
+			t.Fatalf("%q: %v", query, err)
+		}
+	}
+	sync := func() {
+		t.Helper()
+		if err := txManager.ForceUpload(ctx); err != nil {
+			t.Fatalf("Failed to sync: %v", err)
+		}
+	}
+	// restore downloads the database like a new server would and returns
+	// its rows and the number of segments replayed
+	restores := 0
+	restore := func() (string, int) {
+		t.Helper()
+		restores++
+		restored := &DatabaseCache{storage: storage, localPath: filepath.Join(t.TempDir(), fmt.Sprintf("restored-%d.sqlite", restores)), dbName: "testdb", wal: true}
+		if err := restored.Download(ctx); err != nil {
+			t.Fatalf("Failed to restore: %v", err)
+		}
+		if err := verifySnapshot(ctx, restored.GetLocalPath()); err != nil {
+			t.Fatalf("Restored a corrupt database: %v", err)
+		}
+		db, err := sql.Open("sqlite3", restored.GetLocalPath())
+		if err != nil {
+			t.Fatalf("Failed to open restored database: %v", err)
+		}
+		defer db.Close()
+		var ids string
+		var blobs int
+		if err := db.QueryRow("SELECT group_concat(id), (SELECT count(*) FROM blobs) FROM t").Scan(&ids, &blobs); err != nil {
+			t.Fatalf("Failed to read restored database: %v", err)
+		}
+		return fmt.Sprintf("%s/%d", ids, blobs), restored.nextSegment
+	}
+
+	// The first sync uploads a snapshot, the following ones segments
+	exec("writer", "CREATE TABLE t (id INTEGER)")
+	exec("writer", "CREATE TABLE blobs (data BLOB)")
+	exec("writer", "WITH RECURSIVE n(i) AS (SELECT 1 UNION ALL SELECT i + 1 FROM n WHERE i < 1200) INSERT INTO blobs SELECT randomblob(3000) FROM n")
+	exec("writer", "INSERT INTO t VALUES (1)")
+	sync()
+	if rows, segments := restore(); rows != "1/1200" || segments != 0 {
+		t.Errorf("Expected the snapshot alone, got %s from %d segments", rows, segments)
+	}
+
+	// Once shipped, the large WAL is checkpointed and SQLite restarts it
+	exec("writer", "INSERT INTO t VALUES (2)")
+	sync()
+	if rows, segments := restore(); rows != "1,2/1200" || segments != 1 {
+		t.Errorf("Expected one segment on top of the snapshot, got %s from %d segments", rows, segments)
+	}
+	header := append([]byte(nil), replicator.header...)
+
+	// Uncommitted frames are not shipped
+	if err := backend.BeginTransaction("open", "deferred"); err != nil {
+		t.Fatalf("Failed to begin: %v", err)
+	}
+	exec("open", "INSERT INTO t VALUES (99)")
+	sync()
+	if rows, segments := restore(); rows != "1,2/1200" || segments != 1 {
+		t.Errorf("Expected the open transaction to be left out, got %s from %d segments", rows, segments)
+	}
+	if err := backend.RollbackTransaction("open"); err != nil {
+		t.Fatalf("Failed to roll back: %v", err)
+	}
+
+	exec("writer", "INSERT INTO t VALUES (3)")
+	sync()
+	if bytes.Equal(header, replicator.header) {
+		t.Error("Expected the WAL to be restarted after the checkpoint")
+	}
+	if rows, segments := restore(); rows != "1,2,3/1200" || segments != 2 {
+		t.Errorf("Expected the segments of both WALs, got %s from %d segments", rows, segments)
+	}
+
+	// A new snapshot replaces the segments
+	generation := cache.generation
+	txManager.uploadMu.Lock()
+	err = replicator.Snapshot(ctx)
+	txManager.uploadMu.Unlock()
+	if err != nil {
+		t.Fatalf("Failed to snapshot: %v", err)
+	}
+	if exists, _ := storage.Exists(ctx, segmentName("testdb", generation, 0)); exists {
+		t.Error("Expected the segments of the previous snapshot to be deleted")
+	}
+
+	// Commits do not wait for a running upload
+	if err := txManager.Begin("writer", "deferred"); err != nil {
+		t.Fatalf("Failed to begin: %v", err)
+	}
+	exec("writer", "INSERT INTO t VALUES (4)")
+	txManager.uploadMu.Lock()
+	committed := make(chan error, 1)
+	go func() { committed <- txManager.Commit("writer") }()
+	select {
+	case err := <-committed:
+		if err != nil {
+			t.Errorf("Failed to commit: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("Expected the commit not to wait for the upload")
+	}
+	txManager.uploadMu.Unlock()
+	sync()
+	txManager.Stop()
+	if rows, segments := restore(); rows != "1,2,3,4/1200" || segments != 1 {
+		t.Errorf("Expected one segment on top of the new snapshot, got %s from %d segments", rows, segments)
+	}
+
+	// A segment must end with a commit
+	reader, err := storage.Download(ctx, segmentName("testdb", cache.generation, 0))
+	if err != nil || reader == nil {
+		t.Fatalf("Failed to download segment: %v", err)
+	}
+	segment, _ := io.ReadAll(reader)
+	reader.Close()
+	pageSize := int(binary.BigEndian.Uint32(segment[8:]))
+	binary.BigEndian.PutUint32(segment[len(segment)-pageSize-walFrameHeaderSize+4:], 0)
+	file, err := os.CreateTemp(t.TempDir(), "segment")
+	if err != nil {
+		t.Fatalf("Failed to create file: %v", err)
+	}
+	defer file.Close()
+	if err := applySegment(file, segment); err == nil {
+		t.Error("Expected a segment ending inside a transaction to be rejected")
+	}
+
+	if err := deleteSegments(ctx, storage, "testdb"); err != nil {
+		t.Fatalf("Failed to delete segments: %v", err)
+	}
+	names, _ := storage.List(ctx)
+	if strings.Join(names, ",") != "testdb" {
+		t.Errorf("Expected only the snapshot to remain, got %v", names)
+	}
+}
+
+func TestReplicatedDatabases(t *testing.T) {
+	storage, err := NewLocalStorage(t.TempDir())
+	if err != nil {
+		t.Fatalf("Failed to create local storage: %v", err)
+	}
+	ctx := context.Background()
+
+	router := newTestRouter(t, storage)
+	router.replication.wal = true
+	session, err := router.startSession(ctx, "main")
+	if err != nil {
+		t.Fatalf("Failed to start session: %v", err)
+	}
+	main := databaseFromContext(session)
+	runQuery(t, main.handler, session, "CREATE TABLE orders (id INTEGER)")
+	runQuery(t, main.handler, session, "INSERT INTO orders VALUES (1)")
+	if err := main.txManager.ForceUpload(ctx); err != nil {
+		t.Fatalf("Failed to upload: %v", err)
+	}
+	runQuery(t, main.handler, session, "INSERT INTO orders VALUES (2)")
+	router.CloseSession(session)
+
+	// Closing ships the last commit as a segment instead of a snapshot
+	if err := router.Close(ctx); err != nil {
+		t.Fatalf("Failed to close databases: %v", err)
+	}
+	if exists, _ := storage.Exists(ctx, segmentName("main", main.cache.generation, 0)); !exists {
+		t.Error("Expected the last commit to be shipped as a segment")
+	}
+
+	// Databases and their copies are restored from the snapshot and segments
+	router = newTestRouter(t, storage)
+	router.replication.wal = true
+	session, err = router.startSession(ctx, "main")
+	if err != nil {
+		t.Fatalf("Failed to start session: %v", err)
+	}
+	main = databaseFromContext(session)
+	if writer := runQuery(t, main.handler, session, "SELECT count(*) FROM orders"); writer.rows[0][0] != int64(2) {
+		t.Errorf("Expected both rows after restoring, got %v", writer.rows)
+	}
+	if err := router.CreateDatabase(ctx, "copy", "main"); err == nil {
+		t.Error("Expected a template with sessions to be refused")
+	}
+	router.CloseSession(session)
+	if err := router.CreateDatabase(ctx, "copy", "main"); err != nil {
+		t.Fatalf("Failed to copy database: %v", err)
+	}
+	session, err = router.startSession(ctx, "copy")
+	if err != nil {
+		t.Fatalf("Failed to start session: %v", err)
+	}
+	copied := databaseFromContext(session)
+	if writer := runQuery(t, copied.handler, session, "SELECT count(*) FROM orders"); writer.rows[0][0] != int64(2) {
+		t.Errorf("Expected both rows in the copy, got %v", writer.rows)
+	}
+	router.CloseSession(session)
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	wire "github.com/jeroenrinzema/psql-wire"
+	"github.com/lib/pq/oid"
+)
+
+// sessionCounter hands out process-wide unique session numbers
+var sessionCounter uint64
+
+// sessionKey is the context key under which the session is stored
+type sessionKey struct{}
+
+// frontendReader reads the client's messages, for the exchanges psql-wire
+// does not handle itself such as COPY FROM STDIN
+type frontendReader interface {
+	ReadMessage() (byte, []byte, error)
+}
+
+// Session holds the identity of a single client connection
+type Session struct {
+	ID        string
+	Username  string
+	User      *User // the authenticated user, nil without authentication
+	StartTime time.Time
+	Conn      *ProtocolConn
+	Reader    frontendReader
+
+	// ProcessID and SecretKey are the session's BackendKeyData
+	ProcessID uint32
+	SecretKey uint32
+
+	// statements and prepared hold the statements the client parsed, as
+	// psql-wire's own cache is shared by all connections. prepared keeps
+	// what a wire.Statement hides, to run a statement when its portal is
+	// executed.
+	statements wire.DefaultStatementCache
+	prepared   map[string]*preparedStatement
+
+	mu        sync.Mutex
+	cancel    context.CancelFunc // cancels the running statement
+	idleSince time.Time          // end of the last statement
+	closeOnce sync.Once          // ends the session's use of its database
+}
+
+// NewSession creates a session with a unique connection ID
+func NewSession(username string) *Session {
+	n := atomic.AddUint64(&sessionCounter, 1)
+	return &Session{
+		ID:        fmt.Sprintf("%s-%d", username, n),
+		Username:  username,
+		StartTime: time.Now(),
+		ProcessID: uint32(n),
+		idleSince: time.Now(),
+	}
+}
+
+// idleTime returns how long the session has waited for the client, zero
+// while a statement runs
+func (s *Session) idleTime() time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.cancel != nil {
+		return 0
+	}
+	return time.Since(s.idleSince)
+}
+
+// terminate sends a FATAL error to the client and closes its connection;
+// psql-wire then ends the session
+func (s *Session) terminate(code string, message string) {
+	if s.Conn == nil {
+		return
+	}
+	if err := s.Conn.WriteError("FATAL", code, message); err != nil {
+		log.Printf("WARN: Failed to send termination to connection %s: %v", s.ID, err)
+	}
+	s.Conn.Close()
+}
+
+// preparedStatement is a statement the client parsed
+type preparedStatement struct {
+	fn      wire.PreparedStatementFn
+	params  []oid.Oid
+	columns wire.Columns
+}
+
+// sessionStatements is the psql-wire statement cache, keeping the
+// statements of every session apart
+type sessionStatements struct{}
+
+// Set stores a parsed statement in the session of ctx
+func (sessionStatements) Set(ctx context.Context, name string, fn wire.PreparedStatementFn, params []oid.Oid, columns wire.Columns) error {
+	session := sessionFromContext(ctx)
+	if session == nil {
+		return newPostgresError("08003", "no session to prepare statement %q in", name)
+	}
+	if session.prepared == nil {
+		session.prepared = make(map[string]*preparedStatement)
+	}
+	session.prepared[name] = &preparedStatement{fn: fn, params: params, columns: columns}
+	return session.statements.Set(ctx, name, fn, params, columns)
+}
+
+// Get returns a statement of the session of ctx
+func (sessionStatements) Get(ctx context.Context, name string) (*wire.Statement, error) {
+	session := sessionFromContext(ctx)
+	if session == nil {
+		return nil, nil
+	}
+	return session.statements.Get(ctx, name)
+}
+
+// withSession attaches a session to the context
+func withSession(ctx context.Context, session *Session) context.Context {
+	return context.WithValue(ctx, sessionKey{}, session)
+}
+
+// sessionFromContext returns the session attached to the context, if any
+func sessionFromContext(ctx context.Context) *Session {
+	session, _ := ctx.Value(sessionKey{}).(*Session)
+	return session
+}
+
+// StartSession implements the psql-wire SessionHandler and runs once per
+// connection after authentication
+func (h *SimpleWireHandler) StartSession(ctx context.Context) (context.Context, error) {
+	session := NewSession(wire.AuthenticatedUsername(ctx))
+	session.Conn = h.listener.Lookup(wire.ClientParameters(ctx)[connectionParameter])
+	if session.Conn != nil {
+		session.Reader = session.Conn
+		session.User = session.Conn.User()
+		session.Conn.SetTransactionStatus(func() TransactionStatus {
+			return h.txManager.GetTransactionStatus(session.ID)
+		})
+		session.Conn.SetCloseStatement(func(name string) {
+			delete(session.prepared, name)
+			if err := h.backend.ClosePrepared(session.ID, name); err != nil {
+				log.Printf("WARN: Failed to close prepared statement %s: %v", name, err)
+			}
+		})
+	}
+	if err := h.cancels.Register(session); err != nil {
+		return ctx, err
+	}
+	conn := h.backend.GetOrCreateConnection(session.ID)
+	if session.User != nil && session.User.Privilege < PrivilegeDDL {
+		conn.setConnectionDefault("is_superuser", "off")
+	}
+	if err := h.reportSession(session); err != nil {
+		h.cancels.Unregister(session)
+		h.backend.RemoveConnection(session.ID)
+		return ctx, err
+	}
+	return withSession(ctx, session), nil
+}
+
+// reportSession sends the session's parameters and cancel key, which
+// precede the first ReadyForQuery
+func (h *SimpleWireHandler) reportSession(session *Session) error {
+	if session.Conn == nil {
+		return nil
+	}
+
+	settings := h.backend.GetOrCreateConnection(session.ID).Settings()
+	names := make([]string, 0, len(reportedSettings))
+	for name := range reportedSettings {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if err := session.Conn.WriteParameterStatus(reportedSettings[name], settings[name]); err != nil {
+			return err
+		}
+	}
+	if err := session.Conn.WriteParameterStatus("session_authorization", session.Username); err != nil {
+		return err
+	}
+	return session.Conn.WriteBackendKeyData(session.ProcessID, session.SecretKey)
+}
+
+// CloseSession implements the psql-wire CloseFn and releases all state held
+// for the connection, rolling back any transaction left open
+func (h *SimpleWireHandler) CloseSession(ctx context.Context) error {
+	session := sessionFromContext(ctx)
+	if session == nil {
+		return nil
+	}
+
+	if h.txManager.GetTransactionStatus(session.ID) != TxIdle {
+		h.txMonitor.EndTransaction(session.ID, false)
+	}
+	h.cancels.Unregister(session)
+	h.backend.RemoveConnection(session.ID)
+	return nil
+}
@@ -0,0 +1,612 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+
+	wire "github.com/jeroenrinzema/psql-wire"
+	"github.com/lib/pq/oid"
+)
+
+// settingDefaults are the run-time parameters a session can SET and SHOW,
+// keyed by lower-case name. Most have no effect on SQLite and are kept so
+// that drivers and dump scripts setting them on connect keep working.
+var settingDefaults = map[string]string{
+	"server_version":                      "13.0",
+	"server_version_num":                  "130000",
+	"server_encoding":                     "UTF8",
+	"client_encoding":                     "UTF8",
+	"datestyle":                           "ISO, MDY",
+	"timezone":                            "UTC",
+	"intervalstyle":                       "postgres",
+	"integer_datetimes":                   "on",
+	"standard_conforming_strings":         "on",
+	"is_superuser":                        "on",
+	"application_name":                    "",
+	"search_path":                         `"$user", public`,
+	"transaction_isolation":               "serializable",
+	"default_transaction_isolation":       "serializable",
+	"transaction_read_only":               "off",
+	"default_transaction_read_only":       "off",
+	"extra_float_digits":                  "1",
+	"client_min_messages":                 "notice",
+	"statement_timeout":                   "0",
+	"lock_timeout":                        "0",
+	"idle_in_transaction_session_timeout": "0",
+	"max_identifier_length":               "63",
+	"bytea_output":                        "hex",
+	"escape_string_warning":               "on",
+	"check_function_bodies":               "on",
+	"xmloption":                           "content",
+	"row_security":                        "on",
+	"default_tablespace":                  "",
+	"default_table_access_method":         "heap",
+	"default_with_oids":                   "off",
+	"synchronous_commit":                  "on",
+	"lc_messages":                         "C",
+	"lc_monetary":                         "C",
+	"lc_numeric":                          "C",
+	"lc_time":                             "C",
+	"jit":                                 "off",
+}
+
+// readOnlySettings report properties of the server and cannot be changed
+var readOnlySettings = map[string]bool{
+	"server_version":        true,
+	"server_version_num":    true,
+	"server_encoding":       true,
+	"is_superuser":          true,
+	"integer_datetimes":     true,
+	"max_identifier_length": true,
+}
+
+// reportedSettings are sent to the client in ParameterStatus messages on
+// connect and when they change, keyed by lower-case name with PostgreSQL's
+// spelling
+var reportedSettings = map[string]string{
+	"server_version":                "server_version",
+	"server_encoding":               "server_encoding",
+	"client_encoding":               "client_encoding",
+	"datestyle":                     "DateStyle",
+	"timezone":                      "TimeZone",
+	"intervalstyle":                 "IntervalStyle",
+	"integer_datetimes":             "integer_datetimes",
+	"standard_conforming_strings":   "standard_conforming_strings",
+	"is_superuser":                  "is_superuser",
+	"application_name":              "application_name",
+	"default_transaction_read_only": "default_transaction_read_only",
+}
+
+// settingName returns the name a setting is displayed under
+func settingName(name string) string {
+	if display, ok := reportedSettings[name]; ok {
+		return display
+	}
+	return name
+}
+
+// isKnownSetting reports whether a setting may be set; names with a dot are
+// custom options, which PostgreSQL accepts without declaration
+func isKnownSetting(name string) bool {
+	_, ok := settingDefaults[name]
+	return ok || strings.Contains(name, ".")
+}
+
+func unknownSettingError(name string) error {
+	return newPostgresError("42704", "unrecognized configuration parameter %q", name)
+}
+
+func readOnlySettingError(name string) error {
+	return newPostgresError("55P02", "parameter %q cannot be changed", name)
+}
+
+// SetServerSetting changes the default of a run-time parameter for the
+// connections opened afterwards, as a setting in postgresql.conf does
+func (b *SQLiteBackend) SetServerSetting(name string, value string) error {
+	name = strings.ToLower(name)
+	if _, ok := settingDefaults[name]; !ok {
+		return unknownSettingError(name)
+	}
+	if readOnlySettings[name] {
+		return readOnlySettingError(name)
+	}
+	value, err := validateSetting(name, value)
+	if err != nil {
+		return err
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	// Connections share the map, so it is replaced rather than changed
+	settings := make(map[string]string, len(b.serverSettings)+1)
+	for n, v := range b.serverSettings {
+		settings[n] = v
+	}
+	settings[name] = value
+	b.serverSettings = settings
+	return nil
+}
+
+// validateSetting checks the value of a parameter with a typed value and
+// returns it in canonical form
+func validateSetting(name string, value string) (string, error) {
+	switch {
+	case timeoutSettings[name]:
+		if _, err := parseTimeoutSetting(value); err != nil {
+			return "", newPostgresError("22023", "invalid value for parameter %q: %q", name, value)
+		}
+	case name == "client_encoding":
+		// The server only speaks UTF8, and drivers treat any other reported
+		// client_encoding as fatal
+		switch strings.ToUpper(strings.ReplaceAll(value, "-", "")) {
+		case "UTF8", "UNICODE":
+			return "UTF8", nil
+		}
+		return "", newPostgresError("22023", "invalid value for parameter %q: %q", name, value)
+	}
+	return value, nil
+}
+
+// Setting returns the value of a run-time parameter for the session
+func (c *ConnectionState) Setting(name string) (string, bool) {
+	name = strings.ToLower(name)
+
+	c.settingsMu.Lock()
+	defer c.settingsMu.Unlock()
+
+	if value, ok := c.localSettings[name]; ok {
+		return value, true
+	}
+	if value, ok := c.settings[name]; ok {
+		return value, true
+	}
+	if value, ok := c.serverSettings[name]; ok {
+		return value, true
+	}
+	value, ok := settingDefaults[name]
+	return value, ok
+}
+
+// Settings returns the values of all run-time parameters for the session
+func (c *ConnectionState) Settings() map[string]string {
+	c.settingsMu.Lock()
+	defer c.settingsMu.Unlock()
+
+	settings := make(map[string]string, len(settingDefaults)+len(c.settings))
+	for name, value := range settingDefaults {
+		settings[name] = value
+	}
+	for name, value := range c.serverSettings {
+		settings[name] = value
+	}
+	for name, value := range c.settings {
+		settings[name] = value
+	}
+	for name, value := range c.localSettings {
+		settings[name] = value
+	}
+	return settings
+}
+
+// SetSetting changes a run-time parameter. Local values only last until
+// the end of the current transaction.
+func (c *ConnectionState) SetSetting(name string, value string, local bool) error {
+	name = strings.ToLower(name)
+	if !isKnownSetting(name) {
+		return unknownSettingError(name)
+	}
+	if readOnlySettings[name] {
+		return readOnlySettingError(name)
+	}
+	value, err := validateSetting(name, value)
+	if err != nil {
+		return err
+	}
+
+	c.settingsMu.Lock()
+	defer c.settingsMu.Unlock()
+
+	if local {
+		if c.localSettings == nil {
+			c.localSettings = make(map[string]string)
+		}
+		c.localSettings[name] = value
+		return nil
+	}
+
+	if c.settings == nil {
+		c.settings = make(map[string]string)
+	}
+	c.settings[name] = value
+	delete(c.localSettings, name)
+	return nil
+}
+
+// ResetSetting restores a run-time parameter to its default; an empty name
+// resets all of them
+func (c *ConnectionState) ResetSetting(name string) error {
+	name = strings.ToLower(name)
+	if name != "" && !isKnownSetting(name) {
+		return unknownSettingError(name)
+	}
+	if readOnlySettings[name] {
+		return readOnlySettingError(name)
+	}
+
+	c.settingsMu.Lock()
+	defer c.settingsMu.Unlock()
+
+	if name == "" {
+		c.settings = nil
+		c.localSettings = nil
+		return nil
+	}
+	delete(c.settings, name)
+	delete(c.localSettings, name)
+	return nil
+}
+
+// setConnectionDefault changes the default of a parameter for this
+// connection alone, for parameters that depend on the session's user
+func (c *ConnectionState) setConnectionDefault(name string, value string) {
+	c.settingsMu.Lock()
+	defer c.settingsMu.Unlock()
+
+	// Connections share the server defaults, so they are copied first
+	settings := make(map[string]string, len(c.serverSettings)+1)
+	for n, v := range c.serverSettings {
+		settings[n] = v
+	}
+	settings[name] = value
+	c.serverSettings = settings
+}
+
+// beginTransactionSettings records the session's parameters when a
+// transaction block begins, for a rollback to restore
+func (c *ConnectionState) beginTransactionSettings() {
+	c.settingsMu.Lock()
+	defer c.settingsMu.Unlock()
+
+	c.txSettings = make(map[string]string, len(c.settings))
+	for name, value := range c.settings {
+		c.txSettings[name] = value
+	}
+}
+
+// rollbackTransactionSettings undoes the SETs of a rolled back transaction
+// block, as PostgreSQL does
+func (c *ConnectionState) rollbackTransactionSettings() {
+	c.settingsMu.Lock()
+	defer c.settingsMu.Unlock()
+
+	if c.txSettings != nil {
+		c.settings = c.txSettings
+	}
+	c.txSettings = nil
+	c.localSettings = nil
+}
+
+// endTransactionSettings drops the values set with SET LOCAL or set_config
+// with is_local, and the parameters recorded at BEGIN
+func (c *ConnectionState) endTransactionSettings() {
+	c.settingsMu.Lock()
+	defer c.settingsMu.Unlock()
+
+	c.localSettings = nil
+	c.txSettings = nil
+}
+
+// lookupConnection returns the state of an existing connection
+func (b *SQLiteBackend) lookupConnection(connectionID string) (*ConnectionState, bool) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	conn, ok := b.connections[connectionID]
+	return conn, ok
+}
+
+// currentSetting implements current_setting(name [, missing_ok]) for the
+// connection named in the first argument
+func (b *SQLiteBackend) currentSetting(connectionID string, args ...interface{}) (interface{}, error) {
+	if len(args) == 0 || len(args) > 2 {
+		return nil, fmt.Errorf("function current_setting takes one or two arguments")
+	}
+	name := sqlText(args[0])
+	missingOK := len(args) == 2 && args[1] != nil && sqlText(args[1]) != "0"
+
+	conn, ok := b.lookupConnection(connectionID)
+	if !ok {
+		return nil, fmt.Errorf("connection %s not found", connectionID)
+	}
+	value, ok := conn.Setting(name)
+	switch {
+	case ok:
+		return value, nil
+	case missingOK:
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("unrecognized configuration parameter %q", strings.ToLower(name))
+	}
+}
+
+// setConfig implements set_config(name, value, is_local) for the connection
+// named in the first argument
+func (b *SQLiteBackend) setConfig(connectionID string, name string, value interface{}, isLocal interface{}) (interface{}, error) {
+	conn, ok := b.lookupConnection(connectionID)
+	if !ok {
+		return nil, fmt.Errorf("connection %s not found", connectionID)
+	}
+
+	local := isLocal != nil && sqlText(isLocal) != "0"
+	if value == nil {
+		if err := conn.ResetSetting(name); err != nil {
+			return nil, err
+		}
+	} else if err := conn.SetSetting(name, sqlText(value), local); err != nil {
+		return nil, err
+	}
+
+	current, _ := conn.Setting(name)
+	return current, nil
+}
+
+// sessionFunctions are the SQL functions that read or change the session,
+// and the connection-aware functions they are rewritten to
+var sessionFunctions = map[string]string{
+	"current_setting": "pgblob_current_setting",
+	"set_config":      "pgblob_set_config",
+}
+
+// bindSessionFunctions passes the connection ID to the functions that act
+// on the session. SQLite functions are registered per database connection,
+// which is shared by all sessions, so they cannot know the session otherwise.
+func bindSessionFunctions(tokens []token, connectionID string) []token {
+	result := make([]token, 0, len(tokens))
+	for i := 0; i < len(tokens); i++ {
+		t := tokens[i]
+		function, ok := sessionFunctions[strings.ToLower(t.Text)]
+		open := nextSignificant(tokens, i)
+		if !ok || t.Kind != tokenIdent || isQualified(tokens, i) || open >= len(tokens) || !tokens[open].isPunct("(") {
+			result = append(result, t)
+			continue
+		}
+
+		result = append(result, token{Kind: tokenIdent, Text: function}, tokens[open])
+		result = append(result, tokenize(quoteLiteral(connectionID)+", ")...)
+		i = open
+	}
+	return result
+}
+
+// settingCommand is a parsed SET, SHOW or RESET statement
+type settingCommand struct {
+	Verb  string // SET, SHOW or RESET
+	Name  string // lower-case parameter name, empty for SHOW ALL and RESET ALL
+	Value string
+	Local bool
+	Reset bool // SET ... TO DEFAULT
+	NoOp  bool // accepted without effect, like SET TRANSACTION
+}
+
+// parseSettingCommand recognizes the statements that act on run-time
+// parameters. They never reach SQLite.
+func parseSettingCommand(query string) (*settingCommand, bool, error) {
+	sig := significantTokens(tokenize(query))
+	for len(sig) > 0 && sig[len(sig)-1].isPunct(";") {
+		sig = sig[:len(sig)-1]
+	}
+	if len(sig) == 0 {
+		return nil, false, nil
+	}
+
+	switch {
+	case sig[0].is("SET"):
+		command, err := parseSet(sig[1:])
+		return command, true, err
+	case sig[0].is("SHOW"):
+		command := &settingCommand{Verb: "SHOW"}
+		name, err := parseSettingName(sig[1:], true)
+		command.Name = name
+		return command, true, err
+	case sig[0].is("RESET"):
+		command := &settingCommand{Verb: "RESET"}
+		name, err := parseSettingName(sig[1:], true)
+		command.Name = name
+		return command, true, err
+	default:
+		return nil, false, nil
+	}
+}
+
+// parseSet parses the tokens following SET
+func parseSet(sig []token) (*settingCommand, error) {
+	command := &settingCommand{Verb: "SET"}
+	if len(sig) > 0 && (sig[0].is("SESSION") || sig[0].is("LOCAL")) {
+		command.Local = sig[0].is("LOCAL")
+		sig = sig[1:]
+	}
+	if len(sig) == 0 {
+		return nil, newPostgresError("42601", "syntax error at end of input")
+	}
+
+	switch {
+	case sig[0].is("TRANSACTION"), sig[0].is("CHARACTERISTICS"), sig[0].is("CONSTRAINTS"), sig[0].is("ROLE"),
+		sig[0].is("SESSION") && len(sig) > 1 && sig[1].is("AUTHORIZATION"):
+		// SQLite transactions are always serializable and there is a single role
+		command.NoOp = true
+		return command, nil
+	case sig[0].is("TIME") && len(sig) > 1 && sig[1].is("ZONE"):
+		command.Name, sig = "timezone", sig[2:]
+		if len(sig) == 1 && sig[0].is("LOCAL") {
+			command.Reset = true
+			return command, nil
+		}
+	case sig[0].is("NAMES"):
+		command.Name, sig = "client_encoding", sig[1:]
+	case sig[0].is("SCHEMA"):
+		command.Name, sig = "search_path", sig[1:]
+	default:
+		end := qualifiedNameEnd(sig, 0)
+		name, err := parseSettingName(sig[:end], false)
+		if err != nil {
+			return nil, err
+		}
+		command.Name, sig = name, sig[end:]
+		if len(sig) == 0 || !(sig[0].is("TO") || sig[0].isPunct("=")) {
+			return nil, newPostgresError("42601", "syntax error: expected TO or = after %s", name)
+		}
+		sig = sig[1:]
+	}
+
+	switch {
+	case len(sig) == 0:
+		return nil, newPostgresError("42601", "syntax error at end of input")
+	case len(sig) == 1 && sig[0].is("DEFAULT"):
+		command.Reset = true
+		return command, nil
+	}
+
+	var values []string
+	for _, part := range splitTopLevel(sig) {
+		value := ""
+		for _, t := range part {
+			switch t.Kind {
+			case tokenString:
+				value += decodeStringLiteral(t.Text)
+			case tokenIdent, tokenQuotedIdent:
+				value += t.name()
+			default:
+				value += t.Text
+			}
+		}
+		values = append(values, value)
+	}
+	command.Value = strings.Join(values, ", ")
+	return command, nil
+}
+
+// parseSettingName parses the parameter name of SHOW, RESET or SET; ALL
+// yields an empty name when allowed
+func parseSettingName(sig []token, allowAll bool) (string, error) {
+	switch {
+	case len(sig) == 0:
+		return "", newPostgresError("42601", "syntax error at end of input")
+	case allowAll && len(sig) == 1 && sig[0].is("ALL"):
+		return "", nil
+	case len(sig) == 2 && sig[0].is("TIME") && sig[1].is("ZONE"):
+		return "timezone", nil
+	case len(sig) == 3 && sig[0].is("TRANSACTION") && sig[1].is("ISOLATION") && sig[2].is("LEVEL"):
+		return "transaction_isolation", nil
+	case len(sig) == 2 && sig[0].is("SESSION") && sig[1].is("AUTHORIZATION"):
+		return "session_authorization", nil
+	}
+
+	var parts []string
+	for i, t := range sig {
+		switch {
+		case i%2 == 1 && t.isPunct("."):
+		case i%2 == 0 && (t.Kind == tokenIdent || t.Kind == tokenQuotedIdent):
+			parts = append(parts, strings.ToLower(t.name()))
+		default:
+			return "", newPostgresError("42601", "syntax error at or near %q", t.Text)
+		}
+	}
+	return strings.Join(parts, "."), nil
+}
+
+// decodeStringLiteral returns the value of a string literal token
+func decodeStringLiteral(literal string) string {
+	translated := translateLiterals([]token{{Kind: tokenString, Text: literal}})
+	text := translated[0].Text
+	if len(text) >= 2 && text[0] == '\'' {
+		text = text[1 : len(text)-1]
+	}
+	return strings.ReplaceAll(text, "''", "'")
+}
+
+// Columns returns the result columns of the command
+func (c *settingCommand) Columns() wire.Columns {
+	if c.Verb != "SHOW" {
+		return nil
+	}
+	if c.Name == "" {
+		return wire.Columns{
+			{Name: "name", Oid: oid.T_text, Format: wire.TextFormat},
+			{Name: "setting", Oid: oid.T_text, Format: wire.TextFormat},
+			{Name: "description", Oid: oid.T_text, Format: wire.TextFormat},
+		}
+	}
+	return wire.Columns{{Name: settingName(c.Name), Oid: oid.T_text, Format: wire.TextFormat}}
+}
+
+// executeSettingCommand runs a SET, SHOW or RESET statement against the
+// session's parameters
+func (h *SimpleWireHandler) executeSettingCommand(connectionID string, command *settingCommand, writer wire.DataWriter) error {
+	conn := h.backend.GetOrCreateConnection(connectionID)
+
+	switch {
+	case command.NoOp:
+	case command.Verb == "SHOW" && command.Name == "":
+		settings := conn.Settings()
+		names := make([]string, 0, len(settings))
+		for name := range settings {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			if err := writer.Row([]interface{}{settingName(name), settings[name], ""}); err != nil {
+				return err
+			}
+		}
+		return writer.Complete("SHOW")
+	case command.Verb == "SHOW":
+		value, ok := conn.Setting(command.Name)
+		if !ok {
+			return unknownSettingError(command.Name)
+		}
+		if err := writer.Row([]interface{}{value}); err != nil {
+			return err
+		}
+		return writer.Complete("SHOW")
+	case command.Verb == "RESET", command.Reset:
+		if err := conn.ResetSetting(command.Name); err != nil {
+			return err
+		}
+	default:
+		if err := conn.SetSetting(command.Name, command.Value, command.Local); err != nil {
+			return err
+		}
+	}
+
+	return writer.Complete(command.Verb)
+}
+
+// reportingSettings wraps a statement so that changes to reported
+// parameters are sent to the client as ParameterStatus messages
+func (h *SimpleWireHandler) reportingSettings(session *Session, connectionID string, fn wire.PreparedStatementFn) wire.PreparedStatementFn {
+	return func(ctx context.Context, writer wire.DataWriter, parameters []string) error {
+		conn := h.backend.GetOrCreateConnection(connectionID)
+		before := conn.Settings()
+		err := fn(ctx, writer, parameters)
+
+		// Outside a transaction block every statement is its own transaction
+		if h.txManager.GetTransactionStatus(connectionID) == TxIdle {
+			conn.endTransactionSettings()
+		}
+
+		after := conn.Settings()
+		for name, display := range reportedSettings {
+			if after[name] == before[name] || session == nil {
+				continue
+			}
+			if werr := session.Conn.WriteParameterStatus(display, after[name]); werr != nil {
+				log.Printf("WARN: Failed to report %s for connection %s: %v", display, connectionID, werr)
+			}
+		}
+		return err
+	}
+}
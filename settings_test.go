@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	psqlerr "github.com/jeroenrinzema/psql-wire/errors"
+)
+
+func TestSettingCommands(t *testing.T) {
+	handler := newTestHandler(t)
+	ctx, _ := handler.StartSession(context.Background())
+	other, _ := handler.StartSession(context.Background())
+
+	conn := &capturingConn{}
+	sessionFromContext(ctx).Conn = &ProtocolConn{Conn: conn}
+
+	writer := runQuery(t, handler, ctx, "SET application_name = 'my app'")
+	if writer.tag != "SET" {
+		t.Errorf("Expected SET tag, got %q", writer.tag)
+	}
+	if got := conn.written.String(); got != "S\x00\x00\x00\x1capplication_name\x00my app\x00" {
+		t.Errorf("Unexpected ParameterStatus: %q", got)
+	}
+
+	runQuery(t, handler, ctx, "SET TIME ZONE 'Europe/Warsaw'")
+	runQuery(t, handler, ctx, "SET search_path TO public, \"$user\"")
+
+	tests := []struct {
+		query  string
+		column string
+		want   string
+	}{
+		{"SHOW application_name", "application_name", "my app"},
+		{"SHOW TIME ZONE", "TimeZone", "Europe/Warsaw"},
+		{"SHOW search_path", "search_path", "public, $user"},
+		{"SHOW server_version", "server_version", "13.0"},
+		{"SHOW TRANSACTION ISOLATION LEVEL", "transaction_isolation", "serializable"},
+	}
+	for _, tt := range tests {
+		command, _, err := parseSettingCommand(tt.query)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.query, err)
+		}
+		if columns := command.Columns(); len(columns) != 1 || columns[0].Name != tt.column {
+			t.Errorf("%s: unexpected columns %+v", tt.query, columns)
+		}
+		writer := runQuery(t, handler, ctx, tt.query)
+		if len(writer.rows) != 1 || writer.rows[0][0] != tt.want {
+			t.Errorf("%s: got %v; want %q", tt.query, writer.rows, tt.want)
+		}
+	}
+
+	// Settings belong to the session that changed them
+	writer = runQuery(t, handler, other, "SHOW application_name")
+	if writer.rows[0][0] != "" {
+		t.Errorf("Expected other session to keep the default, got %v", writer.rows[0][0])
+	}
+
+	runQuery(t, handler, ctx, "RESET TIME ZONE")
+	writer = runQuery(t, handler, ctx, "SELECT current_setting('TimeZone'), pg_catalog.set_config('app.user', 'alice', false), current_setting('app.user')")
+	if row := writer.rows[0]; row[0] != "UTC" || row[1] != "alice" || row[2] != "alice" {
+		t.Errorf("Unexpected setting functions result: %v", row)
+	}
+
+	// SET LOCAL only lasts until the end of the transaction
+	runQuery(t, handler, ctx, "BEGIN")
+	runQuery(t, handler, ctx, "SET LOCAL statement_timeout = 500")
+	if writer := runQuery(t, handler, ctx, "SHOW statement_timeout"); writer.rows[0][0] != "500" {
+		t.Errorf("Expected local value inside the transaction, got %v", writer.rows[0][0])
+	}
+	runQuery(t, handler, ctx, "COMMIT")
+	if writer := runQuery(t, handler, ctx, "SHOW statement_timeout"); writer.rows[0][0] != "0" {
+		t.Errorf("Expected default after the transaction, got %v", writer.rows[0][0])
+	}
+
+	// A rolled back transaction undoes its SETs, a committed one keeps them
+	runQuery(t, handler, ctx, "BEGIN")
+	runQuery(t, handler, ctx, "SET application_name = 'rolled back'")
+	conn.written.Reset()
+	runQuery(t, handler, ctx, "ROLLBACK")
+	if writer := runQuery(t, handler, ctx, "SHOW application_name"); writer.rows[0][0] != "my app" {
+		t.Errorf("Expected the value from before the transaction, got %v", writer.rows[0][0])
+	}
+	if got := conn.written.String(); got != "S\x00\x00\x00\x1capplication_name\x00my app\x00" {
+		t.Errorf("Expected the restored value to be reported, got %q", got)
+	}
+	runQuery(t, handler, ctx, "BEGIN")
+	runQuery(t, handler, ctx, "SET application_name = 'committed'")
+	runQuery(t, handler, ctx, "COMMIT")
+	if writer := runQuery(t, handler, ctx, "SHOW application_name"); writer.rows[0][0] != "committed" {
+		t.Errorf("Expected the committed value, got %v", writer.rows[0][0])
+	}
+
+	// The server only speaks UTF8
+	runQuery(t, handler, ctx, "SET NAMES 'utf-8'")
+	if writer := runQuery(t, handler, ctx, "SHOW client_encoding"); writer.rows[0][0] != "UTF8" {
+		t.Errorf("Expected client_encoding UTF8, got %v", writer.rows[0][0])
+	}
+
+	queryError := func(query string) string {
+		t.Helper()
+		fn, _, _, err := handler.ParseQuery(ctx, query)
+		if err == nil {
+			err = fn(ctx, &recordingWriter{}, nil)
+		}
+		return string(psqlerr.Flatten(err).Code)
+	}
+	if code := queryError("SET client_encoding = 'LATIN1'"); code != "22023" {
+		t.Errorf("SET client_encoding = 'LATIN1': code = %q; want 22023", code)
+	}
+	for _, query := range []string{"SET server_version = '16.0'", "SET is_superuser = off", "RESET server_encoding", "SELECT set_config('server_version_num', '1', false)"} {
+		if code := queryError(query); code != "55P02" {
+			t.Errorf("%s: code = %q; want 55P02", query, code)
+		}
+	}
+
+	for _, query := range []string{"SET no_such_setting = 1", "SHOW no_such_setting", "SELECT current_setting('no_such_setting')"} {
+		fn, _, _, err := handler.ParseQuery(ctx, query)
+		if err == nil {
+			err = fn(ctx, &recordingWriter{}, nil)
+		}
+		if code := psqlerr.Flatten(err).Code; code != "42704" {
+			t.Errorf("%s: code = %q; want 42704", query, code)
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+// maxIntegrityErrors bounds the integrity_check messages reported for a
+// corrupt snapshot
+const maxIntegrityErrors = 5
+
+// Snapshot writes a transactionally consistent copy of the database to path.
+// The copy holds every transaction committed before it started, including
+// those still in the WAL, and none of those committed while it runs.
+func (b *SQLiteBackend) Snapshot(ctx context.Context, path string) error {
+	conn, err := b.db.Conn(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to snapshot database: %w", err)
+	}
+	defer conn.Close()
+
+	return backupDatabase(conn, path)
+}
+
+// backupDatabase copies the database of conn to path with the online backup
+// API. The backup copies every page in one read transaction, and keeps the
+// page numbers, so that WAL frames of the database apply to the copy.
+func backupDatabase(conn *sql.Conn, path string) error {
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove stale snapshot: %w", err)
+	}
+	dest, err := (&sqlite3.SQLiteDriver{}).Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to create snapshot: %w", err)
+	}
+	defer dest.Close()
+
+	err = conn.Raw(func(driverConn interface{}) error {
+		backup, err := dest.(*sqlite3.SQLiteConn).Backup("main", driverConn.(*sqlite3.SQLiteConn), "main")
+		if err != nil {
+			return err
+		}
+		if _, err := backup.Step(-1); err != nil {
+			backup.Finish()
+			return err
+		}
+		return backup.Finish()
+	})
+	if err != nil {
+		os.Remove(path)
+		return fmt.Errorf("failed to snapshot database: %w", err)
+	}
+	return nil
+}
+
+// verifySnapshot runs PRAGMA integrity_check on the snapshot at path
+func verifySnapshot(ctx context.Context, path string) error {
+	// Nothing else writes to the snapshot, so it is opened without locks
+	db, err := sql.Open("sqlite3", "file:"+path+"?mode=ro&immutable=1")
+	if err != nil {
+		return fmt.Errorf("failed to open snapshot: %w", err)
+	}
+	defer db.Close()
+
+	rows, err := db.QueryContext(ctx, fmt.Sprintf("PRAGMA integrity_check(%d)", maxIntegrityErrors))
+	if err != nil {
+		return fmt.Errorf("failed to check snapshot integrity: %w", err)
+	}
+	defer rows.Close()
+
+	var problems []string
+	for rows.Next() {
+		var message string
+		if err := rows.Scan(&message); err != nil {
+			return fmt.Errorf("failed to check snapshot integrity: %w", err)
+		}
+		problems = append(problems, message)
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("failed to check snapshot integrity: %w", err)
+	}
+	if len(problems) != 1 || problems[0] != "ok" {
+		return fmt.Errorf("snapshot failed integrity check: %s", strings.Join(problems, "; "))
+	}
+	return nil
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestUploadSnapshot(t *testing.T) {
+	storage, err := NewLocalStorage(t.TempDir())
+	if err != nil {
+		t.Fatalf("Failed to create local storage: %v", err)
+	}
+	ctx := context.Background()
+
+	cache := NewDatabaseCache(storage, "testdb", 5)
+	defer cache.Cleanup()
+	if err := cache.Download(ctx); err != nil {
+		t.Fatalf("Failed to download: %v", err)
+	}
+	backend, err := NewSQLiteBackend(cache.GetLocalPath(), "deferred", 5)
+	if err != nil {
+		t.Fatalf("Failed to create backend: %v", err)
+	}
+	defer backend.Close()
+	txManager := NewTransactionManager(backend, cache)
+	defer txManager.Stop()
+
+	for _, query := range []string{
+		"CREATE TABLE t (id INTEGER)",
+		"INSERT INTO t VALUES (1)",
+		"INSERT INTO t VALUES (2)",
+	} {
+		if _, err := backend.Exec("writer", query); err != nil {
+			t.Fatalf("%q: %v", query, err)
+		}
+	}
+	if err := backend.BeginTransaction("open", "deferred"); err != nil {
+		t.Fatalf("Failed to begin: %v", err)
+	}
+	if _, err := backend.Exec("open", "INSERT INTO t VALUES (3)"); err != nil {
+		t.Fatalf("Failed to insert: %v", err)
+	}
+	defer backend.RollbackTransaction("open")
+
+	if info, err := os.Stat(cache.GetLocalPath() + "-wal"); err != nil || info.Size() == 0 {
+		t.Fatalf("Expected the commits to be in the WAL, got %v", err)
+	}
+
+	// The upload holds the commits in the WAL but not the open transaction
+	if err := txManager.ForceUpload(ctx); err != nil {
+		t.Fatalf("Failed to upload: %v", err)
+	}
+	uploaded := filepath.Join(t.TempDir(), "uploaded.db")
+	reader, err := storage.Download(ctx, "testdb")
+	if err != nil {
+		t.Fatalf("Failed to download upload: %v", err)
+	}
+	data, err := io.ReadAll(reader)
+	reader.Close()
+	if err != nil || os.WriteFile(uploaded, data, 0644) != nil {
+		t.Fatalf("Failed to copy upload: %v", err)
+	}
+
+	db, err := sql.Open("sqlite3", uploaded)
+	if err != nil {
+		t.Fatalf("Failed to open upload: %v", err)
+	}
+	defer db.Close()
+	var count, sum int
+	if err := db.QueryRow("SELECT count(*), sum(id) FROM t").Scan(&count, &sum); err != nil || count != 2 || sum != 3 {
+		t.Errorf("Expected the two committed rows, got %d rows summing to %d: %v", count, sum, err)
+	}
+	if _, err := os.Stat(cache.snapshotPath()); !os.IsNotExist(err) {
+		t.Errorf("Expected the snapshot to be removed, got %v", err)
+	}
+}
+
+func TestVerifySnapshot(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "snapshot.db")
+
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	for _, query := range []string{
+		"CREATE TABLE t (id INTEGER PRIMARY KEY, name TEXT)",
+		"CREATE INDEX t_name ON t (name)",
+		"WITH RECURSIVE n(i) AS (SELECT 1 UNION ALL SELECT i + 1 FROM n WHERE i < 500) INSERT INTO t SELECT i, 'row ' || i FROM n",
+	} {
+		if _, err := db.Exec(query); err != nil {
+			t.Fatalf("%q: %v", query, err)
+		}
+	}
+	db.Close()
+
+	if err := verifySnapshot(ctx, path); err != nil {
+		t.Fatalf("Expected a valid snapshot, got %v", err)
+	}
+
+	// Overwrite the tail of the file, where the index pages are
+	file, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatalf("Failed to open snapshot: %v", err)
+	}
+	info, _ := file.Stat()
+	garbage := make([]byte, 4096)
+	for i := range garbage {
+		garbage[i] = 0xA5
+	}
+	file.WriteAt(garbage, info.Size()-int64(len(garbage)))
+	file.Close()
+
+	if err := verifySnapshot(ctx, path); err == nil {
+		t.Error("Expected a corrupt snapshot to fail verification")
+	}
+}
@@ -1,12 +1,16 @@
 package main
 
 import (
+	"context"
 	"database/sql"
+	"errors"
 	"fmt"
 	"strings"
 	"sync"
+	"sync/atomic"
 
-	_ "github.com/mattn/go-sqlite3"
+	"github.com/lib/pq/oid"
+	"github.com/mattn/go-sqlite3"
 )
 
 // SQLiteBackend manages SQLite database connections and operations
@@ -16,16 +20,36 @@ type SQLiteBackend struct {
 	transactionMode string
 	mu              sync.RWMutex
 	connections     map[string]*ConnectionState
+	databaseName    atomic.Value             // reported by current_database()
+	serverSettings  map[string]string        // configured setting defaults
+	databaseLister  func() ([]string, error) // lists pg_database, nil for this database only
 }
 
 // ConnectionState tracks the state of a client connection
 type ConnectionState struct {
-	ID           string
-	Tx           *sql.Tx
-	InTx         bool
-	TxStatus     TransactionStatus
+	ID            string
+	Tx            *sql.Tx
+	TxConn        *sql.Conn // the pooled connection Tx runs on
+	InTx          bool
+	TxStatus      TransactionStatus
 	PreparedStmts map[string]*sql.Stmt
-	mu           sync.Mutex
+	Savepoints    []string // open savepoints, innermost last
+	mu            sync.Mutex
+
+	// preparedQueries and preparedTx record the text of each prepared
+	// statement and the transaction it had to be prepared in, if any
+	preparedQueries map[string]string
+	preparedTx      map[string]*sql.Tx
+
+	// settings holds the run-time parameters changed with SET and
+	// localSettings those changed with SET LOCAL; statements holding mu
+	// read them through current_setting(), so they have their own lock.
+	// txSettings is settings at BEGIN, restored by ROLLBACK.
+	settingsMu     sync.Mutex
+	settings       map[string]string
+	localSettings  map[string]string
+	txSettings     map[string]string
+	serverSettings map[string]string // server-wide defaults, read-only
 }
 
 // TransactionStatus represents the current transaction status
@@ -37,13 +61,34 @@ const (
 	TxFailed
 )
 
+// Indicator returns the status byte sent in ReadyForQuery messages
+func (s TransactionStatus) Indicator() byte {
+	switch s {
+	case TxInTransaction:
+		return 'T'
+	case TxFailed:
+		return 'E'
+	default:
+		return 'I'
+	}
+}
+
 // NewSQLiteBackend creates a new SQLite backend
 func NewSQLiteBackend(dbPath string, transactionMode string, maxConnections int) (*SQLiteBackend, error) {
-	// Open SQLite database with connection pooling
-	db, err := sql.Open("sqlite3", dbPath+"?_journal_mode=WAL&_timeout=5000&_busy_timeout=5000")
-	if err != nil {
-		return nil, fmt.Errorf("failed to open SQLite database: %w", err)
+	b := &SQLiteBackend{
+		dbPath:          dbPath,
+		transactionMode: transactionMode,
+		connections:     make(map[string]*ConnectionState),
+	}
+	b.databaseName.Store("postgres")
+
+	// Open SQLite database with connection pooling; every connection runs
+	// setupConnection to get the PostgreSQL functions and catalog
+	connector := &sqliteConnector{
+		driver: &sqlite3.SQLiteDriver{ConnectHook: b.setupConnection},
+		dsn:    dbPath + "?_journal_mode=WAL&_timeout=5000&_busy_timeout=5000",
 	}
+	db := sql.OpenDB(connector)
 
 	// Set connection pool settings
 	db.SetMaxOpenConns(maxConnections)
@@ -55,12 +100,18 @@ func NewSQLiteBackend(dbPath string, transactionMode string, maxConnections int)
 		return nil, fmt.Errorf("failed to ping SQLite database: %w", err)
 	}
 
-	return &SQLiteBackend{
-		db:              db,
-		dbPath:          dbPath,
-		transactionMode: transactionMode,
-		connections:     make(map[string]*ConnectionState),
-	}, nil
+	b.db = db
+	return b, nil
+}
+
+// SetDatabaseName sets the database name reported to clients
+func (b *SQLiteBackend) SetDatabaseName(name string) {
+	b.databaseName.Store(name)
+}
+
+// DatabaseName returns the database name reported to clients
+func (b *SQLiteBackend) DatabaseName() string {
+	return b.databaseName.Load().(string)
 }
 
 // GetOrCreateConnection gets or creates a connection state for a connection ID
@@ -71,9 +122,12 @@ func (b *SQLiteBackend) GetOrCreateConnection(connectionID string) *ConnectionSt
 	conn, exists := b.connections[connectionID]
 	if !exists {
 		conn = &ConnectionState{
-			ID:            connectionID,
-			PreparedStmts: make(map[string]*sql.Stmt),
-			TxStatus:      TxIdle,
+			ID:              connectionID,
+			PreparedStmts:   make(map[string]*sql.Stmt),
+			TxStatus:        TxIdle,
+			preparedQueries: make(map[string]string),
+			preparedTx:      make(map[string]*sql.Tx),
+			serverSettings:  b.serverSettings,
 		}
 		b.connections[connectionID] = conn
 	}
@@ -94,9 +148,12 @@ func (b *SQLiteBackend) RemoveConnection(connectionID string) {
 		conn.mu.Unlock()
 
 		// Rollback any active transaction
+		conn.mu.Lock()
 		if conn.InTx && conn.Tx != nil {
 			conn.Tx.Rollback()
+			endTransactionLocked(conn)
 		}
+		conn.mu.Unlock()
 
 		delete(b.connections, connectionID)
 	}
@@ -109,7 +166,7 @@ func (b *SQLiteBackend) BeginTransaction(connectionID string, mode string) error
 	defer conn.mu.Unlock()
 
 	if conn.InTx {
-		return fmt.Errorf("transaction already in progress")
+		return newPostgresError("25001", "there is already a transaction in progress")
 	}
 
 	// Determine transaction mode
@@ -118,32 +175,41 @@ func (b *SQLiteBackend) BeginTransaction(connectionID string, mode string) error
 		txMode = b.transactionMode
 	}
 
+	// The transaction keeps its connection, so that statements can be
+	// described against the transaction's schema without running them
+	txConn, err := b.db.Conn(context.Background())
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+
 	// Begin transaction with appropriate mode
 	var tx *sql.Tx
-	var err error
 
 	switch strings.ToLower(txMode) {
 	case "immediate":
-		tx, err = b.db.Begin()
+		tx, err = txConn.BeginTx(context.Background(), nil)
 		if err == nil {
 			_, err = tx.Exec("BEGIN IMMEDIATE")
 		}
 	case "exclusive":
-		tx, err = b.db.Begin()
+		tx, err = txConn.BeginTx(context.Background(), nil)
 		if err == nil {
 			_, err = tx.Exec("BEGIN EXCLUSIVE")
 		}
 	default: // deferred
-		tx, err = b.db.Begin()
+		tx, err = txConn.BeginTx(context.Background(), nil)
 	}
 
 	if err != nil {
+		txConn.Close()
 		return fmt.Errorf("failed to begin transaction: %w", err)
 	}
 
 	conn.Tx = tx
+	conn.TxConn = txConn
 	conn.InTx = true
 	conn.TxStatus = TxInTransaction
+	conn.beginTransactionSettings()
 
 	return nil
 }
@@ -155,7 +221,7 @@ func (b *SQLiteBackend) CommitTransaction(connectionID string) error {
 	defer conn.mu.Unlock()
 
 	if !conn.InTx || conn.Tx == nil {
-		return fmt.Errorf("no transaction in progress")
+		return newPostgresError("25P01", "there is no transaction in progress")
 	}
 
 	if err := conn.Tx.Commit(); err != nil {
@@ -163,10 +229,7 @@ func (b *SQLiteBackend) CommitTransaction(connectionID string) error {
 		return fmt.Errorf("failed to commit transaction: %w", err)
 	}
 
-	conn.Tx = nil
-	conn.InTx = false
-	conn.TxStatus = TxIdle
-
+	endTransactionLocked(conn)
 	return nil
 }
 
@@ -177,46 +240,295 @@ func (b *SQLiteBackend) RollbackTransaction(connectionID string) error {
 	defer conn.mu.Unlock()
 
 	if !conn.InTx || conn.Tx == nil {
-		return fmt.Errorf("no transaction in progress")
+		return newPostgresError("25P01", "there is no transaction in progress")
 	}
 
-	if err := conn.Tx.Rollback(); err != nil {
+	// A failed COMMIT has already ended the transaction
+	if err := conn.Tx.Rollback(); err != nil && !errors.Is(err, sql.ErrTxDone) {
 		return fmt.Errorf("failed to rollback transaction: %w", err)
 	}
+	conn.rollbackTransactionSettings()
 
+	endTransactionLocked(conn)
+	return nil
+}
+
+// endTransactionLocked clears the ended transaction of a connection and
+// returns its connection to the pool. The caller must hold conn.mu.
+func endTransactionLocked(conn *ConnectionState) {
+	if conn.TxConn != nil {
+		conn.TxConn.Close()
+	}
 	conn.Tx = nil
+	conn.TxConn = nil
 	conn.InTx = false
 	conn.TxStatus = TxIdle
+	conn.Savepoints = nil
+}
+
+// Savepoint establishes a savepoint in the current transaction
+func (b *SQLiteBackend) Savepoint(connectionID string, name string) error {
+	conn := b.GetOrCreateConnection(connectionID)
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+
+	if !conn.InTx || conn.Tx == nil {
+		return newPostgresError("25P01", "SAVEPOINT can only be used in transaction blocks")
+	}
+
+	if _, err := conn.Tx.Exec("SAVEPOINT " + quoteIdentifier(name)); err != nil {
+		return fmt.Errorf("failed to create savepoint: %w", err)
+	}
+	conn.Savepoints = append(conn.Savepoints, name)
+	return nil
+}
+
+// ReleaseSavepoint destroys a savepoint and all savepoints established after it,
+// keeping their changes
+func (b *SQLiteBackend) ReleaseSavepoint(connectionID string, name string) error {
+	conn := b.GetOrCreateConnection(connectionID)
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
 
+	i, err := findSavepointLocked(conn, "RELEASE SAVEPOINT", name)
+	if err != nil {
+		return err
+	}
+
+	if _, err := conn.Tx.Exec("RELEASE " + quoteIdentifier(name)); err != nil {
+		return fmt.Errorf("failed to release savepoint: %w", err)
+	}
+	conn.Savepoints = conn.Savepoints[:i]
 	return nil
 }
 
+// RollbackToSavepoint undoes the changes made after a savepoint. The
+// savepoint stays established, and a failed transaction becomes usable again.
+func (b *SQLiteBackend) RollbackToSavepoint(connectionID string, name string) error {
+	conn := b.GetOrCreateConnection(connectionID)
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+
+	i, err := findSavepointLocked(conn, "ROLLBACK TO SAVEPOINT", name)
+	if err != nil {
+		return err
+	}
+
+	if _, err := conn.Tx.Exec("ROLLBACK TO " + quoteIdentifier(name)); err != nil {
+		return fmt.Errorf("failed to roll back to savepoint: %w", err)
+	}
+	conn.Savepoints = conn.Savepoints[:i+1]
+	conn.TxStatus = TxInTransaction
+	return nil
+}
+
+// findSavepointLocked returns the position of the innermost savepoint with
+// the given name. The caller must hold conn.mu.
+func findSavepointLocked(conn *ConnectionState, command string, name string) (int, error) {
+	if !conn.InTx || conn.Tx == nil {
+		return 0, newPostgresError("25P01", "%s can only be used in transaction blocks", command)
+	}
+	for i := len(conn.Savepoints) - 1; i >= 0; i-- {
+		if conn.Savepoints[i] == name {
+			return i, nil
+		}
+	}
+	return 0, newPostgresError("3B001", "savepoint %q does not exist", name)
+}
+
+// FailTransaction marks the current transaction as failed; statements are
+// refused until it is rolled back, as PostgreSQL does after an error
+func (b *SQLiteBackend) FailTransaction(connectionID string) {
+	conn := b.GetOrCreateConnection(connectionID)
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+
+	if conn.InTx {
+		conn.TxStatus = TxFailed
+	}
+}
+
+// quoteIdentifier quotes a name for use as a SQL identifier
+func quoteIdentifier(name string) string {
+	return `"` + strings.ReplaceAll(name, `"`, `""`) + `"`
+}
+
 // Query executes a query and returns rows
 func (b *SQLiteBackend) Query(connectionID string, query string, args ...interface{}) (*sql.Rows, error) {
+	return b.QueryContext(context.Background(), connectionID, query, args...)
+}
+
+// QueryContext executes a query and returns rows. Canceling the context
+// interrupts the running SQLite statement.
+func (b *SQLiteBackend) QueryContext(ctx context.Context, connectionID string, query string, args ...interface{}) (*sql.Rows, error) {
 	conn := b.GetOrCreateConnection(connectionID)
 	conn.mu.Lock()
 	defer conn.mu.Unlock()
 
 	// Use transaction if active, otherwise use regular connection
 	if conn.InTx && conn.Tx != nil {
-		return conn.Tx.Query(query, args...)
+		return conn.Tx.QueryContext(ctx, query, args...)
 	}
 
-	return b.db.Query(query, args...)
+	return b.db.QueryContext(ctx, query, args...)
 }
 
 // Exec executes a query that doesn't return rows
 func (b *SQLiteBackend) Exec(connectionID string, query string, args ...interface{}) (sql.Result, error) {
+	return b.ExecContext(context.Background(), connectionID, query, args...)
+}
+
+// ExecContext executes a query that doesn't return rows. Canceling the
+// context interrupts the running SQLite statement.
+func (b *SQLiteBackend) ExecContext(ctx context.Context, connectionID string, query string, args ...interface{}) (sql.Result, error) {
 	conn := b.GetOrCreateConnection(connectionID)
 	conn.mu.Lock()
 	defer conn.mu.Unlock()
 
 	// Use transaction if active, otherwise use regular connection
 	if conn.InTx && conn.Tx != nil {
-		return conn.Tx.Exec(query, args...)
+		return conn.Tx.ExecContext(ctx, query, args...)
+	}
+
+	return b.db.ExecContext(ctx, query, args...)
+}
+
+// ColumnDescription is the name and declared type of a result column
+type ColumnDescription struct {
+	Name     string
+	DeclType string
+}
+
+// Describe returns the result columns of a query. The query is prepared on
+// the connection of the open transaction, if any, so that it sees the
+// transaction's schema changes, and is never stepped.
+func (b *SQLiteBackend) Describe(connectionID string, query string) ([]ColumnDescription, error) {
+	conn := b.GetOrCreateConnection(connectionID)
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+
+	sqlConn := conn.TxConn
+	if sqlConn == nil {
+		var err error
+		if sqlConn, err = b.db.Conn(context.Background()); err != nil {
+			return nil, err
+		}
+		defer sqlConn.Close()
+	}
+
+	var columns []ColumnDescription
+	err := sqlConn.Raw(func(driverConn interface{}) error {
+		stmt, err := driverConn.(*sqlite3.SQLiteConn).Prepare(query)
+		if err != nil {
+			return err
+		}
+		defer stmt.Close()
+
+		// The column metadata is read through rows; creating them binds no
+		// parameters and does not step the statement
+		rows, err := stmt.(*sqlite3.SQLiteStmt).Query(nil)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		sqliteRows := rows.(*sqlite3.SQLiteRows)
+		for i, name := range sqliteRows.Columns() {
+			columns = append(columns, ColumnDescription{Name: name, DeclType: sqliteRows.ColumnTypeDatabaseTypeName(i)})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Computed columns have no declared type; it is derived from the
+	// expression in the select list
+	items := selectListItems(query)
+	for i := range columns {
+		if columns[i].DeclType == "" && len(items) == len(columns) {
+			columns[i].DeclType = expressionDeclType(items[i])
+		}
 	}
+	return columns, nil
+}
 
-	return b.db.Exec(query, args...)
+// selectListItems returns the expressions a SELECT returns, nil when the
+// statement is not a SELECT
+func selectListItems(query string) [][]token {
+	sig := significantTokens(tokenize(query))
+	if len(sig) == 0 || !sig[0].is("SELECT") {
+		return nil
+	}
+	sig = sig[1:]
+	if len(sig) > 0 && (sig[0].is("DISTINCT") || sig[0].is("ALL")) {
+		sig = sig[1:]
+	}
+
+	depth := 0
+	for i, t := range sig {
+		switch {
+		case t.isPunct("("):
+			depth++
+		case t.isPunct(")"):
+			depth--
+		case depth == 0 && (t.isPunct(";") || t.is("FROM") || t.is("WHERE") || t.is("GROUP") || t.is("HAVING") ||
+			t.is("WINDOW") || t.is("ORDER") || t.is("LIMIT") || t.is("UNION") || t.is("INTERSECT") || t.is("EXCEPT")):
+			return splitTopLevel(sig[:i])
+		}
+	}
+	return splitTopLevel(sig)
+}
+
+// expressionDeclType returns the declared type of a select list expression
+// from its literals, casts and aggregates, empty when it is unknown
+func expressionDeclType(expr []token) string {
+	// Drop the column alias
+	if n := len(expr); n > 2 && expr[n-2].is("AS") {
+		expr = expr[:n-2]
+	} else if n > 1 && (expr[n-1].Kind == tokenIdent || expr[n-1].Kind == tokenQuotedIdent) &&
+		(expr[n-2].isPunct(")") || expr[n-2].Kind == tokenString || expr[n-2].Kind == tokenNumber) {
+		expr = expr[:n-1]
+	}
+
+	switch {
+	case len(expr) == 2 && (expr[0].isPunct("-") || expr[0].isPunct("+")) && expr[1].Kind == tokenNumber:
+		expr = expr[1:]
+		fallthrough
+	case len(expr) == 1 && expr[0].Kind == tokenNumber:
+		if strings.ContainsAny(expr[0].Text, ".eE") {
+			return "NUMERIC"
+		}
+		return "INTEGER"
+	case len(expr) == 1 && expr[0].Kind == tokenString:
+		if expr[0].Text[0] == 'x' || expr[0].Text[0] == 'X' {
+			return "BLOB"
+		}
+		return "TEXT"
+	case len(expr) > 3 && expr[0].is("CAST") && expr[1].isPunct("(") && matchingParen(expr, 1) == len(expr)-1:
+		for i := len(expr) - 2; i > 2; i-- {
+			if expr[i].is("AS") {
+				return joinTokens(expr[i+1 : len(expr)-1])
+			}
+		}
+	case len(expr) > 2 && expr[0].Kind == tokenIdent && expr[1].isPunct("(") && matchingParen(expr, 1) == len(expr)-1:
+		switch strings.ToLower(expr[0].Text) {
+		case "count", "length", "octet_length", "instr", "unicode":
+			return "INTEGER"
+		case "sum", "avg":
+			return "NUMERIC"
+		case "total":
+			return "REAL"
+		case "lower", "upper", "trim", "ltrim", "rtrim", "replace", "substr", "group_concat", "string_agg":
+			return "TEXT"
+		}
+	}
+	for _, t := range expr {
+		if t.isPunct("||") {
+			return "TEXT"
+		}
+	}
+	return ""
 }
 
 // Prepare prepares a statement
@@ -228,38 +540,114 @@ func (b *SQLiteBackend) Prepare(connectionID string, name string, query string)
 	// Close existing statement with same name
 	if stmt, exists := conn.PreparedStmts[name]; exists {
 		stmt.Close()
+		delete(conn.PreparedStmts, name)
 	}
 
 	// Prepare new statement
-	var stmt *sql.Stmt
-	var err error
-
-	if conn.InTx && conn.Tx != nil {
-		stmt, err = conn.Tx.Prepare(query)
-	} else {
-		stmt, err = b.db.Prepare(query)
-	}
-
+	stmt, tx, err := b.prepareLocked(conn, query)
 	if err != nil {
 		return fmt.Errorf("failed to prepare statement: %w", err)
 	}
 
 	conn.PreparedStmts[name] = stmt
+	conn.preparedQueries[name] = query
+	conn.preparedTx[name] = tx
 	return nil
 }
 
+// prepareLocked prepares a statement on the database so it outlives the
+// current transaction, falling back to the transaction for objects that
+// only exist inside it. The caller must hold conn.mu.
+func (b *SQLiteBackend) prepareLocked(conn *ConnectionState, query string) (*sql.Stmt, *sql.Tx, error) {
+	stmt, err := b.db.Prepare(query)
+	if err == nil || !conn.InTx || conn.Tx == nil {
+		return stmt, nil, err
+	}
+
+	stmt, err = conn.Tx.Prepare(query)
+	if err != nil {
+		return nil, nil, err
+	}
+	return stmt, conn.Tx, nil
+}
+
+// preparedLocked returns a named statement bound to the active transaction.
+// The caller must hold conn.mu.
+func (b *SQLiteBackend) preparedLocked(conn *ConnectionState, name string) (*sql.Stmt, error) {
+	stmt, exists := conn.PreparedStmts[name]
+	if !exists {
+		return nil, fmt.Errorf("prepared statement not found: %s", name)
+	}
+
+	// Statements prepared inside a transaction are closed when it ends
+	if tx := conn.preparedTx[name]; tx != nil && tx != conn.Tx {
+		var err error
+		stmt, tx, err = b.prepareLocked(conn, conn.preparedQueries[name])
+		if err != nil {
+			delete(conn.PreparedStmts, name)
+			return nil, fmt.Errorf("failed to prepare statement: %w", err)
+		}
+		conn.PreparedStmts[name] = stmt
+		conn.preparedTx[name] = tx
+	}
+
+	if conn.InTx && conn.Tx != nil && conn.preparedTx[name] == nil {
+		return conn.Tx.Stmt(stmt), nil
+	}
+	return stmt, nil
+}
+
 // ExecutePrepared executes a prepared statement
-func (b *SQLiteBackend) ExecutePrepared(connectionID string, name string, args ...interface{}) (*sql.Rows, error) {
+func (b *SQLiteBackend) ExecutePrepared(ctx context.Context, connectionID string, name string, args ...interface{}) (*sql.Rows, error) {
 	conn := b.GetOrCreateConnection(connectionID)
 	conn.mu.Lock()
 	defer conn.mu.Unlock()
 
-	stmt, exists := conn.PreparedStmts[name]
-	if !exists {
-		return nil, fmt.Errorf("prepared statement not found: %s", name)
+	stmt, err := b.preparedLocked(conn, name)
+	if err != nil {
+		return nil, err
+	}
+
+	return stmt.QueryContext(ctx, args...)
+}
+
+// ExecPrepared executes a prepared statement that doesn't return rows
+func (b *SQLiteBackend) ExecPrepared(ctx context.Context, connectionID string, name string, args ...interface{}) (sql.Result, error) {
+	conn := b.GetOrCreateConnection(connectionID)
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+
+	stmt, err := b.preparedLocked(conn, name)
+	if err != nil {
+		return nil, err
 	}
 
-	return stmt.Query(args...)
+	return stmt.ExecContext(ctx, args...)
+}
+
+// InsertRows runs an INSERT statement once per row in the current
+// transaction, preparing it only once
+func (b *SQLiteBackend) InsertRows(ctx context.Context, connectionID string, query string, rows [][]interface{}) error {
+	conn := b.GetOrCreateConnection(connectionID)
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+
+	if !conn.InTx || conn.Tx == nil {
+		return newPostgresError("25P01", "there is no transaction in progress")
+	}
+
+	stmt, err := conn.Tx.PrepareContext(ctx, query)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	for _, row := range rows {
+		if _, err := stmt.ExecContext(ctx, row...); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 // ClosePrepared closes a prepared statement
@@ -273,14 +661,35 @@ func (b *SQLiteBackend) ClosePrepared(connectionID string, name string) error {
 		return nil // Already closed or doesn't exist
 	}
 
+	delete(conn.PreparedStmts, name)
+	delete(conn.preparedQueries, name)
+	delete(conn.preparedTx, name)
+
 	if err := stmt.Close(); err != nil {
 		return fmt.Errorf("failed to close prepared statement: %w", err)
 	}
-
-	delete(conn.PreparedStmts, name)
 	return nil
 }
 
+// TableColumnTypes returns the declared types of a table's columns keyed by column name
+func (b *SQLiteBackend) TableColumnTypes(connectionID string, table string) (map[string]string, error) {
+	rows, err := b.Query(connectionID, "SELECT name, type FROM pragma_table_info(?)", table)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	types := make(map[string]string)
+	for rows.Next() {
+		var name, declType string
+		if err := rows.Scan(&name, &declType); err != nil {
+			return nil, err
+		}
+		types[strings.ToLower(name)] = declType
+	}
+	return types, rows.Err()
+}
+
 // GetTransactionStatus returns the current transaction status
 func (b *SQLiteBackend) GetTransactionStatus(connectionID string) TransactionStatus {
 	conn := b.GetOrCreateConnection(connectionID)
@@ -308,6 +717,7 @@ func (b *SQLiteBackend) Close() error {
 		// Rollback any active transactions
 		if conn.InTx && conn.Tx != nil {
 			conn.Tx.Rollback()
+			endTransactionLocked(conn)
 		}
 
 		conn.mu.Unlock()
@@ -327,6 +737,10 @@ func SQLiteTypeToPostgres(sqliteType string) string {
 
 	// Handle common SQLite type affinities
 	switch {
+	case sqliteType == "UUID":
+		return "uuid"
+	case sqliteType == "INT4":
+		return "int4" // INT and INTEGER stay int8, SQLite stores 64-bit integers
 	case strings.Contains(sqliteType, "INT"):
 		return "int8"
 	case strings.Contains(sqliteType, "CHAR") || strings.Contains(sqliteType, "CLOB") || strings.Contains(sqliteType, "TEXT"):
@@ -337,10 +751,10 @@ func SQLiteTypeToPostgres(sqliteType string) string {
 		return "float8"
 	case strings.Contains(sqliteType, "NUMERIC") || strings.Contains(sqliteType, "DECIMAL"):
 		return "numeric"
-	case strings.Contains(sqliteType, "DATE"):
-		return "date"
 	case strings.Contains(sqliteType, "TIME"):
 		return "timestamp"
+	case strings.Contains(sqliteType, "DATE"):
+		return "date"
 	case strings.Contains(sqliteType, "BOOL"):
 		return "bool"
 	default:
@@ -348,15 +762,90 @@ func SQLiteTypeToPostgres(sqliteType string) string {
 	}
 }
 
+// PostgresTypeOID returns the type OID for a PostgreSQL type name returned by SQLiteTypeToPostgres
+func PostgresTypeOID(pgType string) oid.Oid {
+	switch pgType {
+	case "int4":
+		return oid.T_int4
+	case "int8":
+		return oid.T_int8
+	case "bytea":
+		return oid.T_bytea
+	case "float8":
+		return oid.T_float8
+	case "numeric":
+		return oid.T_numeric
+	case "date":
+		return oid.T_date
+	case "timestamp":
+		return oid.T_timestamp
+	case "bool":
+		return oid.T_bool
+	case "uuid":
+		return oid.T_uuid
+	default:
+		return oid.T_text
+	}
+}
+
 // MapSQLiteError maps SQLite error codes to PostgreSQL SQLSTATE codes
 func MapSQLiteError(err error) string {
 	if err == nil {
 		return "00000" // Success
 	}
 
-	errMsg := err.Error()
+	var sqliteErr sqlite3.Error
+	if !errors.As(err, &sqliteErr) {
+		// Errors that carry no SQLite code are classified by their message
+		return mapErrorMessage(err.Error())
+	}
+
+	switch sqliteErr.ExtendedCode {
+	case sqlite3.ErrConstraintUnique, sqlite3.ErrConstraintPrimaryKey, sqlite3.ErrConstraintRowID:
+		return "23505" // unique_violation
+	case sqlite3.ErrConstraintNotNull:
+		return "23502" // not_null_violation
+	case sqlite3.ErrConstraintForeignKey:
+		return "23503" // foreign_key_violation
+	case sqlite3.ErrConstraintCheck:
+		return "23514" // check_violation
+	}
+
+	switch sqliteErr.Code {
+	case sqlite3.ErrConstraint:
+		return "23000" // integrity_constraint_violation
+	case sqlite3.ErrBusy, sqlite3.ErrLocked:
+		return "40001" // serialization_failure
+	case sqlite3.ErrInterrupt:
+		return "57014" // query_canceled
+	case sqlite3.ErrIoErr:
+		return "08006" // connection_failure
+	case sqlite3.ErrCorrupt, sqlite3.ErrNotADB:
+		return "58030" // io_error
+	case sqlite3.ErrNomem:
+		return "53200" // out_of_memory
+	case sqlite3.ErrFull:
+		return "53100" // disk_full
+	case sqlite3.ErrReadonly:
+		return "25006" // read_only_sql_transaction
+	case sqlite3.ErrPerm, sqlite3.ErrAuth:
+		return "42501" // insufficient_privilege
+	case sqlite3.ErrTooBig:
+		return "54000" // program_limit_exceeded
+	case sqlite3.ErrMismatch:
+		return "42804" // datatype_mismatch
+	case sqlite3.ErrRange:
+		return "22023" // invalid_parameter_value
+	case sqlite3.ErrError:
+		// Generic SQL errors only differ in their message
+		return mapErrorMessage(sqliteErr.Error())
+	default:
+		return "XX000" // internal_error
+	}
+}
 
-	// Map common SQLite errors to PostgreSQL SQLSTATE codes
+// mapErrorMessage maps an error message to a PostgreSQL SQLSTATE code
+func mapErrorMessage(errMsg string) string {
 	switch {
 	case strings.Contains(errMsg, "UNIQUE constraint failed"):
 		return "23505" // unique_violation
@@ -378,12 +867,22 @@ func MapSQLiteError(err error) string {
 		return "42P01" // undefined_table
 	case strings.Contains(errMsg, "no such column"):
 		return "42703" // undefined_column
-	case strings.Contains(errMsg, "syntax error"):
+	case strings.Contains(errMsg, "no such function"):
+		return "42883" // undefined_function
+	case strings.Contains(errMsg, "already exists"):
+		return "42P07" // duplicate_table
+	case strings.Contains(errMsg, "syntax error"), strings.Contains(errMsg, "incomplete input"):
 		return "42601" // syntax_error
 	case strings.Contains(errMsg, "out of memory"):
 		return "53200" // out_of_memory
 	case strings.Contains(errMsg, "disk full"):
 		return "53100" // disk_full
+	case strings.Contains(errMsg, "unrecognized configuration parameter"):
+		return "42704" // undefined_object
+	case strings.Contains(errMsg, "cannot be changed"):
+		return "55P02" // cant_change_runtime_param
+	case strings.Contains(errMsg, "invalid value for parameter"):
+		return "22023" // invalid_parameter_value
 	default:
 		return "XX000" // internal_error
 	}
@@ -3,6 +3,8 @@ package main
 import (
 	"os"
 	"testing"
+
+	"github.com/lib/pq/oid"
 )
 
 func TestSQLiteBackend(t *testing.T) {
@@ -264,3 +266,101 @@ func TestConnectionCleanup(t *testing.T) {
 		t.Error("Connection should be removed")
 	}
 }
+
+func TestDescribe(t *testing.T) {
+	tmpFile, err := os.CreateTemp("", "test-*.sqlite")
+	if err != nil {
+		t.Fatalf("Failed to create temp file: %v", err)
+	}
+	defer os.Remove(tmpFile.Name())
+	tmpFile.Close()
+
+	backend, err := NewSQLiteBackend(tmpFile.Name(), "deferred", 5)
+	if err != nil {
+		t.Fatalf("Failed to create backend: %v", err)
+	}
+	defer backend.Close()
+
+	connID := "test-conn-6"
+
+	_, err = backend.Exec(connID, "CREATE TABLE test (id INTEGER, name TEXT, created DATETIME)")
+	if err != nil {
+		t.Fatalf("Failed to create table: %v", err)
+	}
+
+	columnTypes, err := backend.Describe(connID, "SELECT id, name, created FROM test")
+	if err != nil {
+		t.Fatalf("Failed to describe query: %v", err)
+	}
+
+	columns := buildColumns(columnTypes)
+	expected := []struct {
+		name string
+		oid  oid.Oid
+	}{
+		{"id", oid.T_int8},
+		{"name", oid.T_text},
+		{"created", oid.T_timestamp},
+	}
+
+	if len(columns) != len(expected) {
+		t.Fatalf("Expected %d columns, got %d", len(expected), len(columns))
+	}
+	for i, want := range expected {
+		if columns[i].Name != want.name || columns[i].Oid != want.oid {
+			t.Errorf("Column %d = %s (%d); want %s (%d)", i, columns[i].Name, columns[i].Oid, want.name, want.oid)
+		}
+	}
+
+	// Describing must not execute the statement
+	if _, err := backend.Describe(connID, "INSERT INTO test (id) VALUES (1) RETURNING id"); err != nil {
+		t.Fatalf("Failed to describe insert: %v", err)
+	}
+
+	rows, err := backend.Query(connID, "SELECT COUNT(*) FROM test")
+	if err != nil {
+		t.Fatalf("Failed to query: %v", err)
+	}
+	defer rows.Close()
+
+	var count int
+	if !rows.Next() {
+		t.Fatal("Expected row count")
+	}
+	if err := rows.Scan(&count); err != nil {
+		t.Fatalf("Failed to scan count: %v", err)
+	}
+	if count != 0 {
+		t.Errorf("Expected describe to leave the table empty, got %d rows", count)
+	}
+	rows.Close()
+
+	// Computed columns are typed by their expressions
+	described, err := backend.Describe(connID, "SELECT count(*), 1, 'a' || name, 2.5, x'00', sum(id) AS total, CAST(name AS INTEGER) n FROM test")
+	if err != nil {
+		t.Fatalf("Failed to describe computed columns: %v", err)
+	}
+	for i, want := range []oid.Oid{oid.T_int8, oid.T_int8, oid.T_text, oid.T_numeric, oid.T_bytea, oid.T_numeric, oid.T_int8} {
+		if got := buildColumns(described)[i].Oid; got != want {
+			t.Errorf("Computed column %d = %d; want %d", i, got, want)
+		}
+	}
+
+	// Inside a transaction the statement sees the transaction's schema
+	if err := backend.BeginTransaction(connID, "deferred"); err != nil {
+		t.Fatalf("Failed to begin: %v", err)
+	}
+	if _, err := backend.Exec(connID, "ALTER TABLE test ADD COLUMN flag BOOLEAN"); err != nil {
+		t.Fatalf("Failed to alter table: %v", err)
+	}
+	described, err = backend.Describe(connID, "SELECT * FROM test")
+	if err != nil {
+		t.Fatalf("Failed to describe query in transaction: %v", err)
+	}
+	if len(described) != 4 || described[3].Name != "flag" {
+		t.Errorf("Expected the column added in the transaction, got %+v", described)
+	}
+	if err := backend.RollbackTransaction(connID); err != nil {
+		t.Fatalf("Failed to roll back: %v", err)
+	}
+}
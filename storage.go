@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"os"
@@ -13,9 +14,11 @@ import (
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
 )
 
-// BlobStorage defines the interface for blob storage backends
+// BlobStorage defines the interface for blob storage backends. List returns
+// the names of every stored blob, WAL segments included.
 type BlobStorage interface {
 	Download(ctx context.Context, dbName string) (io.ReadCloser, error)
 	Upload(ctx context.Context, dbName string, data io.Reader) error
@@ -195,20 +198,22 @@ func (s *S3Storage) Upload(ctx context.Context, dbName string, data io.Reader) e
 }
 
 func (s *S3Storage) List(ctx context.Context) ([]string, error) {
-	result, err := s.client.ListObjectsV2(ctx, &s3.ListObjectsV2Input{
+	paginator := s3.NewListObjectsV2Paginator(s.client, &s3.ListObjectsV2Input{
 		Bucket: aws.String(s.bucket),
 		Prefix: aws.String(s.prefix),
 	})
-	if err != nil {
-		return nil, fmt.Errorf("failed to list S3 objects: %w", err)
-	}
 
 	var databases []string
-	for _, obj := range result.Contents {
-		key := *obj.Key
-		if len(key) > len(s.prefix)+7 { // prefix + name + .sqlite
-			name := key[len(s.prefix) : len(key)-7]
-			databases = append(databases, name)
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list S3 objects: %w", err)
+		}
+		for _, obj := range page.Contents {
+			key := aws.ToString(obj.Key)
+			if len(key) > len(s.prefix)+7 && key[len(key)-7:] == ".sqlite" { // prefix + name + .sqlite
+				databases = append(databases, key[len(s.prefix):len(key)-7])
+			}
 		}
 	}
 	return databases, nil
@@ -244,9 +249,12 @@ func (s *S3Storage) Exists(ctx context.Context, dbName string) (bool, error) {
 	return true, nil
 }
 
+// isS3NotFound reports whether err is the error GetObject returns for a
+// missing key, or the one HeadObject returns
 func isS3NotFound(err error) bool {
-	// Check if error is NoSuchKey or NotFound
-	return err != nil && (err.Error() == "NoSuchKey" || err.Error() == "NotFound")
+	var noSuchKey *types.NoSuchKey
+	var notFound *types.NotFound
+	return errors.As(err, &noSuchKey) || errors.As(err, &notFound)
 }
 
 // AzureStorage implements BlobStorage for Azure Blob Storage
@@ -376,11 +384,20 @@ func (s *AzureStorage) Exists(ctx context.Context, dbName string) (bool, error)
 
 // DatabaseCache manages local caching of database files
 type DatabaseCache struct {
-	storage      BlobStorage
-	localPath    string
-	lastSync     time.Time
-	ttlMinutes   int
-	dbName       string
+	storage    BlobStorage
+	localPath  string
+	lastSync   time.Time
+	ttlMinutes int
+	dbName     string
+
+	// wal is set when WAL segments are shipped on top of the snapshots.
+	// generation names the snapshot downloaded or last uploaded, which the
+	// segments apply to; empty until there is one.
+	wal           bool
+	generation    string
+	snapshotBytes int64
+	nextSegment   int
+	segmentBytes  int64 // of the segments on top of the snapshot
 }
 
 // NewDatabaseCache creates a new database cache
@@ -428,16 +445,34 @@ func (c *DatabaseCache) Download(ctx context.Context) error {
 	if _, err := io.Copy(file, reader); err != nil {
 		return fmt.Errorf("failed to write database to local file: %w", err)
 	}
+	if c.wal {
+		if c.generation, c.snapshotBytes, err = snapshotGeneration(c.localPath); err != nil {
+			return fmt.Errorf("failed to read downloaded database: %w", err)
+		}
+		if err := c.replaySegments(ctx, file); err != nil {
+			return err
+		}
+	}
 
 	c.lastSync = time.Now()
 	return nil
 }
 
-// Upload uploads the database from local cache to blob storage
-func (c *DatabaseCache) Upload(ctx context.Context) error {
-	file, err := os.Open(c.localPath)
+// Upload uploads a snapshot of the local database to blob storage. The
+// snapshot must be taken with SQLiteBackend.Snapshot, as the local file may
+// be torn while it is written and lacks the commits still in its WAL.
+func (c *DatabaseCache) Upload(ctx context.Context, snapshotPath string) error {
+	var generation string
+	var size int64
+	if c.wal {
+		var err error
+		if generation, size, err = snapshotGeneration(snapshotPath); err != nil {
+			return fmt.Errorf("failed to read database snapshot: %w", err)
+		}
+	}
+	file, err := os.Open(snapshotPath)
 	if err != nil {
-		return fmt.Errorf("failed to open local database file: %w", err)
+		return fmt.Errorf("failed to open database snapshot: %w", err)
 	}
 	defer file.Close()
 
@@ -446,6 +481,9 @@ func (c *DatabaseCache) Upload(ctx context.Context) error {
 	}
 
 	c.lastSync = time.Now()
+	if c.wal {
+		c.startGeneration(ctx, generation, size)
+	}
 	return nil
 }
 
@@ -454,8 +492,14 @@ func (c *DatabaseCache) ShouldSync() bool {
 	return time.Since(c.lastSync) > time.Duration(c.ttlMinutes)*time.Minute
 }
 
+// snapshotPath returns the path of the snapshot taken before each upload
+func (c *DatabaseCache) snapshotPath() string {
+	return c.localPath + "-snapshot"
+}
+
 // Cleanup removes the local cache file
 func (c *DatabaseCache) Cleanup() error {
+	os.Remove(c.snapshotPath())
 	if err := os.Remove(c.localPath); err != nil && !os.IsNotExist(err) {
 		return err
 	}
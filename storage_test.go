@@ -3,9 +3,15 @@ package main
 import (
 	"bytes"
 	"context"
+	"errors"
+	"fmt"
+	"io"
 	"os"
 	"path/filepath"
 	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/mattn/go-sqlite3"
 )
 
 func TestLocalStorage(t *testing.T) {
@@ -105,7 +111,7 @@ func TestDatabaseCache(t *testing.T) {
 	}
 
 	// Test Upload
-	if err := cache.Upload(ctx); err != nil {
+	if err := cache.Upload(ctx, localPath); err != nil {
 		t.Fatalf("Failed to upload: %v", err)
 	}
 
@@ -121,6 +127,38 @@ func TestDatabaseCache(t *testing.T) {
 	if !bytes.Equal(buf.Bytes(), testData) {
 		t.Fatalf("Uploaded content doesn't match. Expected %s, got %s", testData, buf.Bytes())
 	}
+
+	// Without WAL replication no segments are looked up
+	snapshotOnly := NewDatabaseCache(segmentlessStorage{storage}, "testdb", 5)
+	defer snapshotOnly.Cleanup()
+	if err := snapshotOnly.Download(ctx); err != nil {
+		t.Fatalf("Failed to download without replication: %v", err)
+	}
+}
+
+// segmentlessStorage fails the download of any WAL segment
+type segmentlessStorage struct {
+	BlobStorage
+}
+
+func (s segmentlessStorage) Download(ctx context.Context, name string) (io.ReadCloser, error) {
+	if isSegmentName(name) {
+		return nil, fmt.Errorf("unexpected download of segment %s", name)
+	}
+	return s.BlobStorage.Download(ctx, name)
+}
+
+func TestS3NotFound(t *testing.T) {
+	// The SDK wraps service errors in operation errors
+	if !isS3NotFound(fmt.Errorf("operation error S3: GetObject: %w", &types.NoSuchKey{})) {
+		t.Error("Expected a wrapped NoSuchKey to be recognized")
+	}
+	if !isS3NotFound(&types.NotFound{}) {
+		t.Error("Expected NotFound to be recognized")
+	}
+	if isS3NotFound(errors.New("AccessDenied")) {
+		t.Error("Expected other errors not to be recognized")
+	}
 }
 
 func TestSQLiteTypeMapping(t *testing.T) {
@@ -130,6 +168,7 @@ func TestSQLiteTypeMapping(t *testing.T) {
 	}{
 		{"INTEGER", "int8"},
 		{"INT", "int8"},
+		{"INT4", "int4"},
 		{"TEXT", "text"},
 		{"VARCHAR(255)", "text"},
 		{"REAL", "float8"},
@@ -140,6 +179,7 @@ func TestSQLiteTypeMapping(t *testing.T) {
 		{"DATE", "date"},
 		{"DATETIME", "timestamp"},
 		{"BOOLEAN", "bool"},
+		{"UUID", "uuid"},
 	}
 
 	for _, tt := range tests {
@@ -174,6 +214,29 @@ func TestMapSQLiteError(t *testing.T) {
 	}
 }
 
+func TestMapSQLiteErrorCodes(t *testing.T) {
+	tests := []struct {
+		err      error
+		sqlState string
+	}{
+		{sqlite3.Error{Code: sqlite3.ErrConstraint, ExtendedCode: sqlite3.ErrConstraintUnique}, "23505"},
+		{sqlite3.Error{Code: sqlite3.ErrConstraint, ExtendedCode: sqlite3.ErrConstraintPrimaryKey}, "23505"},
+		{sqlite3.Error{Code: sqlite3.ErrConstraint, ExtendedCode: sqlite3.ErrConstraintNotNull}, "23502"},
+		{sqlite3.Error{Code: sqlite3.ErrConstraint, ExtendedCode: sqlite3.ErrConstraintTrigger}, "23000"},
+		{sqlite3.Error{Code: sqlite3.ErrBusy, ExtendedCode: sqlite3.ErrBusySnapshot}, "40001"},
+		{sqlite3.Error{Code: sqlite3.ErrLocked}, "40001"},
+		{sqlite3.Error{Code: sqlite3.ErrFull}, "53100"},
+		{fmt.Errorf("exec error: %w", sqlite3.Error{Code: sqlite3.ErrReadonly}), "25006"},
+	}
+
+	for _, tt := range tests {
+		result := MapSQLiteError(tt.err)
+		if result != tt.sqlState {
+			t.Errorf("MapSQLiteError(%v) = %s; want %s", tt.err, result, tt.sqlState)
+		}
+	}
+}
+
 type mockError struct {
 	msg string
 }
@@ -232,6 +295,8 @@ server:
 database:
   name: yamldb
   sqlite_path: /tmp/yamldb.sqlite
+  statement_timeout: 30s
+  idle_in_transaction_session_timeout: 0
 `
 
 	if err := os.WriteFile(configPath, []byte(yamlContent), 0644); err != nil {
@@ -251,6 +316,10 @@ database:
 		t.Errorf("Expected host 127.0.0.1 from YAML, got %s", config.Server.Host)
 	}
 
+	if config.Database.StatementTimeout != "30s" || config.Database.IdleInTransactionSessionTimeout != "0" {
+		t.Errorf("Unexpected timeouts from YAML: %q, %q", config.Database.StatementTimeout, config.Database.IdleInTransactionSessionTimeout)
+	}
+
 	if config.Database.Name != "yamldb" {
 		t.Errorf("Expected database name 'yamldb' from YAML, got %s", config.Database.Name)
 	}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// idleCheckInterval is how often idle transactions are looked for
+const idleCheckInterval = time.Second
+
+// timeoutSettings are the run-time parameters holding a timeout
+var timeoutSettings = map[string]bool{
+	"statement_timeout":                   true,
+	"lock_timeout":                        true,
+	"idle_in_transaction_session_timeout": true,
+}
+
+// timeoutUnits are the units a timeout may be given in; a bare number is
+// in milliseconds
+var timeoutUnits = map[string]time.Duration{
+	"us":  time.Microsecond,
+	"ms":  time.Millisecond,
+	"s":   time.Second,
+	"min": time.Minute,
+	"h":   time.Hour,
+	"d":   24 * time.Hour,
+}
+
+// parseTimeoutSetting parses a timeout the way PostgreSQL does, such as
+// "500", "30s" or "5min". Zero disables the timeout.
+func parseTimeoutSetting(value string) (time.Duration, error) {
+	value = strings.TrimSpace(value)
+	end := len(value)
+	for end > 0 && strings.IndexByte("0123456789.", value[end-1]) < 0 {
+		end--
+	}
+
+	unit := time.Millisecond
+	if suffix := strings.TrimSpace(value[end:]); suffix != "" {
+		var ok bool
+		if unit, ok = timeoutUnits[suffix]; !ok {
+			return 0, fmt.Errorf("invalid timeout unit %q", suffix)
+		}
+	}
+
+	n, err := strconv.ParseFloat(value[:end], 64)
+	if err != nil || n < 0 || n*float64(unit) > math.MaxInt64 {
+		return 0, fmt.Errorf("invalid timeout %q", value)
+	}
+	return time.Duration(n * float64(unit)), nil
+}
+
+// sessionTimeout returns the value of a timeout parameter for the connection
+func (h *SimpleWireHandler) sessionTimeout(connectionID string, name string) time.Duration {
+	conn, ok := h.backend.lookupConnection(connectionID)
+	if !ok {
+		return 0
+	}
+	value, _ := conn.Setting(name)
+	timeout, err := parseTimeoutSetting(value)
+	if err != nil {
+		return 0
+	}
+	return timeout
+}
+
+// RunIdleReaper ends the transactions left idle for longer than the
+// session's idle_in_transaction_session_timeout until ctx is done
+func (h *SimpleWireHandler) RunIdleReaper(ctx context.Context) {
+	ticker := time.NewTicker(idleCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			h.reapIdleTransactions()
+		}
+	}
+}
+
+// reapIdleTransactions rolls back the transactions of sessions idle past
+// their timeout and terminates those sessions, as PostgreSQL does. An idle
+// transaction holds back WAL checkpoints and uploads.
+func (h *SimpleWireHandler) reapIdleTransactions() {
+	// Sessions may set their own timeout, so the check runs once per value
+	timeouts := make(map[time.Duration][]*Session)
+	for _, session := range h.cancels.Sessions() {
+		if timeout := h.sessionTimeout(session.ID, "idle_in_transaction_session_timeout"); timeout > 0 {
+			timeouts[timeout] = append(timeouts[timeout], session)
+		}
+	}
+
+	for timeout, sessions := range timeouts {
+		stale := make(map[string]bool)
+		for _, connectionID := range h.txMonitor.CheckStaleTransactions(timeout) {
+			stale[connectionID] = true
+		}
+
+		for _, session := range sessions {
+			// The monitor records when a statement starts, the session
+			// when it ends; a running statement is not idle
+			if !stale[session.ID] || session.idleTime() <= timeout {
+				continue
+			}
+			if h.txManager.GetTransactionStatus(session.ID) == TxIdle {
+				continue
+			}
+
+			log.Printf("WARN: Terminating connection %s idle in transaction for over %v", session.ID, timeout)
+			if err := h.txManager.Rollback(session.ID); err != nil {
+				log.Printf("WARN: Rollback error for connection %s: %v", session.ID, err)
+			}
+			h.txMonitor.EndTransaction(session.ID, false)
+			session.terminate("25P03", "terminating connection due to idle-in-transaction timeout")
+		}
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	psqlerr "github.com/jeroenrinzema/psql-wire/errors"
+)
+
+func TestParseTimeoutSetting(t *testing.T) {
+	tests := []struct {
+		value string
+		want  time.Duration
+	}{
+		{"0", 0},
+		{"250", 250 * time.Millisecond},
+		{"30s", 30 * time.Second},
+		{"1.5 s", 1500 * time.Millisecond},
+		{"5min", 5 * time.Minute},
+		{"2h", 2 * time.Hour},
+	}
+	for _, tt := range tests {
+		got, err := parseTimeoutSetting(tt.value)
+		if err != nil || got != tt.want {
+			t.Errorf("%q: got %v, %v; want %v", tt.value, got, err, tt.want)
+		}
+	}
+
+	for _, value := range []string{"", "abc", "-1", "10 weeks"} {
+		if _, err := parseTimeoutSetting(value); err == nil {
+			t.Errorf("%q: expected an error", value)
+		}
+	}
+}
+
+func TestStatementTimeout(t *testing.T) {
+	handler := newTestHandler(t)
+	if err := handler.backend.SetServerSetting("statement_timeout", "1min"); err != nil {
+		t.Fatalf("Failed to set server default: %v", err)
+	}
+	ctx, _ := handler.StartSession(context.Background())
+
+	writer := runQuery(t, handler, ctx, "SHOW statement_timeout")
+	if writer.rows[0][0] != "1min" {
+		t.Errorf("Expected the server-wide default, got %v", writer.rows[0][0])
+	}
+
+	fn, _, _, _ := handler.ParseQuery(ctx, "SET statement_timeout = 'soon'")
+	if err := fn(ctx, &recordingWriter{}, nil); psqlerr.GetCode(err) != "22023" {
+		t.Errorf("Expected 22023 for an invalid timeout, got %v", err)
+	}
+
+	runQuery(t, handler, ctx, "SET statement_timeout = 50")
+	fn, _, _, err := handler.ParseQuery(ctx, "WITH RECURSIVE c(x) AS (SELECT 1 UNION ALL SELECT x + 1 FROM c) SELECT count(*) FROM c")
+	if err != nil {
+		t.Fatalf("Failed to parse: %v", err)
+	}
+	err = fn(ctx, &recordingWriter{}, nil)
+	if desc := psqlerr.Flatten(err); desc.Code != "57014" || desc.Message != "canceling statement due to statement timeout" {
+		t.Errorf("Expected a statement timeout, got %+v", desc)
+	}
+
+	runQuery(t, handler, ctx, "RESET statement_timeout")
+	writer = runQuery(t, handler, ctx, "SHOW statement_timeout")
+	if writer.rows[0][0] != "1min" {
+		t.Errorf("Expected RESET to restore the server-wide default, got %v", writer.rows[0][0])
+	}
+}
+
+func TestIdleInTransactionTimeout(t *testing.T) {
+	handler := newTestHandler(t)
+	ctx, _ := handler.StartSession(context.Background())
+	other, _ := handler.StartSession(context.Background())
+	session := sessionFromContext(ctx)
+	conn := &capturingConn{}
+	session.Conn = &ProtocolConn{Conn: conn}
+
+	runQuery(t, handler, ctx, "CREATE TABLE t (id INTEGER)")
+	runQuery(t, handler, ctx, "SET idle_in_transaction_session_timeout = 20")
+	runQuery(t, handler, ctx, "BEGIN")
+	runQuery(t, handler, ctx, "INSERT INTO t VALUES (1)")
+
+	// A session without the timeout keeps its transaction
+	runQuery(t, handler, other, "BEGIN")
+
+	handler.reapIdleTransactions()
+	if status := handler.txManager.GetTransactionStatus(session.ID); status != TxInTransaction {
+		t.Fatalf("Expected a recently active transaction to survive, got status %d", status)
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	handler.reapIdleTransactions()
+	if status := handler.txManager.GetTransactionStatus(session.ID); status != TxIdle {
+		t.Errorf("Expected the idle transaction to be rolled back, got status %d", status)
+	}
+	if status := handler.txManager.GetTransactionStatus(sessionFromContext(other).ID); status != TxInTransaction {
+		t.Errorf("Expected the other session to keep its transaction, got status %d", status)
+	}
+
+	types, bodies := backendMessages(conn.written.Bytes())
+	if string(types) != "E" || string(bodies[0]) != "SFATAL\x00VFATAL\x00C25P03\x00Mterminating connection due to idle-in-transaction timeout\x00\x00" {
+		t.Errorf("Unexpected termination: %q %q", types, bodies)
+	}
+	if !conn.closed {
+		t.Error("Expected the connection to be closed")
+	}
+
+	writer := runQuery(t, handler, other, "SELECT count(*) FROM t")
+	if writer.rows[0][0] != int64(0) {
+		t.Errorf("Expected the insert to be rolled back, got %v rows", writer.rows[0][0])
+	}
+}
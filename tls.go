@@ -0,0 +1,276 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// Request codes of the untyped packets a client may send before the
+// StartupMessage
+const (
+	sslRequestCode    = 80877103
+	gssencRequestCode = 80877104
+)
+
+// maxStartupPacketSize bounds the packets read before the StartupMessage,
+// as PostgreSQL does
+const maxStartupPacketSize = 10000
+
+// negotiationTimeout bounds the TLS handshake of a new connection
+const negotiationTimeout = 10 * time.Second
+
+// tlsVersions maps the accepted tls.min_version values to TLS versions
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// certificateStore holds the server certificate and client CA pool,
+// reloading them when their files change on disk
+type certificateStore struct {
+	config     TLSConfig
+	minVersion uint16
+
+	mu        sync.Mutex
+	modTimes  [3]time.Time // certificate, key and client CA files
+	tlsConfig *tls.Config
+}
+
+// newCertificateStore loads the certificate files of the configuration
+func newCertificateStore(config TLSConfig) (*certificateStore, error) {
+	if config.CertFile == "" || config.KeyFile == "" {
+		return nil, fmt.Errorf("tls requires both cert_file and key_file")
+	}
+
+	minVersion := uint16(tls.VersionTLS12)
+	if config.MinVersion != "" {
+		var ok bool
+		if minVersion, ok = tlsVersions[config.MinVersion]; !ok {
+			return nil, fmt.Errorf("unsupported tls min_version %q", config.MinVersion)
+		}
+	}
+
+	s := &certificateStore{config: config, minVersion: minVersion}
+	if err := s.reload(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// files returns the paths of the watched files
+func (s *certificateStore) files() [3]string {
+	return [3]string{s.config.CertFile, s.config.KeyFile, s.config.ClientCAFile}
+}
+
+// reload reads the certificate files; the caller must not hold s.mu. The
+// modification times are recorded even when loading fails, so a broken file
+// is only retried once it changes again.
+func (s *certificateStore) reload() error {
+	var modTimes [3]time.Time
+	for i, path := range s.files() {
+		if path == "" {
+			continue
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			return fmt.Errorf("failed to read TLS file: %w", err)
+		}
+		modTimes[i] = info.ModTime()
+	}
+
+	config, err := s.load()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.modTimes = modTimes
+	if err != nil {
+		return err
+	}
+	s.tlsConfig = config
+	return nil
+}
+
+// load builds a TLS configuration from the certificate files
+func (s *certificateStore) load() (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(s.config.CertFile, s.config.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load TLS certificate: %w", err)
+	}
+
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   s.minVersion,
+	}
+	if s.config.ClientCAFile != "" {
+		data, err := os.ReadFile(s.config.ClientCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read TLS client CA: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("no certificates found in TLS client CA %s", s.config.ClientCAFile)
+		}
+		// Client certificates are verified when sent; whether one is
+		// required is decided per connection by the authentication rules
+		config.ClientCAs = pool
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	return config, nil
+}
+
+// changed reports whether a watched file was modified since the last load
+func (s *certificateStore) changed() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i, path := range s.files() {
+		if path == "" {
+			continue
+		}
+		if info, err := os.Stat(path); err == nil && !info.ModTime().Equal(s.modTimes[i]) {
+			return true
+		}
+	}
+	return false
+}
+
+// configForClient returns the TLS configuration of a handshake, picking up
+// renewed certificates. A failed reload keeps the previous certificates.
+func (s *certificateStore) configForClient(*tls.ClientHelloInfo) (*tls.Config, error) {
+	if s.changed() {
+		if err := s.reload(); err != nil {
+			log.Printf("WARN: Failed to reload TLS certificates, keeping the previous ones: %v", err)
+		} else {
+			log.Printf("INFO: Reloaded TLS certificates")
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.tlsConfig, nil
+}
+
+// negotiatingConn answers the SSLRequest and GSSENCRequest a client may
+// send before its StartupMessage, upgrading the connection to TLS when
+// asked and a certificate is configured. Only the StartupMessage or
+// CancelRequest that follows is read from it.
+type negotiatingConn struct {
+	net.Conn // the TCP connection, or the TLS connection once negotiated
+	store    *certificateStore
+	required bool
+
+	once    sync.Once
+	err     error
+	pending []byte // the packet read last during negotiation
+}
+
+func (c *negotiatingConn) Read(p []byte) (int, error) {
+	c.once.Do(func() {
+		c.err = c.negotiate()
+	})
+	if c.err != nil {
+		return 0, c.err
+	}
+
+	if len(c.pending) > 0 {
+		n := copy(p, c.pending)
+		c.pending = c.pending[n:]
+		return n, nil
+	}
+	return c.Conn.Read(p)
+}
+
+// negotiate reads packets until the StartupMessage or CancelRequest
+func (c *negotiatingConn) negotiate() error {
+	c.Conn.SetDeadline(time.Now().Add(negotiationTimeout))
+	defer c.Conn.SetDeadline(time.Time{})
+
+	for {
+		packet, err := readStartupPacket(c.Conn)
+		if err != nil {
+			return err
+		}
+		_, secure := c.Conn.(*tls.Conn)
+
+		switch binary.BigEndian.Uint32(packet[4:]) {
+		case sslRequestCode:
+			if secure {
+				return fmt.Errorf("duplicate SSLRequest from %s", c.RemoteAddr())
+			}
+			if c.store == nil {
+				// Without a certificate the client may go on in plain text
+				if _, err := c.Conn.Write([]byte{'N'}); err != nil {
+					return err
+				}
+				continue
+			}
+			if _, err := c.Conn.Write([]byte{'S'}); err != nil {
+				return err
+			}
+			conn := tls.Server(c.Conn, &tls.Config{GetConfigForClient: c.store.configForClient})
+			if err := conn.Handshake(); err != nil {
+				return fmt.Errorf("TLS handshake with %s failed: %w", c.RemoteAddr(), err)
+			}
+			c.Conn = conn
+		case gssencRequestCode:
+			if _, err := c.Conn.Write([]byte{'N'}); err != nil {
+				return err
+			}
+		case cancelRequestCode:
+			// A cancel request carries no credentials and needs no TLS
+			c.pending = packet
+			return nil
+		default:
+			if c.required && !secure {
+				c.Conn.Write(errorResponse("FATAL", "28000", "connection requires SSL"))
+				return fmt.Errorf("rejected a connection without TLS from %s", c.RemoteAddr())
+			}
+			c.pending = packet
+			return nil
+		}
+	}
+}
+
+// TLSState returns the TLS state of the connection, nil without TLS
+func (c *ProtocolConn) TLSState() *tls.ConnectionState {
+	if c == nil {
+		return nil
+	}
+	negotiating, ok := c.Conn.(*negotiatingConn)
+	if !ok {
+		return nil
+	}
+	conn, ok := negotiating.Conn.(*tls.Conn)
+	if !ok {
+		return nil
+	}
+	state := conn.ConnectionState()
+	return &state
+}
+
+// readStartupPacket reads a length-prefixed untyped packet
+func readStartupPacket(r io.Reader) ([]byte, error) {
+	packet := make([]byte, 4)
+	if _, err := io.ReadFull(r, packet); err != nil {
+		return nil, err
+	}
+
+	length := int(binary.BigEndian.Uint32(packet))
+	if length < 8 || length > maxStartupPacketSize {
+		return nil, fmt.Errorf("invalid startup packet length %d", length)
+	}
+	packet = append(packet, make([]byte, length-4)...)
+	if _, err := io.ReadFull(r, packet[4:]); err != nil {
+		return nil, err
+	}
+	return packet, nil
+}
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testCA issues certificates for the TLS tests
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pool *x509.CertPool
+}
+
+func newTestCA(t *testing.T) *testCA {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "pgblob test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("Failed to create CA: %v", err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return &testCA{cert: cert, key: key, pool: pool}
+}
+
+// issue writes a certificate for localhost and its key to the files
+func (ca *testCA) issue(t *testing.T, serial int64, certFile string, keyFile string) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		DNSNames:     []string{"localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatalf("Failed to create certificate: %v", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("Failed to encode key: %v", err)
+	}
+
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatalf("Failed to write certificate: %v", err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatalf("Failed to write key: %v", err)
+	}
+}
+
+// requestPacket encodes an SSLRequest, GSSENCRequest or CancelRequest
+func requestPacket(code uint32) []byte {
+	packet := binary.BigEndian.AppendUint32(nil, 8)
+	return binary.BigEndian.AppendUint32(packet, code)
+}
+
+// tcpPipe returns both ends of a loopback TCP connection. Unlike net.Pipe
+// its writes are buffered, as a failed handshake relies on.
+func tcpPipe(t *testing.T) (net.Conn, net.Conn) {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer listener.Close()
+
+	client, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	server, err := listener.Accept()
+	if err != nil {
+		t.Fatalf("Failed to accept: %v", err)
+	}
+	t.Cleanup(func() { client.Close(); server.Close() })
+	return client, server
+}
+
+// connectTLS negotiates TLS the way libpq does with sslmode=verify-full and
+// returns the server's side of the connection with the startup packet read
+func connectTLS(t *testing.T, store *certificateStore, client *tls.Config) (*tls.Conn, []byte, error) {
+	t.Helper()
+
+	clientConn, serverConn := tcpPipe(t)
+	server := &negotiatingConn{Conn: serverConn, store: store, required: true}
+
+	type result struct {
+		conn *tls.Conn
+		err  error
+	}
+	done := make(chan result, 1)
+	go func() {
+		// GSSAPI encryption is declined before TLS is accepted
+		answer := make([]byte, 1)
+		for _, code := range []uint32{gssencRequestCode, sslRequestCode} {
+			clientConn.Write(requestPacket(code))
+			if _, err := io.ReadFull(clientConn, answer); err != nil {
+				done <- result{err: err}
+				return
+			}
+		}
+		if answer[0] != 'S' {
+			done <- result{err: fmt.Errorf("unexpected answer %q", answer)}
+			return
+		}
+		conn := tls.Client(clientConn, client)
+		if err := conn.Handshake(); err != nil {
+			done <- result{err: err}
+			return
+		}
+		_, err := conn.Write(startupMessage())
+		done <- result{conn: conn, err: err}
+	}()
+
+	packet := make([]byte, len(startupMessage()))
+	_, err := io.ReadFull(server, packet)
+	r := <-done
+	if r.err != nil {
+		return nil, nil, r.err
+	}
+	return r.conn, packet, err
+}
+
+func TestTLSNegotiation(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "server.crt"), filepath.Join(dir, "server.key")
+	ca := newTestCA(t)
+	ca.issue(t, 100, certFile, keyFile)
+
+	store, err := newCertificateStore(TLSConfig{CertFile: certFile, KeyFile: keyFile, MinVersion: "1.2"})
+	if err != nil {
+		t.Fatalf("Failed to load certificates: %v", err)
+	}
+
+	// The client verifies the certificate chain and the host name
+	client := &tls.Config{RootCAs: ca.pool, ServerName: "localhost"}
+	conn, packet, err := connectTLS(t, store, client)
+	if err != nil {
+		t.Fatalf("Failed to negotiate TLS: %v", err)
+	}
+	if !bytes.Equal(packet, startupMessage()) {
+		t.Errorf("Expected the startup packet to pass through, got %q", packet)
+	}
+	if serial := conn.ConnectionState().PeerCertificates[0].SerialNumber.Int64(); serial != 100 {
+		t.Errorf("Unexpected certificate serial %d", serial)
+	}
+
+	// A renewed certificate is picked up by the next handshake
+	ca.issue(t, 101, certFile, keyFile)
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(certFile, later, later)
+	conn, _, err = connectTLS(t, store, client)
+	if err != nil {
+		t.Fatalf("Failed to negotiate TLS after renewal: %v", err)
+	}
+	if serial := conn.ConnectionState().PeerCertificates[0].SerialNumber.Int64(); serial != 101 {
+		t.Errorf("Expected the renewed certificate, got serial %d", serial)
+	}
+
+	// A broken renewal keeps the previous certificate
+	os.WriteFile(keyFile, []byte("not a key"), 0600)
+	os.Chtimes(keyFile, later.Add(time.Minute), later.Add(time.Minute))
+	if _, _, err := connectTLS(t, store, client); err != nil {
+		t.Errorf("Expected the previous certificate to be kept: %v", err)
+	}
+
+	if _, _, err := connectTLS(t, store, &tls.Config{RootCAs: ca.pool, ServerName: "db.example.com"}); err == nil {
+		t.Error("Expected verification of a different host name to fail")
+	}
+}
+
+func TestTLSMinVersion(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "server.crt"), filepath.Join(dir, "server.key")
+	ca := newTestCA(t)
+	ca.issue(t, 1, certFile, keyFile)
+
+	if _, err := newCertificateStore(TLSConfig{CertFile: certFile, KeyFile: keyFile, MinVersion: "2.0"}); err == nil {
+		t.Error("Expected an unknown TLS version to be rejected")
+	}
+
+	store, err := newCertificateStore(TLSConfig{CertFile: certFile, KeyFile: keyFile, MinVersion: "1.3"})
+	if err != nil {
+		t.Fatalf("Failed to load certificates: %v", err)
+	}
+	old := &tls.Config{RootCAs: ca.pool, ServerName: "localhost", MaxVersion: tls.VersionTLS12}
+	if _, _, err := connectTLS(t, store, old); err == nil {
+		t.Error("Expected a TLS 1.2 client to be refused")
+	}
+}
+
+func TestTLSRequired(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "server.crt"), filepath.Join(dir, "server.key")
+	newTestCA(t).issue(t, 1, certFile, keyFile)
+	store, err := newCertificateStore(TLSConfig{CertFile: certFile, KeyFile: keyFile})
+	if err != nil {
+		t.Fatalf("Failed to load certificates: %v", err)
+	}
+
+	// A cleartext StartupMessage is refused, a CancelRequest passes through
+	for _, required := range []bool{true, false} {
+		clientConn, serverConn := net.Pipe()
+		server := &negotiatingConn{Conn: serverConn, store: store, required: required}
+
+		response := make(chan []byte, 1)
+		go func() {
+			clientConn.Write(startupMessage())
+			data, _ := io.ReadAll(clientConn)
+			response <- data
+		}()
+
+		packet := make([]byte, len(startupMessage()))
+		_, err := io.ReadFull(server, packet)
+		serverConn.Close()
+		data := <-response
+		clientConn.Close()
+
+		if required {
+			types, bodies := backendMessages(data)
+			if err == nil || string(types) != "E" || !bytes.Contains(bodies[0], []byte("C28000\x00")) {
+				t.Errorf("Expected the connection to be refused, got %v, %q", err, data)
+			}
+		} else if err != nil || !bytes.Equal(packet, startupMessage()) {
+			t.Errorf("Expected the startup packet without TLS, got %v, %q", err, packet)
+		}
+	}
+
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	server := &negotiatingConn{Conn: serverConn, store: store, required: true}
+	cancel := append(binary.BigEndian.AppendUint32(nil, 16), binary.BigEndian.AppendUint32(nil, cancelRequestCode)...)
+	cancel = append(cancel, 0, 0, 0, 1, 0, 0, 0, 2)
+	go clientConn.Write(cancel)
+	packet := make([]byte, len(cancel))
+	if _, err := io.ReadFull(server, packet); err != nil || !bytes.Equal(packet, cancel) {
+		t.Errorf("Expected the cancel request to pass through, got %v, %q", err, packet)
+	}
+}
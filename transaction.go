@@ -4,6 +4,7 @@ import (
 	"context"
 	"fmt"
 	"log"
+	"os"
 	"sync"
 	"time"
 )
@@ -12,7 +13,9 @@ import (
 type TransactionManager struct {
 	backend       *SQLiteBackend
 	cache         *DatabaseCache
-	mu            sync.Mutex
+	replicator    *Replicator // ships the WAL instead of snapshots when set
+	mu            sync.Mutex  // guards the fields below; commits take it
+	uploadMu      sync.Mutex  // serializes uploads, which can take seconds
 	lastUpload    time.Time
 	uploadPending bool
 	uploadChan    chan bool
@@ -22,9 +25,16 @@ type TransactionManager struct {
 
 // NewTransactionManager creates a new transaction manager
 func NewTransactionManager(backend *SQLiteBackend, cache *DatabaseCache) *TransactionManager {
+	return NewReplicatingTransactionManager(backend, cache, nil)
+}
+
+// NewReplicatingTransactionManager creates a transaction manager that ships
+// the WAL with the replicator after commits instead of uploading snapshots
+func NewReplicatingTransactionManager(backend *SQLiteBackend, cache *DatabaseCache, replicator *Replicator) *TransactionManager {
 	tm := &TransactionManager{
 		backend:    backend,
 		cache:      cache,
+		replicator: replicator,
 		uploadChan: make(chan bool, 1),
 		stopChan:   make(chan bool),
 	}
@@ -40,14 +50,16 @@ func NewTransactionManager(backend *SQLiteBackend, cache *DatabaseCache) *Transa
 func (tm *TransactionManager) uploadWorker() {
 	defer tm.wg.Done()
 
-	ticker := time.NewTicker(time.Duration(tm.cache.ttlMinutes) * time.Minute)
+	interval := time.Duration(tm.cache.ttlMinutes) * time.Minute
+	if tm.replicator != nil {
+		interval = replicationInterval
+	}
+	ticker := time.NewTicker(interval)
 	defer ticker.Stop()
 
 	for {
 		select {
 		case <-tm.stopChan:
-			// Final upload before stopping
-			tm.performUpload()
 			return
 
 		case <-tm.uploadChan:
@@ -57,7 +69,7 @@ func (tm *TransactionManager) uploadWorker() {
 		case <-ticker.C:
 			// Periodic upload check
 			tm.mu.Lock()
-			if tm.uploadPending || tm.cache.ShouldSync() {
+			if tm.uploadPending || tm.cache.ShouldSync() || tm.replicator != nil {
 				tm.mu.Unlock()
 				tm.performUpload()
 			} else {
@@ -69,20 +81,61 @@ func (tm *TransactionManager) uploadWorker() {
 
 // performUpload uploads the database to blob storage
 func (tm *TransactionManager) performUpload() {
-	tm.mu.Lock()
-	defer tm.mu.Unlock()
-
 	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
 	defer cancel()
 
-	if err := tm.cache.Upload(ctx); err != nil {
+	if err := tm.upload(ctx); err != nil {
 		log.Printf("ERROR: Failed to upload database to blob storage: %v", err)
 		return
 	}
 
-	log.Printf("INFO: Successfully uploaded database to blob storage")
+	if tm.replicator == nil {
+		log.Printf("INFO: Successfully uploaded database to blob storage")
+	}
+}
+
+// upload ships the WAL or uploads a snapshot. Uploads run one at a time
+// under tm.uploadMu, while commits only take tm.mu to flag new changes, so
+// they never wait for an upload.
+func (tm *TransactionManager) upload(ctx context.Context) error {
+	tm.uploadMu.Lock()
+	defer tm.uploadMu.Unlock()
+
+	// Commits from now on may not be in this upload and flag another one
+	tm.mu.Lock()
 	tm.uploadPending = false
+	tm.mu.Unlock()
+
+	var err error
+	if tm.replicator != nil {
+		err = tm.replicator.Sync(ctx)
+	} else {
+		err = tm.uploadSnapshot(ctx)
+	}
+
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+	if err != nil {
+		tm.uploadPending = true
+		return err
+	}
 	tm.lastUpload = time.Now()
+	return nil
+}
+
+// uploadSnapshot snapshots the database, verifies the snapshot and uploads
+// it
+func (tm *TransactionManager) uploadSnapshot(ctx context.Context) error {
+	path := tm.cache.snapshotPath()
+	if err := tm.backend.Snapshot(ctx, path); err != nil {
+		return err
+	}
+	defer os.Remove(path)
+
+	if err := verifySnapshot(ctx, path); err != nil {
+		return err
+	}
+	return tm.cache.Upload(ctx, path)
 }
 
 // Begin starts a new transaction
@@ -115,24 +168,45 @@ func (tm *TransactionManager) Rollback(connectionID string) error {
 	return tm.backend.RollbackTransaction(connectionID)
 }
 
+// Savepoint establishes a savepoint in the current transaction
+func (tm *TransactionManager) Savepoint(connectionID string, name string) error {
+	return tm.backend.Savepoint(connectionID, name)
+}
+
+// ReleaseSavepoint releases a savepoint of the current transaction
+func (tm *TransactionManager) ReleaseSavepoint(connectionID string, name string) error {
+	return tm.backend.ReleaseSavepoint(connectionID, name)
+}
+
+// RollbackToSavepoint rolls the current transaction back to a savepoint
+func (tm *TransactionManager) RollbackToSavepoint(connectionID string, name string) error {
+	return tm.backend.RollbackToSavepoint(connectionID, name)
+}
+
+// Fail marks the current transaction as failed after a statement error
+func (tm *TransactionManager) Fail(connectionID string) {
+	tm.backend.FailTransaction(connectionID)
+}
+
 // ForceUpload forces an immediate upload to blob storage
 func (tm *TransactionManager) ForceUpload(ctx context.Context) error {
-	if err := tm.cache.Upload(ctx); err != nil {
+	if err := tm.upload(ctx); err != nil {
 		return fmt.Errorf("failed to force upload: %w", err)
 	}
-
-	tm.mu.Lock()
-	tm.uploadPending = false
-	tm.lastUpload = time.Now()
-	tm.mu.Unlock()
-
 	return nil
 }
 
-// Stop stops the transaction manager and performs final upload
+// Stop stops the transaction manager without uploading; callers keeping
+// the database upload its final state with ForceUpload first
 func (tm *TransactionManager) Stop() {
 	close(tm.stopChan)
 	tm.wg.Wait()
+
+	if tm.replicator != nil {
+		if err := tm.replicator.Close(); err != nil {
+			log.Printf("WARN: Failed to stop replication: %v", err)
+		}
+	}
 }
 
 // GetTransactionStatus returns the current transaction status for a connection
@@ -142,10 +216,10 @@ func (tm *TransactionManager) GetTransactionStatus(connectionID string) Transact
 
 // TransactionContext holds information about a transaction
 type TransactionContext struct {
-	ConnectionID string
-	StartTime    time.Time
-	LastQuery    time.Time
-	QueryCount   int
+	ConnectionID  string
+	StartTime     time.Time
+	LastQuery     time.Time
+	QueryCount    int
 	InTransaction bool
 }
 
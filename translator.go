@@ -0,0 +1,1264 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+)
+
+const (
+	// nowExpression is the SQLite spelling of now(), with millisecond precision
+	nowExpression = "strftime('%Y-%m-%d %H:%M:%f', 'now')"
+
+	// uuidExpression generates a random version 4 UUID
+	uuidExpression = "(lower(hex(randomblob(4))) || '-' || lower(hex(randomblob(2))) || '-4' || " +
+		"substr(lower(hex(randomblob(2))), 2) || '-' || substr('89ab', 1 + (abs(random()) % 4), 1) || " +
+		"substr(lower(hex(randomblob(2))), 2) || '-' || lower(hex(randomblob(6))))"
+)
+
+// functionTranslations maps argument-less PostgreSQL functions to SQLite expressions
+var functionTranslations = map[string]string{
+	"now":                   nowExpression,
+	"transaction_timestamp": nowExpression,
+	"statement_timestamp":   nowExpression,
+	"clock_timestamp":       nowExpression,
+	"gen_random_uuid":       uuidExpression,
+	"uuid_generate_v4":      uuidExpression,
+}
+
+// unsupportedCreates are CREATE statements without a SQLite equivalent
+var unsupportedCreates = []string{
+	"TYPE", "DOMAIN", "SEQUENCE", "FUNCTION", "PROCEDURE", "EXTENSION", "SCHEMA",
+	"MATERIALIZED", "RULE", "POLICY", "AGGREGATE", "OPERATOR", "PUBLICATION", "SUBSCRIPTION",
+}
+
+// unsupportedOperators are PostgreSQL operators SQLite has no counterpart for
+var unsupportedOperators = []string{"@>", "<@", "&&", "?|", "?&", "#>", "#>>", "@@"}
+
+// nonFunctionKeywords are keywords that may precede a parenthesis without
+// being a function call
+var nonFunctionKeywords = map[string]bool{
+	"and": true, "or": true, "not": true, "in": true, "exists": true, "any": true, "all": true,
+	"some": true, "values": true, "select": true, "where": true, "on": true, "using": true,
+	"from": true, "join": true, "as": true, "when": true, "then": true, "else": true,
+	"is": true, "like": true, "ilike": true, "between": true, "by": true, "set": true,
+	"into": true, "returning": true, "having": true, "limit": true, "offset": true,
+	"union": true, "intersect": true, "except": true, "distinct": true, "with": true,
+	"over": true, "filter": true, "check": true, "default": true, "references": true,
+	"table": true, "key": true, "unique": true, "primary": true, "array": true, "row": true,
+}
+
+// dateTimeNames are the functions and keywords whose value is a date, time or
+// timestamp, before translateFunctions expands them
+var dateTimeNames = map[string]bool{
+	"date": true, "time": true, "datetime": true, "strftime": true, "julianday": true, "unixepoch": true,
+	"now": true, "transaction_timestamp": true, "statement_timestamp": true, "clock_timestamp": true,
+	"current_date": true, "current_time": true, "current_timestamp": true, "localtime": true, "localtimestamp": true,
+}
+
+// columnConstraintKeywords start a column constraint in a column definition
+var columnConstraintKeywords = []string{
+	"CONSTRAINT", "NOT", "NULL", "PRIMARY", "UNIQUE", "CHECK", "REFERENCES", "COLLATE", "GENERATED", "DEFAULT",
+}
+
+// featureNotSupported reports a construct the translator cannot express in SQLite
+func featureNotSupported(format string, args ...interface{}) error {
+	return newPostgresError("0A000", format, args...)
+}
+
+// translateStatement rewrites the PostgreSQL constructs of a statement into
+// their SQLite equivalents. Constructs SQLite cannot express are reported as
+// feature_not_supported instead of failing later with a confusing error.
+func translateStatement(tokens []token) ([]token, error) {
+	tokens = translateCatalogNames(tokens)
+	if err := checkUnsupported(significantTokens(tokens)); err != nil {
+		return nil, err
+	}
+
+	tokens = translateLiterals(tokens)
+
+	tokens, err := translateDoubleColonCasts(tokens)
+	if err != nil {
+		return nil, err
+	}
+	if tokens, err = translateExplicitCasts(tokens); err != nil {
+		return nil, err
+	}
+	if tokens, err = translateDateArithmetic(tokens); err != nil {
+		return nil, err
+	}
+
+	tokens = translateFunctions(tokens)
+	tokens = translateOperators(tokens)
+	tokens = stripLockingClauses(tokens)
+
+	switch firstKeyword(joinTokens(tokens)) {
+	case "CREATE":
+		return translateCreateTable(tokens)
+	case "ALTER":
+		return translateAlterTable(tokens)
+	default:
+		return tokens, nil
+	}
+}
+
+// checkUnsupported rejects constructs that have no SQLite translation
+func checkUnsupported(sig []token) error {
+	if len(sig) == 0 {
+		return nil
+	}
+
+	switch {
+	case sig[0].is("LISTEN"), sig[0].is("UNLISTEN"), sig[0].is("NOTIFY"):
+		return featureNotSupported("%s is not supported", strings.ToUpper(sig[0].Text))
+	case sig[0].is("COMMENT") && len(sig) > 1 && sig[1].is("ON"):
+		return featureNotSupported("COMMENT ON is not supported")
+	case sig[0].is("CREATE") && len(sig) > 1:
+		if sig[1].is("OR") {
+			return featureNotSupported("CREATE OR REPLACE is not supported")
+		}
+		for _, kind := range unsupportedCreates {
+			if sig[1].is(kind) {
+				return featureNotSupported("CREATE %s is not supported", kind)
+			}
+		}
+	}
+
+	for i, t := range sig {
+		var next token
+		if i+1 < len(sig) {
+			next = sig[i+1]
+		}
+
+		switch {
+		case t.isPunct("["):
+			return featureNotSupported("arrays are not supported")
+		case t.is("ARRAY") && (next.isPunct("[") || next.isPunct("(")):
+			return featureNotSupported("arrays are not supported")
+		case t.is("DISTINCT") && next.is("ON"):
+			return featureNotSupported("SELECT DISTINCT ON is not supported")
+		case t.is("LATERAL"):
+			return featureNotSupported("LATERAL is not supported")
+		case t.is("SIMILAR") && next.is("TO"):
+			return featureNotSupported("SIMILAR TO is not supported")
+		case t.is("INTERVAL") && next.Kind == tokenString:
+			return featureNotSupported("interval values are not supported")
+		}
+
+		for _, op := range unsupportedOperators {
+			if t.isPunct(op) {
+				return featureNotSupported("operator %s is not supported", op)
+			}
+		}
+	}
+	return nil
+}
+
+// isOperand reports whether a token ends an operand, making a following
+// operator binary
+func isOperand(t token) bool {
+	switch t.Kind {
+	case tokenIdent, tokenQuotedIdent, tokenString, tokenNumber, tokenParam:
+		return true
+	default:
+		return t.isPunct(")")
+	}
+}
+
+// translateLiterals rewrites escape strings, dollar-quoted strings and
+// boolean literals into plain SQLite literals
+func translateLiterals(tokens []token) []token {
+	result := make([]token, len(tokens))
+	copy(result, tokens)
+
+	for i, t := range result {
+		switch {
+		case t.Kind == tokenString && (t.Text[0] == 'e' || t.Text[0] == 'E'):
+			if len(t.Text) >= 3 && strings.HasSuffix(t.Text, "'") {
+				result[i] = token{Kind: tokenString, Text: quoteLiteral(decodeEscapeString(t.Text[2 : len(t.Text)-1]))}
+			}
+		case t.Kind == tokenString && t.Text[0] == '$':
+			tag := t.Text[:strings.IndexByte(t.Text[1:], '$')+2]
+			if len(t.Text) >= 2*len(tag) && strings.HasSuffix(t.Text, tag) {
+				result[i] = token{Kind: tokenString, Text: quoteLiteral(t.Text[len(tag) : len(t.Text)-len(tag)])}
+			}
+		case t.is("TRUE"), t.is("FALSE"):
+			if next := nextSignificant(result, i); isQualified(result, i) || (next < len(result) && result[next].isPunct("(")) {
+				continue
+			}
+			value := "0"
+			if t.is("TRUE") {
+				value = "1"
+			}
+			result[i] = token{Kind: tokenNumber, Text: value}
+		}
+	}
+	return result
+}
+
+// decodeEscapeString resolves the backslash escapes of an E-prefixed string body
+func decodeEscapeString(body string) string {
+	var sb strings.Builder
+	for i := 0; i < len(body); i++ {
+		c := body[i]
+		if c == '\'' && i+1 < len(body) && body[i+1] == '\'' {
+			sb.WriteByte('\'')
+			i++
+			continue
+		}
+		if c != '\\' || i+1 >= len(body) {
+			sb.WriteByte(c)
+			continue
+		}
+
+		i++
+		switch c = body[i]; c {
+		case 'b':
+			sb.WriteByte('\b')
+		case 'f':
+			sb.WriteByte('\f')
+		case 'n':
+			sb.WriteByte('\n')
+		case 'r':
+			sb.WriteByte('\r')
+		case 't':
+			sb.WriteByte('\t')
+		case 'x', 'u', 'U':
+			digits := 2
+			if c == 'u' {
+				digits = 4
+			} else if c == 'U' {
+				digits = 8
+			}
+			end := i + 1
+			for end < len(body) && end-i-1 < digits && isHexDigit(body[end]) {
+				end++
+			}
+			if end == i+1 {
+				sb.WriteByte(c)
+				continue
+			}
+			n, _ := strconv.ParseUint(body[i+1:end], 16, 32)
+			if c == 'x' {
+				sb.WriteByte(byte(n))
+			} else {
+				sb.WriteRune(rune(n))
+			}
+			i = end - 1
+		default:
+			if c >= '0' && c <= '7' {
+				end := i
+				for end < len(body) && end-i < 3 && body[end] >= '0' && body[end] <= '7' {
+					end++
+				}
+				n, _ := strconv.ParseUint(body[i:end], 8, 8)
+				sb.WriteByte(byte(n))
+				i = end - 1
+				continue
+			}
+			sb.WriteByte(c)
+		}
+	}
+	return sb.String()
+}
+
+func isHexDigit(c byte) bool {
+	return isDigit(c) || (c >= 'a' && c <= 'f') || (c >= 'A' && c <= 'F')
+}
+
+// quoteLiteral renders a standard SQL string literal
+func quoteLiteral(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", "''") + "'"
+}
+
+// translateDoubleColonCasts rewrites expr::type into CAST(expr AS type) and
+// typed literals such as DATE '2024-01-01' into casts
+func translateDoubleColonCasts(tokens []token) ([]token, error) {
+	for i := 0; i < len(tokens); i++ {
+		t := tokens[i]
+
+		if t.Kind == tokenIdent && !isQualified(tokens, i) {
+			switch strings.ToLower(t.Text) {
+			case "date", "time", "timestamp", "timestamptz":
+				if next := nextSignificant(tokens, i); next < len(tokens) && tokens[next].Kind == tokenString {
+					cast := spliceTokens("CAST(", tokens[next:next+1], " AS ", tokens[i:i+1], ")")
+					tokens = spliceTokens(tokens[:i], cast, tokens[next+1:])
+				}
+			}
+			continue
+		}
+
+		if !t.isPunct("::") {
+			continue
+		}
+
+		start := castOperandStart(tokens, i)
+		if start < 0 {
+			return nil, newPostgresError("42601", "syntax error at or near \"::\"")
+		}
+		typeStart := nextSignificant(tokens, i)
+		typeEnd := typeNameEnd(tokens, typeStart)
+		if typeEnd <= typeStart {
+			return nil, newPostgresError("42601", "syntax error at or near \"::\"")
+		}
+
+		operand := tokens[start : prevSignificant(tokens, i)+1]
+		cast := spliceTokens("CAST(", operand, " AS ", tokens[typeStart:typeEnd], ")")
+		tokens = spliceTokens(tokens[:start], cast, tokens[typeEnd:])
+		i = start
+	}
+	return tokens, nil
+}
+
+// castOperandStart returns where the operand of the :: at i starts; the
+// cast binds tighter than any operator, so the operand is a single primary
+func castOperandStart(tokens []token, i int) int {
+	j := prevSignificant(tokens, i)
+	if j < 0 {
+		return -1
+	}
+
+	t := tokens[j]
+	switch t.Kind {
+	case tokenIdent, tokenQuotedIdent, tokenString, tokenNumber, tokenParam:
+		return qualifiedStart(tokens, j)
+	}
+	if !t.isPunct(")") {
+		return -1
+	}
+
+	open := matchingOpenParen(tokens, j)
+	if open < 0 {
+		return -1
+	}
+	if p := prevSignificant(tokens, open); p >= 0 && isFunctionName(tokens[p]) {
+		return qualifiedStart(tokens, p)
+	}
+	return open
+}
+
+// isFunctionName reports whether a token before a parenthesis names a function
+func isFunctionName(t token) bool {
+	switch t.Kind {
+	case tokenQuotedIdent:
+		return true
+	case tokenIdent:
+		return !nonFunctionKeywords[strings.ToLower(t.Text)]
+	default:
+		return false
+	}
+}
+
+// qualifiedStart extends a name at j backwards over its qualifiers
+func qualifiedStart(tokens []token, j int) int {
+	for {
+		dot := prevSignificant(tokens, j)
+		if dot < 0 || !tokens[dot].isPunct(".") {
+			return j
+		}
+		qualifier := prevSignificant(tokens, dot)
+		if qualifier < 0 || (tokens[qualifier].Kind != tokenIdent && tokens[qualifier].Kind != tokenQuotedIdent) {
+			return j
+		}
+		j = qualifier
+	}
+}
+
+// isQualified reports whether the name at i is preceded by a dot
+func isQualified(tokens []token, i int) bool {
+	p := prevSignificant(tokens, i)
+	return p >= 0 && tokens[p].isPunct(".")
+}
+
+// typeNameEnd returns the end (exclusive) of the type name starting at i,
+// including a schema qualifier, multi-word names, modifiers and array bounds
+func typeNameEnd(tokens []token, i int) int {
+	if i >= len(tokens) || (tokens[i].Kind != tokenIdent && tokens[i].Kind != tokenQuotedIdent) {
+		return i
+	}
+
+	end := qualifiedNameEnd(tokens, i)
+	for {
+		next := nextSignificant(tokens, end-1)
+		if next >= len(tokens) {
+			return end
+		}
+		switch t := tokens[next]; {
+		case isTypeNameContinuation(t):
+			end = next + 1
+		case t.isPunct("("):
+			closing := matchingParen(tokens, next)
+			if closing < 0 {
+				return end
+			}
+			end = closing + 1
+		case t.isPunct("["):
+			closing := next + 1
+			for closing < len(tokens) && !tokens[closing].isPunct("]") {
+				closing++
+			}
+			if closing >= len(tokens) {
+				return end
+			}
+			end = closing + 1
+		default:
+			return end
+		}
+	}
+}
+
+// qualifiedNameEnd returns the end (exclusive) of the possibly schema
+// qualified name starting at i
+func qualifiedNameEnd(tokens []token, i int) int {
+	end := i + 1
+	for {
+		dot := nextSignificant(tokens, end-1)
+		if dot >= len(tokens) || !tokens[dot].isPunct(".") {
+			return end
+		}
+		name := nextSignificant(tokens, dot)
+		if name >= len(tokens) || (tokens[name].Kind != tokenIdent && tokens[name].Kind != tokenQuotedIdent) {
+			return end
+		}
+		end = name + 1
+	}
+}
+
+// typeModifiers returns the parenthesized modifiers of type tokens, like (64) in varchar(64)
+func typeModifiers(tokens []token) []token {
+	for i, t := range tokens {
+		if t.isPunct("(") {
+			if closing := matchingParen(tokens, i); closing > 0 {
+				return tokens[i : closing+1]
+			}
+		}
+	}
+	return nil
+}
+
+// typeName normalizes type tokens to a lower-case name without schema,
+// modifiers or array bounds, and reports whether it is an array type
+func typeName(tokens []token) (string, bool) {
+	var words []string
+	array := false
+	depth := 0
+	for i, t := range tokens {
+		switch {
+		case t.isPunct("("):
+			depth++
+		case t.isPunct(")"):
+			depth--
+		case t.isPunct("["):
+			array = true
+		case depth > 0:
+		case t.Kind == tokenIdent || t.Kind == tokenQuotedIdent:
+			if next := nextSignificant(tokens, i); next < len(tokens) && tokens[next].isPunct(".") {
+				continue // schema qualifier
+			}
+			words = append(words, t.name())
+		}
+	}
+	return strings.Join(words, " "), array
+}
+
+// translateExplicitCasts rewrites CAST(expr AS type) for the target types
+// whose SQLite cast would not behave like PostgreSQL's
+func translateExplicitCasts(tokens []token) ([]token, error) {
+	result := make([]token, 0, len(tokens))
+	for i := 0; i < len(tokens); i++ {
+		t := tokens[i]
+		open := nextSignificant(tokens, i)
+		if !t.is("CAST") || isQualified(tokens, i) || open >= len(tokens) || !tokens[open].isPunct("(") {
+			result = append(result, t)
+			continue
+		}
+
+		closing := matchingParen(tokens, open)
+		as := -1
+		depth := 0
+		for j := open + 1; j < closing; j++ {
+			switch {
+			case tokens[j].isPunct("("):
+				depth++
+			case tokens[j].isPunct(")"):
+				depth--
+			case depth == 0 && tokens[j].is("AS"):
+				as = j
+			}
+		}
+		if closing < 0 || as < 0 {
+			result = append(result, t)
+			continue
+		}
+
+		operand, err := translateExplicitCasts(tokens[open+1 : as])
+		if err != nil {
+			return nil, err
+		}
+		cast, err := renderCast(trimTokens(operand), trimTokens(tokens[as+1:closing]))
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, cast...)
+		i = closing
+	}
+	return result, nil
+}
+
+// renderCast renders a cast to a PostgreSQL type in SQLite. SQLite casts to
+// types without a storage class (DATE, TIMESTAMP, BOOLEAN) convert to
+// numbers, so those become date functions and comparisons instead.
+func renderCast(operand []token, typeTokens []token) ([]token, error) {
+	name, array := typeName(typeTokens)
+	if array {
+		return nil, featureNotSupported("arrays are not supported")
+	}
+
+	switch name {
+	case "smallint", "integer", "int", "int2", "int4", "int8", "bigint", "oid":
+		return spliceTokens("CAST(", operand, " AS INTEGER)"), nil
+	case "real", "float", "float4", "float8", "double precision":
+		return spliceTokens("CAST(", operand, " AS REAL)"), nil
+	case "numeric", "decimal":
+		return spliceTokens("CAST(", operand, " AS NUMERIC)"), nil
+	case "text", "varchar", "character varying", "char", "character", "bpchar", "name",
+		"uuid", "json", "jsonb", "citext", "xml":
+		return spliceTokens("CAST(", operand, " AS TEXT)"), nil
+	case "bytea", "blob":
+		return spliceTokens("CAST(", operand, " AS BLOB)"), nil
+	case "bool", "boolean":
+		return spliceTokens("(lower(CAST(", operand, " AS TEXT)) IN ('t', 'true', 'y', 'yes', 'on', '1'))"), nil
+	case "date":
+		return spliceTokens("date(", operand, ")"), nil
+	case "time", "timetz", "time without time zone", "time with time zone":
+		return spliceTokens("time(", operand, ")"), nil
+	case "timestamp", "timestamptz", "timestamp without time zone", "timestamp with time zone":
+		return spliceTokens("strftime('%Y-%m-%d %H:%M:%f', ", operand, ")"), nil
+	case "regclass":
+		return renderObjectLookup(operand, "pg_class", "relname"), nil
+	case "regtype":
+		return renderObjectLookup(operand, "pg_type", "typname"), nil
+	case "regnamespace":
+		return renderObjectLookup(operand, "pg_namespace", "nspname"), nil
+	case "interval", "regproc", "regprocedure", "regoper":
+		return nil, featureNotSupported("type %s is not supported", name)
+	default:
+		return spliceTokens("CAST(", operand, " AS ", typeTokens, ")"), nil
+	}
+}
+
+// renderObjectLookup renders a cast to one of the reg* object identifier
+// types: names are looked up in the emulated catalog, numbers pass through
+func renderObjectLookup(operand []token, catalog string, column string) []token {
+	sig := significantTokens(operand)
+	if len(sig) != 1 || sig[0].Kind != tokenString {
+		return spliceTokens("CAST(", operand, " AS INTEGER)")
+	}
+
+	literal := sig[0].Text
+	name := strings.ReplaceAll(literal[1:len(literal)-1], "''", "'")
+	if _, err := strconv.Atoi(name); err == nil {
+		return spliceTokens(name)
+	}
+	nameTokens := significantTokens(tokenize(name))
+	if len(nameTokens) > 0 {
+		name = nameTokens[len(nameTokens)-1].name()
+	}
+	return spliceTokens("(SELECT oid FROM ", catalog, " WHERE ", column, " = ", quoteLiteral(name), ")")
+}
+
+// translateDateArithmetic rewrites date + integer, date - integer and
+// date - date, which PostgreSQL counts in days, into SQLite date functions.
+// Dates are the date() calls casts render to and CURRENT_DATE; SQLite would
+// add to the leading number of their text instead. Date arithmetic whose
+// operands cannot be isolated is rejected rather than translated wrongly.
+func translateDateArithmetic(tokens []token) ([]token, error) {
+	for i := 0; i < len(tokens); i++ {
+		op := tokens[i]
+		if !op.isPunct("+") && !op.isPunct("-") {
+			continue
+		}
+		prev := prevSignificant(tokens, i)
+		if prev < 0 || !isOperand(tokens[prev]) || (tokens[prev].Kind == tokenIdent && nonFunctionKeywords[strings.ToLower(tokens[prev].Text)]) {
+			continue
+		}
+
+		leftStart := castOperandStart(tokens, i)
+		rightStart := nextSignificant(tokens, i)
+		rightEnd := operandEnd(tokens, rightStart)
+		var left, right []token
+		if leftStart >= 0 {
+			left = tokens[leftStart : prev+1]
+		}
+		if rightEnd >= 0 {
+			right = tokens[rightStart:rightEnd]
+		}
+		leftDate, rightDate := isDateOperand(left), isDateOperand(right)
+		if !leftDate && !rightDate {
+			continue
+		}
+
+		// Only a whole operand of + and - can be rewritten: a neighbouring
+		// operator that binds tighter, or a preceding one, takes part of it
+		if leftStart < 0 || rightEnd < 0 {
+			return nil, featureNotSupported("date arithmetic on this expression is not supported")
+		}
+		if before := prevSignificant(tokens, leftStart); before >= 0 && isArithmeticOperator(tokens[before]) {
+			return nil, featureNotSupported("date arithmetic on this expression is not supported")
+		}
+		if after := nextSignificant(tokens, rightEnd-1); after < len(tokens) && isArithmeticOperator(tokens[after]) && !tokens[after].isPunct("+") && !tokens[after].isPunct("-") {
+			return nil, featureNotSupported("date arithmetic on this expression is not supported")
+		}
+
+		var rewritten []token
+		switch {
+		case leftDate && rightDate:
+			if op.isPunct("+") {
+				return nil, featureNotSupported("operator date + date is not supported")
+			}
+			rewritten = spliceTokens("CAST(julianday(", left, ") - julianday(", right, ") AS INTEGER)")
+		case leftDate:
+			days, err := dayModifier(right, op.isPunct("-"))
+			if err != nil {
+				return nil, err
+			}
+			rewritten = spliceTokens("date(", left, ", ", days, ")")
+		default:
+			if op.isPunct("-") {
+				return nil, featureNotSupported("operator integer - date is not supported")
+			}
+			days, err := dayModifier(left, false)
+			if err != nil {
+				return nil, err
+			}
+			rewritten = spliceTokens("date(", right, ", ", days, ")")
+		}
+		tokens = spliceTokens(tokens[:leftStart], rewritten, tokens[rightEnd:])
+		i = leftStart
+	}
+	return tokens, nil
+}
+
+// operandEnd returns the end (exclusive) of the primary starting at k, a
+// signed number included, or -1 if none starts there
+func operandEnd(tokens []token, k int) int {
+	if k >= len(tokens) {
+		return -1
+	}
+
+	t := tokens[k]
+	switch t.Kind {
+	case tokenNumber, tokenString, tokenParam:
+		return k + 1
+	case tokenIdent, tokenQuotedIdent:
+		if t.Kind == tokenIdent && (nonFunctionKeywords[strings.ToLower(t.Text)] || t.is("CASE")) {
+			return -1
+		}
+		end := qualifiedNameEnd(tokens, k)
+		if open := nextSignificant(tokens, end-1); open < len(tokens) && tokens[open].isPunct("(") {
+			if closing := matchingParen(tokens, open); closing >= 0 {
+				return closing + 1
+			}
+			return -1
+		}
+		return end
+	}
+
+	switch {
+	case t.isPunct("+"), t.isPunct("-"):
+		if next := nextSignificant(tokens, k); next < len(tokens) && tokens[next].Kind == tokenNumber {
+			return next + 1
+		}
+	case t.isPunct("("):
+		if closing := matchingParen(tokens, k); closing >= 0 {
+			return closing + 1
+		}
+	}
+	return -1
+}
+
+// isDateOperand reports whether an operand is a date: a date() call or CURRENT_DATE
+func isDateOperand(operand []token) bool {
+	sig := significantTokens(operand)
+	switch {
+	case len(sig) == 1:
+		return sig[0].is("CURRENT_DATE")
+	case len(sig) > 2:
+		return sig[0].is("DATE") && sig[1].isPunct("(") && matchingParen(sig, 1) == len(sig)-1
+	default:
+		return false
+	}
+}
+
+// isArithmeticOperator reports whether a token is an arithmetic operator
+func isArithmeticOperator(t token) bool {
+	switch {
+	case t.isPunct("+"), t.isPunct("-"), t.isPunct("*"), t.isPunct("/"), t.isPunct("%"), t.isPunct("^"):
+		return true
+	default:
+		return false
+	}
+}
+
+// dayModifier renders the number of days an operand adds to a date as a
+// SQLite date modifier, negated for subtraction
+func dayModifier(operand []token, negate bool) ([]token, error) {
+	sig := significantTokens(operand)
+
+	literal := ""
+	switch {
+	case len(sig) == 1 && sig[0].Kind == tokenNumber:
+		literal = sig[0].Text
+	case len(sig) == 2 && sig[1].Kind == tokenNumber:
+		literal = sig[0].Text + sig[1].Text
+	case len(sig) == 1 && sig[0].Kind == tokenString:
+		text := sig[0].Text
+		literal = strings.TrimSpace(strings.ReplaceAll(text[1:len(text)-1], "''", "'"))
+		if _, err := strconv.ParseInt(literal, 10, 32); err != nil {
+			return nil, newPostgresError("22P02", "invalid input syntax for type integer: \"%s\"", literal)
+		}
+	}
+	if literal != "" {
+		days, err := strconv.ParseInt(literal, 10, 32)
+		if err != nil {
+			return nil, featureNotSupported("date arithmetic with %s is not supported", literal)
+		}
+		if negate {
+			days = -days
+		}
+		return spliceTokens(quoteLiteral(strconv.FormatInt(days, 10) + " days")), nil
+	}
+
+	// Date and time values other than the date operand have no day count
+	for _, t := range sig {
+		if t.Kind == tokenIdent && dateTimeNames[strings.ToLower(t.Text)] {
+			return nil, featureNotSupported("date arithmetic with %s is not supported", strings.ToLower(t.Text))
+		}
+	}
+	if negate {
+		operand = spliceTokens("-(", operand, ")")
+	}
+	return spliceTokens("CAST(", operand, " AS INTEGER) || ' days'"), nil
+}
+
+// translateFunctions replaces PostgreSQL functions with SQLite expressions
+func translateFunctions(tokens []token) []token {
+	result := make([]token, 0, len(tokens))
+	for i := 0; i < len(tokens); i++ {
+		t := tokens[i]
+		expression, ok := functionTranslations[strings.ToLower(t.Text)]
+		if !ok || t.Kind != tokenIdent || isQualified(tokens, i) {
+			result = append(result, t)
+			continue
+		}
+
+		open := nextSignificant(tokens, i)
+		if open >= len(tokens) || !tokens[open].isPunct("(") {
+			result = append(result, t)
+			continue
+		}
+		closing := nextSignificant(tokens, open)
+		if closing >= len(tokens) || !tokens[closing].isPunct(")") {
+			result = append(result, t)
+			continue
+		}
+
+		result = append(result, tokenize(expression)...)
+		i = closing
+	}
+	return result
+}
+
+// regexOperators maps the PostgreSQL regular expression operators to SQLite
+// REGEXP, which calls the regexp function registered on every connection
+var regexOperators = map[string]string{
+	"~":   "REGEXP",
+	"!~":  "NOT REGEXP",
+	"~*":  "REGEXP '(?i)' ||",
+	"!~*": "NOT REGEXP '(?i)' ||",
+}
+
+// translateOperators replaces ILIKE with LIKE, which SQLite already
+// evaluates case-insensitively, and the regular expression operators
+// with REGEXP
+func translateOperators(tokens []token) []token {
+	result := make([]token, 0, len(tokens))
+	for i, t := range tokens {
+		if t.is("ILIKE") {
+			t = token{Kind: tokenIdent, Text: "LIKE"}
+		}
+		if replacement, ok := regexOperators[t.Text]; ok && t.Kind == tokenPunct {
+			prev := prevSignificant(tokens, i)
+			if prev >= 0 && isOperand(tokens[prev]) && !(tokens[prev].Kind == tokenIdent && nonFunctionKeywords[strings.ToLower(tokens[prev].Text)]) {
+				result = append(result, tokenize(replacement)...)
+				continue
+			}
+		}
+		result = append(result, t)
+	}
+	return result
+}
+
+// translateCatalogNames maps references to the system schemas onto the
+// emulated catalog: pg_catalog qualifiers are dropped, information_schema
+// relations become information_schema_<name> views, and the OPERATOR() and
+// COLLATE decorations psql adds to its queries are removed
+func translateCatalogNames(tokens []token) []token {
+	result := make([]token, 0, len(tokens))
+	for i := 0; i < len(tokens); i++ {
+		t := tokens[i]
+		isName := t.Kind == tokenIdent || t.Kind == tokenQuotedIdent
+		dot := nextSignificant(tokens, i)
+		qualified := dot < len(tokens) && tokens[dot].isPunct(".") && !isQualified(tokens, i)
+
+		switch {
+		case isName && qualified && t.name() == "pg_catalog":
+			i = dot
+			for i+1 < len(tokens) && !tokens[i+1].significant() {
+				i++
+			}
+		case isName && qualified && t.name() == "information_schema":
+			relation := nextSignificant(tokens, dot)
+			if relation >= len(tokens) {
+				result = append(result, t)
+				continue
+			}
+			result = append(result, token{Kind: tokenIdent, Text: "information_schema_" + tokens[relation].name()})
+			i = relation
+		case t.is("OPERATOR") && dot < len(tokens) && tokens[dot].isPunct("("):
+			closing := matchingParen(tokens, dot)
+			if closing < 0 {
+				result = append(result, t)
+				continue
+			}
+			// OPERATOR(pg_catalog.~) names the operator by its last token
+			op := prevSignificant(tokens, closing)
+			result = append(result, tokens[op])
+			i = closing
+		case t.is("COLLATE") && dot < len(tokens):
+			end := qualifiedNameEnd(tokens, dot)
+			switch strings.ToLower(tokens[end-1].name()) {
+			case "default", "c", "posix", "ucs_basic":
+				// SQLite compares with memcmp, which is what C collation means
+				for len(result) > 0 && !result[len(result)-1].significant() {
+					result = result[:len(result)-1]
+				}
+				i = end - 1
+			default:
+				result = append(result, t)
+			}
+		default:
+			result = append(result, t)
+		}
+	}
+	return result
+}
+
+// stripLockingClauses removes FOR UPDATE/FOR SHARE clauses; SQLite locks the
+// whole database for writers, so row locks are implied
+func stripLockingClauses(tokens []token) []token {
+	for i := 0; i < len(tokens); i++ {
+		if !tokens[i].is("FOR") {
+			continue
+		}
+
+		end := lockingClauseEnd(tokens, i)
+		if end < 0 {
+			continue
+		}
+		tokens = spliceTokens(tokens[:i], tokens[end:])
+		i--
+	}
+	return tokens
+}
+
+// lockingClauseEnd returns the end (exclusive) of the locking clause at i,
+// or -1 when the FOR keyword does not start one
+func lockingClauseEnd(tokens []token, i int) int {
+	words := func(j int, keywords ...string) (int, bool) {
+		for _, keyword := range keywords {
+			j = nextSignificant(tokens, j)
+			if j >= len(tokens) || !tokens[j].is(keyword) {
+				return 0, false
+			}
+		}
+		return j, true
+	}
+
+	var end int
+	var ok bool
+	for _, strength := range [][]string{{"UPDATE"}, {"NO", "KEY", "UPDATE"}, {"SHARE"}, {"KEY", "SHARE"}} {
+		if end, ok = words(i, strength...); ok {
+			break
+		}
+	}
+	if !ok {
+		return -1
+	}
+
+	if of, ok := words(end, "OF"); ok {
+		end = of
+		for {
+			name := nextSignificant(tokens, end)
+			if name >= len(tokens) || (tokens[name].Kind != tokenIdent && tokens[name].Kind != tokenQuotedIdent) {
+				break
+			}
+			end = name
+			if comma := nextSignificant(tokens, end); comma < len(tokens) && tokens[comma].isPunct(",") {
+				end = comma
+				continue
+			}
+			break
+		}
+	}
+
+	if nowait, ok := words(end, "NOWAIT"); ok {
+		end = nowait
+	} else if skip, ok := words(end, "SKIP", "LOCKED"); ok {
+		end = skip
+	}
+	return end + 1
+}
+
+// translateCreateTable translates the column definitions of a CREATE TABLE
+func translateCreateTable(tokens []token) ([]token, error) {
+	i := nextSignificant(tokens, -1)
+	i = nextSignificant(tokens, i)
+	for i < len(tokens) && (tokens[i].is("GLOBAL") || tokens[i].is("LOCAL") || tokens[i].is("UNLOGGED")) {
+		// SQLite only knows TEMP tables
+		tokens = spliceTokens(tokens[:i], tokens[nextSignificant(tokens, i):])
+	}
+	if i < len(tokens) && (tokens[i].is("TEMP") || tokens[i].is("TEMPORARY")) {
+		i = nextSignificant(tokens, i)
+	}
+	if i >= len(tokens) || !tokens[i].is("TABLE") {
+		return tokens, nil
+	}
+
+	open := i
+	for open < len(tokens) && !tokens[open].isPunct("(") {
+		if tokens[open].is("AS") {
+			return tokens, nil // CREATE TABLE ... AS SELECT
+		}
+		open++
+	}
+	closing := matchingParen(tokens, open)
+	if closing < 0 {
+		return tokens, nil
+	}
+
+	elements := splitTopLevel(tokens[open+1 : closing])
+	primaryKey := ""
+	for _, element := range elements {
+		if column, ok := tablePrimaryKey(significantTokens(element)); ok {
+			primaryKey = column
+		}
+	}
+
+	body := make([]token, 0, closing-open)
+	for n, element := range elements {
+		translated, err := translateColumnDefinition(element, primaryKey)
+		if err != nil {
+			return nil, err
+		}
+		if n > 0 {
+			body = append(body, token{Kind: tokenPunct, Text: ","})
+		}
+		body = append(body, translated...)
+	}
+
+	return spliceTokens(tokens[:open+1], body, tokens[closing:]), nil
+}
+
+// translateAlterTable translates ALTER TABLE ... ADD COLUMN and rejects the
+// ALTER TABLE forms SQLite does not implement
+func translateAlterTable(tokens []token) ([]token, error) {
+	sig := significantTokens(tokens)
+	if len(sig) < 4 || !sig[1].is("TABLE") {
+		return tokens, nil
+	}
+	if len(splitTopLevel(tokens)) > 1 {
+		return nil, featureNotSupported("multiple ALTER TABLE actions are not supported")
+	}
+
+	// Find the action following the table name
+	name := nextSignificant(tokens, nextSignificant(tokens, nextSignificant(tokens, -1)))
+	if tokens[name].is("IF") {
+		return nil, featureNotSupported("ALTER TABLE IF EXISTS is not supported")
+	}
+	if tokens[name].is("ONLY") {
+		tokens = spliceTokens(tokens[:name], tokens[nextSignificant(tokens, name):])
+	}
+	action := nextSignificant(tokens, qualifiedNameEnd(tokens, name)-1)
+	if action >= len(tokens) {
+		return tokens, nil
+	}
+
+	switch {
+	case tokens[action].is("ALTER"):
+		return nil, featureNotSupported("ALTER TABLE ... ALTER COLUMN is not supported")
+	case tokens[action].is("ADD"):
+		def := nextSignificant(tokens, action)
+		if def < len(tokens) && tokens[def].is("COLUMN") {
+			def = nextSignificant(tokens, def)
+		}
+		if def >= len(tokens) {
+			return tokens, nil
+		}
+		for _, keyword := range []string{"CONSTRAINT", "PRIMARY", "UNIQUE", "CHECK", "FOREIGN", "EXCLUDE"} {
+			if tokens[def].is(keyword) {
+				return nil, featureNotSupported("ALTER TABLE ... ADD %s is not supported", keyword)
+			}
+		}
+		if tokens[def].is("IF") {
+			return nil, featureNotSupported("ADD COLUMN IF NOT EXISTS is not supported")
+		}
+
+		translated, err := translateColumnDefinition(tokens[def:], "")
+		if err != nil {
+			return nil, err
+		}
+		return spliceTokens(tokens[:def], translated), nil
+	case tokens[action].is("DROP") && nextSignificant(tokens, action) < len(tokens) && tokens[nextSignificant(tokens, action)].is("CONSTRAINT"):
+		return nil, featureNotSupported("ALTER TABLE ... DROP CONSTRAINT is not supported")
+	default:
+		return tokens, nil
+	}
+}
+
+// tablePrimaryKey returns the column of a single-column PRIMARY KEY table constraint
+func tablePrimaryKey(sig []token) (string, bool) {
+	if len(sig) >= 2 && sig[0].is("CONSTRAINT") {
+		sig = sig[2:]
+	}
+	if len(sig) == 5 && sig[0].is("PRIMARY") && sig[1].is("KEY") && sig[2].isPunct("(") && sig[4].isPunct(")") {
+		return sig[3].name(), true
+	}
+	return "", false
+}
+
+// translateColumnDefinition translates the type and constraints of a column
+// definition. SERIAL and identity columns become INTEGER, which SQLite only
+// numbers automatically when it is the primary key.
+func translateColumnDefinition(element []token, tablePrimaryKey string) ([]token, error) {
+	nameIdx := nextSignificant(element, -1)
+	if nameIdx >= len(element) {
+		return element, nil
+	}
+	for _, keyword := range []string{"CONSTRAINT", "PRIMARY", "UNIQUE", "CHECK", "FOREIGN"} {
+		if element[nameIdx].is(keyword) {
+			return element, nil
+		}
+	}
+	if element[nameIdx].is("EXCLUDE") || element[nameIdx].is("LIKE") {
+		return nil, featureNotSupported("%s in CREATE TABLE is not supported", strings.ToUpper(element[nameIdx].Text))
+	}
+
+	column := element[nameIdx].name()
+	typeStart := nextSignificant(element, nameIdx)
+	typeEnd := typeNameEnd(element, typeStart)
+	if typeEnd > typeStart && isColumnConstraint(element[typeStart]) {
+		typeEnd = typeStart
+	}
+
+	typeTokens := element[typeStart:typeEnd]
+	name, array := typeName(typeTokens)
+	if array {
+		return nil, featureNotSupported("array columns are not supported")
+	}
+
+	serial := false
+	switch name {
+	case "serial", "serial4", "bigserial", "serial8", "smallserial", "serial2":
+		serial = true
+		typeTokens = tokenize("INTEGER")
+	case "bytea":
+		typeTokens = tokenize("BLOB")
+	case "timestamptz", "timestamp with time zone":
+		typeTokens = tokenize("TIMESTAMPTZ")
+	case "timestamp without time zone":
+		typeTokens = tokenize("TIMESTAMP")
+	case "timetz", "time with time zone", "time without time zone":
+		typeTokens = tokenize("TIME")
+	case "character varying":
+		typeTokens = spliceTokens("VARCHAR", typeModifiers(typeTokens))
+	}
+
+	constraints, identity, primaryKey := translateColumnConstraints(element[typeEnd:])
+	if (serial || identity) && !primaryKey && tablePrimaryKey != column {
+		return nil, featureNotSupported("column %q: SERIAL and identity columns must be the primary key", column)
+	}
+	if identity && !serial {
+		typeTokens = tokenize("INTEGER")
+	}
+
+	return spliceTokens(element[:typeStart], typeTokens, constraints), nil
+}
+
+// translateColumnConstraints drops identity clauses and parenthesizes
+// DEFAULT expressions, which SQLite only accepts as literals or in parentheses
+func translateColumnConstraints(tokens []token) ([]token, bool, bool) {
+	identity := false
+	primaryKey := false
+	result := make([]token, 0, len(tokens))
+
+	for i := 0; i < len(tokens); i++ {
+		t := tokens[i]
+		next := nextSignificant(tokens, i)
+
+		switch {
+		case t.is("PRIMARY") && next < len(tokens) && tokens[next].is("KEY"):
+			primaryKey = true
+		case t.is("GENERATED"):
+			end := identityClauseEnd(tokens, i)
+			if end > 0 {
+				identity = true
+				for len(result) > 0 && !result[len(result)-1].significant() {
+					result = result[:len(result)-1]
+				}
+				i = end - 1
+				continue
+			}
+		case t.is("DEFAULT") && next < len(tokens):
+			end := next + 1
+			if !tokens[next].is("NULL") {
+				for end < len(tokens) {
+					if t := tokens[end]; t.isPunct("(") {
+						end = matchingParen(tokens, end)
+						if end < 0 {
+							end = len(tokens)
+							break
+						}
+					} else if isColumnConstraint(t) {
+						break
+					}
+					end++
+				}
+			}
+
+			last := prevSignificant(tokens, end)
+			expression := tokens[next : last+1]
+			result = append(result, tokens[i:next]...)
+			if isDefaultLiteral(significantTokens(expression)) {
+				result = append(result, expression...)
+			} else {
+				result = spliceTokens(result, "(", expression, ")")
+			}
+			i = last
+			continue
+		}
+		result = append(result, t)
+	}
+	return result, identity, primaryKey
+}
+
+// identityClauseEnd returns the end (exclusive) of a GENERATED ... AS IDENTITY
+// clause at i, or -1 for generated columns
+func identityClauseEnd(tokens []token, i int) int {
+	j := nextSignificant(tokens, i)
+	switch {
+	case j < len(tokens) && tokens[j].is("ALWAYS"):
+	case j < len(tokens) && tokens[j].is("BY"):
+		j = nextSignificant(tokens, j) // DEFAULT
+	default:
+		return -1
+	}
+
+	as := nextSignificant(tokens, j)
+	identity := nextSignificant(tokens, as)
+	if identity >= len(tokens) || !tokens[as].is("AS") || !tokens[identity].is("IDENTITY") {
+		return -1
+	}
+	if open := nextSignificant(tokens, identity); open < len(tokens) && tokens[open].isPunct("(") {
+		if closing := matchingParen(tokens, open); closing > 0 {
+			return closing + 1
+		}
+	}
+	return identity + 1
+}
+
+// isColumnConstraint reports whether a token starts a column constraint
+func isColumnConstraint(t token) bool {
+	for _, keyword := range columnConstraintKeywords {
+		if t.is(keyword) {
+			return true
+		}
+	}
+	return false
+}
+
+// isDefaultLiteral reports whether a DEFAULT expression is accepted by
+// SQLite without parentheses
+func isDefaultLiteral(sig []token) bool {
+	switch {
+	case len(sig) == 1:
+		t := sig[0]
+		return t.Kind == tokenString || t.Kind == tokenNumber || t.is("NULL") ||
+			t.is("CURRENT_TIME") || t.is("CURRENT_DATE") || t.is("CURRENT_TIMESTAMP")
+	case len(sig) == 2:
+		return (sig[0].isPunct("-") || sig[0].isPunct("+")) && sig[1].Kind == tokenNumber
+	default:
+		return len(sig) > 0 && sig[0].isPunct("(") && matchingParen(sig, 0) == len(sig)-1
+	}
+}
+
+// trimTokens strips leading and trailing whitespace and comments
+func trimTokens(tokens []token) []token {
+	start := nextSignificant(tokens, -1)
+	end := prevSignificant(tokens, len(tokens))
+	if start > end {
+		return nil
+	}
+	return tokens[start : end+1]
+}
+
+// nextSignificant returns the index of the first significant token after i,
+// or len(tokens) if there is none
+func nextSignificant(tokens []token, i int) int {
+	for i++; i < len(tokens); i++ {
+		if tokens[i].significant() {
+			return i
+		}
+	}
+	return len(tokens)
+}
+
+// prevSignificant returns the index of the last significant token before i, or -1
+func prevSignificant(tokens []token, i int) int {
+	for i--; i >= 0; i-- {
+		if tokens[i].significant() {
+			return i
+		}
+	}
+	return -1
+}
+
+// matchingOpenParen returns the index of the parenthesis opening the one at closing, or -1
+func matchingOpenParen(tokens []token, closing int) int {
+	depth := 0
+	for i := closing; i >= 0; i-- {
+		switch {
+		case tokens[i].isPunct(")"):
+			depth++
+		case tokens[i].isPunct("("):
+			depth--
+			if depth == 0 {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+// spliceTokens concatenates token slices and SQL text fragments into a new slice
+func spliceTokens(parts ...interface{}) []token {
+	var result []token
+	for _, part := range parts {
+		switch p := part.(type) {
+		case string:
+			result = append(result, tokenize(p)...)
+		case []token:
+			result = append(result, p...)
+		}
+	}
+	return result
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"testing"
+
+	psqlerr "github.com/jeroenrinzema/psql-wire/errors"
+)
+
+func TestTranslateStatement(t *testing.T) {
+	tests := []struct {
+		query string
+		want  string
+	}{
+		{
+			"CREATE TABLE users (id SERIAL PRIMARY KEY, avatar BYTEA, created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(), active BOOLEAN DEFAULT TRUE)",
+			"CREATE TABLE users (id INTEGER PRIMARY KEY, avatar BLOB, created_at TIMESTAMPTZ NOT NULL DEFAULT (strftime('%Y-%m-%d %H:%M:%f', 'now')), active BOOLEAN DEFAULT 1)",
+		},
+		{
+			"CREATE TABLE events (id BIGSERIAL, name character varying(64), PRIMARY KEY (id))",
+			"CREATE TABLE events (id INTEGER, name VARCHAR(64), PRIMARY KEY (id))",
+		},
+		{
+			"CREATE TABLE t (id bigint GENERATED ALWAYS AS IDENTITY PRIMARY KEY, at timestamp with time zone)",
+			"CREATE TABLE t (id INTEGER PRIMARY KEY, at TIMESTAMPTZ)",
+		},
+		{
+			"SELECT id::text, '42'::integer, price::numeric(10,2), (a + b)::float8 FROM t",
+			"SELECT CAST(id AS TEXT), CAST('42' AS INTEGER), CAST(price AS NUMERIC), CAST((a + b) AS REAL) FROM t",
+		},
+		{
+			"SELECT t.created::date, lower(name)::varchar, '1'::text::int",
+			"SELECT date(t.created), CAST(lower(name) AS TEXT), CAST(CAST('1' AS TEXT) AS INTEGER)",
+		},
+		{
+			"SELECT * FROM users WHERE name ILIKE ?1 AND active = TRUE FOR UPDATE",
+			"SELECT * FROM users WHERE name LIKE ?1 AND active = 1 ",
+		},
+		{
+			`SELECT E'it\'s\n', $$a 'quoted' value$$`,
+			"SELECT 'it''s\n', 'a ''quoted'' value'",
+		},
+		{
+			"SELECT 'now'::timestamptz, TIMESTAMP '2024-01-01 10:00:00'",
+			"SELECT strftime('%Y-%m-%d %H:%M:%f', 'now'), strftime('%Y-%m-%d %H:%M:%f', '2024-01-01 10:00:00')",
+		},
+		{
+			"ALTER TABLE users ADD COLUMN token uuid DEFAULT gen_random_uuid()",
+			"ALTER TABLE users ADD COLUMN token uuid DEFAULT " + uuidExpression,
+		},
+		{
+			"SELECT CAST(x AS INTEGER), \"true\", t.false FROM t",
+			"SELECT CAST(x AS INTEGER), \"true\", t.false FROM t",
+		},
+		{
+			"SELECT c.relname FROM pg_catalog.pg_class c WHERE c.relname OPERATOR(pg_catalog.~) '^(users)$' COLLATE pg_catalog.default AND pg_catalog.pg_table_is_visible(c.oid)",
+			"SELECT c.relname FROM pg_class c WHERE c.relname REGEXP '^(users)$' AND pg_table_is_visible(c.oid)",
+		},
+		{
+			"SELECT column_name FROM information_schema.columns WHERE name !~* 'x' AND ~flags = 0",
+			"SELECT column_name FROM information_schema_columns WHERE name NOT REGEXP '(?i)' || 'x' AND ~flags = 0",
+		},
+		{
+			"SELECT 'public.users'::regclass, '16385'::regclass, 'int4'::regtype",
+			"SELECT (SELECT oid FROM pg_class WHERE relname = 'users'), 16385, (SELECT oid FROM pg_type WHERE typname = 'int4')",
+		},
+		{
+			"SELECT '2024-01-01'::date + 1, CURRENT_DATE - 7 - 1, 2 + DATE '2024-01-01'",
+			"SELECT date(date('2024-01-01'), '1 days'), date(date(CURRENT_DATE, '-7 days'), '-1 days'), date(date('2024-01-01'), '2 days')",
+		},
+		{
+			"SELECT t.created::date - $1, CURRENT_DATE + t.days FROM t WHERE d::date - e::date > 3",
+			"SELECT date(date(t.created), CAST(-($1) AS INTEGER) || ' days'), date(CURRENT_DATE, CAST(t.days AS INTEGER) || ' days') FROM t WHERE CAST(julianday(date(d)) - julianday(date(e)) AS INTEGER) > 3",
+		},
+	}
+
+	for _, tt := range tests {
+		translated, err := translateStatement(tokenize(tt.query))
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", tt.query, err)
+			continue
+		}
+		if got := joinTokens(translated); got != tt.want {
+			t.Errorf("%s:\n got: %s\nwant: %s", tt.query, got, tt.want)
+		}
+	}
+}
+
+func TestTranslateUnsupported(t *testing.T) {
+	queries := []string{
+		"SELECT DISTINCT ON (a) a, b FROM t",
+		"SELECT ARRAY[1, 2]",
+		"SELECT tags[1] FROM t",
+		"SELECT now() - INTERVAL '1 day'",
+		"SELECT 'f'::regproc",
+		"SELECT CURRENT_DATE + 1.5",
+		"SELECT x::date + 2 * 3",
+		"SELECT 1 - CURRENT_DATE",
+		"SELECT CURRENT_DATE + now()",
+		"CREATE TABLE t (id SERIAL, name TEXT)",
+		"CREATE TABLE t (tags TEXT[])",
+		"CREATE EXTENSION pgcrypto",
+		"ALTER TABLE t ALTER COLUMN name TYPE VARCHAR(10)",
+	}
+
+	for _, query := range queries {
+		_, err := translateStatement(tokenize(query))
+		if err == nil {
+			t.Errorf("%s: expected an error", query)
+			continue
+		}
+		if code := psqlerr.Flatten(err).Code; code != "0A000" {
+			t.Errorf("%s: code = %s; want 0A000", query, code)
+		}
+	}
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"crypto/rand"
+	"fmt"
+	"strings"
+)
+
+// Privilege is the category of statements a user may run; each level
+// includes the ones below it
+type Privilege int
+
+const (
+	PrivilegeReadOnly  Privilege = iota // queries, SET and transaction control
+	PrivilegeReadWrite                  // INSERT, UPDATE, DELETE and COPY FROM
+	PrivilegeDDL                        // CREATE, DROP, ALTER and everything else
+)
+
+// privilegeNames are the configuration names of the privilege levels
+var privilegeNames = []string{"read-only", "read-write", "ddl"}
+
+func (p Privilege) String() string {
+	if int(p) < len(privilegeNames) {
+		return privilegeNames[p]
+	}
+	return fmt.Sprintf("Privilege(%d)", int(p))
+}
+
+// parsePrivilege reads a privilege level from the configuration
+func parsePrivilege(name string) (Privilege, error) {
+	for i, candidate := range privilegeNames {
+		if strings.EqualFold(name, candidate) {
+			return Privilege(i), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown privilege %q, expected one of %s", name, strings.Join(privilegeNames, ", "))
+}
+
+// User is a configured database user
+type User struct {
+	Name      string
+	Privilege Privilege
+
+	databases map[string]bool // nil allows every database
+	verifier  passwordVerifier
+}
+
+// CanConnect reports whether the user may connect to the database
+func (u *User) CanConnect(database string) bool {
+	return u.databases == nil || u.databases[database]
+}
+
+// UserRegistry holds the configured users by name
+type UserRegistry struct {
+	users map[string]*User
+}
+
+// NewUserRegistry prepares the configured users. Without a users list, the
+// single user and password of the configuration may run any statement on
+// any database.
+func NewUserRegistry(config AuthenticationConfig) (*UserRegistry, error) {
+	users := config.Users
+	if len(users) == 0 {
+		users = []UserConfig{{Name: config.User, Password: config.Password, Privilege: "ddl"}}
+	}
+
+	r := &UserRegistry{users: make(map[string]*User)}
+	for _, uc := range users {
+		if uc.Name == "" {
+			return nil, fmt.Errorf("user without a name")
+		}
+		if _, ok := r.users[uc.Name]; ok {
+			return nil, fmt.Errorf("duplicate user %s", uc.Name)
+		}
+
+		user := &User{Name: uc.Name, Privilege: PrivilegeReadOnly}
+		if uc.Privilege != "" {
+			privilege, err := parsePrivilege(uc.Privilege)
+			if err != nil {
+				return nil, fmt.Errorf("user %s: %w", uc.Name, err)
+			}
+			user.Privilege = privilege
+		}
+
+		for _, database := range uc.Databases {
+			if database == "all" {
+				user.databases = nil
+				break
+			}
+			if user.databases == nil {
+				user.databases = make(map[string]bool)
+			}
+			user.databases[database] = true
+		}
+
+		verifier, err := prepareVerifier(uc.Password)
+		if err != nil {
+			return nil, fmt.Errorf("user %s: %w", uc.Name, err)
+		}
+		user.verifier = verifier
+		r.users[uc.Name] = user
+	}
+	return r, nil
+}
+
+// prepareVerifier parses a configured password. A plaintext password is
+// kept for MD5 and cleartext authentication and turned into a SCRAM
+// verifier once.
+func prepareVerifier(password string) (passwordVerifier, error) {
+	if password == "" {
+		return passwordVerifier{}, fmt.Errorf("a password is required")
+	}
+	verifier, err := parsePasswordVerifier(password)
+	if err != nil {
+		return passwordVerifier{}, err
+	}
+	if verifier.plaintext != "" {
+		salt := make([]byte, 16)
+		if _, err := rand.Read(salt); err != nil {
+			return passwordVerifier{}, fmt.Errorf("failed to generate salt: %w", err)
+		}
+		scram := scramVerifier(verifier.plaintext, salt, scramIterations)
+		scram.plaintext = verifier.plaintext
+		verifier = scram
+	}
+	return verifier, nil
+}
+
+// Lookup returns the user with the name, or nil
+func (r *UserRegistry) Lookup(name string) *User {
+	return r.users[name]
+}
+
+// readOnlyPragmas are the PRAGMAs that only report something when run
+// without an argument
+var readOnlyPragmas = map[string]bool{
+	"user_version":      true,
+	"schema_version":    true,
+	"application_id":    true,
+	"data_version":      true,
+	"page_size":         true,
+	"page_count":        true,
+	"max_page_count":    true,
+	"freelist_count":    true,
+	"encoding":          true,
+	"journal_mode":      true,
+	"auto_vacuum":       true,
+	"foreign_keys":      true,
+	"database_list":     true,
+	"collation_list":    true,
+	"function_list":     true,
+	"module_list":       true,
+	"pragma_list":       true,
+	"compile_options":   true,
+	"table_list":        true,
+	"foreign_key_check": true,
+	"integrity_check":   true,
+	"quick_check":       true,
+}
+
+// introspectionPragmas are the PRAGMAs that take an argument in parentheses
+// without changing anything
+var introspectionPragmas = map[string]bool{
+	"table_info":        true,
+	"table_xinfo":       true,
+	"table_list":        true,
+	"index_list":        true,
+	"index_info":        true,
+	"index_xinfo":       true,
+	"foreign_key_list":  true,
+	"foreign_key_check": true,
+	"integrity_check":   true,
+	"quick_check":       true,
+}
+
+// statementPrivilege returns the privilege a statement requires. Unknown
+// statements require the highest level.
+func statementPrivilege(query string) Privilege {
+	sig := significantTokens(tokenize(query))
+	if len(sig) == 0 {
+		return PrivilegeReadOnly
+	}
+
+	switch strings.ToUpper(sig[0].Text) {
+	case "SELECT", "VALUES", "TABLE", "EXPLAIN", "SHOW", "SET", "RESET", "DISCARD",
+		"BEGIN", "START", "COMMIT", "END", "ROLLBACK", "ABORT", "SAVEPOINT", "RELEASE":
+		return PrivilegeReadOnly
+	case "INSERT", "UPDATE", "DELETE", "REPLACE", "TRUNCATE":
+		return PrivilegeReadWrite
+	case "WITH":
+		// A data-modifying statement may follow the common table expressions
+		for _, t := range sig[1:] {
+			if t.is("INSERT") || t.is("UPDATE") || t.is("DELETE") || t.is("REPLACE") {
+				return PrivilegeReadWrite
+			}
+		}
+		return PrivilegeReadOnly
+	case "COPY":
+		// COPY ... FROM loads rows, COPY ... TO reads them
+		depth := 0
+		for _, t := range sig[1:] {
+			switch {
+			case t.isPunct("("):
+				depth++
+			case t.isPunct(")"):
+				depth--
+			case depth == 0 && t.is("FROM"):
+				return PrivilegeReadWrite
+			}
+		}
+		return PrivilegeReadOnly
+	case "PRAGMA":
+		// Only the introspection PRAGMAs are read-only; any other may
+		// change the database file, like optimize or wal_checkpoint
+		pragma := sig[1:]
+		for len(pragma) > 0 && pragma[len(pragma)-1].isPunct(";") {
+			pragma = pragma[:len(pragma)-1]
+		}
+		if len(pragma) > 2 && pragma[1].isPunct(".") {
+			pragma = pragma[2:]
+		}
+		if len(pragma) == 0 {
+			return PrivilegeDDL
+		}
+		name := strings.ToLower(pragma[0].name())
+		switch {
+		case len(pragma) == 1 && readOnlyPragmas[name]:
+			return PrivilegeReadOnly
+		case len(pragma) > 1 && pragma[1].isPunct("(") && pragma[len(pragma)-1].isPunct(")") && introspectionPragmas[name]:
+			return PrivilegeReadOnly
+		}
+		return PrivilegeDDL
+	default:
+		return PrivilegeDDL
+	}
+}
+
+// checkPrivilege refuses a statement the session's user may not run.
+// Sessions without a configured user, such as in tests, are unrestricted.
+func checkPrivilege(session *Session, query string) error {
+	if session == nil || session.User == nil {
+		return nil
+	}
+	required := statementPrivilege(query)
+	if session.User.Privilege >= required {
+		return nil
+	}
+	return newPostgresError("42501", "permission denied to run %s: user %q has %s privilege, %s is required",
+		firstKeyword(query), session.User.Name, session.User.Privilege, required)
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	psqlerr "github.com/jeroenrinzema/psql-wire/errors"
+)
+
+func TestStatementPrivilege(t *testing.T) {
+	tests := []struct {
+		query string
+		want  Privilege
+	}{
+		{"SELECT * FROM t", PrivilegeReadOnly},
+		{"  -- comment\n select 1", PrivilegeReadOnly},
+		{"SET search_path = public", PrivilegeReadOnly},
+		{"BEGIN", PrivilegeReadOnly},
+		{"EXPLAIN SELECT 1", PrivilegeReadOnly},
+		{"WITH x AS (SELECT 1) SELECT * FROM x", PrivilegeReadOnly},
+		{"COPY t TO STDOUT", PrivilegeReadOnly},
+		{"COPY (SELECT a FROM t) TO STDOUT", PrivilegeReadOnly},
+		{"PRAGMA table_info(t)", PrivilegeReadOnly},
+		{"PRAGMA user_version", PrivilegeReadOnly},
+		{"PRAGMA main.table_info(t);", PrivilegeReadOnly},
+		{"PRAGMA integrity_check", PrivilegeReadOnly},
+		{"INSERT INTO t VALUES (1)", PrivilegeReadWrite},
+		{"UPDATE t SET a = 1", PrivilegeReadWrite},
+		{"DELETE FROM t", PrivilegeReadWrite},
+		{"WITH x AS (SELECT 1) INSERT INTO t SELECT * FROM x", PrivilegeReadWrite},
+		{"COPY t FROM STDIN", PrivilegeReadWrite},
+		{"CREATE TABLE t (a INTEGER)", PrivilegeDDL},
+		{"DROP TABLE t", PrivilegeDDL},
+		{"ALTER TABLE t ADD COLUMN b TEXT", PrivilegeDDL},
+		{"PRAGMA user_version = 2", PrivilegeDDL},
+		{"PRAGMA journal_mode(DELETE)", PrivilegeDDL},
+		{"PRAGMA optimize", PrivilegeDDL},
+		{"PRAGMA wal_checkpoint(TRUNCATE)", PrivilegeDDL},
+		{"PRAGMA main.incremental_vacuum", PrivilegeDDL},
+		{"ATTACH DATABASE 'x.db' AS x", PrivilegeDDL},
+		{"VACUUM", PrivilegeDDL},
+	}
+	for _, tt := range tests {
+		if got := statementPrivilege(tt.query); got != tt.want {
+			t.Errorf("%q: got %s, want %s", tt.query, got, tt.want)
+		}
+	}
+}
+
+func TestUserRegistry(t *testing.T) {
+	registry, err := NewUserRegistry(AuthenticationConfig{User: "postgres", Password: "postgres"})
+	if err != nil {
+		t.Fatalf("Failed to create registry: %v", err)
+	}
+	admin := registry.Lookup("postgres")
+	if admin == nil || admin.Privilege != PrivilegeDDL || !admin.CanConnect("anything") {
+		t.Errorf("Expected the single configured user to be unrestricted, got %+v", admin)
+	}
+
+	registry, err = NewUserRegistry(AuthenticationConfig{
+		User:     "postgres",
+		Password: "postgres",
+		Users: []UserConfig{
+			{Name: "reader", Password: "r", Databases: []string{"sales", "hr"}},
+			{Name: "writer", Password: "w", Databases: []string{"all"}, Privilege: "read-write"},
+		},
+	})
+	if err != nil {
+		t.Fatalf("Failed to create registry: %v", err)
+	}
+	if registry.Lookup("postgres") != nil {
+		t.Error("Expected the users list to replace the single user")
+	}
+	reader := registry.Lookup("reader")
+	if reader.Privilege != PrivilegeReadOnly || !reader.CanConnect("hr") || reader.CanConnect("myapp") {
+		t.Errorf("Unexpected reader %+v", reader)
+	}
+	writer := registry.Lookup("writer")
+	if writer.Privilege != PrivilegeReadWrite || !writer.CanConnect("myapp") {
+		t.Errorf("Unexpected writer %+v", writer)
+	}
+
+	for _, users := range [][]UserConfig{
+		{{Name: "a", Password: "x"}, {Name: "a", Password: "y"}},
+		{{Name: "a", Password: "x", Privilege: "superuser"}},
+		{{Name: "a"}},
+		{{Password: "x"}},
+	} {
+		if _, err := NewUserRegistry(AuthenticationConfig{Users: users}); err == nil {
+			t.Errorf("Expected %+v to be rejected", users)
+		}
+	}
+}
+
+func TestAuthenticateRegisteredUsers(t *testing.T) {
+	auth, err := NewAuthenticator(AuthenticationConfig{Users: []UserConfig{
+		{Name: "alice", Password: "a-secret"},
+		{Name: "bob", Password: "b-secret"},
+	}}, nil)
+	if err != nil {
+		t.Fatalf("Failed to create authenticator: %v", err)
+	}
+
+	for _, attempt := range []struct {
+		user, password string
+		ok             bool
+	}{{"alice", "a-secret", true}, {"bob", "b-secret", true}, {"bob", "a-secret", false}} {
+		client := &scramClient{password: attempt.password}
+		err := auth.authenticate(&scriptedAuthConn{respond: client.respond}, attempt.user, authMethodSCRAM)
+		if (err == nil) != attempt.ok {
+			t.Errorf("%s/%s: unexpected result %v", attempt.user, attempt.password, err)
+		}
+	}
+}
+
+func TestPrivilegeEnforcement(t *testing.T) {
+	handler := newTestHandler(t)
+	admin, _ := handler.StartSession(context.Background())
+	runQuery(t, handler, admin, "CREATE TABLE t (id INTEGER)")
+
+	sessions := map[Privilege]context.Context{}
+	for _, privilege := range []Privilege{PrivilegeReadOnly, PrivilegeReadWrite} {
+		user := &User{Name: privilege.String(), Privilege: privilege}
+		ctx, err := handler.StartSession(context.Background())
+		if err != nil {
+			t.Fatalf("Failed to start session: %v", err)
+		}
+		sessionFromContext(ctx).User = user
+		sessions[privilege] = ctx
+	}
+
+	tests := []struct {
+		privilege Privilege
+		query     string
+		allowed   bool
+	}{
+		{PrivilegeReadOnly, "SELECT count(*) FROM t", true},
+		{PrivilegeReadOnly, "SHOW search_path", true},
+		{PrivilegeReadOnly, "INSERT INTO t VALUES (1)", false},
+		{PrivilegeReadOnly, "SELECT 1; DELETE FROM t", false},
+		{PrivilegeReadWrite, "INSERT INTO t VALUES (1)", true},
+		{PrivilegeReadWrite, "BEGIN; UPDATE t SET id = 2; COMMIT", true},
+		{PrivilegeReadWrite, "CREATE TABLE u (id INTEGER)", false},
+		{PrivilegeReadWrite, "DROP TABLE t", false},
+	}
+	for _, tt := range tests {
+		ctx := sessions[tt.privilege]
+		fn, _, _, err := handler.ParseQuery(ctx, tt.query)
+		if err == nil {
+			err = fn(ctx, &recordingWriter{}, nil)
+		}
+		if tt.allowed && err != nil {
+			t.Errorf("%s %q: unexpected error %v", tt.privilege, tt.query, err)
+		}
+		if !tt.allowed && psqlerr.GetCode(err) != "42501" {
+			t.Errorf("%s %q: expected 42501, got %v", tt.privilege, tt.query, err)
+		}
+	}
+
+	writer := runQuery(t, handler, admin, "SELECT id FROM t")
+	if len(writer.rows) != 1 || writer.rows[0][0] != int64(2) {
+		t.Errorf("Expected only the read-write changes, got %v", writer.rows)
+	}
+}
@@ -2,12 +2,17 @@ package main
 
 import (
 	"context"
+	"database/sql"
+	"errors"
 	"fmt"
 	"log"
+	"strconv"
 	"strings"
+	"time"
 
 	wire "github.com/jeroenrinzema/psql-wire"
 	"github.com/lib/pq/oid"
+	"github.com/mattn/go-sqlite3"
 )
 
 // SimpleWireHandler provides a simplified wire protocol handler
@@ -15,15 +20,20 @@ type SimpleWireHandler struct {
 	backend   *SQLiteBackend
 	txManager *TransactionManager
 	txMonitor *TransactionMonitor
+	listener  *ProtocolListener
+	cancels   *CancelRegistry
+	router    *DatabaseRouter // creates and drops databases, nil for a single database
 	config    *Config
 }
 
 // NewSimpleWireHandler creates a new simplified wire protocol handler
-func NewSimpleWireHandler(backend *SQLiteBackend, txManager *TransactionManager, txMonitor *TransactionMonitor, config *Config) *SimpleWireHandler {
+func NewSimpleWireHandler(backend *SQLiteBackend, txManager *TransactionManager, txMonitor *TransactionMonitor, listener *ProtocolListener, config *Config) *SimpleWireHandler {
 	return &SimpleWireHandler{
 		backend:   backend,
 		txManager: txManager,
 		txMonitor: txMonitor,
+		listener:  listener,
+		cancels:   NewCancelRegistry(),
 		config:    config,
 	}
 }
@@ -33,19 +43,287 @@ func (h *SimpleWireHandler) ParseQuery(ctx context.Context, query string) (wire.
 	// Get connection ID from context
 	connectionID := getConnectionIDSimple(ctx)
 
+	// An Execute runs the statement its portal is bound to
+	if session := sessionFromContext(ctx); session != nil && session.Conn.portalBind() != nil {
+		name := session.Conn.portalBind().Statement
+		prepared, ok := session.prepared[name]
+		if !ok {
+			return nil, nil, nil, newPostgresError("26000", "prepared statement %q does not exist", name)
+		}
+		return prepared.fn, prepared.params, prepared.columns, nil
+	}
+
+	// Any error aborts the transaction block it happens in
+	fn, paramTypes, columns, err := h.parseQuery(ctx, connectionID, query)
+	if err != nil {
+		h.txManager.Fail(connectionID)
+		h.reportError(ctx, err)
+		return nil, nil, nil, err
+	}
+	failing := func(ctx context.Context, writer wire.DataWriter, parameters []string) error {
+		// A CancelRequest for the session or the statement_timeout
+		// interrupts the statement through ctx
+		if session := sessionFromContext(ctx); session != nil {
+			var done context.CancelFunc
+			ctx, done = session.startStatement(ctx, h.sessionTimeout(connectionID, "statement_timeout"))
+			defer done()
+		}
+
+		err := fn(ctx, writer, parameters)
+		if err != nil {
+			if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+				err = newPostgresError("57014", "canceling statement due to statement timeout")
+			}
+			h.txManager.Fail(connectionID)
+			h.reportError(ctx, err)
+		}
+		return err
+	}
+	return failing, paramTypes, columns, nil
+}
+
+// reportError hands the error psql-wire reports next to the connection,
+// which sends it with all its fields
+func (h *SimpleWireHandler) reportError(ctx context.Context, err error) {
+	if session := sessionFromContext(ctx); session != nil {
+		session.Conn.reportError(err)
+	}
+}
+
+// parseQuery prepares a query and returns the function executing it
+func (h *SimpleWireHandler) parseQuery(ctx context.Context, connectionID string, query string) (wire.PreparedStatementFn, []oid.Oid, wire.Columns, error) {
+	session := sessionFromContext(ctx)
+
+	// Recover the statement name and message type psql-wire does not pass along
+	var msg statementMessage
+	if session != nil {
+		msg = session.Conn.statement()
+	}
+	name := msg.Name
+
+	// A simple Query message may carry several statements
+	if statements := splitStatements(query); len(statements) > 1 {
+		if msg.Type == 'P' {
+			return nil, nil, nil, newPostgresError("42601", "cannot insert multiple commands into a prepared statement")
+		}
+		fn := func(ctx context.Context, writer wire.DataWriter, parameters []string) error {
+			return h.executeBatchSimple(ctx, session, connectionID, statements, writer)
+		}
+		return h.reportingSettings(session, connectionID, fn), nil, nil, nil
+	}
+
+	if err := h.checkTransactionAborted(connectionID, query); err != nil {
+		return nil, nil, nil, err
+	}
+	if err := checkPrivilege(session, query); err != nil {
+		return nil, nil, nil, err
+	}
+
+	// COPY exchanges its data with the client outside psql-wire
+	if firstKeyword(query) == "COPY" {
+		command, err := parseCopyCommand(query)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		fn := func(ctx context.Context, writer wire.DataWriter, parameters []string) error {
+			return h.executeCopy(ctx, session, connectionID, command, writer)
+		}
+		return h.reportingSettings(session, connectionID, fn), nil, nil, nil
+	}
+
+	// CREATE DATABASE and DROP DATABASE act on blob storage
+	dbCommand, ok, err := parseDatabaseCommand(query)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if ok {
+		fn := func(ctx context.Context, writer wire.DataWriter, parameters []string) error {
+			return h.executeDatabaseCommand(ctx, connectionID, dbCommand, writer)
+		}
+		return fn, nil, nil, nil
+	}
+
+	// SET, SHOW and RESET are answered from the session's parameters
+	command, ok, err := parseSettingCommand(query)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if ok {
+		fn := func(ctx context.Context, writer wire.DataWriter, parameters []string) error {
+			if err := h.checkTransactionAborted(connectionID, query); err != nil {
+				return err
+			}
+			return h.executeSettingCommand(connectionID, command, writer)
+		}
+		return h.reportingSettings(session, connectionID, fn), nil, command.Columns(), nil
+	}
+
+	stmt, err := h.prepareStatementSimple(connectionID, name, query)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	// Types the client declared in its Parse take precedence
+	for i, typeOid := range msg.ParamTypes {
+		if typeOid != 0 && i < len(stmt.ParamTypes) {
+			stmt.ParamTypes[i] = typeOid
+		}
+	}
+
+	// Describe the result columns up front, psql-wire sends the RowDescription before execution
+	columns, err := h.describeQuerySimple(connectionID, stmt)
+	if err != nil {
+		return nil, nil, nil, toPostgresError(err)
+	}
+
+	// Named statements are cached on the connection and reused on every execute
+	if stmt.Name != "" && isCacheableSimple(stmt.Query) {
+		if err := h.backend.Prepare(connectionID, stmt.Name, stmt.Query); err != nil {
+			return nil, nil, nil, toPostgresError(err)
+		}
+	} else {
+		stmt.Name = ""
+	}
+
 	// Create a prepared statement function
 	fn := func(ctx context.Context, writer wire.DataWriter, parameters []string) error {
-		return h.executeQuerySimple(ctx, connectionID, query, writer)
+		bind := &bindMessage{Values: parameters}
+		if session != nil && session.Conn.portalBind() != nil {
+			bind = session.Conn.portalBind()
+		}
+		args, err := bindParametersSimple(stmt, bind)
+		if err != nil {
+			return err
+		}
+		writer = resultWriter(session, columns, bind.ResultFormats, writer)
+		return toPostgresError(h.executeQuerySimple(ctx, connectionID, stmt, args, columns, writer))
+	}
+
+	return h.reportingSettings(session, connectionID, fn), stmt.ParamTypes, columns, nil
+}
+
+// prepareStatementSimple translates a PostgreSQL statement for SQLite and
+// infers the types of its parameters
+func (h *SimpleWireHandler) prepareStatementSimple(connectionID string, name string, query string) (*Statement, error) {
+	tokens, count := rewritePlaceholders(tokenize(strings.TrimSpace(query)))
+	stmt := &Statement{Name: name}
+	if count > 0 {
+		// Parameter types are inferred from the statement as the client wrote it
+		stmt.ParamTypes = inferParameterTypes(tokens, count, h.columnTypeLookup(connectionID, tokens))
+	}
+
+	translated, err := translateStatement(tokens)
+	if err != nil {
+		return nil, err
+	}
+	stmt.Query = joinTokens(bindSessionFunctions(translated, connectionID))
+	return stmt, nil
+}
+
+// columnTypeLookup resolves column types of the tables a statement references
+func (h *SimpleWireHandler) columnTypeLookup(connectionID string, tokens []token) columnTypeLookup {
+	tables := statementTables(significantTokens(tokens))
+	columnTypes := make(map[string]map[string]string)
+	return func(qualifier string, column string) (string, bool) {
+		for alias, table := range tables {
+			if qualifier != "" && alias != qualifier {
+				continue
+			}
+			if _, loaded := columnTypes[table]; !loaded {
+				types, err := h.backend.TableColumnTypes(connectionID, table)
+				if err != nil {
+					log.Printf("WARN: Failed to read columns of %s: %v", table, err)
+				}
+				columnTypes[table] = types
+			}
+			if declType, ok := columnTypes[table][column]; ok {
+				return declType, true
+			}
+		}
+		return "", false
+	}
+}
+
+// bindParametersSimple converts the bound parameter values using the formats
+// of the Bind message they arrived in
+func bindParametersSimple(stmt *Statement, bind *bindMessage) ([]interface{}, error) {
+	if len(bind.Values) == 0 {
+		return nil, nil
 	}
 
-	return fn, nil, nil, nil
+	args := make([]interface{}, len(bind.Values))
+	for i, value := range bind.Values {
+		if i < len(bind.Nulls) && bind.Nulls[i] {
+			continue
+		}
+
+		typeOid := oid.T_text
+		if i < len(stmt.ParamTypes) {
+			typeOid = stmt.ParamTypes[i]
+		}
+
+		arg, err := decodeParameter(value, typeOid, formatCode(bind.ParamFormats, i))
+		if err != nil {
+			return nil, newPostgresError("22P02", "invalid value for parameter $%d: %v", i+1, err)
+		}
+		args[i] = arg
+	}
+	return args, nil
+}
+
+// resultWriter returns the writer for the rows of a bound statement. Rows
+// requested in binary format bypass psql-wire, which only encodes text.
+func resultWriter(session *Session, columns wire.Columns, formats []int16, writer wire.DataWriter) wire.DataWriter {
+	if session == nil || session.Conn == nil {
+		return writer
+	}
+	for _, format := range formats {
+		if format == int16(wire.BinaryFormat) {
+			return &batchWriter{conn: session.Conn, columns: columns, formats: formats, final: writer, described: true}
+		}
+	}
+	return writer
+}
+
+// isCacheableSimple reports whether a statement may be cached as a SQLite
+// prepared statement; transaction control must go through the transaction manager
+func isCacheableSimple(query string) bool {
+	switch firstKeyword(query) {
+	case "BEGIN", "START", "COMMIT", "END", "ROLLBACK", "ABORT", "SAVEPOINT", "RELEASE":
+		return false
+	default:
+		return true
+	}
+}
+
+// describeQuerySimple returns the result columns for row returning statements
+func (h *SimpleWireHandler) describeQuerySimple(connectionID string, stmt *Statement) (wire.Columns, error) {
+	query := stmt.Query
+	if query == "" {
+		return nil, nil
+	}
+
+	// Any other statement may return rows, INSERT ... RETURNING included
+	switch firstKeyword(query) {
+	case "BEGIN", "START", "COMMIT", "END", "ROLLBACK", "ABORT", "SAVEPOINT", "RELEASE", "CREATE", "DROP", "ALTER":
+		return nil, nil
+	}
+
+	described, err := h.backend.Describe(connectionID, query)
+	if err != nil {
+		return nil, fmt.Errorf("query error: %w", err)
+	}
+
+	return buildColumns(described), nil
 }
 
 // executeQuerySimple executes queries
-func (h *SimpleWireHandler) executeQuerySimple(ctx context.Context, connectionID string, query string, writer wire.DataWriter) error {
-	query = strings.TrimSpace(query)
+func (h *SimpleWireHandler) executeQuerySimple(ctx context.Context, connectionID string, stmt *Statement, args []interface{}, columns wire.Columns, writer wire.DataWriter) error {
+	query := stmt.Query
 	if query == "" {
-		return nil
+		return writer.Empty()
+	}
+	if err := h.checkTransactionAborted(connectionID, query); err != nil {
+		return err
 	}
 
 	// Log query
@@ -55,23 +333,130 @@ func (h *SimpleWireHandler) executeQuerySimple(ctx context.Context, connectionID
 	h.txMonitor.RecordQuery(connectionID)
 
 	// Handle transaction control statements
-	upperQuery := strings.ToUpper(query)
-	switch {
-	case strings.HasPrefix(upperQuery, "BEGIN"):
-		return h.handleBeginSimple(connectionID, query)
-	case strings.HasPrefix(upperQuery, "COMMIT"):
-		return h.handleCommitSimple(connectionID)
-	case strings.HasPrefix(upperQuery, "ROLLBACK"):
-		return h.handleRollbackSimple(connectionID)
-	case strings.HasPrefix(upperQuery, "SELECT"):
-		return h.handleSelectSimple(ctx, connectionID, query)
-	case strings.HasPrefix(upperQuery, "INSERT"), strings.HasPrefix(upperQuery, "UPDATE"), strings.HasPrefix(upperQuery, "DELETE"):
-		return h.handleDMLSimple(ctx, connectionID, query)
-	case strings.HasPrefix(upperQuery, "CREATE"), strings.HasPrefix(upperQuery, "DROP"), strings.HasPrefix(upperQuery, "ALTER"):
-		return h.handleDDLSimple(ctx, connectionID, query)
+	switch firstKeyword(query) {
+	case "BEGIN", "START":
+		if h.txManager.GetTransactionStatus(connectionID) != TxIdle {
+			// Like PostgreSQL, a nested BEGIN only warns
+			if session := sessionFromContext(ctx); session != nil {
+				if err := session.Conn.WriteNotice("WARNING", "25001", "there is already a transaction in progress"); err != nil {
+					log.Printf("WARN: Failed to send notice to connection %s: %v", connectionID, err)
+				}
+			}
+			return writer.Complete(commandTag(query, 0))
+		}
+		if err := h.handleBeginSimple(connectionID, query); err != nil {
+			return err
+		}
+		return writer.Complete(commandTag(query, 0))
+	case "COMMIT", "END":
+		if h.txManager.GetTransactionStatus(connectionID) == TxFailed {
+			// Committing a failed transaction rolls it back
+			h.handleRollbackSimple(connectionID)
+			return writer.Complete("ROLLBACK")
+		}
+		if err := h.handleCommitSimple(connectionID); err != nil {
+			return err
+		}
+		return writer.Complete("COMMIT")
+	case "ROLLBACK", "ABORT":
+		if name, ok := savepointName(query); ok {
+			if err := h.txManager.RollbackToSavepoint(connectionID, name); err != nil {
+				return err
+			}
+			return writer.Complete("ROLLBACK")
+		}
+		if err := h.handleRollbackSimple(connectionID); err != nil {
+			return err
+		}
+		return writer.Complete("ROLLBACK")
+	case "SAVEPOINT", "RELEASE":
+		name, ok := savepointName(query)
+		if !ok {
+			return newPostgresError("42601", "syntax error at end of input")
+		}
+		if firstKeyword(query) == "SAVEPOINT" {
+			if err := h.txManager.Savepoint(connectionID, name); err != nil {
+				return err
+			}
+			return writer.Complete("SAVEPOINT")
+		}
+		if err := h.txManager.ReleaseSavepoint(connectionID, name); err != nil {
+			return err
+		}
+		return writer.Complete("RELEASE")
+	case "SELECT":
+		return h.handleSelectSimple(ctx, connectionID, stmt, args, columns, writer)
+	case "INSERT", "UPDATE", "DELETE":
+		if len(columns) > 0 {
+			// RETURNING streams the changed rows
+			return h.handleSelectSimple(ctx, connectionID, stmt, args, columns, writer)
+		}
+		return h.handleDMLSimple(ctx, connectionID, stmt, args, writer)
+	case "CREATE", "DROP", "ALTER":
+		return h.handleDDLSimple(ctx, connectionID, stmt, args, writer)
 	default:
-		return h.handleGenericSimple(ctx, connectionID, query)
+		return h.handleGenericSimple(ctx, connectionID, stmt, args, columns, writer)
+	}
+}
+
+// queryStatementSimple runs a row returning statement, through the
+// connection's prepared statement cache when it is named
+func (h *SimpleWireHandler) queryStatementSimple(ctx context.Context, connectionID string, stmt *Statement, args []interface{}) (*sql.Rows, error) {
+	if stmt.Name != "" {
+		return h.backend.ExecutePrepared(ctx, connectionID, stmt.Name, args...)
+	}
+	return h.backend.QueryContext(ctx, connectionID, stmt.Query, args...)
+}
+
+// execStatementSimple runs a statement without rows, through the
+// connection's prepared statement cache when it is named
+func (h *SimpleWireHandler) execStatementSimple(ctx context.Context, connectionID string, stmt *Statement, args []interface{}) (sql.Result, error) {
+	if stmt.Name != "" {
+		return h.backend.ExecPrepared(ctx, connectionID, stmt.Name, args...)
+	}
+	return h.backend.ExecContext(ctx, connectionID, stmt.Query, args...)
+}
+
+// checkTransactionAborted refuses every statement but COMMIT and ROLLBACK
+// in a failed transaction block
+func (h *SimpleWireHandler) checkTransactionAborted(connectionID string, query string) error {
+	if h.txManager.GetTransactionStatus(connectionID) != TxFailed {
+		return nil
 	}
+	switch firstKeyword(query) {
+	case "COMMIT", "END", "ROLLBACK", "ABORT":
+		return nil
+	}
+	return newPostgresError("25P02", "current transaction is aborted, commands ignored until end of transaction block")
+}
+
+// savepointName returns the savepoint named by SAVEPOINT, RELEASE [SAVEPOINT]
+// or ROLLBACK [WORK | TRANSACTION] TO [SAVEPOINT]. ok is false for a ROLLBACK
+// of the whole transaction.
+func savepointName(query string) (string, bool) {
+	sig := significantTokens(tokenize(query))
+	for len(sig) > 0 && sig[len(sig)-1].isPunct(";") {
+		sig = sig[:len(sig)-1]
+	}
+	if len(sig) < 2 {
+		return "", false
+	}
+
+	if sig[0].is("ROLLBACK") || sig[0].is("ABORT") {
+		to := false
+		for _, t := range sig[1:] {
+			to = to || t.is("TO")
+		}
+		if !to {
+			return "", false
+		}
+	}
+
+	last := sig[len(sig)-1]
+	if last.Kind != tokenIdent && last.Kind != tokenQuotedIdent || last.is("SAVEPOINT") || last.is("TO") {
+		return "", false
+	}
+	return last.name(), true
 }
 
 func (h *SimpleWireHandler) handleBeginSimple(connectionID string, query string) error {
@@ -109,57 +494,264 @@ func (h *SimpleWireHandler) handleRollbackSimple(connectionID string) error {
 	return nil
 }
 
-func (h *SimpleWireHandler) handleSelectSimple(ctx context.Context, connectionID string, query string) error {
-	rows, err := h.backend.Query(connectionID, query)
+func (h *SimpleWireHandler) handleSelectSimple(ctx context.Context, connectionID string, stmt *Statement, args []interface{}, columns wire.Columns, writer wire.DataWriter) error {
+	rows, err := h.queryStatementSimple(ctx, connectionID, stmt, args)
 	if err != nil {
 		return fmt.Errorf("query error: %w", err)
 	}
 	defer rows.Close()
 
-	// Just iterate through rows (actual wire protocol writing would be done by psql-wire)
-	for rows.Next() {
-		// Skip for now
+	count, err := writeRowsSimple(rows, columns, writer)
+	if err != nil {
+		return err
 	}
 
-	return rows.Err()
+	return writer.Complete(commandTag(stmt.Query, int64(count)))
 }
 
-func (h *SimpleWireHandler) handleDMLSimple(ctx context.Context, connectionID string, query string) error {
-	_, err := h.backend.Exec(connectionID, query)
+func (h *SimpleWireHandler) handleDMLSimple(ctx context.Context, connectionID string, stmt *Statement, args []interface{}, writer wire.DataWriter) error {
+	result, err := h.execStatementSimple(ctx, connectionID, stmt, args)
 	if err != nil {
 		return fmt.Errorf("exec error: %w", err)
 	}
-	return nil
+
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("exec error: %w", err)
+	}
+	return writer.Complete(commandTag(stmt.Query, affected))
 }
 
-func (h *SimpleWireHandler) handleDDLSimple(ctx context.Context, connectionID string, query string) error {
-	_, err := h.backend.Exec(connectionID, query)
+func (h *SimpleWireHandler) handleDDLSimple(ctx context.Context, connectionID string, stmt *Statement, args []interface{}, writer wire.DataWriter) error {
+	_, err := h.execStatementSimple(ctx, connectionID, stmt, args)
 	if err != nil {
 		return fmt.Errorf("ddl error: %w", err)
 	}
-	return nil
+	return writer.Complete(commandTag(stmt.Query, 0))
+}
+
+func (h *SimpleWireHandler) handleGenericSimple(ctx context.Context, connectionID string, stmt *Statement, args []interface{}, columns wire.Columns, writer wire.DataWriter) error {
+	// Statements with result columns (PRAGMA, WITH, VALUES, ...) are streamed like a SELECT
+	// and tagged after their main statement
+	if len(columns) > 0 {
+		return h.handleSelectSimple(ctx, connectionID, stmt, args, columns, writer)
+	}
+
+	result, err := h.execStatementSimple(ctx, connectionID, stmt, args)
+	if err != nil {
+		return err
+	}
+
+	// Data-modifying WITH statements report the rows they changed
+	affected, err := result.RowsAffected()
+	if err != nil {
+		affected = 0
+	}
+	return writer.Complete(commandTag(stmt.Query, affected))
 }
 
-func (h *SimpleWireHandler) handleGenericSimple(ctx context.Context, connectionID string, query string) error {
-	// Try as query first
-	rows, err := h.backend.Query(connectionID, query)
-	if err == nil {
-		defer rows.Close()
-		for rows.Next() {
-			// Skip
+// commandTag returns the CommandComplete tag PostgreSQL sends for a
+// statement; rows is the number of rows returned or affected
+func commandTag(query string, rows int64) string {
+	sig := significantTokens(tokenize(query))
+	if len(sig) == 0 {
+		return ""
+	}
+
+	keyword := strings.ToUpper(sig[0].Text)
+	if keyword == "WITH" {
+		keyword = mainKeyword(sig)
+	}
+
+	switch keyword {
+	case "SELECT", "VALUES", "TABLE", "PRAGMA", "EXPLAIN":
+		return fmt.Sprintf("SELECT %d", rows)
+	case "INSERT":
+		// The second number is the OID of the inserted row, always 0 since PostgreSQL 12
+		return fmt.Sprintf("INSERT 0 %d", rows)
+	case "UPDATE", "DELETE":
+		return fmt.Sprintf("%s %d", keyword, rows)
+	case "START":
+		return "START TRANSACTION"
+	case "END":
+		return "COMMIT"
+	case "ABORT":
+		return "ROLLBACK"
+	case "CREATE", "DROP", "ALTER":
+		// CREATE UNIQUE INDEX and CREATE TEMP TABLE report the object type only
+		for _, t := range sig[1:] {
+			if t.Kind != tokenIdent {
+				break
+			}
+			switch word := strings.ToUpper(t.Text); word {
+			case "TEMP", "TEMPORARY", "UNIQUE", "VIRTUAL", "OR", "REPLACE", "UNLOGGED", "GLOBAL", "LOCAL":
+			default:
+				return keyword + " " + word
+			}
+		}
+		return keyword
+	default:
+		return keyword
+	}
+}
+
+// mainKeyword returns the keyword of the statement following the common
+// table expressions of a WITH statement
+func mainKeyword(sig []token) string {
+	depth := 0
+	for _, t := range sig[1:] {
+		switch {
+		case t.isPunct("("):
+			depth++
+		case t.isPunct(")"):
+			depth--
+		case depth == 0 && (t.is("SELECT") || t.is("INSERT") || t.is("UPDATE") || t.is("DELETE") || t.is("VALUES")):
+			return strings.ToUpper(t.Text)
 		}
-		return rows.Err()
+	}
+	return "SELECT"
+}
+
+// buildColumns maps SQLite column metadata to PostgreSQL row descriptions
+func buildColumns(described []ColumnDescription) wire.Columns {
+	columns := make(wire.Columns, 0, len(described))
+	for _, column := range described {
+		columns = append(columns, wire.Column{
+			Name:   column.Name,
+			Oid:    PostgresTypeOID(SQLiteTypeToPostgres(column.DeclType)),
+			Format: wire.TextFormat,
+		})
+	}
+	return columns
+}
+
+// describeColumnTypes returns the column metadata of a result set
+func describeColumnTypes(columnTypes []*sql.ColumnType) []ColumnDescription {
+	described := make([]ColumnDescription, len(columnTypes))
+	for i, columnType := range columnTypes {
+		described[i] = ColumnDescription{Name: columnType.Name(), DeclType: columnType.DatabaseTypeName()}
+	}
+	return described
+}
+
+// writeRowsSimple streams all rows to the client and returns the number of rows written
+func writeRowsSimple(rows *sql.Rows, columns wire.Columns, writer wire.DataWriter) (int, error) {
+	values := make([]interface{}, len(columns))
+	pointers := make([]interface{}, len(columns))
+	for i := range values {
+		pointers[i] = &values[i]
 	}
 
-	// Try as exec
-	_, err = h.backend.Exec(connectionID, query)
-	return err
+	count := 0
+	for rows.Next() {
+		if err := rows.Scan(pointers...); err != nil {
+			return count, fmt.Errorf("failed to scan row: %w", err)
+		}
+
+		row := make([]interface{}, len(values))
+		for i, value := range values {
+			row[i] = convertValueSimple(value, columns[i].Oid)
+		}
+
+		if err := writer.Row(row); err != nil {
+			return count, fmt.Errorf("failed to write row: %w", err)
+		}
+		count++
+	}
+
+	return count, rows.Err()
+}
+
+// convertValueSimple coerces a dynamically typed SQLite value into a Go value
+// that psql-wire can encode for the column's PostgreSQL type
+func convertValueSimple(value interface{}, typeOid oid.Oid) interface{} {
+	if value == nil {
+		return nil
+	}
+
+	switch typeOid {
+	case oid.T_text, oid.T_uuid:
+		return formatValueSimple(value)
+	case oid.T_bytea:
+		if v, ok := value.(string); ok {
+			return []byte(v)
+		}
+		if _, ok := value.([]byte); !ok {
+			return []byte(formatValueSimple(value))
+		}
+	case oid.T_bool:
+		switch v := value.(type) {
+		case int64:
+			return v != 0
+		case float64:
+			return v != 0
+		case []byte:
+			return string(v)
+		}
+	case oid.T_int4, oid.T_int8, oid.T_float8, oid.T_numeric:
+		switch v := value.(type) {
+		case []byte:
+			return string(v)
+		case bool:
+			if v {
+				return int64(1)
+			}
+			return int64(0)
+		case time.Time:
+			return v.Unix()
+		}
+	case oid.T_date, oid.T_timestamp:
+		switch v := value.(type) {
+		case int64:
+			return time.Unix(v, 0).UTC()
+		case []byte:
+			return parseTimeSimple(string(v))
+		case string:
+			return parseTimeSimple(v)
+		}
+	}
+
+	return value
+}
+
+// formatValueSimple renders a SQLite value in PostgreSQL text format
+func formatValueSimple(value interface{}) string {
+	switch v := value.(type) {
+	case string:
+		return v
+	case []byte:
+		return string(v)
+	case int64:
+		return strconv.FormatInt(v, 10)
+	case float64:
+		return strconv.FormatFloat(v, 'g', -1, 64)
+	case bool:
+		if v {
+			return "t"
+		}
+		return "f"
+	case time.Time:
+		return v.Format("2006-01-02 15:04:05.999999")
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// parseTimeSimple parses the timestamp layouts SQLite understands; values that
+// cannot be parsed are passed through and reported by the encoder
+func parseTimeSimple(value string) interface{} {
+	value = strings.TrimSuffix(value, "Z")
+	for _, layout := range sqlite3.SQLiteTimestampFormats {
+		if t, err := time.ParseInLocation(layout, value, time.UTC); err == nil {
+			return t
+		}
+	}
+	return value
 }
 
 func getConnectionIDSimple(ctx context.Context) string {
-	username := wire.AuthenticatedUsername(ctx)
-	if username != "" {
-		return username
+	if session := sessionFromContext(ctx); session != nil {
+		return session.ID
 	}
 	return "unknown"
 }
@@ -0,0 +1,414 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	psqlerr "github.com/jeroenrinzema/psql-wire/errors"
+	"github.com/lib/pq"
+	"github.com/lib/pq/oid"
+)
+
+func newTestHandler(t *testing.T) *SimpleWireHandler {
+	t.Helper()
+
+	storage, err := NewLocalStorage(t.TempDir())
+	if err != nil {
+		t.Fatalf("Failed to create local storage: %v", err)
+	}
+
+	cache := NewDatabaseCache(storage, "testdb", 5)
+	t.Cleanup(func() { cache.Cleanup() })
+
+	if err := cache.Download(context.Background()); err != nil {
+		t.Fatalf("Failed to download: %v", err)
+	}
+
+	backend, err := NewSQLiteBackend(cache.GetLocalPath(), "deferred", 5)
+	if err != nil {
+		t.Fatalf("Failed to create backend: %v", err)
+	}
+	t.Cleanup(func() { backend.Close() })
+
+	txManager := NewTransactionManager(backend, cache)
+	t.Cleanup(txManager.Stop)
+
+	config, err := LoadConfig("")
+	if err != nil {
+		t.Fatalf("Failed to load default config: %v", err)
+	}
+
+	return NewSimpleWireHandler(backend, txManager, NewTransactionMonitor(), nil, config)
+}
+
+func TestSessionIsolation(t *testing.T) {
+	handler := newTestHandler(t)
+
+	// Two clients logging in with the same user must get separate sessions
+	ctx1, err := handler.StartSession(context.Background())
+	if err != nil {
+		t.Fatalf("Failed to start session: %v", err)
+	}
+	ctx2, err := handler.StartSession(context.Background())
+	if err != nil {
+		t.Fatalf("Failed to start session: %v", err)
+	}
+
+	id1 := getConnectionIDSimple(ctx1)
+	id2 := getConnectionIDSimple(ctx2)
+	if id1 == id2 {
+		t.Fatalf("Expected unique connection IDs, both got %s", id1)
+	}
+
+	if err := handler.handleBeginSimple(id1, "BEGIN"); err != nil {
+		t.Fatalf("Failed to begin transaction: %v", err)
+	}
+
+	if status := handler.txManager.GetTransactionStatus(id1); status != TxInTransaction {
+		t.Errorf("Expected first session in transaction, got %d", status)
+	}
+	if status := handler.txManager.GetTransactionStatus(id2); status != TxIdle {
+		t.Errorf("Expected second session to be idle, got %d", status)
+	}
+
+	// Closing the socket tears down the connection state
+	if err := handler.CloseSession(ctx1); err != nil {
+		t.Fatalf("Failed to close session: %v", err)
+	}
+
+	handler.backend.mu.Lock()
+	_, exists := handler.backend.connections[id1]
+	handler.backend.mu.Unlock()
+	if exists {
+		t.Error("Connection state should be removed when the session closes")
+	}
+}
+
+// recordingWriter is a wire.DataWriter that keeps everything written to it
+type recordingWriter struct {
+	rows     [][]interface{}
+	tag      string
+	empty    bool
+	complete bool
+}
+
+func (w *recordingWriter) Row(values []interface{}) error {
+	w.rows = append(w.rows, values)
+	return nil
+}
+
+func (w *recordingWriter) Written() uint64 {
+	return uint64(len(w.rows))
+}
+
+func (w *recordingWriter) Empty() error {
+	w.empty = true
+	return nil
+}
+
+func (w *recordingWriter) Complete(description string) error {
+	w.tag = description
+	w.complete = true
+	return nil
+}
+
+// runQuery parses and executes a query the way psql-wire does
+func runQuery(t *testing.T, handler *SimpleWireHandler, ctx context.Context, query string, parameters ...string) *recordingWriter {
+	t.Helper()
+
+	fn, _, _, err := handler.ParseQuery(ctx, query)
+	if err != nil {
+		t.Fatalf("Failed to parse %q: %v", query, err)
+	}
+
+	writer := &recordingWriter{}
+	if err := fn(ctx, writer, parameters); err != nil {
+		t.Fatalf("Failed to execute %q: %v", query, err)
+	}
+	return writer
+}
+
+func TestBoundParameters(t *testing.T) {
+	handler := newTestHandler(t)
+	ctx, _ := handler.StartSession(context.Background())
+
+	runQuery(t, handler, ctx, "CREATE TABLE users (id INTEGER PRIMARY KEY, name TEXT, score REAL)")
+	runQuery(t, handler, ctx, "INSERT INTO users (id, name, score) VALUES ($1, $2, $3)", "1", "Alice", "9.5")
+	runQuery(t, handler, ctx, "INSERT INTO users (id, name, score) VALUES ($1, $2, $3)", "2", "Bob", "7")
+
+	_, paramTypes, columns, err := handler.ParseQuery(ctx, "SELECT name, score FROM users WHERE id = $1")
+	if err != nil {
+		t.Fatalf("Failed to parse: %v", err)
+	}
+	if len(paramTypes) != 1 || paramTypes[0] != oid.T_int8 {
+		t.Errorf("Expected a single int8 parameter, got %v", paramTypes)
+	}
+	if len(columns) != 2 || columns[0].Oid != oid.T_text || columns[1].Oid != oid.T_float8 {
+		t.Errorf("Unexpected columns: %+v", columns)
+	}
+
+	writer := runQuery(t, handler, ctx, "SELECT name, score FROM users WHERE id = $1", "2")
+	if len(writer.rows) != 1 || writer.rows[0][0] != "Bob" || writer.rows[0][1] != 7.0 {
+		t.Errorf("Unexpected rows: %v", writer.rows)
+	}
+	if writer.tag != "SELECT 1" {
+		t.Errorf("Expected SELECT 1, got %q", writer.tag)
+	}
+}
+
+func TestErrorResponses(t *testing.T) {
+	handler := newTestHandler(t)
+	ctx, _ := handler.StartSession(context.Background())
+
+	runQuery(t, handler, ctx, "CREATE TABLE users (id INTEGER PRIMARY KEY, email TEXT UNIQUE, name TEXT NOT NULL)")
+	runQuery(t, handler, ctx, "INSERT INTO users (id, email, name) VALUES (1, 'a@example.com', 'Alice')")
+
+	tests := []struct {
+		query      string
+		code       string
+		message    string
+		constraint string
+	}{
+		{"INSERT INTO users (id, email, name) VALUES (2, 'a@example.com', 'Bob')", "23505", `duplicate key value violates unique constraint "users_email_key"`, "users_email_key"},
+		{"INSERT INTO users (id, email, name) VALUES (1, 'b@example.com', 'Bob')", "23505", `duplicate key value violates unique constraint "users_pkey"`, "users_pkey"},
+		{"INSERT INTO users (id, email) VALUES (3, 'c@example.com')", "23502", `null value in column "name" of relation "users" violates not-null constraint`, ""},
+		{"SELECT * FROM missing", "42P01", `relation "missing" does not exist`, ""},
+		{"SELECT nope FROM users", "42703", `column "nope" does not exist`, ""},
+		{"SELEC 1", "42601", `syntax error at or near "SELEC"`, ""},
+	}
+
+	for _, tt := range tests {
+		fn, _, _, err := handler.ParseQuery(ctx, tt.query)
+		if err == nil {
+			err = fn(ctx, &recordingWriter{}, nil)
+		}
+		if err == nil {
+			t.Errorf("%s: expected an error", tt.query)
+			continue
+		}
+
+		desc := psqlerr.Flatten(err)
+		if string(desc.Code) != tt.code {
+			t.Errorf("%s: code = %s; want %s", tt.query, desc.Code, tt.code)
+		}
+		if desc.Message != tt.message {
+			t.Errorf("%s: message = %q; want %q", tt.query, desc.Message, tt.message)
+		}
+		if desc.ConstraintName != tt.constraint {
+			t.Errorf("%s: constraint = %q; want %q", tt.query, desc.ConstraintName, tt.constraint)
+		}
+		if desc.Severity != psqlerr.LevelError {
+			t.Errorf("%s: severity = %s; want ERROR", tt.query, desc.Severity)
+		}
+	}
+}
+
+func TestErrorFields(t *testing.T) {
+	storage, err := NewLocalStorage(t.TempDir())
+	if err != nil {
+		t.Fatalf("Failed to create local storage: %v", err)
+	}
+	db := serveTestDatabases(t, storage)
+	if _, err := db.Exec("CREATE TABLE users (id INTEGER PRIMARY KEY, email TEXT UNIQUE, name TEXT NOT NULL)"); err != nil {
+		t.Fatalf("Failed to create table: %v", err)
+	}
+	if _, err := db.Exec("INSERT INTO users (id, email, name) VALUES (1, 'a@example.com', 'Alice')"); err != nil {
+		t.Fatalf("Failed to insert: %v", err)
+	}
+
+	// The error fields psql-wire does not write reach the client
+	tests := []struct {
+		query  string
+		fields pq.Error
+	}{
+		{"INSERT INTO users (id, email, name) VALUES (2, 'a@example.com', 'Bob')",
+			pq.Error{Code: "23505", Schema: "public", Table: "users", Constraint: "users_email_key", Detail: "Key (email) already exists."}},
+		{"INSERT INTO users (id, email) VALUES (3, 'c@example.com')",
+			pq.Error{Code: "23502", Schema: "public", Table: "users", Column: "name", Detail: "Failing column: users.name."}},
+		{"SELECT nope FROM users", pq.Error{Code: "42703"}},
+	}
+	for _, tt := range tests {
+		_, err := db.Exec(tt.query)
+		pqErr, ok := err.(*pq.Error)
+		if !ok {
+			t.Errorf("%s: expected an error response, got %v", tt.query, err)
+			continue
+		}
+		got := pq.Error{Code: pqErr.Code, Schema: pqErr.Schema, Table: pqErr.Table, Column: pqErr.Column, Constraint: pqErr.Constraint, Detail: pqErr.Detail}
+		if got != tt.fields {
+			t.Errorf("%s: fields = %+v; want %+v", tt.query, got, tt.fields)
+		}
+	}
+}
+
+func TestDialectTranslation(t *testing.T) {
+	handler := newTestHandler(t)
+	ctx, _ := handler.StartSession(context.Background())
+
+	runQuery(t, handler, ctx, "CREATE TABLE users (id SERIAL PRIMARY KEY, name TEXT NOT NULL, token UUID DEFAULT gen_random_uuid(), active BOOLEAN DEFAULT TRUE, created_at TIMESTAMPTZ DEFAULT NOW())")
+	runQuery(t, handler, ctx, "INSERT INTO users (name) VALUES (E'O\\'Brien'), ('alice')")
+
+	writer := runQuery(t, handler, ctx, "SELECT id::text, name, length(token), active FROM users WHERE name ILIKE 'ALICE' AND active = TRUE")
+	if len(writer.rows) != 1 {
+		t.Fatalf("Expected one row, got %d", len(writer.rows))
+	}
+	row := writer.rows[0]
+	if row[0] != "2" || row[1] != "alice" || row[2] != int64(36) || row[3] != true {
+		t.Errorf("Unexpected row: %#v", row)
+	}
+
+	writer = runQuery(t, handler, ctx, "SELECT name FROM users WHERE id = 1")
+	if len(writer.rows) != 1 || writer.rows[0][0] != "O'Brien" {
+		t.Errorf("Unexpected rows: %v", writer.rows)
+	}
+
+	writer = runQuery(t, handler, ctx, "SELECT '2024-01-31'::date + 1, DATE '2024-03-01' - 1, '2024-03-01'::date - '2024-01-01'::date")
+	if len(writer.rows) != 1 || writer.rows[0][0] != "2024-02-01" || writer.rows[0][1] != "2024-02-29" || writer.rows[0][2] != int64(60) {
+		t.Errorf("Unexpected date arithmetic: %v", writer.rows)
+	}
+
+	_, _, _, err := handler.ParseQuery(ctx, "SELECT DISTINCT ON (name) name FROM users")
+	if code := psqlerr.Flatten(err).Code; code != "0A000" {
+		t.Errorf("Expected 0A000 for DISTINCT ON, got %q", code)
+	}
+}
+
+func TestCommandTags(t *testing.T) {
+	handler := newTestHandler(t)
+	ctx, _ := handler.StartSession(context.Background())
+
+	tests := []struct {
+		query string
+		tag   string
+	}{
+		{"CREATE TABLE items (id INTEGER PRIMARY KEY, name TEXT, qty INTEGER)", "CREATE TABLE"},
+		{"CREATE UNIQUE INDEX items_name ON items (name)", "CREATE INDEX"},
+		{"BEGIN", "BEGIN"},
+		{"INSERT INTO items (name, qty) VALUES ('a', 1), ('b', 2), ('c', 3)", "INSERT 0 3"},
+		{"UPDATE items SET qty = qty + 1 WHERE qty > 1", "UPDATE 2"},
+		{"DELETE FROM items WHERE name = 'nope'", "DELETE 0"},
+		{"SELECT * FROM items", "SELECT 3"},
+		{"COMMIT", "COMMIT"},
+		{"START TRANSACTION", "START TRANSACTION"},
+		{"WITH doomed AS (SELECT 1) DELETE FROM items WHERE qty = 1", "DELETE 1"},
+		{"ROLLBACK", "ROLLBACK"},
+		{"VALUES (1), (2)", "SELECT 2"},
+		{"ALTER TABLE items ADD COLUMN note TEXT", "ALTER TABLE"},
+		{"DROP INDEX items_name", "DROP INDEX"},
+	}
+
+	for _, tt := range tests {
+		writer := runQuery(t, handler, ctx, tt.query)
+		if writer.tag != tt.tag {
+			t.Errorf("%s: tag = %q; want %q", tt.query, writer.tag, tt.tag)
+		}
+	}
+}
+
+func TestReturning(t *testing.T) {
+	handler := newTestHandler(t)
+	ctx, _ := handler.StartSession(context.Background())
+
+	runQuery(t, handler, ctx, "CREATE TABLE items (id SERIAL PRIMARY KEY, name TEXT NOT NULL, qty INTEGER DEFAULT 0)")
+
+	query := "INSERT INTO items (name) VALUES ($1), ($2) RETURNING id, name"
+	_, _, columns, err := handler.ParseQuery(ctx, query)
+	if err != nil {
+		t.Fatalf("Failed to parse: %v", err)
+	}
+	if len(columns) != 2 || columns[0].Name != "id" || columns[0].Oid != oid.T_int8 || columns[1].Oid != oid.T_text {
+		t.Errorf("Unexpected columns: %+v", columns)
+	}
+
+	writer := runQuery(t, handler, ctx, query, "a", "b")
+	if writer.tag != "INSERT 0 2" || len(writer.rows) != 2 || writer.rows[1][0] != int64(2) || writer.rows[1][1] != "b" {
+		t.Errorf("Unexpected result: %s %v", writer.tag, writer.rows)
+	}
+
+	writer = runQuery(t, handler, ctx, "UPDATE items SET qty = qty + 5 WHERE id = 1 RETURNING qty")
+	if writer.tag != "UPDATE 1" || len(writer.rows) != 1 || writer.rows[0][0] != int64(5) {
+		t.Errorf("Unexpected result: %s %v", writer.tag, writer.rows)
+	}
+
+	writer = runQuery(t, handler, ctx, "DELETE FROM items RETURNING *")
+	if writer.tag != "DELETE 2" || len(writer.rows) != 2 || len(writer.rows[0]) != 3 {
+		t.Errorf("Unexpected result: %s %v", writer.tag, writer.rows)
+	}
+
+	// The changes are applied even though they were streamed
+	if writer := runQuery(t, handler, ctx, "SELECT count(*) FROM items"); writer.rows[0][0] != int64(0) {
+		t.Errorf("Expected all rows deleted, got %v", writer.rows[0][0])
+	}
+}
+
+func TestSavepoints(t *testing.T) {
+	handler := newTestHandler(t)
+	ctx, _ := handler.StartSession(context.Background())
+	connectionID := getConnectionIDSimple(ctx)
+
+	queryError := func(query string) string {
+		fn, _, _, err := handler.ParseQuery(ctx, query)
+		if err == nil {
+			err = fn(ctx, &recordingWriter{}, nil)
+		}
+		if err == nil {
+			return ""
+		}
+		return string(psqlerr.Flatten(err).Code)
+	}
+
+	runQuery(t, handler, ctx, "CREATE TABLE items (id INTEGER PRIMARY KEY)")
+	if code := queryError("SAVEPOINT a"); code != "25P01" {
+		t.Errorf("SAVEPOINT outside a transaction: code = %q; want 25P01", code)
+	}
+
+	runQuery(t, handler, ctx, "BEGIN")
+	runQuery(t, handler, ctx, "INSERT INTO items VALUES (1)")
+	if writer := runQuery(t, handler, ctx, "SAVEPOINT a"); writer.tag != "SAVEPOINT" {
+		t.Errorf("Expected SAVEPOINT tag, got %q", writer.tag)
+	}
+	runQuery(t, handler, ctx, "INSERT INTO items VALUES (2)")
+
+	// An error aborts the transaction until it is rolled back
+	if code := queryError("INSERT INTO items VALUES (1)"); code != "23505" {
+		t.Fatalf("Expected a unique violation, got %q", code)
+	}
+	if status := handler.txManager.GetTransactionStatus(connectionID); status != TxFailed {
+		t.Errorf("Expected failed transaction, got status %d", status)
+	}
+	for _, query := range []string{"SELECT 1", "SHOW TimeZone", "SAVEPOINT b"} {
+		if code := queryError(query); code != "25P02" {
+			t.Errorf("%s: code = %q; want 25P02", query, code)
+		}
+	}
+
+	if writer := runQuery(t, handler, ctx, "ROLLBACK TO SAVEPOINT a"); writer.tag != "ROLLBACK" {
+		t.Errorf("Expected ROLLBACK tag, got %q", writer.tag)
+	}
+	runQuery(t, handler, ctx, "INSERT INTO items VALUES (3)")
+	runQuery(t, handler, ctx, `SAVEPOINT "B"`)
+	if code := queryError("RELEASE b"); code != "3B001" {
+		t.Errorf("RELEASE of a missing savepoint: code = %q; want 3B001", code)
+	}
+	runQuery(t, handler, ctx, "ROLLBACK TO a")
+	if writer := runQuery(t, handler, ctx, "RELEASE SAVEPOINT a"); writer.tag != "RELEASE" {
+		t.Errorf("Expected RELEASE tag, got %q", writer.tag)
+	}
+	runQuery(t, handler, ctx, "COMMIT")
+
+	writer := runQuery(t, handler, ctx, "SELECT id FROM items ORDER BY id")
+	if len(writer.rows) != 1 || writer.rows[0][0] != int64(1) {
+		t.Errorf("Unexpected rows: %v", writer.rows)
+	}
+
+	// COMMIT of a failed transaction rolls it back
+	runQuery(t, handler, ctx, "BEGIN")
+	runQuery(t, handler, ctx, "INSERT INTO items VALUES (4)")
+	queryError("SELECT nope FROM items")
+	if writer := runQuery(t, handler, ctx, "COMMIT"); writer.tag != "ROLLBACK" {
+		t.Errorf("Expected ROLLBACK tag, got %q", writer.tag)
+	}
+	if writer := runQuery(t, handler, ctx, "SELECT count(*) FROM items"); writer.rows[0][0] != int64(1) {
+		t.Errorf("Expected the failed transaction to be rolled back, got %v rows", writer.rows[0][0])
+	}
+}